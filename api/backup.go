@@ -0,0 +1,402 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rstms/mabctl/util"
+)
+
+const BACKUP_INDEX_FORMAT = "mabctl-backup-index"
+const BACKUP_INDEX_VERSION = 1
+const BACKUP_INDEX_FILE = "index.json"
+const BACKUP_ID_LAYOUT = "20060102T150405Z"
+const BACKUP_LATEST = "latest"
+
+// BackupEntry describes one backup file in a BackupStore
+type BackupEntry struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Created   time.Time `json:"created"`
+	Username  string    `json:"username,omitempty"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Encrypted bool      `json:"encrypted"`
+	Users     int       `json:"users"`
+	Books     int       `json:"books"`
+	Cards     int       `json:"cards"`
+}
+
+func (e BackupEntry) String() string {
+	ret := fmt.Sprintf("%-18s  %s  %8d  %d users, %d books, %d cards", e.ID, e.Created.Local().Format(time.DateTime), e.Size, e.Users, e.Books, e.Cards)
+	if e.Username != "" {
+		ret += "  user=" + e.Username
+	}
+	if e.Encrypted {
+		ret += "  encrypted"
+	}
+	return ret
+}
+
+// BackupIndex lists the backups in a BackupStore, oldest first
+type BackupIndex struct {
+	Format  string        `json:"format"`
+	Version int           `json:"version"`
+	Backups []BackupEntry `json:"backups"`
+}
+
+// BackupPolicy selects the backups kept when pruning: the newest backup of
+// each of the most recent Daily days, Weekly ISO weeks and Monthly months.
+// A zero count disables that period.
+type BackupPolicy struct {
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+}
+
+// Expired returns the backups which the policy does not keep.  The policy
+// applies separately to the backups of each Username, the full backups
+// being a series of their own, so the backups of one user never expire
+// those of another.  The newest backup of each series is always kept, and a
+// policy with every count zero keeps them all.
+func (p BackupPolicy) Expired(backups []BackupEntry) []BackupEntry {
+	if len(backups) == 0 || (p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0) {
+		return []BackupEntry{}
+	}
+	series := make(map[string][]BackupEntry)
+	for _, backup := range backups {
+		series[backup.Username] = append(series[backup.Username], backup)
+	}
+	keep := make(map[string]bool)
+	for _, entries := range series {
+		p.keep(entries, keep)
+	}
+	expired := []BackupEntry{}
+	for _, backup := range backups {
+		if !keep[backup.ID] {
+			expired = append(expired, backup)
+		}
+	}
+	return expired
+}
+
+// keep marks the IDs of the backups of one series kept by the policy
+func (p BackupPolicy) keep(backups []BackupEntry, keep map[string]bool) {
+	// newest first; of backups created in the same second, the later in
+	// the index is newer
+	newest := make([]BackupEntry, len(backups))
+	for i, backup := range backups {
+		newest[len(backups)-1-i] = backup
+	}
+	sort.SliceStable(newest, func(i, j int) bool { return newest[i].Created.After(newest[j].Created) })
+	periods := []struct {
+		count int
+		key   func(time.Time) string
+	}{
+		{p.Daily, func(t time.Time) string { return t.Format(time.DateOnly) }},
+		{p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	keep[newest[0].ID] = true
+	for _, period := range periods {
+		seen := make(map[string]bool)
+		for _, backup := range newest {
+			key := period.key(backup.Created.UTC())
+			if seen[key] {
+				continue
+			}
+			if len(seen) >= period.count {
+				break
+			}
+			seen[key] = true
+			keep[backup.ID] = true
+		}
+	}
+}
+
+// BackupStore is a directory of compressed, optionally encrypted dumps
+// listed in an index file
+type BackupStore struct {
+	Dir string
+}
+
+// NewBackupStore returns the store in dir, creating the directory if needed
+func NewBackupStore(dir string) (*BackupStore, error) {
+	if dir == "" {
+		return nil, util.Fatalf("no backup directory configured")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, util.Fatalf("failed creating backup directory: %w", err)
+	}
+	return &BackupStore{Dir: dir}, nil
+}
+
+// Index returns the store's index; a store without an index is empty
+func (s *BackupStore) Index() (*BackupIndex, error) {
+	index := BackupIndex{Format: BACKUP_INDEX_FORMAT, Version: BACKUP_INDEX_VERSION, Backups: []BackupEntry{}}
+	data, err := os.ReadFile(filepath.Join(s.Dir, BACKUP_INDEX_FILE))
+	if errors.Is(err, os.ErrNotExist) {
+		return &index, nil
+	}
+	if err != nil {
+		return nil, util.Fatalf("failed reading backup index: %w", err)
+	}
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		return nil, util.Fatalf("failed decoding backup index: %w", err)
+	}
+	if index.Format != BACKUP_INDEX_FORMAT {
+		return nil, util.Fatalf("unrecognized backup index format: '%s'", index.Format)
+	}
+	if index.Version > BACKUP_INDEX_VERSION {
+		return nil, util.Fatalf("unsupported backup index version %d; maximum is %d", index.Version, BACKUP_INDEX_VERSION)
+	}
+	return &index, nil
+}
+
+func (s *BackupStore) saveIndex(index *BackupIndex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return util.Fatalf("failed encoding backup index: %w", err)
+	}
+	return s.writeFile(BACKUP_INDEX_FILE, data)
+}
+
+// writeFile replaces a file in the store atomically
+func (s *BackupStore) writeFile(filename string, data []byte) error {
+	file, err := os.CreateTemp(s.Dir, ".tmp-*")
+	if err != nil {
+		return util.Fatalf("failed creating backup file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(s.Dir, filename))
+	}
+	if err != nil {
+		return util.Fatalf("failed writing %s: %w", filename, err)
+	}
+	return nil
+}
+
+// Find returns the backup with the given ID, or the newest backup for
+// "latest"
+func (s *BackupStore) Find(id string) (*BackupEntry, error) {
+	index, err := s.Index()
+	if err != nil {
+		return nil, err
+	}
+	if id == BACKUP_LATEST && len(index.Backups) > 0 {
+		return &index.Backups[len(index.Backups)-1], nil
+	}
+	for _, backup := range index.Backups {
+		if backup.ID == id {
+			return &backup, nil
+		}
+	}
+	return nil, util.Fatalf("%w: backup '%s'", ErrNotFound, id)
+}
+
+// Write stores dump as a new backup, verifies it by reading it back, and
+// adds it to the index.  The backup is encrypted if passphrase is not empty.
+func (s *BackupStore) Write(dump *DumpFile, username string, passphrase []byte) (*BackupEntry, error) {
+	index, err := s.Index()
+	if err != nil {
+		return nil, err
+	}
+	entry := BackupEntry{Created: dump.Created, Username: username, Encrypted: len(passphrase) > 0}
+	entry.Users, entry.Books, entry.Cards = dump.Counts()
+	entry.ID = dump.Created.UTC().Format(BACKUP_ID_LAYOUT)
+	for n := 2; index.contains(entry.ID); n++ {
+		entry.ID = fmt.Sprintf("%s-%d", dump.Created.UTC().Format(BACKUP_ID_LAYOUT), n)
+	}
+	entry.Filename = "mabctl-" + entry.ID + ".json.gz"
+	if entry.Encrypted {
+		entry.Filename += ".enc"
+	}
+
+	plaintext, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return nil, util.Fatalf("failed encoding dump: %w", err)
+	}
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err = writer.Write(plaintext)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, util.Fatalf("failed compressing dump: %w", err)
+	}
+	data := buf.Bytes()
+	if entry.Encrypted {
+		data, err = util.Encrypt(data, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	entry.Size = int64(len(data))
+	entry.SHA256 = digest(data)
+	err = s.writeFile(entry.Filename, data)
+	if err != nil {
+		return nil, err
+	}
+
+	restored, err := s.Load(&entry, passphrase)
+	if err == nil && len(DiffDumps(dump, restored)) > 0 {
+		err = fmt.Errorf("backup content differs from dump")
+	}
+	if err != nil {
+		os.Remove(filepath.Join(s.Dir, entry.Filename))
+		return nil, util.Fatalf("failed verifying backup %s: %w", entry.ID, err)
+	}
+
+	index.Backups = append(index.Backups, entry)
+	err = s.saveIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Load reads, checks and decodes a backup
+func (s *BackupStore) Load(entry *BackupEntry, passphrase []byte) (*DumpFile, error) {
+	data, err := os.ReadFile(filepath.Join(s.Dir, entry.Filename))
+	if err != nil {
+		return nil, util.Fatalf("failed reading backup %s: %w", entry.ID, err)
+	}
+	if digest(data) != entry.SHA256 {
+		return nil, util.Fatalf("backup %s is damaged: checksum mismatch", entry.ID)
+	}
+	if entry.Encrypted {
+		if len(passphrase) == 0 {
+			return nil, util.Fatalf("backup %s is encrypted: passphrase required", entry.ID)
+		}
+		data, err = util.Decrypt(data, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, util.Fatalf("failed decompressing backup %s: %w", entry.ID, err)
+	}
+	plaintext, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, util.Fatalf("failed decompressing backup %s: %w", entry.ID, err)
+	}
+	return ReadDump(bytes.NewReader(plaintext))
+}
+
+// Prune deletes the backups expired by policy, returning them.  With
+// dryRun nothing is deleted.
+func (s *BackupStore) Prune(policy BackupPolicy, dryRun bool) ([]BackupEntry, error) {
+	index, err := s.Index()
+	if err != nil {
+		return nil, err
+	}
+	expired := policy.Expired(index.Backups)
+	if dryRun || len(expired) == 0 {
+		return expired, nil
+	}
+	removed := make(map[string]bool)
+	for _, backup := range expired {
+		removed[backup.ID] = true
+	}
+	kept := []BackupEntry{}
+	for _, backup := range index.Backups {
+		if !removed[backup.ID] {
+			kept = append(kept, backup)
+		}
+	}
+	index.Backups = kept
+	// update the index first so it never lists a deleted file
+	err = s.saveIndex(index)
+	if err != nil {
+		return nil, err
+	}
+	for _, backup := range expired {
+		err = os.Remove(filepath.Join(s.Dir, backup.Filename))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, util.Fatalf("failed deleting backup %s: %w", backup.ID, err)
+		}
+	}
+	return expired, nil
+}
+
+func (i *BackupIndex) contains(id string) bool {
+	for _, backup := range i.Backups {
+		if backup.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Counts returns the number of users, books and cards in the dump
+func (d *DumpFile) Counts() (users, books, cards int) {
+	for _, user := range d.Users {
+		users++
+		for _, book := range user.Books {
+			books++
+			cards += len(book.Cards)
+		}
+	}
+	return users, books, cards
+}
+
+type BackupResponse struct {
+	Response
+	Backup BackupEntry   `json:"backup"`
+	Pruned []BackupEntry `json:"pruned"`
+}
+
+// Backup dumps username, or all users if empty, into store and then prunes
+// the store by policy
+func Backup(ctx context.Context, mab AddressBookManager, store *BackupStore, username string, passphrase []byte, policy BackupPolicy) (*BackupResponse, error) {
+	dump, err := mab.DumpCtx(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := store.Write(&dump.Dump, username, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	pruned, err := store.Prune(policy, false)
+	if err != nil {
+		return nil, err
+	}
+	ret := BackupResponse{
+		Response: Response{Success: true, Request: "backup", Message: fmt.Sprintf("backup %s: %d users, %d books, %d cards", entry.ID, entry.Users, entry.Books, entry.Cards)},
+		Backup:   *entry,
+		Pruned:   pruned,
+	}
+	return &ret, nil
+}
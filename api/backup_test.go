@@ -0,0 +1,124 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupPolicy(t *testing.T) {
+	start := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	backups := []BackupEntry{}
+	// two backups a day for 120 days
+	for day := 0; day < 120; day++ {
+		for _, hour := range []int{0, 12} {
+			created := start.AddDate(0, 0, day).Add(time.Duration(hour) * time.Hour)
+			backups = append(backups, BackupEntry{ID: created.Format(BACKUP_ID_LAYOUT), Created: created})
+		}
+	}
+	expired := BackupPolicy{Daily: 7, Weekly: 4, Monthly: 3}.Expired(backups)
+	kept := map[string]bool{}
+	for _, backup := range backups {
+		kept[backup.ID] = true
+	}
+	for _, backup := range expired {
+		delete(kept, backup.ID)
+	}
+	// 7 days, plus 2 earlier weeks and 2 earlier months not already kept
+	require.Len(t, kept, 7+2+2)
+	require.True(t, kept[backups[len(backups)-1].ID])
+	require.False(t, kept[backups[len(backups)-2].ID])
+
+	require.Empty(t, BackupPolicy{}.Expired(backups))
+	require.Len(t, BackupPolicy{Daily: 1}.Expired(backups), len(backups)-1)
+}
+
+func TestBackupPolicyUsers(t *testing.T) {
+	start := time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC)
+	backups := []BackupEntry{}
+	// a full backup each day, and a backup of one user after it
+	for day := 0; day < 10; day++ {
+		created := start.AddDate(0, 0, day)
+		backups = append(backups,
+			BackupEntry{ID: created.Format(BACKUP_ID_LAYOUT), Created: created},
+			BackupEntry{ID: created.Format(BACKUP_ID_LAYOUT) + "-2", Created: created, Username: "user@example.org"},
+		)
+	}
+	// an old backup of another user is the newest of its series
+	other := BackupEntry{ID: "other", Created: start, Username: "other@example.org"}
+	backups = append(backups, other)
+
+	expired := BackupPolicy{Daily: 3}.Expired(backups)
+	kept := map[string]bool{}
+	for _, backup := range backups {
+		kept[backup.ID] = true
+	}
+	for _, backup := range expired {
+		delete(kept, backup.ID)
+	}
+	full, user := 0, 0
+	for _, backup := range backups {
+		if !kept[backup.ID] {
+			continue
+		}
+		switch backup.Username {
+		case "":
+			full++
+		case "user@example.org":
+			user++
+		}
+	}
+	require.Equal(t, 3, full)
+	require.Equal(t, 3, user)
+	require.True(t, kept[other.ID])
+	require.Len(t, kept, 3+3+1)
+}
+
+func TestBackupStore(t *testing.T) {
+	legacy := `{"Users": {"user@example.org": {"Password": "secret", "Books": {"work": ["boss@example.com"]}}}}`
+	dump, err := ReadDump(strings.NewReader(legacy))
+	require.Nil(t, err)
+	store, err := NewBackupStore(filepath.Join(t.TempDir(), "backup"))
+	require.Nil(t, err)
+
+	first, err := store.Write(dump, "", nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, first.Cards)
+	second, err := store.Write(dump, "", []byte("passphrase"))
+	require.Nil(t, err)
+	require.Equal(t, first.ID+"-2", second.ID)
+	require.True(t, second.Encrypted)
+
+	latest, err := store.Find(BACKUP_LATEST)
+	require.Nil(t, err)
+	require.Equal(t, second.ID, latest.ID)
+	found, err := store.Find(first.ID)
+	require.Nil(t, err)
+	require.Equal(t, first.SHA256, found.SHA256)
+	_, err = store.Find("19700101")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	_, err = store.Load(second, nil)
+	require.NotNil(t, err)
+	loaded, err := store.Load(second, []byte("passphrase"))
+	require.Nil(t, err)
+	require.Empty(t, DiffDumps(dump, loaded))
+
+	require.Nil(t, os.WriteFile(filepath.Join(store.Dir, first.Filename), []byte("damaged"), 0600))
+	_, err = store.Load(first, nil)
+	require.NotNil(t, err)
+
+	pruned, err := store.Prune(BackupPolicy{Daily: 1}, false)
+	require.Nil(t, err)
+	require.Len(t, pruned, 1)
+	require.Equal(t, first.ID, pruned[0].ID)
+	_, err = os.Stat(filepath.Join(store.Dir, first.Filename))
+	require.True(t, os.IsNotExist(err))
+	index, err := store.Index()
+	require.Nil(t, err)
+	require.Len(t, index.Backups, 1)
+}
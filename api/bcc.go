@@ -2,8 +2,11 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/emersion/go-vcard"
 	"github.com/emersion/go-webdav/carddav"
 	davapi "github.com/rstms/mabctl/carddav"
 	"github.com/rstms/mabctl/util"
@@ -13,6 +16,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 )
 
 const PASSWORD_LENGTH = 12
@@ -27,6 +31,11 @@ type Controller struct {
 	url      string
 	apikey   string
 	client   *http.Client
+	retry    *util.RetryPolicy
+	Emitter
+	cache      *Cache
+	conns      *connections
+	syncStates *syncStates
 }
 
 type User struct {
@@ -91,6 +100,11 @@ type AddressesResponse struct {
 	Addresses []string `json:"addresses"`
 }
 
+type CardsResponse struct {
+	Response
+	Cards []carddav.AddressObject `json:"cards"`
+}
+
 type AddressResponse struct {
 	Response
 	Address *carddav.AddressObject `json:"address"`
@@ -122,13 +136,13 @@ type ConfigDump struct {
 
 type DumpResponse struct {
 	Response
-	Dump ConfigDump
+	Dump DumpFile
 }
 
 func Format(data interface{}) (string, error) {
 	formatted, err := json.MarshalIndent(data, "", "  ")
 	if err != nil {
-		return "", util.Fatalf("failed formatting JSON: %v", err)
+		return "", util.Fatalf("failed formatting JSON: %w", err)
 	}
 	return string(formatted), nil
 }
@@ -152,21 +166,21 @@ func FormatIfJSON(body []byte) string {
 func URIPath(uri string) (string, error) {
 	parsed, err := url.Parse(uri)
 	if err != nil {
-		return "", util.Fatalf("failed parsing URI %s: %v", uri, err)
+		return "", util.Fatalf("failed parsing URI %s: %w", uri, err)
 	}
 	return parsed.Path, nil
 }
 
-func (c *Controller) request(method, path string, data *[]byte) (*http.Request, error) {
+func (c *Controller) request(ctx context.Context, method, path string, data *[]byte) (*http.Request, error) {
 	var body *bytes.Buffer
 	if data == nil {
 		body = bytes.NewBuffer([]byte{})
 	} else {
 		body = bytes.NewBuffer(*data)
 	}
-	req, err := http.NewRequest(method, c.url+path, body)
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, body)
 	if err != nil {
-		return nil, util.Fatalf("failed creating %s request: %v", method, err)
+		return nil, util.Fatalf("failed creating %s request: %w", method, err)
 	}
 	req.Header.Set("X-Api-Key", c.apikey)
 	req.Header.Set("X-Admin-Username", c.username)
@@ -177,66 +191,83 @@ func (c *Controller) request(method, path string, data *[]byte) (*http.Request,
 	return req, nil
 }
 
-func (c *Controller) get(path string, ret interface{}) error {
-	req, err := c.request("GET", path, nil)
-	if err != nil {
-		return err
-	}
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return util.Fatalf("GET %s failed: %v", path, err)
-	}
-	defer resp.Body.Close()
-	return c.handleResponse("GET", path, resp, ret)
+// idempotentPosts are the POST endpoints which may be safely repeated
+var idempotentPosts = map[string]bool{
+	"/initialize/": true,
+	"/reset/":      true,
+	"/accounts/":   true,
 }
 
-func (c *Controller) post(path string, data *[]byte, ret interface{}) error {
-	req, err := c.request("POST", path, data)
-	if err != nil {
-		return err
-	}
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return util.Fatalf("POST %s failed: %v", path, err)
-	}
-	defer resp.Body.Close()
-	return c.handleResponse("POST", path, resp, ret)
+func (c *Controller) do(ctx context.Context, method, path string, data *[]byte, ret interface{}) error {
+	idempotent := util.IdempotentMethod(method) || idempotentPosts[path]
+	return c.retry.Do(ctx, idempotent, func() error {
+		req, err := c.request(ctx, method, path, data)
+		if err != nil {
+			return err
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return util.RequestError(method, path, err)
+		}
+		defer resp.Body.Close()
+		return c.handleResponse(method, path, resp, ret)
+	})
 }
 
-func (c *Controller) del(path string, data *[]byte, ret interface{}) error {
-	req, err := c.request("DELETE", path, data)
-	if err != nil {
-		return err
-	}
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return util.Fatalf("DELETE %s failed: %v", path, err)
+func (c *Controller) get(ctx context.Context, path string, ret interface{}) error {
+	return c.do(ctx, "GET", path, nil, ret)
+}
+
+func (c *Controller) post(ctx context.Context, path string, data *[]byte, ret interface{}) error {
+	return c.do(ctx, "POST", path, data, ret)
+}
+
+func (c *Controller) del(ctx context.Context, path string, data *[]byte, ret interface{}) error {
+	return c.do(ctx, "DELETE", path, data, ret)
+}
+
+// errorDetail returns the ErrorResponse detail if present, otherwise the body
+func errorDetail(body []byte) string {
+	var response ErrorResponse
+	err := json.Unmarshal(body, &response)
+	if err == nil && response.Detail != "" {
+		return response.Detail
 	}
-	defer resp.Body.Close()
-	return c.handleResponse("DELETE", path, resp, ret)
+	return FormatIfJSON(body)
 }
 
 func (c *Controller) handleResponse(method, path string, resp *http.Response, ret interface{}) error {
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return util.Fatalf("%s %s failed reading response body: %v", method, path, err)
+		return util.Fatalf("%s %s failed reading response body: %w", method, path, err)
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return util.Fatalf("Error: %s %s '%s'\n%s", method, path, resp.Status, FormatIfJSON(body))
+		return &HTTPError{
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Detail:     errorDetail(body),
+		}
 	}
 	if len(body) == 0 {
 		return nil
 	}
 	err = json.Unmarshal(body, ret)
 	if err != nil {
-		return util.Fatalf("failed decoding response: %v\n%v", err, string(body))
+		return util.Fatalf("failed decoding response: %w\n%v", err, string(body))
 	}
 	return nil
 }
 
 func (c *Controller) Initialize() (*Response, error) {
+	return c.InitializeCtx(context.Background())
+}
+
+func (c *Controller) InitializeCtx(ctx context.Context) (*Response, error) {
 	var ret Response
-	err := c.post("/initialize/", nil, &ret)
+	err := c.post(ctx, "/initialize/", nil, &ret)
+	c.invalidate("")
 	if err != nil {
 		return nil, err
 	}
@@ -244,8 +275,13 @@ func (c *Controller) Initialize() (*Response, error) {
 }
 
 func (c *Controller) Reset() (*Response, error) {
+	return c.ResetCtx(context.Background())
+}
+
+func (c *Controller) ResetCtx(ctx context.Context) (*Response, error) {
 	var ret Response
-	err := c.post("/reset/", nil, &ret)
+	err := c.post(ctx, "/reset/", nil, &ret)
+	c.invalidate("")
 	if err != nil {
 		return nil, err
 	}
@@ -253,8 +289,12 @@ func (c *Controller) Reset() (*Response, error) {
 }
 
 func (c *Controller) GetStatus() (*StatusResponse, error) {
+	return c.GetStatusCtx(context.Background())
+}
+
+func (c *Controller) GetStatusCtx(ctx context.Context) (*StatusResponse, error) {
 	var ret StatusResponse
-	err := c.get("/status/", &ret)
+	err := c.get(ctx, "/status/", &ret)
 	if err != nil {
 		return nil, err
 	}
@@ -262,8 +302,12 @@ func (c *Controller) GetStatus() (*StatusResponse, error) {
 }
 
 func (c *Controller) GetUptime() (*Response, error) {
+	return c.GetUptimeCtx(context.Background())
+}
+
+func (c *Controller) GetUptimeCtx(ctx context.Context) (*Response, error) {
 	var ret Response
-	err := c.get("/uptime/", &ret)
+	err := c.get(ctx, "/uptime/", &ret)
 	if err != nil {
 		return nil, err
 	}
@@ -271,8 +315,12 @@ func (c *Controller) GetUptime() (*Response, error) {
 }
 
 func (c *Controller) RequestShutdown() (*Response, error) {
+	return c.RequestShutdownCtx(context.Background())
+}
+
+func (c *Controller) RequestShutdownCtx(ctx context.Context) (*Response, error) {
 	var ret Response
-	err := c.post("/shutdown/", nil, &ret)
+	err := c.post(ctx, "/shutdown/", nil, &ret)
 	if err != nil {
 		return nil, err
 	}
@@ -280,8 +328,12 @@ func (c *Controller) RequestShutdown() (*Response, error) {
 }
 
 func (c *Controller) GetUsers() (*UsersResponse, error) {
+	return c.GetUsersCtx(context.Background())
+}
+
+func (c *Controller) GetUsersCtx(ctx context.Context) (*UsersResponse, error) {
 	var ret UsersResponse
-	err := c.get("/users/", &ret)
+	err := c.get(ctx, "/users/", &ret)
 	if err != nil {
 		return nil, err
 	}
@@ -289,30 +341,44 @@ func (c *Controller) GetUsers() (*UsersResponse, error) {
 }
 
 func (c *Controller) GetUserBooks() (*UserBooksResponse, error) {
+	return c.GetUserBooksCtx(context.Background())
+}
+
+func (c *Controller) GetUserBooksCtx(ctx context.Context) (*UserBooksResponse, error) {
 	var ret UserBooksResponse
 	ret.Success = true
 	ret.Message = "all users and address books"
 	ret.Request = "get user books"
-	usersResponse, err := c.GetUsers()
+	usersResponse, err := c.GetUsersCtx(ctx)
 	if err != nil {
 		return nil, err
 	}
 	ret.UserBooks = make(map[string][]string)
+	op := c.Start("userbooks", len(usersResponse.Users))
 	for _, user := range usersResponse.Users {
-		booksResponse, err := c.GetBooks(user.UserName)
+		booksResponse, err := c.GetBooksCtx(ctx, user.UserName)
 		if err != nil {
+			op.User(user.UserName, err)
+			op.Finish(err)
 			return nil, err
 		}
 		books := make([]string, len(booksResponse.Books))
 		for i, book := range booksResponse.Books {
 		    books[i] = book.BookName
+		    op.Book(user.UserName, book.BookName, nil)
 		}
 	    	ret.UserBooks[user.UserName] = books
+		op.User(user.UserName, nil)
 	}
+	op.Finish(nil)
 	return &ret, nil
 }
 
 func (c *Controller) AddUser(username, display, password string) (*AddUserResponse, error) {
+	return c.AddUserCtx(context.Background(), username, display, password)
+}
+
+func (c *Controller) AddUserCtx(ctx context.Context, username, display, password string) (*AddUserResponse, error) {
 	var err error
 	if display == "" {
 		display = username
@@ -320,7 +386,7 @@ func (c *Controller) AddUser(username, display, password string) (*AddUserRespon
 	if password == "" {
 		password, err = mkpasswd(PASSWORD_LENGTH)
 		if err != nil {
-			return nil, util.Fatalf("failed generating password: %v", err)
+			return nil, util.Fatalf("failed generating password: %w", err)
 		}
 	}
 	user := map[string]string{
@@ -330,14 +396,15 @@ func (c *Controller) AddUser(username, display, password string) (*AddUserRespon
 	}
 	jsonData, err := json.Marshal(user)
 	if err != nil {
-		return nil, util.Fatalf("failed formatting add user request data: %v", err)
+		return nil, util.Fatalf("failed formatting add user request data: %w", err)
 	}
 	var ret AddUserResponse
-	err = c.post("/user/", &jsonData, &ret)
+	err = c.post(ctx, "/user/", &jsonData, &ret)
 	if err != nil {
-		return nil, err
+		return nil, util.Classify(err, nil, ErrUserExists)
 	}
-	_, err = c.DeleteBook(username, "default address book")
+	c.invalidate(username)
+	_, err = c.DeleteBookCtx(ctx, username, "default address book")
 	if err != nil {
 		return nil, err
 	}
@@ -345,6 +412,10 @@ func (c *Controller) AddUser(username, display, password string) (*AddUserRespon
 }
 
 func (c *Controller) AddBook(username, bookname, description string) (*AddBookResponse, error) {
+	return c.AddBookCtx(context.Background(), username, bookname, description)
+}
+
+func (c *Controller) AddBookCtx(ctx context.Context, username, bookname, description string) (*AddBookResponse, error) {
 	if description == "" {
 		description = bookname
 	}
@@ -353,9 +424,9 @@ func (c *Controller) AddBook(username, bookname, description string) (*AddBookRe
 		"bookname":    bookname,
 		"description": description,
 	}
-	booksResponse, err := c.GetBooks(username)
+	booksResponse, err := c.GetBooksCtx(ctx, username)
 	if err != nil {
-	    return nil, util.Fatalf("requesting existing books: %v", err)
+	    return nil, util.Fatalf("requesting existing books: %w", err)
 	}
 	for _, book := range booksResponse.Books {
 	    if book.BookName == bookname {
@@ -369,33 +440,43 @@ func (c *Controller) AddBook(username, bookname, description string) (*AddBookRe
 	}
 	jsonData, err := json.Marshal(book)
 	if err != nil {
-		return nil, util.Fatalf("failed formatting add book request data: %v", err)
+		return nil, util.Fatalf("failed formatting add book request data: %w", err)
 	}
 	var ret AddBookResponse
-	err = c.post("/book/", &jsonData, &ret)
+	err = c.post(ctx, "/book/", &jsonData, &ret)
 	if err != nil {
-		return nil, err
+		return nil, util.Classify(err, ErrUserNotFound, ErrBookExists)
 	}
+	c.cache.InvalidateBook(username, bookname, true)
 	return &ret, nil
 }
 
 func (c *Controller) DeleteUser(username string) (*Response, error) {
+	return c.DeleteUserCtx(context.Background(), username)
+}
+
+func (c *Controller) DeleteUserCtx(ctx context.Context, username string) (*Response, error) {
 	user := map[string]string{
 		"username": username,
 	}
 	jsonData, err := json.Marshal(user)
 	if err != nil {
-		return nil, util.Fatalf("failed formatting delete user request data: %v", err)
+		return nil, util.Fatalf("failed formatting delete user request data: %w", err)
 	}
 	var ret Response
-	err = c.del("/user/", &jsonData, &ret)
+	err = c.del(ctx, "/user/", &jsonData, &ret)
+	c.invalidate(username)
 	if err != nil {
-		return nil, err
+		return nil, util.Classify(err, ErrUserNotFound, nil)
 	}
 	return &ret, nil
 }
 
 func (c *Controller) DeleteBook(username, bookname string) (*Response, error) {
+	return c.DeleteBookCtx(context.Background(), username, bookname)
+}
+
+func (c *Controller) DeleteBookCtx(ctx context.Context, username, bookname string) (*Response, error) {
 	token := util.BookToken(username, bookname)
 	user := map[string]string{
 		"username": username,
@@ -403,39 +484,37 @@ func (c *Controller) DeleteBook(username, bookname string) (*Response, error) {
 	}
 	jsonData, err := json.Marshal(user)
 	if err != nil {
-		return nil, util.Fatalf("failed formatting delete user request data: %v", err)
+		return nil, util.Fatalf("failed formatting delete user request data: %w", err)
 	}
 	var ret Response
-	err = c.del("/book/", &jsonData, &ret)
+	err = c.del(ctx, "/book/", &jsonData, &ret)
+	c.cache.InvalidateBook(username, bookname, true)
 	if err != nil {
-		return nil, err
+		return nil, util.Classify(err, ErrBookNotFound, nil)
 	}
 	return &ret, nil
 }
 
+// Addresses returns the addresses of a book; dav, if not nil, becomes the
+// client used for username
 func (c *Controller) Addresses(dav *davapi.CardClient, username, bookname string) (*AddressesResponse, error) {
+	c.useClient(username, dav)
+	return c.AddressesCtx(context.Background(), username, bookname)
+}
 
-	if dav == nil {
-		var err error
-		dav, err = c.davClient(username)
-		if err != nil {
-			return nil, err
-		}
-	}
-	book, err := c.GetBook(username, bookname)
-	if err != nil {
-		return nil, err
-	}
-	path, err := URIPath(book.URI)
+func (c *Controller) AddressesCtx(ctx context.Context, username, bookname string) (*AddressesResponse, error) {
+
+	dav, err := c.davClient(ctx, username)
 	if err != nil {
 		return nil, err
 	}
-	davAddrs, err := dav.Addresses(path)
+	_, state, err := c.syncBook(ctx, dav, syncMirror, username, bookname)
 	if err != nil {
 		return nil, err
 	}
+	davAddrs := state.sortedObjects()
 
-	addrs, err := c.EmailAddressList(davAddrs)
+	addrs, err := c.EmailAddressList(&davAddrs)
 	if err != nil {
 	    return nil, err
 	}
@@ -449,8 +528,34 @@ func (c *Controller) Addresses(dav *davapi.CardClient, username, bookname string
 	return &response, nil
 }
 
+func (c *Controller) Cards(username, bookname string) (*CardsResponse, error) {
+	return c.CardsCtx(context.Background(), username, bookname)
+}
+
+// CardsCtx returns the address objects of a book ordered by path
+func (c *Controller) CardsCtx(ctx context.Context, username, bookname string) (*CardsResponse, error) {
+	dav, err := c.davClient(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	_, state, err := c.syncBook(ctx, dav, syncMirror, username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	response := CardsResponse{}
+	response.Success = true
+	response.Request = "address book cards"
+	response.Message = fmt.Sprintf("%s %s cards", username, bookname)
+	response.Cards = state.sortedObjects()
+	return &response, nil
+}
+
 func (c *Controller) GetBook(username, bookname string) (*Book, error) {
-	response, err := c.GetBooks(username)
+	return c.GetBookCtx(context.Background(), username, bookname)
+}
+
+func (c *Controller) GetBookCtx(ctx context.Context, username, bookname string) (*Book, error) {
+	response, err := c.GetBooksCtx(ctx, username)
 	if err != nil {
 		return nil, err
 	}
@@ -459,19 +564,23 @@ func (c *Controller) GetBook(username, bookname string) (*Book, error) {
 			return &book, nil
 		}
 	}
-	return nil, util.Fatalf("book name not found: %s", bookname)
+	return nil, util.Fatalf("%w: %s", ErrBookNotFound, bookname)
 }
 
 func (c *Controller) GetBooks(username string) (*BooksResponse, error) {
+	return c.GetBooksCtx(context.Background(), username)
+}
+
+func (c *Controller) GetBooksCtx(ctx context.Context, username string) (*BooksResponse, error) {
 	response := BooksResponse{}
-	err := c.get(fmt.Sprintf("/books/%s/", username), &response)
+	err := c.get(ctx, fmt.Sprintf("/books/%s/", username), &response)
 	if err != nil {
-		return nil, err
+		return nil, util.Classify(err, ErrUserNotFound, nil)
 	}
 	return &response, nil
 }
 
-func (c *Controller) convertBook(username string, dav *davapi.CardClient, davBook *carddav.AddressBook, detailed bool) (*Book, error) {
+func (c *Controller) convertBook(ctx context.Context, username string, davBook *carddav.AddressBook, detailed bool) (*Book, error) {
 
 	parsedUsername, bookname, token, err := util.ParseBookPath(davBook.Path)
 	if err != nil {
@@ -493,9 +602,9 @@ func (c *Controller) convertBook(username string, dav *davapi.CardClient, davBoo
 		}
 		book.URI = fmt.Sprintf("%s%s", viper.GetString("mabctl.dav_url"), davBook.Path[uriIndex:])
 
-		addressesResponse, err := c.Addresses(dav, username, bookname)
+		addressesResponse, err := c.AddressesCtx(ctx, username, bookname)
 		if err != nil {
-			return nil, util.Fatalf("convertBook Addresses query failed: %v", err)
+			return nil, util.Fatalf("convertBook Addresses query failed: %w", err)
 		}
 		book.Contacts = len(addressesResponse.Addresses)
 	}
@@ -503,38 +612,59 @@ func (c *Controller) convertBook(username string, dav *davapi.CardClient, davBoo
 
 }
 
+// AddAddress adds an address to a book; dav, if not nil, becomes the client
+// used for username
 func (c *Controller) AddAddress(dav *davapi.CardClient, username, bookname, email, name string) (*AddressResponse, error) {
+	c.useClient(username, dav)
+	return c.AddAddressCtx(context.Background(), username, bookname, email, name)
+}
+
+func (c *Controller) AddAddressCtx(ctx context.Context, username, bookname, email, name string) (*AddressResponse, error) {
+	return c.AddAddressIfCtx(ctx, username, bookname, email, name, Precondition{})
+}
+
+// AddAddressIfCtx adds an address subject to cond: IfNoneMatch fails with a
+// ConflictError if the address exists, and IfMatch fails unless the address
+// exists with that ETag.
+func (c *Controller) AddAddressIfCtx(ctx context.Context, username, bookname, email, name string, cond Precondition) (*AddressResponse, error) {
 	verbose := viper.GetBool("verbose")
-	var err error
-	if dav == nil {
-		dav, err = c.davClient(username)
-		if err != nil {
-			return nil, err
-		}
+	dav, err := c.davClient(ctx, username)
+	if err != nil {
+		return nil, err
 	}
 	response := AddressResponse{}
 	response.Success = true
 	response.Request = fmt.Sprintf("Add CardDAV address: %s", email)
-	found, err := dav.QueryAddress(bookname, email)
+	found, err := dav.FindCardCtx(ctx, bookname, email)
 	if err != nil {
 		return nil, err
 	}
 	for _, addr := range *found {
-	    if verbose {
-		log.Printf("AddAddress: found existing: %+v\n", addr)
-	    }
-	    response.Address = &addr
-	    response.Message = fmt.Sprintf("existing %s", email)
-	    return &response, nil
+		if verbose {
+			log.Printf("AddAddress: found existing: %+v\n", addr)
+		}
+		if cond.IfNoneMatch {
+			return nil, &ConflictError{Path: addr.Path, Err: fmt.Errorf("%w: %s", ErrAddressExists, email)}
+		}
+		if cond.IfMatch != "" && cond.IfMatch != addr.ETag {
+			return nil, &ConflictError{Path: addr.Path, ETag: cond.IfMatch, Err: fmt.Errorf("ETag mismatch: %s", addr.ETag)}
+		}
+		response.Address = &addr
+		response.Message = fmt.Sprintf("existing %s", email)
+		return &response, nil
+	}
+	if cond.IfMatch != "" {
+		return nil, &ConflictError{ETag: cond.IfMatch, Err: fmt.Errorf("%w: %s", ErrAddressNotFound, email)}
 	}
 
-	    added, err := dav.AddAddress(bookname, email, name)
-	    if err != nil {
+	added, err := dav.AddAddressCtx(ctx, bookname, email, name)
+	c.cache.InvalidateBook(username, bookname, false)
+	if err != nil {
 		return nil, err
-	    }
-	    response.Address = added
-	    response.Message = fmt.Sprintf("added %s", email)
-	    return &response, nil
+	}
+	response.Address = added
+	response.Message = fmt.Sprintf("added %s", email)
+	return &response, nil
 
 }
 
@@ -560,11 +690,24 @@ func (c *Controller) EmailAddressList(addrs *[]carddav.AddressObject) (*[]string
 }
 
 func (c *Controller) DeleteAddress(username, bookname, email string) (*AddressesResponse, error) {
-	dav, err := c.davClient(username)
+	return c.DeleteAddressCtx(context.Background(), username, bookname, email)
+}
+
+func (c *Controller) DeleteAddressCtx(ctx context.Context, username, bookname, email string) (*AddressesResponse, error) {
+	return c.DeleteAddressIfCtx(ctx, username, bookname, email, Precondition{})
+}
+
+// DeleteAddressIfCtx deletes the addresses equal to email.  Each delete is
+// conditional on cond.IfMatch if set, otherwise on the ETag returned by the
+// query, and fails with a ConflictError if the address was modified.
+// cond.IfMatch is refused if more than one address matches.
+func (c *Controller) DeleteAddressIfCtx(ctx context.Context, username, bookname, email string, cond Precondition) (*AddressesResponse, error) {
+	dav, err := c.davClient(ctx, username)
 	if err != nil {
 		return nil, err
 	}
-	deleted, err := dav.DeleteAddress(bookname, email)
+	deleted, err := dav.DeleteAddressIfCtx(ctx, bookname, email, cond)
+	c.cache.InvalidateBook(username, bookname, false)
 	if err != nil {
 		return nil, err
 	}
@@ -585,15 +728,40 @@ func (c *Controller) DeleteAddress(username, bookname, email string) (*Addresses
 }
 
 func (c *Controller) QueryAddress(username, bookname, email string) (*AddressResponse, error) {
-	dav, err := c.davClient(username)
+	return c.QueryAddressCtx(context.Background(), username, bookname, email)
+}
+
+func (c *Controller) QueryAddressCtx(ctx context.Context, username, bookname, email string) (*AddressResponse, error) {
+	dav, err := c.davClient(ctx, username)
 	if err != nil {
 		return nil, err
 	}
-	found, err := dav.QueryAddress(bookname, email)
+	found, err := dav.QueryAddressCtx(ctx, bookname, email)
 	if err != nil {
 		return nil, err
 	    }
-	
+	return queryResponse(email, found), nil
+}
+
+func (c *Controller) FindAddress(username, bookname, email string) (*AddressResponse, error) {
+	return c.FindAddressCtx(context.Background(), username, bookname, email)
+}
+
+// FindAddressCtx returns the address with an EMAIL equal to email, where
+// QueryAddressCtx returns the first address containing it.
+func (c *Controller) FindAddressCtx(ctx context.Context, username, bookname, email string) (*AddressResponse, error) {
+	dav, err := c.davClient(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	found, err := dav.FindCardCtx(ctx, bookname, email)
+	if err != nil {
+		return nil, err
+	}
+	return queryResponse(email, found), nil
+}
+
+func queryResponse(email string, found *[]carddav.AddressObject) *AddressResponse {
 	response := AddressResponse{}
 	response.Success = true
 	response.Request = fmt.Sprintf("Query CardDAV address: %s", email)
@@ -604,24 +772,38 @@ func (c *Controller) QueryAddress(username, bookname, email string) (*AddressRes
 		response.Message = fmt.Sprintf("found: %d", len(*found))
 		response.Address = &(*found)[0]
 	}
-	return &response, nil
+	return &response
 }
 
 // return books containing address
 func (c *Controller) ScanAddress(username, email string) (*BooksResponse, error) {
+	return c.ScanAddressCtx(context.Background(), username, email)
+}
 
-	log.Printf("ScanAddress username=%s email=%s\n", username, email)
+func (c *Controller) ScanAddressCtx(ctx context.Context, username, email string) (*BooksResponse, error) {
+
+	if viper.GetBool("verbose") {
+		log.Printf("ScanAddress username=%s email=%s\n", username, email)
+	}
 
 	response := BooksResponse{}
 	response.Success = false
 	response.Request = fmt.Sprintf("Scan books for CardDAV address: %s", email)
 
-	dav, err := c.davClient(username)
-	if err != nil {
-		response.Message = fmt.Sprintf("%v", err)
-		return &response, nil
+	connect := c.connector(ctx, username)
+	var books *[]carddav.AddressBook
+	var err error
+	if c.cache != nil {
+		var found []carddav.AddressBook
+		found, err = c.cache.scan(ctx, connect, username, email)
+		books = &found
+	} else {
+		var dav *davapi.CardClient
+		dav, err = connect()
+		if err == nil {
+			books, err = dav.ScanAddressCtx(ctx, email)
+		}
 	}
-	books, err := dav.ScanAddress(email)
 	if err != nil {
 		response.Message = fmt.Sprintf("%v", err)
 		return &response, nil
@@ -630,7 +812,7 @@ func (c *Controller) ScanAddress(username, email string) (*BooksResponse, error)
 	response.Message = fmt.Sprintf("books found: %d", len(*books))
 	response.Books = make([]Book, len(*books))
 	for i, davBook := range *books {
-		book, err := c.convertBook(username, dav, &davBook, false)
+		book, err := c.convertBook(ctx, username, &davBook, false)
 		if err != nil {
 			response.Success = false
 			response.Message = fmt.Sprintf("%v", err)
@@ -638,24 +820,41 @@ func (c *Controller) ScanAddress(username, email string) (*BooksResponse, error)
 		}
 		response.Books[i] = *book
 	}
+	response.Success = true
 	return &response, nil
 }
 
 func (c *Controller) GetPassword(username string) (*AccountResponse, error) {
-	response := AccountResponse{}
-	response.Request = fmt.Sprintf("get password: %s", username)
-	err := c.get("/password/"+username+"/", &response)
+	return c.GetPasswordCtx(context.Background(), username)
+}
+
+func (c *Controller) GetPasswordCtx(ctx context.Context, username string) (*AccountResponse, error) {
+	response, err := c.getPassword(ctx, username)
 	if err != nil {
 		response.Message = fmt.Sprintf("%v", err)
-		return &response, nil
+		return response, nil
 	}
 	response.Success = true
+	return response, nil
+}
+
+func (c *Controller) getPassword(ctx context.Context, username string) (*AccountResponse, error) {
+	response := AccountResponse{}
+	response.Request = fmt.Sprintf("get password: %s", username)
+	err := c.get(ctx, "/password/"+username+"/", &response)
+	if err != nil {
+		return &response, util.Classify(err, ErrUserNotFound, nil)
+	}
 	return &response, nil
 }
 
 func (c *Controller) GetAccounts() (*UserAccountsResponse, error) {
+	return c.GetAccountsCtx(context.Background())
+}
+
+func (c *Controller) GetAccountsCtx(ctx context.Context) (*UserAccountsResponse, error) {
 	response := UserAccountsResponse{}
-	err := c.get("/accounts/", &response)
+	err := c.get(ctx, "/accounts/", &response)
 	if err != nil {
 		return nil, err
 	}
@@ -663,12 +862,17 @@ func (c *Controller) GetAccounts() (*UserAccountsResponse, error) {
 }
 
 func (c *Controller) SetAccounts(request *UserAccountsRequest) (*UserAccountsResponse, error) {
+	return c.SetAccountsCtx(context.Background(), request)
+}
+
+func (c *Controller) SetAccountsCtx(ctx context.Context, request *UserAccountsRequest) (*UserAccountsResponse, error) {
 	response := UserAccountsResponse{}
 	jsonData, err := json.Marshal(request)
 	if err != nil {
-		return nil, util.Fatalf("failed formatting set passwords request data: %v", err)
+		return nil, util.Fatalf("failed formatting set passwords request data: %w", err)
 	}
-	err = c.post("/accounts/", &jsonData, &response)
+	err = c.post(ctx, "/accounts/", &jsonData, &response)
+	c.invalidate("")
 	if err != nil {
 		return nil, err
 	}
@@ -676,94 +880,52 @@ func (c *Controller) SetAccounts(request *UserAccountsRequest) (*UserAccountsRes
 }
 
 func (c *Controller) Dump(dumpUser string) (*DumpResponse, error) {
-	verbose := viper.GetBool("verbose")
-	dump := ConfigDump{Users: make(map[string]UserDump)}
-	usersResponse, err := c.GetUsers()
+	return c.DumpCtx(context.Background(), dumpUser)
+}
+
+// DumpCtx returns the users, books and cards on the server; users are dumped
+// concurrently by Jobs() workers
+func (c *Controller) DumpCtx(ctx context.Context, dumpUser string) (*DumpResponse, error) {
+	dump := NewDumpFile()
+	usersResponse, err := c.GetUsersCtx(ctx)
 	if err != nil {
 		return nil, err
 	}
-	type DumpResult struct {
-		username string
-		err      error
-		ret      UserDump
-	}
-	results := make(chan DumpResult)
-	accountsResponse, err := c.GetAccounts()
+	accountsResponse, err := c.GetAccountsCtx(ctx)
 	if err != nil {
 	    return nil, err
 	}
-	resultCount := 0
+	displayNames := make(map[string]string)
+	usernames := []string{}
 	for _, user := range usersResponse.Users {
 		if dumpUser != "" && user.UserName != dumpUser {
 		    continue
 		}
-		resultCount++
-		go func(username string, accounts map[string]string) {
-			if verbose {
-				log.Printf("dumping user %s\n", username)
-			}
-			var dav *davapi.CardClient
-			password, ok := accounts[username]
-			if !ok {
-			    results <- DumpResult{username, fmt.Errorf("password not found: username=%s", username), UserDump{}}
-				return
-			}
-			userdump := UserDump{Password: password, Books: make(map[string][]string)}
-			booksResponse, err := c.GetBooks(username)
-			if err != nil {
-				results <- DumpResult{username, err, UserDump{}}
-				return
-			}
-			for _, book := range booksResponse.Books {
-				if verbose {
-					log.Printf("dumping book %s/%s\n", username, book.BookName)
-				}
-
-				if book.Contacts == 0 {
-					userdump.Books[book.BookName] = []string{}
-				} else {
-
-					if dav == nil {
-						d, err := c.davClient(username)
-						if err != nil {
-							results <- DumpResult{username, err, UserDump{}}
-							return
-						}
-						dav = d
-						if verbose {
-							log.Printf("created davClient: %+v\n", dav)
-						}
-					}
-
-					addressesResponse, err := c.Addresses(dav, username, book.BookName)
-					if err != nil {
-						results <- DumpResult{username, err, UserDump{}}
-						return
-					}
-					userdump.Books[book.BookName] = make([]string, len(addressesResponse.Addresses))
-					for i, email := range addressesResponse.Addresses {
-						userdump.Books[book.BookName][i] = email
-						if verbose {
-							log.Printf("dumping address %s/%s/%s\n", username, book.BookName, email)
-						}
-					}
-				}
+		displayNames[user.UserName] = user.DisplayName
+		usernames = append(usernames, user.UserName)
+	}
+	var mutex sync.Mutex
+	var firstErr error
+	op := c.Start("dump", len(usernames))
+	forEachUser(ctx, usernames, func(username string) {
+		userdump, err := c.dumpUser(ctx, op, username, displayNames[username], accountsResponse.Accounts)
+		op.User(username, err)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
 			}
-			results <- DumpResult{username, nil, userdump}
-		}(user.UserName, accountsResponse.Accounts)
-
-	}
-
-	for i := 0; i < resultCount; i++ {
-		result := <-results
-		if result.err != nil {
-			err = result.err
-		} else {
-			dump.Users[result.username] = result.ret
+			return
 		}
+		dump.Users[username] = userdump
+	})
+	if firstErr == nil {
+		firstErr = ctx.Err()
 	}
-	if err != nil {
-		return nil, err
+	op.Finish(firstErr)
+	if firstErr != nil {
+		return nil, firstErr
 	}
 	var ret DumpResponse
 	ret.Success = true
@@ -772,146 +934,236 @@ func (c *Controller) Dump(dumpUser string) (*DumpResponse, error) {
 	    ret.Request = fmt.Sprintf("dump user %s", dumpUser)
 	}
 	ret.Message = "dumped"
-	ret.Dump = dump
+	ret.Dump = *dump
 	return &ret, nil
 }
 
-func (c *Controller) Restore(dump *ConfigDump, restoreUser string) (*Response, error) {
+// dumpUser returns the books and cards of one user
+func (c *Controller) dumpUser(ctx context.Context, op *Operation, username, display string, accounts map[string]string) (DumpUser, error) {
 	verbose := viper.GetBool("verbose")
-	type RestoreResult struct {
-		username string
-		err      error
+	if verbose {
+		log.Printf("dumping user %s\n", username)
 	}
-	results := make(chan RestoreResult)
-	type BookAddrs struct {
-		bookname  string
-		addresses []string
+	var dav *davapi.CardClient
+	password, ok := accounts[username]
+	if !ok {
+		return DumpUser{}, util.Fatalf("%w: password not found: username=%s", ErrUserNotFound, username)
 	}
-
-	userbooks := make(map[string][]BookAddrs)
-
-	for username, user := range dump.Users {
-		if restoreUser != "" && username != restoreUser {
-		    continue
-		}
-		_, err := c.AddUser(username, username, user.Password)
-		if err != nil {
-			return nil, util.Fatalf("failed restoring username=%s: %v", username, err)
-		}
+	userdump := DumpUser{DisplayName: display, Password: password, Books: make(map[string]DumpBook)}
+	booksResponse, err := c.GetBooksCtx(ctx, username)
+	if err != nil {
+		return DumpUser{}, err
+	}
+	for _, book := range booksResponse.Books {
 		if verbose {
-			log.Printf("created user: %s\n", username)
+			log.Printf("dumping book %s/%s\n", username, book.BookName)
 		}
 
-		userjobs := []BookAddrs{}
-		for bookname, addresses := range user.Books {
-			if strings.ToLower(bookname) != "default address book" {
-				_, err := c.AddBook(username, bookname, "")
+		bookdump := DumpBook{Description: book.Description, Cards: []DumpCard{}}
+		if book.Contacts > 0 {
+
+			if dav == nil {
+				d, err := c.davClient(ctx, username)
 				if err != nil {
-					return nil, util.Fatalf("failed restoring username=%s bookname=%s: %v", username, bookname, err)
+					return DumpUser{}, err
 				}
+				dav = d
 				if verbose {
-					log.Printf("created book: %s/%s [%d]\n", username, bookname, len(addresses))
+					log.Printf("created davClient: %+v\n", dav)
+				}
+			}
+
+			// the synchronized copy of the book, so only changes are
+			// transferred
+			_, state, err := c.syncBookURI(ctx, dav, syncMirror, username, &book)
+			if err != nil {
+				return DumpUser{}, err
+			}
+			for _, addr := range state.sortedObjects() {
+				card, err := NewDumpCard(addr.Card)
+				if err != nil {
+					return DumpUser{}, err
 				}
-				if len(addresses) > 0 {
-					userjobs = append(userjobs, BookAddrs{bookname, addresses})
+				card.Path = addr.Path
+				card.ETag = addr.ETag
+				bookdump.Cards = append(bookdump.Cards, card)
+				op.Address(username, book.BookName, card.UID, addr.Card.Value(vcard.FieldEmail), nil)
+				if verbose {
+					log.Printf("dumping card %s/%s/%s\n", username, book.BookName, card.UID)
 				}
 			}
+			sortCards(bookdump.Cards)
 		}
-		userbooks[username] = userjobs
+		userdump.Books[book.BookName] = bookdump
+		op.Book(username, book.BookName, nil)
+	}
+	return userdump, nil
+}
+
+// Restore recreates the users and addresses of a legacy dump
+func (c *Controller) Restore(dump *ConfigDump, restoreUser string) (*Response, error) {
+	upgraded, err := dump.Upgrade()
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.RestoreCtx(context.Background(), upgraded, restoreUser, nil)
+	if err != nil {
+		return nil, err
 	}
+	return &response.Response, nil
+}
 
-	resultCount := 0
-	for username, jobs := range userbooks {
-		if restoreUser != "" && username != restoreUser {
-		    continue 
+// RestoreCtx recreates the users, books and cards of a dump.  Cards keep
+// their UIDs; a card which already exists on the server is left unchanged.
+// Each step is recorded in journal, if not nil, and steps it shows as
+// completed are skipped.  A failed user or book skips its contents; every
+// other step is attempted, and the response lists all failures.  Users are
+// restored concurrently by Jobs() workers.
+func (c *Controller) RestoreCtx(ctx context.Context, dump *DumpFile, restoreUser string, journal *RestoreJournal) (*RestoreResponse, error) {
+	report := NewRestoreReport(journal, "restore")
+	usernames := []string{}
+	for _, username := range sortedKeys(dump.Users) {
+		if restoreUser == "" || username == restoreUser {
+			usernames = append(usernames, username)
 		}
-		resultCount++
+	}
+	op := c.Start("restore", len(usernames))
+	forEachUser(ctx, usernames, func(username string) {
+		err := c.restoreUser(ctx, op, report, username, dump.Users[username])
+		op.User(username, err)
+	})
 
-		go func(username string, jobs []BookAddrs, results chan RestoreResult) {
+	if ctx.Err() != nil {
+		op.Finish(ctx.Err())
+		return nil, ctx.Err()
+	}
+	response, err := report.Result()
+	op.Finish(err)
+	return response, err
+}
+
+// restoreUser creates one user of a dump with its books and cards, returning
+// the error which stopped the user, if any
+func (c *Controller) restoreUser(ctx context.Context, op *Operation, report *RestoreReport, username string, user DumpUser) error {
+	verbose := viper.GetBool("verbose")
+	entry := JournalEntry{Action: PLAN_CREATE, Kind: PLAN_USER, Username: username}
+	if !report.Done(entry) {
+		display := user.DisplayName
+		if display == "" {
+			display = username
+		}
+		_, err := c.AddUserCtx(ctx, username, display, user.Password)
+		if report.Record(entry, err) != nil {
+			return err
+		}
+		if verbose {
+			log.Printf("created user: %s\n", username)
+		}
+	}
+
+	var dav *davapi.CardClient
+	for _, bookname := range sortedKeys(user.Books) {
+		if IsDefaultBook(bookname) {
+			continue
+		}
+		book := user.Books[bookname]
+		entry := JournalEntry{Action: PLAN_CREATE, Kind: PLAN_BOOK, Username: username, Bookname: bookname}
+		if !report.Done(entry) {
+			_, err := c.AddBookCtx(ctx, username, bookname, book.Description)
+			if report.Record(entry, err) != nil {
+				op.Book(username, bookname, err)
+				continue
+			}
 			if verbose {
-				log.Printf("restore[%s]: begin\n", username)
+				log.Printf("created book: %s/%s [%d]\n", username, bookname, len(book.Cards))
+			}
+		}
+		for _, dumpCard := range book.Cards {
+			entry := JournalEntry{Action: PLAN_CREATE, Kind: PLAN_CARD, Username: username, Bookname: bookname, UID: dumpCard.UID}
+			if report.Done(entry) {
+				continue
 			}
-			var dav *davapi.CardClient
-			for _, job := range jobs {
+			if ctx.Err() != nil {
+				return report.Record(entry, ctx.Err())
+			}
+
+			if dav == nil {
+				d, err := c.davClient(ctx, username)
+				if err != nil {
+					return report.Record(entry, err)
+				}
+				dav = d
 				if verbose {
-					log.Printf("restore[%s]: job=%+v\n", username, job)
+					log.Printf("restore[%s]: created dav client: %v\n", username, dav)
 				}
-				for _, address := range job.addresses {
-
-					if dav == nil {
-						d, err := c.davClient(username)
-						if err != nil {
-							results <- RestoreResult{username, err}
-							return
-						}
-						dav = d
-						if verbose {
-							log.Printf("restore[%s]: created dav client: %v\n", username, dav)
-						}
-					}
-
-					_, err := c.AddAddress(dav, username, job.bookname, address, "")
-					if err != nil {
-						results <- RestoreResult{username, util.Fatalf("failed restoring username=%s bookname=%s address=%s: %v", username, job.bookname, address, err)}
-					}
-					if verbose {
-						log.Printf("restore[%s]: created address: %s/%s/%s\n", username, username, job.bookname, address)
-					}
+			}
+
+			card, err := dumpCard.Card()
+			address := ""
+			if err == nil {
+				address = card.Value(vcard.FieldEmail)
+				_, err = dav.PutCardCtx(ctx, bookname, card, Precondition{IfNoneMatch: true})
+			}
+			if errors.Is(err, ErrConflict) {
+				if verbose {
+					log.Printf("restore[%s]: existing card: %s/%s/%s\n", username, username, bookname, dumpCard.UID)
 				}
+				report.Skip(entry)
+				op.Address(username, bookname, dumpCard.UID, address, nil)
+				continue
+			}
+			op.Address(username, bookname, dumpCard.UID, address, err)
+			if report.Record(entry, err) != nil {
+				continue
 			}
 			if verbose {
-				log.Printf("restore[%s]: success\n", username)
+				log.Printf("restore[%s]: created card: %s/%s/%s\n", username, username, bookname, dumpCard.UID)
 			}
-			results <- RestoreResult{username, nil}
-		}(username, jobs, results)
-	}
-
-	errors := []string{}
-
-	for i := 0; i < resultCount; i++ {
-		result := <-results
-		if result.err != nil {
-			errors = append(errors, fmt.Sprintf("restore[%s] fail: %v", result.username, result.err))
 		}
+		op.Book(username, bookname, nil)
 	}
-	if len(errors) > 0 {
-		return nil, fmt.Errorf("%s", strings.Join(errors, "\n"))
-	}
-	return &Response{Request: "restore", Success: true, Message: "restored"}, nil
+	return nil
 }
 
 func (c *Controller) Clear() (*Response, error) {
+	return c.ClearCtx(context.Background())
+}
+
+func (c *Controller) ClearCtx(ctx context.Context) (*Response, error) {
 	verbose := viper.GetBool("verbose")
 	users := make(map[string]bool)
 	accounts := make(map[string]bool)
 	names := make(map[string]bool)
 
-	accountsResponse, err := c.GetAccounts()
+	accountsResponse, err := c.GetAccountsCtx(ctx)
 	if err != nil {
-		return nil, util.Fatalf("failed getting accounts: %v", err)
+		return nil, util.Fatalf("failed getting accounts: %w", err)
 	}
 	for username, _ := range accountsResponse.Accounts {
 		accounts[username] = true
 		names[username] = true
 	}
 
-	usersResponse, err := c.GetUsers()
+	usersResponse, err := c.GetUsersCtx(ctx)
 	if err != nil {
-		return nil, util.Fatalf("failed getting users: %v", err)
+		return nil, util.Fatalf("failed getting users: %w", err)
 	}
 	for _, user := range usersResponse.Users {
 		users[user.UserName] = true
 		names[user.UserName] = true
 	}
 
+	op := c.Start("clear", len(names))
 	for username, _ := range names {
 		_, ok := users[username]
 		if ok {
 			if verbose {
 				log.Printf("clearing user %s\n", username)
 			}
-			_, err := c.DeleteUser(username)
+			_, err := c.DeleteUserCtx(ctx, username)
 			if err != nil {
+				op.User(username, err)
+				op.Finish(err)
 				return nil, err
 			}
 			delete(accounts, username)
@@ -921,8 +1173,10 @@ func (c *Controller) Clear() (*Response, error) {
 			if verbose {
 				log.Printf("clearing account %s\n", username)
 			}
-			c.DeleteUser(username)
+			c.DeleteUserCtx(ctx, username)
 		}
+		op.User(username, nil)
 	}
+	op.Finish(nil)
 	return &Response{Request: "clear", Success: true, Message: "cleared"}, nil
 }
@@ -1,19 +1,58 @@
 package api
 
 import (
+	"context"
 	"fmt"
+	"github.com/rstms/mabctl/testserver"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
+	"maps"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
-func initConfig(t *testing.T) {
+func initConfig(t *testing.T) *testserver.Server {
+	server, err := testserver.Start(t.TempDir())
+	require.Nil(t, err)
+	t.Cleanup(server.Close)
+	viper.Reset()
 	viper.SetConfigType("yaml")
-	viper.SetConfigFile("/etc/mabctl/config.yaml")
-	err := viper.ReadInConfig()
+	err = viper.ReadConfig(strings.NewReader(server.Config()))
 	require.Nil(t, err)
 	viper.Set("verbose", true)
 	viper.Set("hostname", "radicale.mailcapsule.io")
+	return server
+}
+
+// testBooks maps the names of books to the addresses added to them
+type testBooks map[string][]string
+
+// initController starts a test server and returns a controller for it,
+// adding username with books unless username is empty
+func initController(t *testing.T, username string, books testBooks) (*Controller, *testserver.Server) {
+	server := initConfig(t)
+	api, err := NewAddressBookController()
+	require.Nil(t, err)
+	if username != "" {
+		addTestUser(t, api, username, books)
+	}
+	return api, server
+}
+
+// addTestUser adds username with books holding the given addresses
+func addTestUser(t *testing.T, api *Controller, username string, books testBooks) {
+	_, err := api.AddUser(username, "", "")
+	require.Nil(t, err)
+	for _, bookname := range slices.Sorted(maps.Keys(books)) {
+		_, err = api.AddBook(username, bookname, "")
+		require.Nil(t, err)
+		for _, email := range books[bookname] {
+			_, err = api.AddAddress(nil, username, bookname, email, "")
+			require.Nil(t, err)
+		}
+	}
 }
 
 func TestApiInit(t *testing.T) {
@@ -55,3 +94,221 @@ func TestScanBadUser(t *testing.T) {
 	fmt.Printf("request: %v\n", response.Request)
 	fmt.Printf("books: %v\n", response.Books)
 }
+
+func TestAddressRoundTrip(t *testing.T) {
+
+	api, _ := initController(t, "user@example.org", testBooks{"friends": nil})
+
+	added, err := api.AddAddress(nil, "user@example.org", "friends", "friend@example.com", "Good Friend")
+	require.Nil(t, err)
+	require.Equal(t, "added friend@example.com", added.Message)
+
+	existing, err := api.AddAddress(nil, "user@example.org", "friends", "friend@example.com", "Good Friend")
+	require.Nil(t, err)
+	require.Equal(t, "existing friend@example.com", existing.Message)
+
+	scan, err := api.ScanAddress("user@example.org", "friend@example.com")
+	require.Nil(t, err)
+	require.Len(t, scan.Books, 1)
+	require.Equal(t, "friends", scan.Books[0].BookName)
+
+	dump, err := api.Dump("")
+	require.Nil(t, err)
+	emails, err := dump.Dump.Users["user@example.org"].Books["friends"].Emails()
+	require.Nil(t, err)
+	require.Equal(t, []string{"friend@example.com"}, emails)
+
+	deleted, err := api.DeleteAddress("user@example.org", "friends", "friend@example.com")
+	require.Nil(t, err)
+	require.Equal(t, []string{"friend@example.com"}, deleted.Addresses)
+}
+
+func TestErrors(t *testing.T) {
+
+	api, _ := initController(t, "", nil)
+
+	_, err := api.GetBooks("nobody@example.org")
+	require.ErrorIs(t, err, ErrUserNotFound)
+	require.ErrorIs(t, err, ErrNotFound)
+	var httpErr *HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	require.Equal(t, 404, httpErr.StatusCode)
+	require.Equal(t, "GET", httpErr.Method)
+	require.Contains(t, httpErr.Detail, "nobody@example.org")
+
+	_, err = api.AddUser("user@example.org", "", "")
+	require.Nil(t, err)
+	_, err = api.AddUser("user@example.org", "", "")
+	require.ErrorIs(t, err, ErrUserExists)
+
+	_, err = api.GetBook("user@example.org", "missing")
+	require.ErrorIs(t, err, ErrBookNotFound)
+
+	viper.Set("mabctl.api_key", "invalid")
+	api, err = NewAddressBookController()
+	require.Nil(t, err)
+	_, err = api.GetUsers()
+	require.ErrorIs(t, err, ErrUnauthorized)
+}
+
+func TestRetry(t *testing.T) {
+
+	server := initConfig(t)
+	viper.Set("mabctl.retry.backoff", "1ms")
+	api, err := NewAddressBookController()
+	require.Nil(t, err)
+
+	server.FailNext(503, 502)
+	_, err = api.GetUsers()
+	require.Nil(t, err)
+
+	server.FailNext(503, 503, 503)
+	_, err = api.GetUsers()
+	require.ErrorIs(t, err, ErrUnavailable)
+
+	// a failed non-idempotent POST is not repeated
+	server.FailNext(503)
+	_, err = api.AddUser("user@example.org", "", "")
+	require.ErrorIs(t, err, ErrServerError)
+
+	server.FailNext(404)
+	_, err = api.GetUsers()
+	require.ErrorIs(t, err, ErrNotFound)
+
+	_, err = api.AddUser("user@example.org", "", "")
+	require.Nil(t, err)
+	_, err = api.AddBook("user@example.org", "friends", "")
+	require.Nil(t, err)
+	// connect first, so the failure is returned to the address request
+	_, err = api.davClient(context.Background(), "user@example.org")
+	require.Nil(t, err)
+	server.FailNext(500)
+	_, err = api.AddAddress(nil, "user@example.org", "friends", "friend@example.com", "")
+	require.Nil(t, err)
+	addrs, err := api.Addresses(nil, "user@example.org", "friends")
+	require.Nil(t, err)
+	require.Equal(t, []string{"friend@example.com"}, addrs.Addresses)
+}
+
+func TestSharedClient(t *testing.T) {
+
+	username := "user@example.org"
+	api, _ := initController(t, username, testBooks{"friends": {"friend@example.com"}})
+	ctx := context.Background()
+
+	// goroutines looking up one user share its CardDAV client
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			for j := 0; j < 5; j++ {
+				response, err := api.FindAddressCtx(ctx, username, "friends", "friend@example.com")
+				if err == nil && response.Address == nil {
+					err = fmt.Errorf("not found: %s", response.Message)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		require.Nil(t, <-errs)
+	}
+}
+
+func TestJobsAndRateLimit(t *testing.T) {
+
+	api, _ := initController(t, "", nil)
+	for i := 0; i < 5; i++ {
+		username := fmt.Sprintf("user%d@example.org", i)
+		addTestUser(t, api, username, testBooks{"friends": {"friend@example.com"}})
+	}
+
+	viper.Set("mabctl.jobs", 1)
+	serial, err := api.Dump("")
+	require.Nil(t, err)
+	viper.Set("mabctl.jobs", 8)
+	parallel, err := api.Dump("")
+	require.Nil(t, err)
+	require.Len(t, parallel.Dump.Users, 5)
+	require.Empty(t, DiffDumps(&serial.Dump, &parallel.Dump))
+
+	// the limiter is shared by every client created while the rate is set
+	viper.Set("mabctl.rate_limit", 20)
+	defer viper.Set("mabctl.rate_limit", 0)
+	first, err := NewAddressBookController()
+	require.Nil(t, err)
+	second, err := NewAddressBookController()
+	require.Nil(t, err)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err = first.GetUsers()
+		require.Nil(t, err)
+		_, err = second.GetUsers()
+		require.Nil(t, err)
+	}
+	require.GreaterOrEqual(t, time.Since(start), 5*50*time.Millisecond)
+}
+
+func TestEvents(t *testing.T) {
+
+	api, _ := initController(t, "", nil)
+	for i := 0; i < 2; i++ {
+		username := fmt.Sprintf("user%d@example.org", i)
+		addTestUser(t, api, username, testBooks{"friends": {"friend@example.com"}})
+	}
+
+	events := []Event{}
+	api.Events().SetEventHandler(func(event Event) {
+		events = append(events, event)
+	})
+	count := func(eventType string) int {
+		n := 0
+		for _, event := range events {
+			if event.Type == eventType {
+				n++
+			}
+		}
+		return n
+	}
+
+	dump, err := api.Dump("")
+	require.Nil(t, err)
+	require.Equal(t, EVENT_START, events[0].Type)
+	require.Equal(t, "dump", events[0].Operation)
+	require.Equal(t, 2, events[0].Total)
+	last := events[len(events)-1]
+	require.Equal(t, EVENT_DONE, last.Type)
+	require.Equal(t, 2, last.Done)
+	require.Empty(t, last.Error)
+	require.Equal(t, 2, count(EVENT_USER))
+	require.Equal(t, 2, count(EVENT_BOOK))
+	require.Equal(t, 2, count(EVENT_ADDRESS))
+	require.Equal(t, 0, count(EVENT_ERROR))
+
+	events = []Event{}
+	_, err = api.Clear()
+	require.Nil(t, err)
+	require.Equal(t, "clear", events[0].Operation)
+	require.Equal(t, EVENT_DONE, events[len(events)-1].Type)
+
+	events = []Event{}
+	_, err = api.RestoreCtx(context.Background(), &dump.Dump, "", nil)
+	require.Nil(t, err)
+	require.Equal(t, "restore", events[0].Operation)
+	require.Equal(t, 2, count(EVENT_USER))
+	require.Equal(t, 2, count(EVENT_ADDRESS))
+	for _, event := range events {
+		if event.Type == EVENT_ADDRESS {
+			require.Equal(t, "friend@example.com", event.Address)
+		}
+	}
+
+	api.Events().SetEventHandler(nil)
+	events = []Event{}
+	_, err = api.Dump("")
+	require.Nil(t, err)
+	require.Empty(t, events)
+}
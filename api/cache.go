@@ -0,0 +1,401 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-webdav/carddav"
+	davapi "github.com/rstms/mabctl/carddav"
+	"github.com/rstms/mabctl/util"
+	"github.com/spf13/viper"
+)
+
+const DEFAULT_CACHE_SIZE = 1000
+const DEFAULT_CONNECTION_TTL = 5 * time.Minute
+
+// lruCache holds at most size values, discarding the least recently used.
+// Values older than ttl are stale; they are returned so they may be
+// revalidated, but never reported as fresh.
+type lruCache[V any] struct {
+	size  int
+	ttl   time.Duration
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruItem[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+func newLRUCache[V any](size int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{size: size, ttl: ttl, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns the value for key and whether it is still fresh
+func (c *lruCache[V]) get(key string) (value V, fresh, ok bool) {
+	element, ok := c.items[key]
+	if !ok {
+		return value, false, false
+	}
+	c.order.MoveToFront(element)
+	item := element.Value.(*lruItem[V])
+	return item.value, time.Now().Before(item.expires), true
+}
+
+func (c *lruCache[V]) put(key string, value V) {
+	expires := time.Now().Add(c.ttl)
+	if element, ok := c.items[key]; ok {
+		c.order.MoveToFront(element)
+		item := element.Value.(*lruItem[V])
+		item.value = value
+		item.expires = expires
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruItem[V]{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruItem[V]).key)
+	}
+}
+
+func (c *lruCache[V]) remove(key string) {
+	if element, ok := c.items[key]; ok {
+		c.order.Remove(element)
+		delete(c.items, key)
+	}
+}
+
+// removePrefix removes the keys beginning with prefix
+func (c *lruCache[V]) removePrefix(prefix string) {
+	for key, element := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.order.Remove(element)
+			delete(c.items, key)
+		}
+	}
+}
+
+// cachedBook is the email addresses of a book, by address object path
+type cachedBook struct {
+	token  string
+	emails map[string][]string
+}
+
+func newCachedBook(token string, addrs []carddav.AddressObject) *cachedBook {
+	book := cachedBook{token: token, emails: make(map[string][]string)}
+	book.update(addrs, nil)
+	return &book
+}
+
+func (b *cachedBook) update(updated []carddav.AddressObject, deleted []string) {
+	for _, addr := range updated {
+		emails := addr.Card.Values("EMAIL")
+		for i := range emails {
+			emails[i] = strings.ToLower(emails[i])
+		}
+		b.emails[addr.Path] = emails
+	}
+	for _, path := range deleted {
+		delete(b.emails, path)
+	}
+}
+
+func (b *cachedBook) contains(email string) bool {
+	email = strings.ToLower(email)
+	for _, emails := range b.emails {
+		for _, e := range emails {
+			if e == email {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CacheStats counts cache lookups
+type CacheStats struct {
+	Hits          int `json:"hits"`
+	Misses        int `json:"misses"`
+	Revalidations int `json:"revalidations"`
+}
+
+// Cache holds user passwords, the books of each user and the addresses in
+// each book so that repeated lookups are answered from memory.  Entries
+// expire after the TTL; with revalidate, an expired address set is brought
+// up to date with a sync-collection request instead of being fetched again.
+// Changes made through the Controller invalidate the affected entries.  A
+// nil Cache caches nothing.
+type Cache struct {
+	mutex      sync.Mutex
+	revalidate bool
+	passwords  *lruCache[string]
+	books      *lruCache[[]carddav.AddressBook]
+	addresses  *lruCache[*cachedBook]
+	stats      CacheStats
+}
+
+// NewCache returns a cache holding up to size entries of each kind for
+// ttl, or nil if ttl is not positive
+func NewCache(ttl time.Duration, size int, revalidate bool) *Cache {
+	if ttl <= 0 {
+		return nil
+	}
+	if size < 1 {
+		size = DEFAULT_CACHE_SIZE
+	}
+	return &Cache{
+		revalidate: revalidate,
+		passwords:  newLRUCache[string](size, ttl),
+		books:      newLRUCache[[]carddav.AddressBook](size, ttl),
+		addresses:  newLRUCache[*cachedBook](size, ttl),
+	}
+}
+
+// newConfiguredCache returns the cache set by the mabctl.cache.ttl,
+// mabctl.cache.size and mabctl.cache.revalidate config keys; caching is
+// disabled unless a TTL is set
+func newConfiguredCache() *Cache {
+	size := DEFAULT_CACHE_SIZE
+	if viper.IsSet("mabctl.cache.size") {
+		size = viper.GetInt("mabctl.cache.size")
+	}
+	return NewCache(viper.GetDuration("mabctl.cache.ttl"), size, viper.GetBool("mabctl.cache.revalidate"))
+}
+
+// davConnector returns a CardDAV client, connecting only when first called
+type davConnector func() (*davapi.CardClient, error)
+
+// connections holds the CardDAV client of each user so that successive
+// operations share one connection.  Clients expire after
+// DEFAULT_CONNECTION_TTL, and are discarded with the user's cache entries;
+// a password changed by another controller is used once the client expires.
+type connections struct {
+	mutex   sync.Mutex
+	clients *lruCache[*davapi.CardClient]
+}
+
+func newConnections() *connections {
+	return &connections{clients: newLRUCache[*davapi.CardClient](DEFAULT_CACHE_SIZE, DEFAULT_CONNECTION_TTL)}
+}
+
+// get returns the client of username, or nil if there is none or it expired
+func (c *connections) get(username string) *davapi.CardClient {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	dav, fresh, _ := c.clients.get(username)
+	if !fresh {
+		return nil
+	}
+	return dav
+}
+
+func (c *connections) put(username string, dav *davapi.CardClient) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clients.put(username, dav)
+}
+
+// remove discards the client of username, or of all users if username is
+// empty
+func (c *connections) remove(username string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if username == "" {
+		c.clients.removePrefix("")
+		return
+	}
+	c.clients.remove(username)
+}
+
+func bookKey(username, bookname string) string {
+	return username + "\x00" + bookname
+}
+
+// Stats returns the lookup counts
+func (c *Cache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stats
+}
+
+// Invalidate discards everything cached for username, or for all users if
+// username is empty
+func (c *Cache) Invalidate(username string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	prefix := ""
+	if username != "" {
+		prefix = bookKey(username, "")
+	}
+	c.addresses.removePrefix(prefix)
+	if username == "" {
+		c.passwords.removePrefix("")
+		c.books.removePrefix("")
+		return
+	}
+	c.passwords.remove(username)
+	c.books.remove(username)
+}
+
+// InvalidateBook discards the cached addresses of a book, and the user's
+// book list if the book was created or deleted
+func (c *Cache) InvalidateBook(username, bookname string, listChanged bool) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.addresses.remove(bookKey(username, bookname))
+	if listChanged {
+		c.books.remove(username)
+	}
+}
+
+func (c *Cache) count(fresh, ok bool) {
+	switch {
+	case fresh:
+		c.stats.Hits++
+	case ok && c.revalidate:
+		c.stats.Revalidations++
+	default:
+		c.stats.Misses++
+	}
+}
+
+// password returns the cached password of username, calling fetch if it is
+// not cached
+func (c *Cache) password(username string, fetch func() (string, error)) (string, error) {
+	if c == nil {
+		return fetch()
+	}
+	c.mutex.Lock()
+	password, fresh, _ := c.passwords.get(username)
+	c.count(fresh, false)
+	c.mutex.Unlock()
+	if fresh {
+		return password, nil
+	}
+	password, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	c.mutex.Lock()
+	c.passwords.put(username, password)
+	c.mutex.Unlock()
+	return password, nil
+}
+
+// userBooks returns the cached CardDAV address books of username
+func (c *Cache) userBooks(ctx context.Context, connect davConnector, username string) ([]carddav.AddressBook, error) {
+	c.mutex.Lock()
+	books, fresh, _ := c.books.get(username)
+	c.count(fresh, false)
+	c.mutex.Unlock()
+	if fresh {
+		return books, nil
+	}
+	dav, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	found, err := dav.ListCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.books.put(username, *found)
+	c.mutex.Unlock()
+	return *found, nil
+}
+
+// bookAddresses returns the cached address set of the book at path
+func (c *Cache) bookAddresses(ctx context.Context, connect davConnector, username, bookname, path string) (*cachedBook, error) {
+	key := bookKey(username, bookname)
+	c.mutex.Lock()
+	book, fresh, ok := c.addresses.get(key)
+	c.count(fresh, ok)
+	c.mutex.Unlock()
+	if fresh {
+		return book, nil
+	}
+	dav, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	if c.revalidate {
+		token := ""
+		if ok {
+			token = book.token
+		}
+		changes, err := dav.SyncAddressBookCtx(ctx, path, token)
+		if errors.Is(err, ErrSyncTokenInvalid) {
+			token = ""
+			changes, err = dav.SyncAddressBookCtx(ctx, path, "")
+		}
+		if err == nil {
+			updated := newCachedBook(changes.SyncToken, nil)
+			if token != "" {
+				// cached sets are shared with concurrent readers, so
+				// changes are applied to a copy
+				for path, emails := range book.emails {
+					updated.emails[path] = emails
+				}
+			}
+			updated.update(changes.Updated, changes.Deleted)
+			c.store(key, updated)
+			return updated, nil
+		}
+		if !errors.Is(err, ErrSyncUnsupported) {
+			return nil, err
+		}
+	}
+	addrs, err := dav.AddressesCtx(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	book = newCachedBook("", *addrs)
+	c.store(key, book)
+	return book, nil
+}
+
+func (c *Cache) store(key string, book *cachedBook) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.addresses.put(key, book)
+}
+
+// scan returns the books of username containing email
+func (c *Cache) scan(ctx context.Context, connect davConnector, username, email string) ([]carddav.AddressBook, error) {
+	books, err := c.userBooks(ctx, connect, username)
+	if err != nil {
+		return nil, err
+	}
+	ret := []carddav.AddressBook{}
+	for _, book := range books {
+		_, bookname, _, err := util.ParseBookPath(book.Path)
+		if err != nil {
+			return nil, err
+		}
+		addresses, err := c.bookAddresses(ctx, connect, username, bookname, book.Path)
+		if err != nil {
+			return nil, err
+		}
+		if addresses.contains(email) {
+			ret = append(ret, book)
+		}
+	}
+	return ret, nil
+}
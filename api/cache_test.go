@@ -0,0 +1,79 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+
+	username := "user@example.org"
+	other, _ := initController(t, username, testBooks{"friends": nil})
+
+	viper.Set("mabctl.cache.ttl", time.Minute)
+	viper.Set("mabctl.cache.revalidate", true)
+	api, err := NewAddressBookController()
+	require.Nil(t, err)
+	require.NotNil(t, api.Cache())
+	require.Nil(t, other.Cache())
+
+	scan := func(email string) []string {
+		response, err := api.ScanAddress(username, email)
+		require.Nil(t, err)
+		require.NotNil(t, response.Books, response.Message)
+		names := []string{}
+		for _, book := range response.Books {
+			names = append(names, book.BookName)
+		}
+		return names
+	}
+
+	require.Empty(t, scan("friend@example.com"))
+	misses := api.Cache().Stats().Misses
+	require.Equal(t, 3, misses)
+
+	// changes made by another controller are not seen until invalidated
+	_, err = other.AddAddress(nil, username, "friends", "friend@example.com", "")
+	require.Nil(t, err)
+	require.Empty(t, scan("friend@example.com"))
+	require.Equal(t, misses, api.Cache().Stats().Misses)
+	require.Equal(t, 2, api.Cache().Stats().Hits)
+	api.Cache().Invalidate(username)
+	require.Equal(t, []string{"friends"}, scan("Friend@Example.com"))
+
+	// local changes invalidate the book
+	_, err = api.AddBook(username, "work", "")
+	require.Nil(t, err)
+	_, err = api.AddAddress(nil, username, "work", "boss@example.com", "")
+	require.Nil(t, err)
+	require.Equal(t, []string{"work"}, scan("boss@example.com"))
+	_, err = api.DeleteAddress(username, "work", "boss@example.com")
+	require.Nil(t, err)
+	require.Empty(t, scan("boss@example.com"))
+
+	// expired address sets are revalidated with sync-collection
+	viper.Set("mabctl.cache.ttl", 10*time.Millisecond)
+	api, err = NewAddressBookController()
+	require.Nil(t, err)
+	require.Equal(t, []string{"friends"}, scan("friend@example.com"))
+	_, err = other.DeleteAddress(username, "friends", "friend@example.com")
+	require.Nil(t, err)
+	time.Sleep(20 * time.Millisecond)
+	require.Empty(t, scan("friend@example.com"))
+	require.Equal(t, 2, api.Cache().Stats().Revalidations)
+
+	// cached and uncached scans both match whole addresses
+	_, err = api.AddAddress(nil, username, "friends", "jimbob@example.com", "")
+	require.Nil(t, err)
+	for _, mab := range []*Controller{api, other} {
+		response, err := mab.ScanAddress(username, "bob@example.com")
+		require.Nil(t, err)
+		require.Empty(t, response.Books, response.Message)
+		response, err = mab.ScanAddress(username, "JimBob@example.com")
+		require.Nil(t, err)
+		require.Len(t, response.Books, 1, response.Message)
+	}
+}
@@ -0,0 +1,403 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav/carddav"
+	"github.com/google/uuid"
+	davapi "github.com/rstms/mabctl/carddav"
+	"github.com/rstms/mabctl/util"
+)
+
+// Contact is the editable subset of a vCard; properties not represented
+// here are preserved when a contact is written back to an existing card
+type Contact struct {
+	UID          string   `json:"uid"`
+	FullName     string   `json:"fullname,omitempty"`
+	GivenName    string   `json:"givenname,omitempty"`
+	FamilyName   string   `json:"familyname,omitempty"`
+	Emails       []string `json:"emails,omitempty"`
+	Phones       []string `json:"phones,omitempty"`
+	Organization string   `json:"organization,omitempty"`
+	Title        string   `json:"title,omitempty"`
+	Notes        string   `json:"notes,omitempty"`
+	Categories   []string `json:"categories,omitempty"`
+	Path         string   `json:"path,omitempty"`
+	ETag         string   `json:"etag,omitempty"`
+}
+
+// Precondition restricts a write to a known state of the address object
+type Precondition = davapi.Precondition
+
+type ContactResponse struct {
+	Response
+	Contact *Contact `json:"contact"`
+}
+
+// NewContact returns the Contact represented by a CardDAV address object
+func NewContact(addr carddav.AddressObject) *Contact {
+	card := addr.Card
+	contact := Contact{
+		UID:          card.Value(vcard.FieldUID),
+		FullName:     card.Value(vcard.FieldFormattedName),
+		Emails:       card.Values(vcard.FieldEmail),
+		Phones:       card.Values(vcard.FieldTelephone),
+		Organization: card.Value(vcard.FieldOrganization),
+		Title:        card.Value(vcard.FieldTitle),
+		Notes:        strings.Join(card.Values(vcard.FieldNote), "\n"),
+		Path:         addr.Path,
+		ETag:         addr.ETag,
+	}
+	if card.Value(vcard.FieldCategories) != "" {
+		contact.Categories = card.Categories()
+	}
+	name := card.Name()
+	if name != nil {
+		contact.GivenName = name.GivenName
+		contact.FamilyName = name.FamilyName
+		if contact.GivenName == "" && contact.FamilyName == "" {
+			contact.GivenName = name.AdditionalName
+		}
+	}
+	return &contact
+}
+
+// Merge copies the non-empty fields of update into c
+func (c *Contact) Merge(update *Contact) {
+	if update.FullName != "" {
+		c.FullName = update.FullName
+	}
+	if update.GivenName != "" {
+		c.GivenName = update.GivenName
+	}
+	if update.FamilyName != "" {
+		c.FamilyName = update.FamilyName
+	}
+	if len(update.Emails) > 0 {
+		c.Emails = update.Emails
+	}
+	if len(update.Phones) > 0 {
+		c.Phones = update.Phones
+	}
+	if update.Organization != "" {
+		c.Organization = update.Organization
+	}
+	if update.Title != "" {
+		c.Title = update.Title
+	}
+	if update.Notes != "" {
+		c.Notes = update.Notes
+	}
+	if len(update.Categories) > 0 {
+		c.Categories = update.Categories
+	}
+}
+
+// DisplayName returns the formatted name, falling back to the structured
+// name and then the first email address
+func (c *Contact) DisplayName() string {
+	if c.FullName != "" {
+		return c.FullName
+	}
+	name := strings.TrimSpace(c.GivenName + " " + c.FamilyName)
+	if name != "" {
+		return name
+	}
+	if len(c.Emails) > 0 {
+		return c.Emails[0]
+	}
+	return c.UID
+}
+
+// setFields replaces the fields named key with values, keeping the
+// parameters of existing fields whose value is unchanged
+func setFields(card vcard.Card, key string, values []string) {
+	existing := make(map[string]*vcard.Field)
+	for _, field := range card[key] {
+		existing[strings.ToLower(field.Value)] = field
+	}
+	fields := []*vcard.Field{}
+	for _, value := range values {
+		field := &vcard.Field{}
+		if previous, ok := existing[strings.ToLower(value)]; ok {
+			copied := *previous
+			field = &copied
+		}
+		field.Value = value
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		delete(card, key)
+		return
+	}
+	card[key] = fields
+}
+
+func setValue(card vcard.Card, key, value string) {
+	if value == "" {
+		delete(card, key)
+		return
+	}
+	card.SetValue(key, value)
+}
+
+// Card returns base updated with the fields of c; properties of base which
+// are not part of the Contact model are retained
+func (c *Contact) Card(base vcard.Card) vcard.Card {
+	card := make(vcard.Card)
+	for key, fields := range base {
+		card[key] = fields
+	}
+	if card.Value(vcard.FieldVersion) == "" {
+		card.SetValue(vcard.FieldVersion, davapi.VCARD_VERSION)
+	}
+	card.SetValue(vcard.FieldUID, c.UID)
+	card.SetValue(vcard.FieldFormattedName, c.DisplayName())
+	name := card.Name()
+	if name == nil {
+		name = &vcard.Name{}
+	}
+	name.GivenName = c.GivenName
+	name.FamilyName = c.FamilyName
+	name.AdditionalName = ""
+	card.SetName(name)
+	setFields(card, vcard.FieldEmail, c.Emails)
+	setFields(card, vcard.FieldTelephone, c.Phones)
+	setValue(card, vcard.FieldOrganization, c.Organization)
+	setValue(card, vcard.FieldTitle, c.Title)
+	setValue(card, vcard.FieldNote, c.Notes)
+	if len(c.Categories) > 0 {
+		card.SetCategories(c.Categories)
+	} else {
+		delete(card, vcard.FieldCategories)
+	}
+	return card
+}
+
+// findContact returns the address object identified by an email address
+// or a UID
+func (c *Controller) findContact(ctx context.Context, dav *davapi.CardClient, bookname, id string) (*carddav.AddressObject, error) {
+	if !strings.Contains(id, "@") {
+		return dav.GetCardCtx(ctx, bookname, id)
+	}
+	found, err := dav.FindCardCtx(ctx, bookname, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(*found) == 0 {
+		return nil, util.Fatalf("%w: %s", ErrAddressNotFound, id)
+	}
+	return &(*found)[0], nil
+}
+
+func (c *Controller) GetContact(username, bookname, id string) (*ContactResponse, error) {
+	return c.GetContactCtx(context.Background(), username, bookname, id)
+}
+
+// GetContactCtx returns the contact with the given email address or UID
+func (c *Controller) GetContactCtx(ctx context.Context, username, bookname, id string) (*ContactResponse, error) {
+	dav, err := c.davClient(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := c.findContact(ctx, dav, bookname, id)
+	if err != nil {
+		return nil, err
+	}
+	response := ContactResponse{}
+	response.Success = true
+	response.Request = fmt.Sprintf("Get CardDAV contact: %s", id)
+	response.Message = "found"
+	response.Contact = NewContact(*addr)
+	return &response, nil
+}
+
+func (c *Controller) PutContact(username, bookname string, contact *Contact) (*ContactResponse, error) {
+	return c.PutContactCtx(context.Background(), username, bookname, contact)
+}
+
+// PutContactCtx creates or replaces a contact.  If UID is empty, an existing
+// card having the first email address is replaced, otherwise a new UID is
+// assigned.  Card properties outside the Contact model are preserved.  An
+// existing card is replaced at its own path, conditional on ETag if set,
+// otherwise on the ETag of the card as read; a new contact is never written
+// over one created concurrently.
+func (c *Controller) PutContactCtx(ctx context.Context, username, bookname string, contact *Contact) (*ContactResponse, error) {
+	dav, err := c.davClient(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	var existing *carddav.AddressObject
+	switch {
+	case contact.UID != "":
+		existing, err = dav.GetCardCtx(ctx, bookname, contact.UID)
+		if errors.Is(err, ErrAddressNotFound) {
+			existing, err = nil, nil
+		}
+	case len(contact.Emails) > 0:
+		existing, err = c.findContact(ctx, dav, bookname, contact.Emails[0])
+		if errors.Is(err, ErrAddressNotFound) {
+			existing, err = nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	update := *contact
+	base := vcard.Card{}
+	if existing != nil {
+		base = existing.Card
+		update.UID = existing.Card.Value(vcard.FieldUID)
+	}
+	if update.UID == "" {
+		update.UID = uuid.New().String()
+	}
+	var added *carddav.AddressObject
+	if existing != nil {
+		// replace the card where it is stored, which for cards written by
+		// other clients is not necessarily the path derived from the UID
+		cond := Precondition{IfMatch: existing.ETag}
+		if contact.ETag != "" {
+			cond.IfMatch = contact.ETag
+		}
+		added, err = dav.PutObjectCtx(ctx, existing.Path, update.Card(base), cond)
+	} else {
+		cond := Precondition{IfMatch: contact.ETag, IfNoneMatch: contact.ETag == ""}
+		added, err = dav.PutCardCtx(ctx, bookname, update.Card(base), cond)
+	}
+	c.cache.InvalidateBook(username, bookname, false)
+	if err != nil {
+		return nil, err
+	}
+	response := ContactResponse{}
+	response.Success = true
+	response.Request = fmt.Sprintf("Put CardDAV contact: %s", update.DisplayName())
+	if existing == nil {
+		response.Message = fmt.Sprintf("created %s", update.UID)
+	} else {
+		response.Message = fmt.Sprintf("updated %s", update.UID)
+	}
+	response.Contact = NewContact(*added)
+	return &response, nil
+}
+
+func (c *Controller) UpdateContact(username, bookname, id string, update *Contact) (*ContactResponse, error) {
+	return c.UpdateContactCtx(context.Background(), username, bookname, id, update)
+}
+
+// UpdateContactCtx merges the non-empty fields of update into the existing
+// contact with the given email address or UID.  The write is conditional on
+// update.ETag if set, otherwise on the ETag of the card as read.
+func (c *Controller) UpdateContactCtx(ctx context.Context, username, bookname, id string, update *Contact) (*ContactResponse, error) {
+	dav, err := c.davClient(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := c.findContact(ctx, dav, bookname, id)
+	if err != nil {
+		return nil, err
+	}
+	contact := NewContact(*addr)
+	contact.Merge(update)
+	cond := Precondition{IfMatch: addr.ETag}
+	if update.ETag != "" {
+		cond.IfMatch = update.ETag
+	}
+	updated, err := dav.PutObjectCtx(ctx, addr.Path, contact.Card(addr.Card), cond)
+	c.cache.InvalidateBook(username, bookname, false)
+	if err != nil {
+		return nil, err
+	}
+	response := ContactResponse{}
+	response.Success = true
+	response.Request = fmt.Sprintf("Update CardDAV contact: %s", id)
+	response.Message = fmt.Sprintf("updated %s", contact.UID)
+	response.Contact = NewContact(*updated)
+	return &response, nil
+}
+
+func (c *Controller) PutCard(username, bookname string, card vcard.Card, cond Precondition) (*AddressResponse, error) {
+	return c.PutCardCtx(context.Background(), username, bookname, card, cond)
+}
+
+// PutCardCtx writes a complete vCard, keeping its UID, subject to cond
+func (c *Controller) PutCardCtx(ctx context.Context, username, bookname string, card vcard.Card, cond Precondition) (*AddressResponse, error) {
+	dav, err := c.davClient(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := dav.PutCardCtx(ctx, bookname, card, cond)
+	c.cache.InvalidateBook(username, bookname, false)
+	if err != nil {
+		return nil, err
+	}
+	response := AddressResponse{}
+	response.Success = true
+	response.Request = fmt.Sprintf("Put CardDAV card: %s", card.Value(vcard.FieldUID))
+	response.Message = fmt.Sprintf("stored %s", card.Value(vcard.FieldUID))
+	response.Address = addr
+	return &response, nil
+}
+
+func (c *Controller) DeleteCard(username, bookname, uid string, cond Precondition) (*Response, error) {
+	return c.DeleteCardCtx(context.Background(), username, bookname, uid, cond)
+}
+
+// DeleteCardCtx deletes the card with the given UID subject to cond
+func (c *Controller) DeleteCardCtx(ctx context.Context, username, bookname, uid string, cond Precondition) (*Response, error) {
+	dav, err := c.davClient(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	err = dav.DeleteCardCtx(ctx, bookname, uid, cond)
+	c.cache.InvalidateBook(username, bookname, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Success: true, Request: fmt.Sprintf("Delete CardDAV card: %s", uid), Message: fmt.Sprintf("deleted %s", uid)}, nil
+}
+
+func (c *Controller) PutObject(username, bookname, path string, card vcard.Card, cond Precondition) (*AddressResponse, error) {
+	return c.PutObjectCtx(context.Background(), username, bookname, path, card, cond)
+}
+
+// PutObjectCtx replaces the card stored at path subject to cond
+func (c *Controller) PutObjectCtx(ctx context.Context, username, bookname, path string, card vcard.Card, cond Precondition) (*AddressResponse, error) {
+	dav, err := c.davClient(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := dav.PutObjectCtx(ctx, path, card, cond)
+	c.cache.InvalidateBook(username, bookname, false)
+	if err != nil {
+		return nil, err
+	}
+	response := AddressResponse{}
+	response.Success = true
+	response.Request = fmt.Sprintf("Put CardDAV card: %s", path)
+	response.Message = fmt.Sprintf("stored %s", card.Value(vcard.FieldUID))
+	response.Address = addr
+	return &response, nil
+}
+
+func (c *Controller) DeleteObject(username, bookname, path string, cond Precondition) (*Response, error) {
+	return c.DeleteObjectCtx(context.Background(), username, bookname, path, cond)
+}
+
+// DeleteObjectCtx deletes the card stored at path subject to cond
+func (c *Controller) DeleteObjectCtx(ctx context.Context, username, bookname, path string, cond Precondition) (*Response, error) {
+	dav, err := c.davClient(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	err = dav.DeleteObjectCtx(ctx, path, cond)
+	c.cache.InvalidateBook(username, bookname, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{Success: true, Request: fmt.Sprintf("Delete CardDAV card: %s", path), Message: fmt.Sprintf("deleted %s", path)}, nil
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+	"github.com/rstms/mabctl/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContacts(t *testing.T) {
+
+	api, _ := initController(t, "user@example.org", testBooks{"friends": nil})
+	_, err := api.AddAddress(nil, "user@example.org", "friends", "friend@example.com", "Good Friend")
+	require.Nil(t, err)
+
+	response, err := api.GetContact("user@example.org", "friends", "friend@example.com")
+	require.Nil(t, err)
+	contact := response.Contact
+	require.Equal(t, "Good", contact.GivenName)
+	require.Equal(t, "Friend", contact.FamilyName)
+	require.Equal(t, []string{"friend@example.com"}, contact.Emails)
+	require.Empty(t, contact.Categories)
+
+	update := Contact{Phones: []string{"+1 555 0100"}, Organization: "Example Inc", Categories: []string{"golf", "work"}}
+	response, err = api.UpdateContact("user@example.org", "friends", contact.UID, &update)
+	require.Nil(t, err)
+	require.Equal(t, "Good", response.Contact.GivenName)
+	require.Equal(t, []string{"+1 555 0100"}, response.Contact.Phones)
+	require.Equal(t, []string{"golf", "work"}, response.Contact.Categories)
+
+	replaced := Contact{UID: contact.UID, FullName: "Best Friend", Emails: []string{"friend@example.com", "friend@example.net"}}
+	response, err = api.PutContact("user@example.org", "friends", &replaced)
+	require.Nil(t, err)
+	require.Equal(t, "updated "+contact.UID, response.Message)
+	require.Equal(t, "Best Friend", response.Contact.FullName)
+	require.Empty(t, response.Contact.Organization)
+	require.Empty(t, response.Contact.Phones)
+
+	response, err = api.GetContact("user@example.org", "friends", "friend@example.net")
+	require.Nil(t, err)
+	require.Equal(t, contact.UID, response.Contact.UID)
+
+	created := Contact{Emails: []string{"new@example.com"}, Notes: "met at the conference"}
+	response, err = api.PutContact("user@example.org", "friends", &created)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(response.Message, "created "))
+	require.Equal(t, "new@example.com", response.Contact.FullName)
+
+	_, err = api.GetContact("user@example.org", "friends", "stranger@example.com")
+	require.ErrorIs(t, err, ErrAddressNotFound)
+	_, err = api.GetContact("user@example.org", "friends", "no-such-uid")
+	require.ErrorIs(t, err, ErrAddressNotFound)
+}
+
+func TestPreconditions(t *testing.T) {
+
+	api, _ := initController(t, "user@example.org", testBooks{"friends": nil})
+	added, err := api.AddAddress(nil, "user@example.org", "friends", "friend@example.com", "")
+	require.Nil(t, err)
+	etag := added.Address.ETag
+	require.NotEmpty(t, etag)
+
+	_, err = api.AddAddressIfCtx(context.Background(), "user@example.org", "friends", "friend@example.com", "", Precondition{IfNoneMatch: true})
+	require.ErrorIs(t, err, ErrConflict)
+	require.ErrorIs(t, err, ErrAddressExists)
+
+	existing, err := api.AddAddressIfCtx(context.Background(), "user@example.org", "friends", "friend@example.com", "", Precondition{IfMatch: etag})
+	require.Nil(t, err)
+	require.Equal(t, "existing friend@example.com", existing.Message)
+
+	updated, err := api.UpdateContact("user@example.org", "friends", "friend@example.com", &Contact{Title: "Boss", ETag: etag})
+	require.Nil(t, err)
+	require.NotEqual(t, etag, updated.Contact.ETag)
+
+	// the original ETag is now stale
+	_, err = api.UpdateContact("user@example.org", "friends", "friend@example.com", &Contact{Title: "Peer", ETag: etag})
+	require.ErrorIs(t, err, ErrConflict)
+	var conflict *ConflictError
+	require.ErrorAs(t, err, &conflict)
+	require.Equal(t, etag, conflict.ETag)
+
+	_, err = api.DeleteAddressIfCtx(context.Background(), "user@example.org", "friends", "friend@example.com", Precondition{IfMatch: etag})
+	require.ErrorIs(t, err, ErrConflict)
+
+	deleted, err := api.DeleteAddressIfCtx(context.Background(), "user@example.org", "friends", "friend@example.com", Precondition{IfMatch: updated.Contact.ETag})
+	require.Nil(t, err)
+	require.Equal(t, []string{"friend@example.com"}, deleted.Addresses)
+
+	// only the address given is deleted, not others containing it
+	bob, err := api.AddAddress(nil, "user@example.org", "friends", "bob@example.com", "")
+	require.Nil(t, err)
+	_, err = api.AddAddress(nil, "user@example.org", "friends", "jimbob@example.com", "")
+	require.Nil(t, err)
+	deleted, err = api.DeleteAddressIfCtx(context.Background(), "user@example.org", "friends", "bob@example.com", Precondition{IfMatch: bob.Address.ETag})
+	require.Nil(t, err)
+	require.Equal(t, []string{"bob@example.com"}, deleted.Addresses)
+
+	// an ETag cannot apply to several cards having the address
+	dav, err := api.davClient(context.Background(), "user@example.org")
+	require.Nil(t, err)
+	for _, uid := range []string{"first-uid", "second-uid"} {
+		card := (&Contact{UID: uid, Emails: []string{"pal@example.com"}}).Card(nil)
+		_, err = dav.PutCard("friends", card, Precondition{IfNoneMatch: true})
+		require.Nil(t, err)
+	}
+	first, err := dav.GetCard("friends", "first-uid")
+	require.Nil(t, err)
+	_, err = api.DeleteAddressIfCtx(context.Background(), "user@example.org", "friends", "pal@example.com", Precondition{IfMatch: first.ETag})
+	require.ErrorIs(t, err, ErrConflict)
+	addrs, err := api.Addresses(nil, "user@example.org", "friends")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"jimbob@example.com", "pal@example.com", "pal@example.com"}, addrs.Addresses)
+}
+
+func TestContactForeignPath(t *testing.T) {
+
+	username := "user@example.org"
+	api, _ := initController(t, username, testBooks{"friends": nil})
+	ctx := context.Background()
+	dav, err := api.davClient(ctx, username)
+	require.Nil(t, err)
+
+	// a card written by another client, stored at a path unrelated to its UID
+	path := util.BookURI(username, "friends") + "thunderbird-1.vcf"
+	card := (&Contact{UID: "foreign-uid", FullName: "Good Friend", Emails: []string{"friend@example.com"}}).Card(nil)
+	_, err = dav.PutObjectCtx(ctx, path, card, Precondition{IfNoneMatch: true})
+	require.Nil(t, err)
+
+	response, err := api.GetContact(username, "friends", "foreign-uid")
+	require.Nil(t, err)
+	require.Equal(t, path, response.Contact.Path)
+
+	response, err = api.UpdateContact(username, "friends", "friend@example.com", &Contact{Title: "Boss"})
+	require.Nil(t, err)
+	require.Equal(t, path, response.Contact.Path)
+
+	response, err = api.PutContact(username, "friends", &Contact{UID: "foreign-uid", FullName: "Best Friend", Emails: []string{"friend@example.com"}})
+	require.Nil(t, err)
+	require.Equal(t, "updated foreign-uid", response.Message)
+	require.Equal(t, path, response.Contact.Path)
+
+	response, err = api.PutContact(username, "friends", &Contact{FullName: "Old Friend", Emails: []string{"friend@example.com"}})
+	require.Nil(t, err)
+	require.Equal(t, path, response.Contact.Path)
+
+	addrs, err := api.Addresses(nil, username, "friends")
+	require.Nil(t, err)
+	require.Equal(t, []string{"friend@example.com"}, addrs.Addresses)
+	found, err := dav.FindCardCtx(ctx, "friends", "friend@example.com")
+	require.Nil(t, err)
+	require.Len(t, *found, 1)
+	require.Equal(t, "Old Friend", (*found)[0].Card.Value(vcard.FieldFormattedName))
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/hex"
@@ -114,21 +115,21 @@ func SetDefaults() error {
 func NewAddressBookController() (*Controller, error) {
 	err := SetDefaults()
 	if err != nil {
-		return nil, util.Fatalf("failed setting config defaults: %v", err)
+		return nil, util.Fatalf("failed setting config defaults: %w", err)
 	}
 
 	clientCert, err := tls.LoadX509KeyPair(viper.GetString("mabctl.client_cert"), viper.GetString("mabctl.client_key"))
 	if err != nil {
-		return nil, util.Fatalf("failed loading client certificate: %v", err)
+		return nil, util.Fatalf("failed loading client certificate: %w", err)
 	}
 	tlsConfig := &tls.Config{Certificates: []tls.Certificate{clientCert},
 		InsecureSkipVerify: viper.GetBool("mabctl.insecure_no_validate_server_certificate"),
 	}
 	client := &http.Client{
-		Transport: &http.Transport{
+		Transport: util.NewRateLimitedTransport(&http.Transport{
 			TLSClientConfig: tlsConfig,
 			IdleConnTimeout: 5 * time.Second,
-		},
+		}),
 	}
 
 	c := Controller{
@@ -137,21 +138,69 @@ func NewAddressBookController() (*Controller, error) {
 		viper.GetString("mabctl.bcc_url"),
 		viper.GetString("mabctl.api_key"),
 		client,
+		util.NewRetryPolicy(),
+		Emitter{},
+		newConfiguredCache(),
+		newConnections(),
+		newSyncStates(),
 	}
 
 	return &c, nil
 }
 
 
-func (c *Controller) davClient(username string) (*davapi.CardClient, error) {
-	response, err := c.GetPassword(username)
+// Cache returns the controller's lookup cache, which is nil unless
+// mabctl.cache.ttl is set
+func (c *Controller) Cache() *Cache {
+	return c.cache
+}
+
+// connector returns a davConnector for username which connects only when
+// first called
+func (c *Controller) connector(ctx context.Context, username string) davConnector {
+	return func() (*davapi.CardClient, error) {
+		return c.davClient(ctx, username)
+	}
+}
+
+// invalidate discards the cached lookups and connection of username, or of
+// all users if username is empty
+func (c *Controller) invalidate(username string) {
+	c.cache.Invalidate(username)
+	c.conns.remove(username)
+}
+
+// davClient returns the CardDAV connection of username, reusing the one
+// made by an earlier call until it expires
+// useClient makes dav, if not nil, the client used for username
+func (c *Controller) useClient(username string, dav *davapi.CardClient) {
+	if dav != nil {
+		c.conns.put(username, dav)
+	}
+}
+
+func (c *Controller) davClient(ctx context.Context, username string) (*davapi.CardClient, error) {
+	if dav := c.conns.get(username); dav != nil {
+		return dav, nil
+	}
+	password, err := c.cache.password(username, func() (string, error) {
+		response, err := c.getPassword(ctx, username)
+		if err != nil {
+			return "", err
+		}
+		return response.Password, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	password := response.Password
 	url := viper.GetString("mabctl.dav_url")
 	cert := viper.GetString("mabctl.client_cert")
 	key := viper.GetString("mabctl.client_key")
 	insecure := viper.GetBool("mabctl.insecure_no_validate_server_certificate")
-	return davapi.NewClient(username, password, url, cert, key, insecure)
+	dav, err := davapi.NewClientCtx(ctx, username, password, url, cert, key, insecure)
+	if err != nil {
+		return nil, err
+	}
+	c.conns.put(username, dav)
+	return dav, nil
 }
@@ -0,0 +1,259 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/rstms/mabctl/util"
+)
+
+// difference kinds
+const (
+	DIFF_ADDED   = "added"
+	DIFF_REMOVED = "removed"
+	DIFF_CHANGED = "changed"
+)
+
+// Difference describes one user, book or card which differs between two
+// dumps.  Fields lists what changed; passwords are never included.
+type Difference struct {
+	Change   string   `json:"change"`
+	Kind     string   `json:"kind"`
+	Username string   `json:"username"`
+	Bookname string   `json:"bookname,omitempty"`
+	UID      string   `json:"uid,omitempty"`
+	Emails   []string `json:"emails,omitempty"`
+	Fields   []string `json:"fields,omitempty"`
+}
+
+func (d Difference) String() string {
+	var symbol string
+	switch d.Change {
+	case DIFF_ADDED:
+		symbol = "+"
+	case DIFF_REMOVED:
+		symbol = "-"
+	default:
+		symbol = "~"
+	}
+	var ret string
+	switch d.Kind {
+	case PLAN_USER:
+		ret = fmt.Sprintf("%s user %s", symbol, d.Username)
+	case PLAN_BOOK:
+		ret = fmt.Sprintf("%s book %s/%s", symbol, d.Username, d.Bookname)
+	default:
+		ret = fmt.Sprintf("%s card %s/%s/%s %s", symbol, d.Username, d.Bookname, d.UID, strings.Join(d.Emails, ","))
+	}
+	if len(d.Fields) > 0 {
+		ret += ": " + strings.Join(d.Fields, ", ")
+	}
+	return ret
+}
+
+// ScopeDump returns the part of dump belonging to username, or dump itself
+// if username is empty
+func ScopeDump(dump *DumpFile, username string) *DumpFile {
+	if username == "" {
+		return dump
+	}
+	ret := *dump
+	ret.Users = make(map[string]DumpUser)
+	if user, ok := dump.Users[username]; ok {
+		ret.Users[username] = user
+	}
+	return &ret
+}
+
+// cardFields returns the names of the properties which differ between two
+// cards
+func cardFields(a, b DumpCard) []string {
+	cardA, errA := a.Card()
+	cardB, errB := b.Card()
+	if errA != nil || errB != nil {
+		return []string{"vcard"}
+	}
+	names := make(map[string]bool)
+	for name := range cardA {
+		names[name] = true
+	}
+	for name := range cardB {
+		names[name] = true
+	}
+	fields := []string{}
+	for _, name := range sortedKeys(names) {
+		if !sameFields(cardA[name], cardB[name]) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+func sameFields(a, b []*vcard.Field) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Value != b[i].Value || a[i].Group != b[i].Group || fmt.Sprint(a[i].Params) != fmt.Sprint(b[i].Params) {
+			return false
+		}
+	}
+	return true
+}
+
+func cardEmails(card DumpCard) []string {
+	parsed, err := card.Card()
+	if err != nil {
+		return nil
+	}
+	return parsed.Values(vcard.FieldEmail)
+}
+
+// DiffDumps returns the changes which turn dump a into dump b
+func DiffDumps(a, b *DumpFile) []Difference {
+	diffs := []Difference{}
+	usernames := make(map[string]bool)
+	for username := range a.Users {
+		usernames[username] = true
+	}
+	for username := range b.Users {
+		usernames[username] = true
+	}
+	for _, username := range sortedKeys(usernames) {
+		userA, inA := a.Users[username]
+		userB, inB := b.Users[username]
+		switch {
+		case !inA:
+			diffs = append(diffs, Difference{Change: DIFF_ADDED, Kind: PLAN_USER, Username: username})
+		case !inB:
+			diffs = append(diffs, Difference{Change: DIFF_REMOVED, Kind: PLAN_USER, Username: username})
+		default:
+			fields := []string{}
+			if userA.DisplayName != userB.DisplayName {
+				fields = append(fields, "displayname")
+			}
+			if userA.Password != userB.Password {
+				fields = append(fields, "password")
+			}
+			if len(fields) > 0 {
+				diffs = append(diffs, Difference{Change: DIFF_CHANGED, Kind: PLAN_USER, Username: username, Fields: fields})
+			}
+		}
+		books := make(map[string]bool)
+		for bookname := range userA.Books {
+			books[bookname] = true
+		}
+		for bookname := range userB.Books {
+			books[bookname] = true
+		}
+		for _, bookname := range sortedKeys(books) {
+			bookA, inA := userA.Books[bookname]
+			bookB, inB := userB.Books[bookname]
+			switch {
+			case !inA:
+				diffs = append(diffs, Difference{Change: DIFF_ADDED, Kind: PLAN_BOOK, Username: username, Bookname: bookname})
+			case !inB:
+				diffs = append(diffs, Difference{Change: DIFF_REMOVED, Kind: PLAN_BOOK, Username: username, Bookname: bookname})
+			case bookA.Description != bookB.Description:
+				diffs = append(diffs, Difference{Change: DIFF_CHANGED, Kind: PLAN_BOOK, Username: username, Bookname: bookname, Fields: []string{"description"}})
+			}
+			cardsA := cardIndex(bookA.Cards)
+			cardsB := cardIndex(bookB.Cards)
+			uids := make(map[string]bool)
+			for uid := range cardsA {
+				uids[uid] = true
+			}
+			for uid := range cardsB {
+				uids[uid] = true
+			}
+			for _, uid := range sortedKeys(uids) {
+				cardA, inA := cardsA[uid]
+				cardB, inB := cardsB[uid]
+				diff := Difference{Kind: PLAN_CARD, Username: username, Bookname: bookname, UID: uid}
+				switch {
+				case !inA:
+					diff.Change = DIFF_ADDED
+					diff.Emails = cardEmails(cardB)
+				case !inB:
+					diff.Change = DIFF_REMOVED
+					diff.Emails = cardEmails(cardA)
+				case !cardA.Equal(cardB):
+					diff.Change = DIFF_CHANGED
+					diff.Emails = cardEmails(cardB)
+					diff.Fields = cardFields(cardA, cardB)
+				default:
+					continue
+				}
+				diffs = append(diffs, diff)
+			}
+		}
+	}
+	return diffs
+}
+
+// passwordDigest identifies a password in diff output without revealing it
+func passwordDigest(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return "sha256:" + hex.EncodeToString(sum[:])[:12]
+}
+
+// Lines returns a canonical line-oriented rendering of the dump suitable
+// for a textual diff; passwords are replaced by a digest
+func (d *DumpFile) Lines() []string {
+	lines := []string{}
+	for _, username := range sortedKeys(d.Users) {
+		user := d.Users[username]
+		lines = append(lines, "user "+username)
+		lines = append(lines, "  displayname: "+user.DisplayName)
+		lines = append(lines, "  password: "+passwordDigest(user.Password))
+		for _, bookname := range sortedKeys(user.Books) {
+			book := user.Books[bookname]
+			lines = append(lines, "  book "+bookname)
+			lines = append(lines, "    description: "+book.Description)
+			cards := append([]DumpCard{}, book.Cards...)
+			sortCards(cards)
+			for _, card := range cards {
+				lines = append(lines, "    card "+card.UID)
+				text := card.VCard
+				if parsed, err := card.Card(); err == nil {
+					if canonical, err := NewDumpCard(parsed); err == nil {
+						text = canonical.VCard
+					}
+				}
+				for _, line := range strings.Split(strings.TrimRight(text, "\r\n"), "\n") {
+					lines = append(lines, "      "+strings.TrimRight(line, "\r"))
+				}
+			}
+		}
+	}
+	return lines
+}
+
+// UnifiedDiff returns a unified diff of the canonical renderings of two
+// dumps, or an empty string if they are the same
+func UnifiedDiff(a, b *DumpFile, nameA, nameB string) (string, error) {
+	diff := difflib.UnifiedDiff{
+		A:        withNewlines(a.Lines()),
+		B:        withNewlines(b.Lines()),
+		FromFile: nameA,
+		ToFile:   nameB,
+		Context:  3,
+	}
+	ret, err := difflib.GetUnifiedDiffString(diff)
+	if err != nil {
+		return "", util.Fatalf("failed formatting diff: %w", err)
+	}
+	return ret, nil
+}
+
+func withNewlines(lines []string) []string {
+	ret := make([]string, len(lines))
+	for i, line := range lines {
+		ret[i] = line + "\n"
+	}
+	return ret
+}
@@ -0,0 +1,224 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-vcard"
+	"github.com/google/uuid"
+	davapi "github.com/rstms/mabctl/carddav"
+	"github.com/rstms/mabctl/util"
+)
+
+const DUMP_FORMAT = "mabctl-dump"
+const DUMP_VERSION = 2
+
+// DumpFile is the versioned dump schema.  Cards are stored as serialized
+// vCards so every property, including the UID, survives a restore.
+// Upgraded is set on a dump converted from the legacy format, whose cards
+// hold only an email address under a generated UID.
+type DumpFile struct {
+	Format   string              `json:"format"`
+	Version  int                 `json:"version"`
+	Created  time.Time           `json:"created"`
+	Upgraded bool                `json:"upgraded,omitempty"`
+	Users    map[string]DumpUser `json:"users"`
+}
+
+type DumpUser struct {
+	DisplayName string              `json:"displayname"`
+	Password    string              `json:"password"`
+	Books       map[string]DumpBook `json:"books"`
+}
+
+type DumpBook struct {
+	Description string     `json:"description"`
+	Cards       []DumpCard `json:"cards"`
+}
+
+type DumpCard struct {
+	UID   string `json:"uid"`
+	VCard string `json:"vcard"`
+	// Path and ETag locate the card on the server it was dumped from; they
+	// are not saved, so a dump file can be restored to any server
+	Path string `json:"-"`
+	ETag string `json:"-"`
+}
+
+// NewDumpFile returns an empty dump of the current version
+func NewDumpFile() *DumpFile {
+	return &DumpFile{
+		Format:  DUMP_FORMAT,
+		Version: DUMP_VERSION,
+		Created: time.Now().UTC().Truncate(time.Second),
+		Users:   make(map[string]DumpUser),
+	}
+}
+
+// NewDumpCard serializes card
+func NewDumpCard(card vcard.Card) (DumpCard, error) {
+	var buf bytes.Buffer
+	err := vcard.NewEncoder(&buf).Encode(card)
+	if err != nil {
+		return DumpCard{}, util.Fatalf("failed encoding vCard %s: %w", card.Value(vcard.FieldUID), err)
+	}
+	return DumpCard{UID: card.Value(vcard.FieldUID), VCard: buf.String()}, nil
+}
+
+// Card returns the parsed vCard
+func (d DumpCard) Card() (vcard.Card, error) {
+	card, err := vcard.NewDecoder(strings.NewReader(d.VCard)).Decode()
+	if err != nil {
+		return nil, util.Fatalf("%w: failed decoding vCard %s: %v", ErrAddressInvalid, d.UID, err)
+	}
+	if card.Value(vcard.FieldUID) == "" {
+		return nil, util.Fatalf("%w: vCard %s has no UID", ErrAddressInvalid, d.UID)
+	}
+	return card, nil
+}
+
+// Equal reports whether two cards have the same properties; cards which
+// cannot be parsed are compared as text
+func (d DumpCard) Equal(other DumpCard) bool {
+	if d.VCard == other.VCard {
+		return true
+	}
+	a, err := d.Card()
+	if err != nil {
+		return false
+	}
+	b, err := other.Card()
+	if err != nil {
+		return false
+	}
+	canonical, err := NewDumpCard(a)
+	if err != nil {
+		return false
+	}
+	otherCanonical, err := NewDumpCard(b)
+	if err != nil {
+		return false
+	}
+	return canonical.VCard == otherCanonical.VCard
+}
+
+// Emails returns the sorted email addresses of all cards in the book
+func (b DumpBook) Emails() ([]string, error) {
+	ret := []string{}
+	for _, dumpCard := range b.Cards {
+		card, err := dumpCard.Card()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, card.Values(vcard.FieldEmail)...)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// sortCards orders cards by UID so dumps of the same state are identical
+func sortCards(cards []DumpCard) {
+	sort.Slice(cards, func(i, j int) bool { return cards[i].UID < cards[j].UID })
+}
+
+// Upgrade converts a legacy dump, creating a card for each email address.
+// The UIDs are derived from the user, book and address so that upgrading
+// the same legacy dump twice gives the same cards.
+func (d *ConfigDump) Upgrade() (*DumpFile, error) {
+	ret := NewDumpFile()
+	ret.Upgraded = true
+	for username, u := range d.Users {
+		user := DumpUser{DisplayName: username, Password: u.Password, Books: make(map[string]DumpBook)}
+		for bookname, addresses := range u.Books {
+			book := DumpBook{Cards: []DumpCard{}}
+			for _, address := range addresses {
+				card := vcard.Card{}
+				card.SetValue(vcard.FieldVersion, davapi.VCARD_VERSION)
+				uid := uuid.NewSHA1(uuid.NameSpaceURL, []byte("mabctl:"+username+"/"+bookname+"/"+address))
+				card.SetValue(vcard.FieldUID, uid.String())
+				card.SetValue(vcard.FieldFormattedName, address)
+				card.SetName(&vcard.Name{})
+				card.SetValue(vcard.FieldEmail, address)
+				dumpCard, err := NewDumpCard(card)
+				if err != nil {
+					return nil, err
+				}
+				book.Cards = append(book.Cards, dumpCard)
+			}
+			sortCards(book.Cards)
+			user.Books[bookname] = book
+		}
+		ret.Users[username] = user
+	}
+	return ret, nil
+}
+
+// ReadDump decodes a dump of any supported version; legacy ConfigDump
+// files are upgraded to the current schema
+func ReadDump(r io.Reader) (*DumpFile, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, util.Fatalf("failed reading dump: %w", err)
+	}
+	var header struct {
+		Format  string `json:"format"`
+		Version int    `json:"version"`
+	}
+	err = json.Unmarshal(data, &header)
+	if err != nil {
+		return nil, util.Fatalf("failed decoding dump: %w", err)
+	}
+	if header.Version == 0 {
+		var legacy ConfigDump
+		err = json.Unmarshal(data, &legacy)
+		if err != nil {
+			return nil, util.Fatalf("failed decoding legacy dump: %w", err)
+		}
+		return legacy.Upgrade()
+	}
+	if header.Format != DUMP_FORMAT {
+		return nil, util.Fatalf("unrecognized dump format: '%s'", header.Format)
+	}
+	if header.Version > DUMP_VERSION {
+		return nil, util.Fatalf("unsupported dump version %d; maximum is %d", header.Version, DUMP_VERSION)
+	}
+	dump := DumpFile{}
+	err = json.Unmarshal(data, &dump)
+	if err != nil {
+		return nil, util.Fatalf("failed decoding dump: %w", err)
+	}
+	if dump.Users == nil {
+		dump.Users = make(map[string]DumpUser)
+	}
+	err = dump.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &dump, nil
+}
+
+// Validate checks that every card in the dump can be restored
+func (d *DumpFile) Validate() error {
+	for username, user := range d.Users {
+		for bookname, book := range user.Books {
+			for _, dumpCard := range book.Cards {
+				_, err := dumpCard.Card()
+				if err != nil {
+					return fmt.Errorf("%s/%s: %w", username, bookname, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// IsDefaultBook reports whether bookname is the book the server creates
+// with each user; AddUser deletes it, so restores skip it with its cards
+func IsDefaultBook(bookname string) bool {
+	return strings.ToLower(bookname) == "default address book"
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpRestore(t *testing.T) {
+
+	api, _ := initController(t, "", nil)
+
+	_, err := api.AddUser("user@example.org", "Test User", "secret")
+	require.Nil(t, err)
+	_, err = api.AddBook("user@example.org", "friends", "Close Friends")
+	require.Nil(t, err)
+	contact := Contact{
+		FullName:   "Good Friend",
+		Emails:     []string{"friend@example.com", "friend@example.net"},
+		Phones:     []string{"+1 555 0100"},
+		Notes:      "met at the conference",
+		Categories: []string{"golf"},
+	}
+	created, err := api.PutContact("user@example.org", "friends", &contact)
+	require.Nil(t, err)
+
+	before, err := api.Dump("")
+	require.Nil(t, err)
+	require.Equal(t, DUMP_VERSION, before.Dump.Version)
+	user := before.Dump.Users["user@example.org"]
+	require.Equal(t, "Test User", user.DisplayName)
+	require.Equal(t, "Close Friends", user.Books["friends"].Description)
+	require.Len(t, user.Books["friends"].Cards, 1)
+	require.Equal(t, created.Contact.UID, user.Books["friends"].Cards[0].UID)
+
+	data, err := json.Marshal(before.Dump)
+	require.Nil(t, err)
+	dump, err := ReadDump(bytes.NewReader(data))
+	require.Nil(t, err)
+
+	_, err = api.Clear()
+	require.Nil(t, err)
+	_, err = api.RestoreCtx(context.Background(), dump, "", nil)
+	require.Nil(t, err)
+
+	after, err := api.Dump("")
+	require.Nil(t, err)
+	require.Equal(t, before.Dump.Users, after.Dump.Users)
+
+	restored, err := api.GetContact("user@example.org", "friends", created.Contact.UID)
+	require.Nil(t, err)
+	require.Equal(t, created.Contact.Phones, restored.Contact.Phones)
+	require.Equal(t, created.Contact.Notes, restored.Contact.Notes)
+}
+
+func TestRestoreDefaultBook(t *testing.T) {
+
+	api, _ := initController(t, "", nil)
+	legacy := `{"Users": {"user@example.org": {"Password": "secret", "Books": {"default address book": ["pal@example.com"], "work": ["boss@example.com"]}}}}`
+	dump, err := ReadDump(strings.NewReader(legacy))
+	require.Nil(t, err)
+
+	// the default book is deleted with each new user, so it is skipped
+	// along with its cards
+	_, err = api.RestoreCtx(context.Background(), dump, "", nil)
+	require.Nil(t, err)
+	books, err := api.GetBooks("user@example.org")
+	require.Nil(t, err)
+	require.Len(t, books.Books, 1)
+	require.Equal(t, "work", books.Books[0].BookName)
+}
+
+func TestRestoreConfigDump(t *testing.T) {
+
+	api, _ := initController(t, "", nil)
+	dump := ConfigDump{Users: map[string]UserDump{
+		"user@example.org": {Password: "secret", Books: map[string][]string{"work": {"boss@example.com", "peer@example.com"}}},
+	}}
+	_, err := api.Restore(&dump, "")
+	require.Nil(t, err)
+	addrs, err := api.Addresses(nil, "user@example.org", "work")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"boss@example.com", "peer@example.com"}, addrs.Addresses)
+}
+
+func TestReadLegacyDump(t *testing.T) {
+	legacy := `{"Users": {"user@example.org": {"Password": "secret", "Books": {"work": ["boss@example.com", "peer@example.com"]}}}}`
+	dump, err := ReadDump(strings.NewReader(legacy))
+	require.Nil(t, err)
+	require.Equal(t, DUMP_VERSION, dump.Version)
+	user := dump.Users["user@example.org"]
+	require.Equal(t, "secret", user.Password)
+	require.Equal(t, "user@example.org", user.DisplayName)
+	emails, err := user.Books["work"].Emails()
+	require.Nil(t, err)
+	require.Equal(t, []string{"boss@example.com", "peer@example.com"}, emails)
+	for _, card := range user.Books["work"].Cards {
+		require.NotEmpty(t, card.UID)
+	}
+
+	again, err := ReadDump(strings.NewReader(legacy))
+	require.Nil(t, err)
+	require.Empty(t, DiffDumps(dump, again))
+
+	_, err = ReadDump(strings.NewReader(`{"format": "mabctl-dump", "version": 99, "users": {}}`))
+	require.NotNil(t, err)
+}
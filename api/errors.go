@@ -0,0 +1,31 @@
+package api
+
+import (
+	"github.com/rstms/mabctl/util"
+)
+
+// HTTPError is returned for non-2xx responses from the bcc API and the
+// CardDAV server; use errors.As to inspect the status and server detail.
+type HTTPError = util.HTTPError
+
+// ConflictError is returned when an If-Match or If-None-Match precondition
+// on an address object fails.
+type ConflictError = util.ConflictError
+
+// Sentinel errors for use with errors.Is
+var (
+	ErrUnauthorized     = util.ErrUnauthorized
+	ErrNotFound         = util.ErrNotFound
+	ErrConflict         = util.ErrConflict
+	ErrServerError      = util.ErrServerError
+	ErrUnavailable      = util.ErrUnavailable
+	ErrUserNotFound     = util.ErrUserNotFound
+	ErrUserExists       = util.ErrUserExists
+	ErrBookNotFound     = util.ErrBookNotFound
+	ErrBookExists       = util.ErrBookExists
+	ErrAddressNotFound  = util.ErrAddressNotFound
+	ErrAddressExists    = util.ErrAddressExists
+	ErrAddressInvalid   = util.ErrAddressInvalid
+	ErrSyncUnsupported  = util.ErrSyncUnsupported
+	ErrSyncTokenInvalid = util.ErrSyncTokenInvalid
+)
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// event types
+const (
+	EVENT_START   = "start"
+	EVENT_USER    = "user"
+	EVENT_BOOK    = "book"
+	EVENT_ADDRESS = "address"
+	EVENT_ERROR   = "error"
+	EVENT_DONE    = "done"
+)
+
+// Event reports the progress of a long operation such as dump or restore.
+// Done and Total count the users finished and to be processed.  An error
+// event identifies the user, book or address which failed; a user event
+// follows for every user whether or not it failed.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Operation string    `json:"operation"`
+	Username  string    `json:"username,omitempty"`
+	Bookname  string    `json:"bookname,omitempty"`
+	UID       string    `json:"uid,omitempty"`
+	Address   string    `json:"address,omitempty"`
+	Done      int       `json:"done"`
+	Total     int       `json:"total"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type EventHandler func(Event)
+
+// Emitter delivers events to a handler.  The handler is never called
+// concurrently.  The zero Emitter discards events.
+type Emitter struct {
+	mutex   sync.Mutex
+	handler EventHandler
+}
+
+// SetEventHandler directs events to handler; nil discards them
+func (e *Emitter) SetEventHandler(handler EventHandler) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.handler = handler
+}
+
+// Events returns the emitter, satisfying AddressBookManager
+func (e *Emitter) Events() *Emitter {
+	return e
+}
+
+func (e *Emitter) emit(event Event) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.handler != nil {
+		event.Time = time.Now().UTC()
+		e.handler(event)
+	}
+}
+
+// Operation tracks one long operation, emitting its events
+type Operation struct {
+	emitter *Emitter
+	name    string
+	mutex   sync.Mutex
+	done    int
+	total   int
+}
+
+// Start emits the start event of an operation processing total users
+func (e *Emitter) Start(name string, total int) *Operation {
+	op := Operation{emitter: e, name: name, total: total}
+	op.emit(Event{Type: EVENT_START}, nil)
+	return &op
+}
+
+func (o *Operation) emit(event Event, err error) {
+	o.mutex.Lock()
+	if event.Type == EVENT_USER {
+		o.done++
+	}
+	event.Operation = o.name
+	event.Done = o.done
+	event.Total = o.total
+	o.mutex.Unlock()
+	if err != nil {
+		event.Error = err.Error()
+		if event.Type != EVENT_USER && event.Type != EVENT_DONE {
+			event.Type = EVENT_ERROR
+		}
+	}
+	o.emitter.emit(event)
+}
+
+// Address reports an address processed, or failed if err is not nil
+func (o *Operation) Address(username, bookname, uid, address string, err error) {
+	o.emit(Event{Type: EVENT_ADDRESS, Username: username, Bookname: bookname, UID: uid, Address: address}, err)
+}
+
+// Book reports a book processed, or failed if err is not nil
+func (o *Operation) Book(username, bookname string, err error) {
+	o.emit(Event{Type: EVENT_BOOK, Username: username, Bookname: bookname}, err)
+}
+
+// User reports a user finished; err is the error which stopped it, if any
+func (o *Operation) User(username string, err error) {
+	if err != nil {
+		o.emit(Event{Type: EVENT_ERROR, Username: username}, err)
+	}
+	o.emit(Event{Type: EVENT_USER, Username: username}, err)
+}
+
+// Finish emits the done event, with the operation's error if it failed
+func (o *Operation) Finish(err error) {
+	o.emit(Event{Type: EVENT_DONE}, err)
+}
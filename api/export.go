@@ -0,0 +1,369 @@
+package api
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav/carddav"
+	"github.com/rstms/mabctl/util"
+)
+
+// export file formats
+const (
+	EXPORT_VCF  = "vcf"
+	EXPORT_CSV  = "csv"
+	EXPORT_LDIF = "ldif"
+	EXPORT_JSON = "json"
+)
+
+var EXPORT_FORMATS = []string{EXPORT_VCF, EXPORT_CSV, EXPORT_LDIF, EXPORT_JSON}
+
+// exportCSVHeader is the Thunderbird address book CSV layout, which
+// Outlook and Google Contacts also accept
+var exportCSVHeader = []string{
+	"First Name", "Last Name", "Display Name", "Nickname", "Primary Email", "Secondary Email",
+	"Work Phone", "Home Phone", "Mobile Number", "Job Title", "Organization", "Notes",
+}
+
+type ExportFile struct {
+	Bookname string `json:"bookname"`
+	Filename string `json:"filename"`
+	Cards    int    `json:"cards"`
+}
+
+func (f ExportFile) String() string {
+	return fmt.Sprintf("%s: %d cards -> %s", f.Bookname, f.Cards, f.Filename)
+}
+
+type ExportResponse struct {
+	Response
+	Output string       `json:"output"`
+	Files  []ExportFile `json:"files"`
+}
+
+// CheckExportFormat returns an error if format is not supported
+func CheckExportFormat(format string) error {
+	for _, f := range EXPORT_FORMATS {
+		if f == format {
+			return nil
+		}
+	}
+	return util.Fatalf("unknown export format '%s'; expected one of %s", format, strings.Join(EXPORT_FORMATS, ", "))
+}
+
+// WriteExport writes cards to w in format
+func WriteExport(w io.Writer, format string, cards []carddav.AddressObject) error {
+	var err error
+	switch format {
+	case EXPORT_VCF:
+		encoder := vcard.NewEncoder(w)
+		for _, addr := range cards {
+			err = encoder.Encode(addr.Card)
+			if err != nil {
+				break
+			}
+		}
+	case EXPORT_CSV:
+		err = writeExportCSV(w, cards)
+	case EXPORT_LDIF:
+		err = writeExportLDIF(w, cards)
+	case EXPORT_JSON:
+		contacts := make([]*Contact, len(cards))
+		for i, addr := range cards {
+			contacts[i] = NewContact(addr)
+		}
+		var data []byte
+		data, err = json.MarshalIndent(contacts, "", "  ")
+		if err == nil {
+			_, err = w.Write(append(data, '\n'))
+		}
+	default:
+		return CheckExportFormat(format)
+	}
+	if err != nil {
+		return util.Fatalf("failed writing %s export: %w", format, err)
+	}
+	return nil
+}
+
+// displayName returns the contact's full name, or else its given and
+// family names
+func displayName(contact *Contact) string {
+	if contact.FullName != "" {
+		return contact.FullName
+	}
+	return strings.TrimSpace(contact.GivenName + " " + contact.FamilyName)
+}
+
+// exportPhones assigns the card's telephone numbers to the work, home and
+// mobile columns by type, placing untyped numbers in the first free column
+func exportPhones(card vcard.Card) [3]string {
+	var ret [3]string
+	untyped := []string{}
+	for _, field := range card[vcard.FieldTelephone] {
+		slot := -1
+		for _, t := range field.Params.Types() {
+			switch strings.ToLower(t) {
+			case vcard.TypeWork:
+				slot = 0
+			case vcard.TypeHome:
+				slot = 1
+			case vcard.TypeCell:
+				slot = 2
+			}
+		}
+		if slot >= 0 && ret[slot] == "" {
+			ret[slot] = field.Value
+		} else {
+			untyped = append(untyped, field.Value)
+		}
+	}
+	for i := range ret {
+		if ret[i] == "" && len(untyped) > 0 {
+			ret[i] = untyped[0]
+			untyped = untyped[1:]
+		}
+	}
+	return ret
+}
+
+func writeExportCSV(w io.Writer, cards []carddav.AddressObject) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write(exportCSVHeader)
+	if err != nil {
+		return err
+	}
+	for _, addr := range cards {
+		contact := NewContact(addr)
+		emails := append(contact.Emails, "", "")
+		phones := exportPhones(addr.Card)
+		err = writer.Write([]string{
+			contact.GivenName, contact.FamilyName, displayName(contact), addr.Card.Value(vcard.FieldNickname), emails[0], emails[1],
+			phones[0], phones[1], phones[2], contact.Title, contact.Organization, contact.Notes,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// ldifSafe reports whether value may be written without base64 encoding
+func ldifSafe(value string) bool {
+	if value == "" {
+		return true
+	}
+	if strings.ContainsAny(value[:1], " :<") || strings.HasSuffix(value, " ") {
+		return false
+	}
+	for _, r := range value {
+		if r < 0x20 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLDIFAttribute(w io.Writer, name, value string) error {
+	var err error
+	if ldifSafe(value) {
+		_, err = fmt.Fprintf(w, "%s: %s\n", name, value)
+	} else {
+		_, err = fmt.Fprintf(w, "%s:: %s\n", name, base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	return err
+}
+
+// dnEscaper escapes the characters special in an LDAP distinguished name
+var dnEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, "+", `\+`, `"`, `\"`, "<", `\<`, ">", `\>`, ";", `\;`, "=", `\=`)
+
+// writeExportLDIF writes entries in the layout Thunderbird exports
+func writeExportLDIF(w io.Writer, cards []carddav.AddressObject) error {
+	for _, addr := range cards {
+		contact := NewContact(addr)
+		email := ""
+		if len(contact.Emails) > 0 {
+			email = contact.Emails[0]
+		}
+		name := displayName(contact)
+		if name == "" {
+			name = email
+		}
+		phones := exportPhones(addr.Card)
+		attributes := [][2]string{
+			{"dn", fmt.Sprintf("cn=%s,mail=%s", dnEscaper.Replace(name), dnEscaper.Replace(email))},
+			{"objectclass", "top"},
+			{"objectclass", "person"},
+			{"objectclass", "organizationalPerson"},
+			{"objectclass", "inetOrgPerson"},
+			{"objectclass", "mozillaAbPersonAlpha"},
+			{"givenName", contact.GivenName},
+			{"sn", contact.FamilyName},
+			{"cn", name},
+			{"mozillaNickname", addr.Card.Value(vcard.FieldNickname)},
+			{"mail", email},
+		}
+		for _, second := range contact.Emails[min(1, len(contact.Emails)):] {
+			attributes = append(attributes, [2]string{"mozillaSecondEmail", second})
+		}
+		attributes = append(attributes,
+			[2]string{"telephoneNumber", phones[0]},
+			[2]string{"homePhone", phones[1]},
+			[2]string{"mobile", phones[2]},
+			[2]string{"title", contact.Title},
+			[2]string{"o", contact.Organization},
+			[2]string{"description", contact.Notes},
+		)
+		for _, attribute := range attributes {
+			if attribute[1] == "" {
+				continue
+			}
+			err := writeLDIFAttribute(w, attribute[0], attribute[1])
+			if err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintln(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportBook writes the contents of a book to w in format, returning the
+// number of cards written
+func ExportBook(ctx context.Context, mab AddressBookManager, username, bookname, format string, w io.Writer) (int, error) {
+	err := CheckExportFormat(format)
+	if err != nil {
+		return 0, err
+	}
+	response, err := mab.CardsCtx(ctx, username, bookname)
+	if err != nil {
+		return 0, err
+	}
+	err = WriteExport(w, format, response.Cards)
+	if err != nil {
+		return 0, err
+	}
+	return len(response.Cards), nil
+}
+
+// exportFilename names the file holding a book in a directory or archive
+func exportFilename(bookname, format string) string {
+	return strings.ReplaceAll(bookname, string(filepath.Separator), "_") + "." + format
+}
+
+// exportFilenames returns the filename of each book, failing if two books
+// would be written to the same file; names differing only in case collide,
+// as they do on case-insensitive filesystems
+func exportFilenames(books []Book, format string) ([]string, error) {
+	ret := make([]string, len(books))
+	used := make(map[string]string)
+	for i, book := range books {
+		ret[i] = exportFilename(book.BookName, format)
+		key := strings.ToLower(ret[i])
+		if other, ok := used[key]; ok {
+			return nil, util.Fatalf("books '%s' and '%s' would both be exported to %s", other, book.BookName, ret[i])
+		}
+		used[key] = book.BookName
+	}
+	return ret, nil
+}
+
+// ExportAll writes every book of username in format, one file per book,
+// into the directory output, or into a zip archive if output ends in .zip
+func ExportAll(ctx context.Context, mab AddressBookManager, username, format, output string) (*ExportResponse, error) {
+	err := CheckExportFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	books, err := mab.GetBooksCtx(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	filenames, err := exportFilenames(books.Books, format)
+	if err != nil {
+		return nil, err
+	}
+	ret := ExportResponse{
+		Response: Response{Success: true, User: username, Request: fmt.Sprintf("export %s", username)},
+		Output:   output,
+		Files:    []ExportFile{},
+	}
+
+	var archive *zip.Writer
+	if strings.EqualFold(filepath.Ext(output), ".zip") {
+		file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, util.Fatalf("failed creating archive: %w", err)
+		}
+		defer file.Close()
+		archive = zip.NewWriter(file)
+	} else {
+		err = os.MkdirAll(output, 0700)
+		if err != nil {
+			return nil, util.Fatalf("failed creating export directory: %w", err)
+		}
+	}
+
+	op := mab.Events().Start("export", 1)
+	for i, book := range books.Books {
+		filename := filenames[i]
+		var count int
+		if archive != nil {
+			var w io.Writer
+			w, err = archive.Create(filename)
+			if err == nil {
+				count, err = ExportBook(ctx, mab, username, book.BookName, format, w)
+			}
+		} else {
+			filename = filepath.Join(output, filename)
+			count, err = exportBookFile(ctx, mab, username, book.BookName, format, filename)
+		}
+		op.Book(username, book.BookName, err)
+		if err != nil {
+			op.User(username, err)
+			op.Finish(err)
+			return nil, err
+		}
+		ret.Files = append(ret.Files, ExportFile{Bookname: book.BookName, Filename: filename, Cards: count})
+	}
+	op.User(username, nil)
+	op.Finish(nil)
+	if archive != nil {
+		err = archive.Close()
+		if err != nil {
+			return nil, util.Fatalf("failed writing archive: %w", err)
+		}
+	}
+	ret.Message = fmt.Sprintf("exported %d books to %s", len(ret.Files), output)
+	return &ret, nil
+}
+
+func exportBookFile(ctx context.Context, mab AddressBookManager, username, bookname, format, filename string) (int, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, util.Fatalf("failed creating export file: %w", err)
+	}
+	count, err := ExportBook(ctx, mab, username, bookname, format, file)
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	err = file.Close()
+	if err != nil {
+		return 0, util.Fatalf("failed writing export file: %w", err)
+	}
+	return count, nil
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+
+	username := "user@example.org"
+	api, _ := initController(t, username, testBooks{"friends": nil, "work": {"boss@example.com"}})
+	_, err := api.PutContact(username, "friends", &Contact{FullName: "Zoë Friend", GivenName: "Zoë", FamilyName: "Friend", Emails: []string{"zoe@example.com", "zoe@example.net"}, Phones: []string{"555-1212"}})
+	require.Nil(t, err)
+	_, err = api.AddAddress(nil, username, "friends", "pal@example.com", "Pal")
+	require.Nil(t, err)
+
+	for _, format := range EXPORT_FORMATS {
+		var buf bytes.Buffer
+		count, err := ExportBook(context.Background(), api, username, "friends", format, &buf)
+		require.Nil(t, err)
+		require.Equal(t, 2, count)
+		if format == EXPORT_JSON {
+			var contacts []Contact
+			err = json.Unmarshal(buf.Bytes(), &contacts)
+			require.Nil(t, err)
+			require.Len(t, contacts, 2)
+			continue
+		}
+		records, err := ReadImport("friends."+format, buf.Bytes(), ImportOptions{})
+		require.Nil(t, err, format)
+		found := map[string]string{}
+		for _, record := range records {
+			found[record.Email] = record.Name
+		}
+		require.Equal(t, "Zoë Friend", found["zoe@example.com"], format)
+		require.Equal(t, "Pal", found["pal@example.com"], format)
+		if format != EXPORT_VCF {
+			require.Contains(t, buf.String(), "555-1212", format)
+		}
+	}
+
+	_, err = ExportBook(context.Background(), api, username, "friends", "xml", &bytes.Buffer{})
+	require.NotNil(t, err)
+
+	dir := filepath.Join(t.TempDir(), "export")
+	response, err := ExportAll(context.Background(), api, username, EXPORT_CSV, dir)
+	require.Nil(t, err)
+	require.Len(t, response.Files, 2)
+	data, err := os.ReadFile(filepath.Join(dir, "work.csv"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "boss@example.com")
+
+	archive := filepath.Join(t.TempDir(), "books.zip")
+	response, err = ExportAll(context.Background(), api, username, EXPORT_VCF, archive)
+	require.Nil(t, err)
+	info, err := os.Stat(archive)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	reader, err := zip.OpenReader(archive)
+	require.Nil(t, err)
+	defer reader.Close()
+	names := []string{}
+	for _, file := range reader.File {
+		names = append(names, file.Name)
+	}
+	require.ElementsMatch(t, []string{"friends.vcf", "work.vcf"}, names)
+}
+
+func TestExportFilenames(t *testing.T) {
+	names, err := exportFilenames([]Book{{BookName: "friends"}, {BookName: "work"}}, EXPORT_CSV)
+	require.Nil(t, err)
+	require.Equal(t, []string{"friends.csv", "work.csv"}, names)
+
+	for _, books := range [][]Book{
+		{{BookName: "a" + string(filepath.Separator) + "b"}, {BookName: "a_b"}},
+		{{BookName: "Work"}, {BookName: "work"}},
+	} {
+		_, err = exportFilenames(books, EXPORT_CSV)
+		require.NotNil(t, err)
+	}
+}
@@ -0,0 +1,546 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-vcard"
+	"github.com/google/uuid"
+	davapi "github.com/rstms/mabctl/carddav"
+	"github.com/rstms/mabctl/util"
+)
+
+// import file formats
+const (
+	IMPORT_CSV         = "csv"
+	IMPORT_VCF         = "vcf"
+	IMPORT_LDIF        = "ldif"
+	IMPORT_THUNDERBIRD = "thunderbird"
+	IMPORT_GOOGLE      = "google"
+)
+
+var IMPORT_FORMATS = []string{IMPORT_CSV, IMPORT_VCF, IMPORT_LDIF, IMPORT_THUNDERBIRD, IMPORT_GOOGLE}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// ImportOptions selects the format of an import file and, for generic
+// CSV, the columns holding the email address and name.  A column is a
+// header name or a 1-based column number.
+type ImportOptions struct {
+	Format      string
+	EmailColumn string
+	NameColumn  string
+	NoHeader    bool
+}
+
+// ImportRecord is one address read from an import file.  Record is the
+// line number of a CSV row or LDIF entry, or the position of a vCard in
+// the file.  Reason explains why a record was skipped or is invalid.
+type ImportRecord struct {
+	Record int    `json:"record"`
+	Email  string `json:"email"`
+	Name   string `json:"name,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	card   vcard.Card
+}
+
+func (r ImportRecord) String() string {
+	ret := fmt.Sprintf("record %d: %s", r.Record, r.Email)
+	if r.Reason != "" {
+		ret += ": " + r.Reason
+	}
+	return ret
+}
+
+type ImportResponse struct {
+	Response
+	Added   []ImportRecord `json:"added"`
+	Skipped []ImportRecord `json:"skipped"`
+	Invalid []ImportRecord `json:"invalid"`
+}
+
+// DetectImportFormat chooses a format from the filename extension or, if
+// that is not conclusive, the content.  CSV exports from Thunderbird and
+// Google Contacts are recognized by their header row.
+func DetectImportFormat(filename string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".vcf", ".vcard":
+		return IMPORT_VCF
+	case ".ldif", ".ldi":
+		return IMPORT_LDIF
+	}
+	text := strings.ToLower(strings.TrimSpace(string(bytes.TrimPrefix(data, utf8BOM))))
+	switch {
+	case strings.HasPrefix(text, "begin:vcard"):
+		return IMPORT_VCF
+	case strings.HasPrefix(text, "dn:"), strings.HasPrefix(text, "version:"):
+		return IMPORT_LDIF
+	}
+	header, _, _ := strings.Cut(text, "\n")
+	switch {
+	case strings.Contains(header, "primary email"):
+		return IMPORT_THUNDERBIRD
+	case strings.Contains(header, "e-mail 1 - value"):
+		return IMPORT_GOOGLE
+	}
+	return IMPORT_CSV
+}
+
+// ReadImport parses an import file.  Rows or entries without a usable
+// email address are returned with Reason set.
+func ReadImport(filename string, data []byte, options ImportOptions) ([]ImportRecord, error) {
+	data = bytes.TrimPrefix(data, utf8BOM)
+	format := options.Format
+	switch {
+	case format != "":
+	case options.EmailColumn != "", options.NameColumn != "", options.NoHeader:
+		format = IMPORT_CSV
+	default:
+		format = DetectImportFormat(filename, data)
+	}
+	var records []ImportRecord
+	var err error
+	switch format {
+	case IMPORT_CSV, IMPORT_THUNDERBIRD, IMPORT_GOOGLE:
+		records, err = readImportCSV(data, format, options)
+	case IMPORT_VCF:
+		records, err = readImportVCF(data)
+	case IMPORT_LDIF:
+		records, err = readImportLDIF(data)
+	default:
+		return nil, util.Fatalf("unknown import format '%s'; expected one of %s", format, strings.Join(IMPORT_FORMATS, ", "))
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		records[i].validate()
+	}
+	return records, nil
+}
+
+// validate normalizes the email address, taking the name from it if it is
+// written as "Name <email>", and sets Reason if it is unusable
+func (r *ImportRecord) validate() {
+	if r.Reason != "" {
+		return
+	}
+	if r.Email == "" {
+		r.Reason = "no email address"
+		return
+	}
+	parsed, err := mail.ParseAddress(r.Email)
+	if err != nil {
+		r.Reason = fmt.Sprintf("%v: %s", ErrAddressInvalid, r.Email)
+		return
+	}
+	r.Email = parsed.Address
+	if r.Name == "" {
+		r.Name = parsed.Name
+	}
+}
+
+var googleEmailColumn = regexp.MustCompile(`^e-mail \d+ - value$`)
+
+// csvColumns locates the columns of a CSV import.  The name is the first
+// of names which is not empty, or else the parts columns joined.
+type csvColumns struct {
+	emails []int
+	names  []int
+	parts  []int
+}
+
+func (c csvColumns) records(line int, row []string) []ImportRecord {
+	field := func(i int) string {
+		if i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	name := ""
+	for _, i := range c.names {
+		if name == "" {
+			name = field(i)
+		}
+	}
+	if name == "" {
+		parts := []string{}
+		for _, i := range c.parts {
+			if field(i) != "" {
+				parts = append(parts, field(i))
+			}
+		}
+		name = strings.Join(parts, " ")
+	}
+	ret := []ImportRecord{}
+	for _, i := range c.emails {
+		for _, email := range strings.Split(field(i), ":::") {
+			email = strings.TrimSpace(email)
+			if email != "" {
+				ret = append(ret, ImportRecord{Record: line, Email: email, Name: name})
+			}
+		}
+	}
+	if len(ret) == 0 {
+		ret = append(ret, ImportRecord{Record: line, Name: name})
+	}
+	return ret
+}
+
+// findColumn returns the index of the first header matching one of names,
+// ignoring case, or -1
+func findColumn(header []string, names ...string) int {
+	for _, name := range names {
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// findColumns returns the indexes of the headers matching names
+func findColumns(header []string, names ...string) []int {
+	ret := []int{}
+	for _, name := range names {
+		if i := findColumn(header, name); i >= 0 {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// selectColumn resolves a column given by header name or 1-based number
+func selectColumn(header []string, spec string) (int, error) {
+	n, err := strconv.Atoi(spec)
+	if err == nil {
+		if n < 1 {
+			return -1, util.Fatalf("invalid column number: %d", n)
+		}
+		return n - 1, nil
+	}
+	i := findColumn(header, spec)
+	if i < 0 {
+		return -1, util.Fatalf("column not found: '%s'", spec)
+	}
+	return i, nil
+}
+
+func importColumns(format string, header []string, options ImportOptions) (csvColumns, error) {
+	columns := csvColumns{}
+	switch format {
+	case IMPORT_THUNDERBIRD:
+		columns.emails = findColumns(header, "Primary Email", "Secondary Email")
+		columns.names = findColumns(header, "Display Name")
+		columns.parts = findColumns(header, "First Name", "Last Name")
+	case IMPORT_GOOGLE:
+		for i, h := range header {
+			if googleEmailColumn.MatchString(strings.ToLower(strings.TrimSpace(h))) {
+				columns.emails = append(columns.emails, i)
+			}
+		}
+		columns.names = findColumns(header, "Name")
+		columns.parts = findColumns(header, "First Name", "Given Name", "Middle Name", "Additional Name", "Last Name", "Family Name")
+	default:
+		email := -1
+		name := -1
+		var err error
+		switch {
+		case options.EmailColumn != "":
+			email, err = selectColumn(header, options.EmailColumn)
+		case options.NoHeader:
+			email = 0
+		default:
+			email = findColumn(header, "email", "e-mail", "email address", "e-mail address", "mail")
+		}
+		if err != nil {
+			return columns, err
+		}
+		switch {
+		case options.NameColumn != "":
+			name, err = selectColumn(header, options.NameColumn)
+		case options.NoHeader:
+			name = 1
+		default:
+			name = findColumn(header, "name", "full name", "display name", "displayname")
+		}
+		if err != nil {
+			return columns, err
+		}
+		columns.emails = []int{email}
+		if name >= 0 {
+			columns.names = []int{name}
+		}
+	}
+	if len(columns.emails) == 0 || columns.emails[0] < 0 {
+		return columns, util.Fatalf("no email column found in %s header; select one by name or number", format)
+	}
+	return columns, nil
+}
+
+func readImportCSV(data []byte, format string, options ImportOptions) ([]ImportRecord, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	var header []string
+	if format != IMPORT_CSV || !options.NoHeader {
+		var err error
+		header, err = reader.Read()
+		if errors.Is(err, io.EOF) {
+			return []ImportRecord{}, nil
+		}
+		if err != nil {
+			return nil, util.Fatalf("failed reading CSV header: %w", err)
+		}
+	}
+	columns, err := importColumns(format, header, options)
+	if err != nil {
+		return nil, err
+	}
+	ret := []ImportRecord{}
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, util.Fatalf("failed reading CSV: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+		ret = append(ret, columns.records(line, row)...)
+	}
+	return ret, nil
+}
+
+func readImportVCF(data []byte) ([]ImportRecord, error) {
+	decoder := vcard.NewDecoder(bytes.NewReader(data))
+	ret := []ImportRecord{}
+	for {
+		card, err := decoder.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, util.Fatalf("failed decoding vCard %d: %w", len(ret)+1, err)
+		}
+		record := ImportRecord{Record: len(ret) + 1, Email: card.PreferredValue(vcard.FieldEmail), Name: card.Value(vcard.FieldFormattedName), card: card}
+		if record.Name == "" && card.Name() != nil {
+			name := card.Name()
+			record.Name = strings.TrimSpace(name.GivenName + " " + name.FamilyName)
+			if record.Name == "" {
+				record.Name = name.AdditionalName
+			}
+		}
+		ret = append(ret, record)
+	}
+	return ret, nil
+}
+
+// ldifEntry is the attributes of one LDIF entry, keyed by lower case name
+type ldifEntry struct {
+	line  int
+	attrs map[string][]string
+}
+
+func (e ldifEntry) value(names ...string) string {
+	for _, name := range names {
+		if values := e.attrs[name]; len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+func readImportLDIF(data []byte) ([]ImportRecord, error) {
+	// unfold continuation lines, remembering where each logical line starts
+	type ldifLine struct {
+		number int
+		text   string
+	}
+	lines := []ldifLine{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for number := 1; scanner.Scan(); number++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(text, " ") && len(lines) > 0 && lines[len(lines)-1].text != "" {
+			lines[len(lines)-1].text += text[1:]
+			continue
+		}
+		lines = append(lines, ldifLine{number, text})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, util.Fatalf("failed reading LDIF: %w", err)
+	}
+
+	entries := []ldifEntry{}
+	var entry *ldifEntry
+	for _, line := range lines {
+		if line.text == "" {
+			entry = nil
+			continue
+		}
+		if strings.HasPrefix(line.text, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line.text, ":")
+		if !ok {
+			return nil, util.Fatalf("LDIF line %d: expected 'attribute: value'", line.number)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if i := strings.Index(name, ";"); i >= 0 {
+			name = name[:i]
+		}
+		switch {
+		case strings.HasPrefix(value, ":"):
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+			if err != nil {
+				return nil, util.Fatalf("LDIF line %d: invalid base64 value: %w", line.number, err)
+			}
+			value = string(decoded)
+		case strings.HasPrefix(value, "<"):
+			// values loaded from URLs are not supported
+			continue
+		default:
+			value = strings.TrimSpace(value)
+		}
+		if entry == nil {
+			if name == "version" {
+				continue
+			}
+			entries = append(entries, ldifEntry{line: line.number, attrs: make(map[string][]string)})
+			entry = &entries[len(entries)-1]
+		}
+		entry.attrs[name] = append(entry.attrs[name], value)
+	}
+
+	ret := []ImportRecord{}
+	for _, entry := range entries {
+		name := entry.value("displayname", "cn")
+		if name == "" {
+			name = strings.TrimSpace(entry.value("givenname") + " " + entry.value("sn"))
+		}
+		emails := append(entry.attrs["mail"], entry.attrs["mozillasecondemail"]...)
+		if len(emails) == 0 {
+			ret = append(ret, ImportRecord{Record: entry.line, Name: name})
+		}
+		for _, email := range emails {
+			ret = append(ret, ImportRecord{Record: entry.line, Email: email, Name: name})
+		}
+	}
+	return ret, nil
+}
+
+// Import adds the valid records to a book, skipping addresses which are
+// already in the book or appear earlier in the file.  vCards are stored
+// whole; other records are added as new cards with the address and name.
+// With dryRun, the response lists what would be added.
+func Import(ctx context.Context, mab AddressBookManager, username, bookname string, records []ImportRecord, dryRun bool) (*ImportResponse, error) {
+	ret := ImportResponse{
+		Response: Response{Success: true, User: username, Request: fmt.Sprintf("import %s %s", username, bookname)},
+		Added:    []ImportRecord{},
+		Skipped:  []ImportRecord{},
+		Invalid:  []ImportRecord{},
+	}
+	op := mab.Events().Start("import", 1)
+	existing, err := bookEmails(ctx, mab, username, bookname)
+	if err != nil {
+		op.User(username, err)
+		op.Finish(err)
+		return nil, err
+	}
+	seen := make(map[string]int)
+	for _, record := range records {
+		if record.Reason != "" {
+			ret.Invalid = append(ret.Invalid, record)
+			continue
+		}
+		key := strings.ToLower(record.Email)
+		if first, ok := seen[key]; ok {
+			record.Reason = fmt.Sprintf("duplicate of record %d", first)
+			ret.Skipped = append(ret.Skipped, record)
+			continue
+		}
+		seen[key] = record.Record
+		if existing[key] {
+			record.Reason = "exists"
+			ret.Skipped = append(ret.Skipped, record)
+			continue
+		}
+		if !dryRun {
+			err = importRecord(ctx, mab, username, bookname, record)
+			if errors.Is(err, ErrAddressExists) {
+				record.Reason = "card UID exists"
+				ret.Skipped = append(ret.Skipped, record)
+				continue
+			}
+			op.Address(username, bookname, "", record.Email, err)
+			if err != nil {
+				op.User(username, err)
+				op.Finish(err)
+				return nil, err
+			}
+		}
+		ret.Added = append(ret.Added, record)
+	}
+	op.User(username, nil)
+	op.Finish(nil)
+	verb := "added"
+	if dryRun {
+		verb = "would add"
+	}
+	ret.Message = fmt.Sprintf("%s %d, skipped %d, invalid %d", verb, len(ret.Added), len(ret.Skipped), len(ret.Invalid))
+	return &ret, nil
+}
+
+// bookEmails returns the lower case EMAIL values of the cards in a book.
+// Existing addresses are matched exactly, as a server query also finds
+// the addresses containing the one sought.
+func bookEmails(ctx context.Context, mab AddressBookManager, username, bookname string) (map[string]bool, error) {
+	cards, err := mab.CardsCtx(ctx, username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]bool)
+	for _, card := range cards.Cards {
+		for _, email := range card.Card.Values(vcard.FieldEmail) {
+			ret[strings.ToLower(email)] = true
+		}
+	}
+	return ret, nil
+}
+
+func importRecord(ctx context.Context, mab AddressBookManager, username, bookname string, record ImportRecord) error {
+	name := record.Name
+	if name == "" {
+		name = record.Email
+	}
+	if record.card == nil {
+		_, err := mab.AddAddressCtx(ctx, username, bookname, record.Email, name)
+		return err
+	}
+	card := record.card
+	if card.Value(vcard.FieldVersion) == "" {
+		card.SetValue(vcard.FieldVersion, davapi.VCARD_VERSION)
+	}
+	if card.Value(vcard.FieldUID) == "" {
+		card.SetValue(vcard.FieldUID, uuid.New().String())
+	}
+	if card.Value(vcard.FieldFormattedName) == "" {
+		card.SetValue(vcard.FieldFormattedName, name)
+	}
+	_, err := mab.PutCardCtx(ctx, username, bookname, card, Precondition{IfNoneMatch: true})
+	return err
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadImport(t *testing.T) {
+	emails := func(records []ImportRecord) []string {
+		ret := []string{}
+		for _, record := range records {
+			ret = append(ret, record.Email+"|"+record.Name+"|"+record.Reason)
+		}
+		return ret
+	}
+
+	csvData := "Name,Email\nGood Friend,friend@example.com\nNobody,\n,\"Pal <pal@example.com>\"\nBad,not-an-address\n"
+	records, err := ReadImport("friends.csv", []byte(csvData), ImportOptions{})
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		"friend@example.com|Good Friend|",
+		"|Nobody|no email address",
+		"pal@example.com|Pal|",
+		"not-an-address|Bad|" + ErrAddressInvalid.Error() + ": not-an-address",
+	}, emails(records))
+	require.Equal(t, 2, records[0].Record)
+
+	records, err = ReadImport("-", []byte("x,friend@example.com,Good Friend\n"), ImportOptions{NoHeader: true, EmailColumn: "2", NameColumn: "3"})
+	require.Nil(t, err)
+	require.Equal(t, []string{"friend@example.com|Good Friend|"}, emails(records))
+
+	_, err = ReadImport("-", []byte("Who,Where\nx,y\n"), ImportOptions{})
+	require.NotNil(t, err)
+
+	thunderbird := "First Name,Last Name,Display Name,Nickname,Primary Email,Secondary Email\nGood,Friend,,,friend@example.com,friend@example.net\n"
+	require.Equal(t, IMPORT_THUNDERBIRD, DetectImportFormat("-", []byte(thunderbird)))
+	records, err = ReadImport("-", []byte(thunderbird), ImportOptions{})
+	require.Nil(t, err)
+	require.Equal(t, []string{"friend@example.com|Good Friend|", "friend@example.net|Good Friend|"}, emails(records))
+
+	google := "First Name,Middle Name,Last Name,E-mail 1 - Label,E-mail 1 - Value,E-mail 2 - Value\nGood,,Friend,* Home,friend@example.com ::: home@example.com,work@example.com\n"
+	require.Equal(t, IMPORT_GOOGLE, DetectImportFormat("contacts.csv", []byte(google)))
+	records, err = ReadImport("contacts.csv", []byte(google), ImportOptions{})
+	require.Nil(t, err)
+	require.Equal(t, []string{"friend@example.com|Good Friend|", "home@example.com|Good Friend|", "work@example.com|Good Friend|"}, emails(records))
+
+	vcf := "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Good Friend\r\nEMAIL:friend@example.com\r\nTEL:555-1212\r\nEND:VCARD\r\nBEGIN:VCARD\r\nVERSION:3.0\r\nFN:No Mail\r\nEND:VCARD\r\n"
+	require.Equal(t, IMPORT_VCF, DetectImportFormat("-", []byte(vcf)))
+	records, err = ReadImport("-", []byte(vcf), ImportOptions{})
+	require.Nil(t, err)
+	require.Equal(t, []string{"friend@example.com|Good Friend|", "|No Mail|no email address"}, emails(records))
+	require.Equal(t, 2, records[1].Record)
+
+	ldif := "dn: cn=Good Friend,mail=friend@example.com\nobjectclass: top\ncn: Good Friend\nmail: friend@exam\n ple.com\n\ndn: cn=Pal\ncn:: UGFs\nmail: pal@example.com\nmozillaSecondEmail: pal@example.net\n"
+	require.Equal(t, IMPORT_LDIF, DetectImportFormat("-", []byte(ldif)))
+	records, err = ReadImport("book.ldif", []byte(ldif), ImportOptions{})
+	require.Nil(t, err)
+	require.Equal(t, []string{"friend@example.com|Good Friend|", "pal@example.com|Pal|", "pal@example.net|Pal|"}, emails(records))
+	require.Equal(t, 7, records[1].Record)
+}
+
+func TestImport(t *testing.T) {
+
+	username := "user@example.org"
+	api, _ := initController(t, username, testBooks{"friends": {"friend@example.com"}})
+
+	vcf := "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Good Pal\r\nEMAIL:pal@example.com\r\nTEL:555-1212\r\nEND:VCARD\r\n"
+	records, err := ReadImport("-", []byte(vcf), ImportOptions{})
+	require.Nil(t, err)
+	csvRecords, err := ReadImport("-", []byte("email,name\nfriend@example.com,Friend\nnew@example.com,New\nNEW@example.com,Again\nbogus,\n"), ImportOptions{})
+	require.Nil(t, err)
+	records = append(records, csvRecords...)
+
+	response, err := Import(context.Background(), api, username, "friends", records, true)
+	require.Nil(t, err)
+	require.Equal(t, "would add 2, skipped 2, invalid 1", response.Message)
+	addresses, err := api.Addresses(nil, username, "friends")
+	require.Nil(t, err)
+	require.Len(t, addresses.Addresses, 1)
+
+	response, err = Import(context.Background(), api, username, "friends", records, false)
+	require.Nil(t, err)
+	require.Equal(t, "added 2, skipped 2, invalid 1", response.Message)
+	require.Equal(t, "exists", response.Skipped[0].Reason)
+	require.Equal(t, "duplicate of record 3", response.Skipped[1].Reason)
+
+	found, err := api.QueryAddress(username, "friends", "pal@example.com")
+	require.Nil(t, err)
+	require.NotNil(t, found.Address)
+	require.Equal(t, "555-1212", found.Address.Card.Value(vcard.FieldTelephone))
+
+	response, err = Import(context.Background(), api, username, "friends", records, false)
+	require.Nil(t, err)
+	require.Equal(t, "added 0, skipped 4, invalid 1", response.Message)
+
+	// an address containing another does not make it exist
+	records, err = ReadImport("-", []byte("email\nbob@example.com\n"), ImportOptions{})
+	require.Nil(t, err)
+	_, err = api.AddAddress(nil, username, "friends", "jimbob@example.com", "")
+	require.Nil(t, err)
+	response, err = Import(context.Background(), api, username, "friends", records, false)
+	require.Nil(t, err)
+	require.Equal(t, "added 1, skipped 0, invalid 0", response.Message)
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"context"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+const DEFAULT_JOBS = 4
+
+// Jobs returns the number of users Dump and Restore process concurrently,
+// set by the mabctl.jobs config key
+func Jobs() int {
+	jobs := DEFAULT_JOBS
+	if viper.IsSet("mabctl.jobs") {
+		jobs = viper.GetInt("mabctl.jobs")
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+	return jobs
+}
+
+// forEachUser calls fn for each username from a pool of Jobs() workers,
+// returning when all calls are complete.  No further calls are started once
+// ctx is done.
+func forEachUser(ctx context.Context, usernames []string, fn func(username string)) {
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(Jobs(), len(usernames)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for username := range queue {
+				fn(username)
+			}
+		}()
+	}
+	for _, username := range usernames {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- username
+	}
+	close(queue)
+	wg.Wait()
+}
@@ -0,0 +1,299 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rstms/mabctl/util"
+)
+
+const JOURNAL_FORMAT = "mabctl-restore-journal"
+const JOURNAL_VERSION = 1
+
+// JOURNAL_CLEAR is the kind of the journal entry recording that a replace
+// restore deleted the users it is about to recreate
+const JOURNAL_CLEAR = "clear"
+
+var ErrRestoreIncomplete = errors.New("restore incomplete")
+
+// JournalHeader is the first line of a journal.  It holds everything needed
+// to resume the restore.
+type JournalHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Mode    string    `json:"mode"`
+	User    string    `json:"user,omitempty"`
+	Dump    DumpFile  `json:"dump"`
+}
+
+// JournalEntry records the outcome of one restore step
+type JournalEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Kind     string    `json:"kind"`
+	Username string    `json:"username,omitempty"`
+	Bookname string    `json:"bookname,omitempty"`
+	UID      string    `json:"uid,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (e JournalEntry) key() string {
+	return strings.Join([]string{e.Action, e.Kind, e.Username, e.Bookname, e.UID}, "/")
+}
+
+func (e JournalEntry) String() string {
+	var ret string
+	switch e.Kind {
+	case JOURNAL_CLEAR:
+		ret = "clear"
+		if e.Username != "" {
+			ret += " user " + e.Username
+		}
+	case PLAN_USER:
+		ret = fmt.Sprintf("%s user %s", e.Action, e.Username)
+	case PLAN_BOOK:
+		ret = fmt.Sprintf("%s book %s/%s", e.Action, e.Username, e.Bookname)
+	default:
+		ret = fmt.Sprintf("%s card %s/%s/%s", e.Action, e.Username, e.Bookname, e.UID)
+	}
+	if e.Error != "" {
+		ret += ": " + e.Error
+	}
+	return ret
+}
+
+// RestoreJournal is an append-only record of the steps a restore has
+// completed.  A nil journal records nothing.
+type RestoreJournal struct {
+	Header JournalHeader
+	mutex  sync.Mutex
+	file   *os.File
+	done   map[string]bool
+}
+
+// CreateJournal starts a new journal for restoring dump; the file must not
+// already exist
+func CreateJournal(filename string, dump *DumpFile, mode, username string) (*RestoreJournal, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, util.Fatalf("failed creating journal: %w", err)
+	}
+	journal := RestoreJournal{
+		Header: JournalHeader{
+			Format:  JOURNAL_FORMAT,
+			Version: JOURNAL_VERSION,
+			Created: time.Now().UTC().Truncate(time.Second),
+			Mode:    mode,
+			User:    username,
+			Dump:    *dump,
+		},
+		file: file,
+		done: make(map[string]bool),
+	}
+	err = journal.write(&journal.Header)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &journal, nil
+}
+
+// OpenJournal reads a journal written by an interrupted restore and opens
+// it for appending.  A partly written last line is discarded.
+func OpenJournal(filename string) (*RestoreJournal, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return nil, util.Fatalf("failed opening journal: %w", err)
+	}
+	journal := RestoreJournal{file: file, done: make(map[string]bool)}
+	err = journal.read()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &journal, nil
+}
+
+func (j *RestoreJournal) read() error {
+	reader := bufio.NewReader(j.file)
+	var offset int64
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return util.Fatalf("failed reading journal: %w", err)
+		}
+		complete := bytes.HasSuffix(line, []byte("\n"))
+		if lineNumber == 1 {
+			if !complete || json.Unmarshal(line, &j.Header) != nil || j.Header.Format != JOURNAL_FORMAT {
+				return util.Fatalf("not a restore journal")
+			}
+			if j.Header.Version > JOURNAL_VERSION {
+				return util.Fatalf("unsupported journal version %d; maximum is %d", j.Header.Version, JOURNAL_VERSION)
+			}
+			err = j.Header.Dump.Validate()
+			if err != nil {
+				return err
+			}
+		} else if complete {
+			entry := JournalEntry{}
+			if json.Unmarshal(line, &entry) != nil {
+				return util.Fatalf("failed decoding journal line %d", lineNumber)
+			}
+			if entry.Error == "" {
+				j.done[entry.key()] = true
+			}
+		}
+		if !complete {
+			break
+		}
+		offset += int64(len(line))
+	}
+	err := j.file.Truncate(offset)
+	if err == nil {
+		_, err = j.file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		return util.Fatalf("failed opening journal for append: %w", err)
+	}
+	return nil
+}
+
+func (j *RestoreJournal) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return util.Fatalf("failed encoding journal entry: %w", err)
+	}
+	_, err = j.file.Write(append(data, '\n'))
+	if err != nil {
+		return util.Fatalf("failed writing journal: %w", err)
+	}
+	return nil
+}
+
+// Done reports whether the journal records entry as completed
+func (j *RestoreJournal) Done(entry JournalEntry) bool {
+	if j == nil {
+		return false
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.done[entry.key()]
+}
+
+// Record appends entry to the journal
+func (j *RestoreJournal) Record(entry JournalEntry) error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entry.Time = time.Now().UTC()
+	err := j.write(&entry)
+	if err != nil {
+		return err
+	}
+	if entry.Error == "" {
+		j.done[entry.key()] = true
+	}
+	return nil
+}
+
+// Close closes the journal file
+func (j *RestoreJournal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+type RestoreResponse struct {
+	Response
+	Restored int            `json:"restored"`
+	Skipped  int            `json:"skipped"`
+	Failures []JournalEntry `json:"failures"`
+}
+
+// RestoreReport collects the outcome of each restore step and records it in
+// the journal.  It is safe for concurrent use.
+type RestoreReport struct {
+	mutex    sync.Mutex
+	journal  *RestoreJournal
+	response RestoreResponse
+	err      error
+}
+
+func NewRestoreReport(journal *RestoreJournal, request string) *RestoreReport {
+	return &RestoreReport{
+		journal:  journal,
+		response: RestoreResponse{Response: Response{Request: request}, Failures: []JournalEntry{}},
+	}
+}
+
+// Done reports whether the journal shows entry was completed by an earlier
+// run, counting it as skipped if so
+func (r *RestoreReport) Done(entry JournalEntry) bool {
+	if !r.journal.Done(entry) {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.response.Skipped++
+	return true
+}
+
+// Record notes the outcome of a step, returning err
+func (r *RestoreReport) Record(entry JournalEntry, err error) error {
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	journalErr := r.journal.Record(entry)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if journalErr != nil && r.err == nil {
+		r.err = journalErr
+	}
+	if err != nil {
+		r.response.Failures = append(r.response.Failures, entry)
+	} else {
+		r.response.Restored++
+	}
+	return err
+}
+
+// Skip notes a step which needed no change, such as a card already present
+func (r *RestoreReport) Skip(entry JournalEntry) {
+	journalErr := r.journal.Record(entry)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if journalErr != nil && r.err == nil {
+		r.err = journalErr
+	}
+	r.response.Skipped++
+}
+
+// Result returns the response.  If any step failed the response, listing
+// every failure, is returned along with an ErrRestoreIncomplete error.
+func (r *RestoreReport) Result() (*RestoreResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	ret := r.response
+	if len(ret.Failures) > 0 {
+		ret.Message = fmt.Sprintf("%d failures", len(ret.Failures))
+		return &ret, fmt.Errorf("%w: %d failures", ErrRestoreIncomplete, len(ret.Failures))
+	}
+	ret.Success = true
+	ret.Message = "restored"
+	return &ret, nil
+}
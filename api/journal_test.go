@@ -0,0 +1,52 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreJournal(t *testing.T) {
+
+	api, server := initController(t, "user@example.org", testBooks{"friends": {"one@example.com", "two@example.com", "three@example.com"}})
+	ctx := context.Background()
+
+	before, err := api.Dump("")
+	require.Nil(t, err)
+	_, err = api.Clear()
+	require.Nil(t, err)
+
+	filename := filepath.Join(t.TempDir(), "journal")
+	journal, err := CreateJournal(filename, &before.Dump, RESTORE_REPLACE, "")
+	require.Nil(t, err)
+	_, err = CreateJournal(filename, &before.Dump, RESTORE_REPLACE, "")
+	require.NotNil(t, err)
+
+	// a failed card is reported and the remaining cards are still restored
+	server.FailNextMethod(http.MethodPut, 400)
+	response, err := api.RestoreCtx(ctx, &before.Dump, "", journal)
+	require.ErrorIs(t, err, ErrRestoreIncomplete)
+	require.False(t, response.Success)
+	require.Len(t, response.Failures, 1)
+	require.Equal(t, PLAN_CARD, response.Failures[0].Kind)
+	require.NotEmpty(t, response.Failures[0].Error)
+	require.Equal(t, 4, response.Restored)
+	require.Nil(t, journal.Close())
+
+	journal, err = OpenJournal(filename)
+	require.Nil(t, err)
+	require.Equal(t, RESTORE_REPLACE, journal.Header.Mode)
+	response, err = api.RestoreCtx(ctx, &journal.Header.Dump, journal.Header.User, journal)
+	require.Nil(t, err)
+	require.True(t, response.Success)
+	require.Equal(t, 1, response.Restored)
+	require.Equal(t, 4, response.Skipped)
+	require.Nil(t, journal.Close())
+
+	after, err := api.Dump("")
+	require.Nil(t, err)
+	require.Empty(t, DiffDumps(&before.Dump, &after.Dump))
+}
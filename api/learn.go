@@ -0,0 +1,246 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rstms/mabctl/util"
+)
+
+const DEFAULT_LEARN_BOOK = "collected"
+
+// DEFAULT_LEARN_EXCLUDE matches automated addresses that are not worth
+// learning
+var DEFAULT_LEARN_EXCLUDE = []string{
+	"noreply@*", "no-reply@*", "donotreply@*", "do-not-reply@*",
+	"mailer-daemon@*", "postmaster@*", "*-bounces@*",
+}
+
+// the recipient headers read from a message
+var learnHeaders = []string{"To", "Cc", "Bcc"}
+
+// LearnOptions controls Learn.  Exclude holds glob patterns, as accepted by
+// path.Match, matched against the lowercase address; with Create, a
+// missing book is created.
+type LearnOptions struct {
+	Exclude []string
+	Create  bool
+	DryRun  bool
+}
+
+// ReadRecipients returns the To, Cc and Bcc addresses of an RFC 5322
+// message as records numbered record, with the display name of each.
+// Addresses that cannot be parsed are returned with a Reason.
+func ReadRecipients(r io.Reader, record int) ([]ImportRecord, error) {
+	message, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, util.Fatalf("failed reading message: %w", err)
+	}
+	records := []ImportRecord{}
+	for _, header := range learnHeaders {
+		for _, value := range message.Header[header] {
+			addrs, err := mail.ParseAddressList(value)
+			if err != nil {
+				records = append(records, parseRecipients(value, record)...)
+				continue
+			}
+			for _, addr := range addrs {
+				records = append(records, recipientRecord(addr, record))
+			}
+		}
+	}
+	return records, nil
+}
+
+// parseRecipients parses the addresses of a malformed header one at a time
+// so that one bad address does not hide the others
+func parseRecipients(value string, record int) []ImportRecord {
+	records := []ImportRecord{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		addr, err := mail.ParseAddress(part)
+		if err != nil {
+			records = append(records, ImportRecord{Record: record, Email: part, Reason: "invalid address"})
+			continue
+		}
+		records = append(records, recipientRecord(addr, record))
+	}
+	return records
+}
+
+// recipientRecord returns the record for an address, cleaning up the
+// display name
+func recipientRecord(addr *mail.Address, record int) ImportRecord {
+	name := strings.TrimSpace(strings.Trim(strings.TrimSpace(addr.Name), `"'`))
+	if strings.EqualFold(name, addr.Address) {
+		name = ""
+	}
+	return ImportRecord{Record: record, Email: addr.Address, Name: name}
+}
+
+// ReadMaildir returns the recipients of the messages in the cur and new
+// subdirectories of a Maildir folder modified since the given time,
+// numbering the messages in filename order.  Messages that cannot be
+// parsed are skipped.
+func ReadMaildir(dir string, since time.Time) ([]ImportRecord, error) {
+	files := []string{}
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, util.Fatalf("failed reading maildir: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					// removed since the directory was read
+					continue
+				}
+				return nil, util.Fatalf("failed reading maildir: %w", err)
+			}
+			if info.ModTime().Before(since) {
+				continue
+			}
+			files = append(files, filepath.Join(dir, sub, entry.Name()))
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+	records := []ImportRecord{}
+	for i, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, util.Fatalf("failed reading message: %w", err)
+		}
+		found, err := ReadRecipients(bytes.NewReader(data), i+1)
+		if err != nil {
+			log.Printf("learn: skipping %s: %v", file, err)
+			continue
+		}
+		records = append(records, found...)
+	}
+	return records, nil
+}
+
+// learnExcluded returns the exclude pattern matching email, if any
+func learnExcluded(patterns []string, email string) string {
+	email = strings.ToLower(email)
+	for _, pattern := range patterns {
+		matched, _ := path.Match(strings.ToLower(pattern), email)
+		if matched {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// Learn adds the recipients in records to a book of username, skipping the
+// user's own address, addresses matching an exclude pattern, addresses
+// already in the book and repeated addresses.
+func Learn(ctx context.Context, mab AddressBookManager, username, bookname string, records []ImportRecord, options LearnOptions) (*ImportResponse, error) {
+	for _, pattern := range options.Exclude {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, util.Fatalf("invalid exclude pattern '%s': %w", pattern, err)
+		}
+	}
+	missing := false
+	if options.Create {
+		_, err := mab.GetBookCtx(ctx, username, bookname)
+		switch {
+		case errors.Is(err, ErrBookNotFound):
+			missing = true
+		case err != nil:
+			return nil, err
+		}
+		if missing && !options.DryRun {
+			_, err = mab.AddBookCtx(ctx, username, bookname, "")
+			if err != nil {
+				return nil, err
+			}
+			missing = false
+		}
+	}
+
+	skipped := []ImportRecord{}
+	learn := []ImportRecord{}
+	for _, record := range records {
+		if record.Reason == "" {
+			if strings.EqualFold(record.Email, username) {
+				record.Reason = "sender"
+			} else if pattern := learnExcluded(options.Exclude, record.Email); pattern != "" {
+				record.Reason = fmt.Sprintf("excluded by %s", pattern)
+			}
+			if record.Reason != "" {
+				skipped = append(skipped, record)
+				continue
+			}
+		}
+		learn = append(learn, record)
+	}
+	var ret *ImportResponse
+	if missing {
+		ret = learnNewBook(username, bookname, learn)
+	} else {
+		var err error
+		ret, err = Import(ctx, mab, username, bookname, learn, options.DryRun)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ret.Request = fmt.Sprintf("learn %s %s", username, bookname)
+	ret.Skipped = append(skipped, ret.Skipped...)
+	verb := "added"
+	if options.DryRun {
+		verb = "would add"
+	}
+	ret.Message = fmt.Sprintf("%s %d, skipped %d, invalid %d", verb, len(ret.Added), len(ret.Skipped), len(ret.Invalid))
+	return ret, nil
+}
+
+// learnNewBook returns the result of a dry run adding records to a book
+// that does not exist yet
+func learnNewBook(username, bookname string, records []ImportRecord) *ImportResponse {
+	ret := ImportResponse{
+		Response: Response{Success: true, User: username},
+		Added:    []ImportRecord{},
+		Skipped:  []ImportRecord{},
+		Invalid:  []ImportRecord{},
+	}
+	seen := make(map[string]int)
+	for _, record := range records {
+		key := strings.ToLower(record.Email)
+		switch first, ok := seen[key]; {
+		case record.Reason != "":
+			ret.Invalid = append(ret.Invalid, record)
+		case ok:
+			record.Reason = fmt.Sprintf("duplicate of record %d", first)
+			ret.Skipped = append(ret.Skipped, record)
+		default:
+			seen[key] = record.Record
+			ret.Added = append(ret.Added, record)
+		}
+	}
+	return &ret
+}
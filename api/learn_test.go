@@ -0,0 +1,30 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadRecipients(t *testing.T) {
+
+	message := "From: user@example.org\r\n" +
+		"To: \"Good Friend\" <friend@example.com>, =?utf-8?q?J=C3=BCrgen_M=C3=BCller?= <jurgen@example.de>\r\n" +
+		"Cc: 'Pal' <pal@example.com>, broken@, other@example.com\r\n" +
+		"Bcc: Self <self@example.com>\r\n" +
+		"Subject: test\r\n\r\nbody\r\n"
+	records, err := ReadRecipients(strings.NewReader(message), 7)
+	require.Nil(t, err)
+	require.Equal(t, []ImportRecord{
+		{Record: 7, Email: "friend@example.com", Name: "Good Friend"},
+		{Record: 7, Email: "jurgen@example.de", Name: "Jürgen Müller"},
+		{Record: 7, Email: "pal@example.com", Name: "Pal"},
+		{Record: 7, Email: "broken@", Reason: "invalid address"},
+		{Record: 7, Email: "other@example.com"},
+		{Record: 7, Email: "self@example.com", Name: "Self"},
+	}, records)
+
+	_, err = ReadRecipients(strings.NewReader("not a message"), 1)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type lookupEntry struct {
+	books   []string
+	expires time.Time
+}
+
+// senderLookup finds the books of a recipient containing a sender for the
+// policy and milter servers.  Results, and the list of users, are cached
+// for ttl, holding at most size results.
+type senderLookup struct {
+	mab         AddressBookManager
+	ttl         time.Duration
+	size        int
+	mutex       sync.Mutex
+	cache       map[string]lookupEntry
+	users       map[string]string
+	usersExpire time.Time
+}
+
+func newSenderLookup(mab AddressBookManager, ttl time.Duration, size int) *senderLookup {
+	return &senderLookup{
+		mab:   mab,
+		ttl:   ttl,
+		size:  size,
+		cache: make(map[string]lookupEntry),
+	}
+}
+
+// lookup returns the names of the recipient's books containing sender, or
+// none if the recipient is not a user.  The recipient is matched to a user
+// ignoring case.
+func (l *senderLookup) lookup(ctx context.Context, recipient, sender string) ([]string, error) {
+	username, err := l.username(ctx, recipient)
+	if err != nil || username == "" {
+		return nil, err
+	}
+	key := username + "\x00" + sender
+	now := time.Now()
+	l.mutex.Lock()
+	entry, ok := l.cache[key]
+	l.mutex.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.books, nil
+	}
+	response, err := l.mab.ScanAddressCtx(ctx, username, sender)
+	if err != nil {
+		return nil, err
+	}
+	if !response.Success {
+		return nil, fmt.Errorf("%s", response.Message)
+	}
+	books := make([]string, len(response.Books))
+	for i, book := range response.Books {
+		books[i] = strings.NewReplacer("\r", "", "\n", "").Replace(book.BookName)
+	}
+	l.store(key, lookupEntry{books: books, expires: now.Add(l.ttl)})
+	return books, nil
+}
+
+// store caches an entry, first discarding expired entries and then
+// arbitrary ones if the cache is full
+func (l *senderLookup) store(key string, entry lookupEntry) {
+	if l.ttl <= 0 || l.size <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.cache) >= l.size {
+		now := time.Now()
+		for k, e := range l.cache {
+			if !now.Before(e.expires) {
+				delete(l.cache, k)
+			}
+		}
+		for k := range l.cache {
+			if len(l.cache) < l.size {
+				break
+			}
+			delete(l.cache, k)
+		}
+	}
+	l.cache[key] = entry
+}
+
+// username returns the name of the user equal to recipient ignoring case,
+// as the server stores it, or an empty string if there is none.  The cached
+// list of users is refreshed when it expires.
+func (l *senderLookup) username(ctx context.Context, recipient string) (string, error) {
+	l.mutex.Lock()
+	users := l.users
+	expired := !time.Now().Before(l.usersExpire)
+	l.mutex.Unlock()
+	if users == nil || expired {
+		response, err := l.mab.GetUsersCtx(ctx)
+		if err != nil {
+			return "", err
+		}
+		users = make(map[string]string)
+		for _, user := range response.Users {
+			users[strings.ToLower(user.UserName)] = user.UserName
+		}
+		l.mutex.Lock()
+		l.users = users
+		l.usersExpire = time.Now().Add(l.ttl)
+		l.mutex.Unlock()
+	}
+	return users[strings.ToLower(recipient)], nil
+}
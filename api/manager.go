@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav/carddav"
+)
+
+// AddressBookManager is the set of address book operations provided by
+// Controller.  Consumers should depend on this interface rather than the
+// concrete type so an alternate implementation (see the memory package)
+// can be substituted in tests.
+type AddressBookManager interface {
+	InitializeCtx(ctx context.Context) (*Response, error)
+	ResetCtx(ctx context.Context) (*Response, error)
+	GetStatusCtx(ctx context.Context) (*StatusResponse, error)
+	GetUptimeCtx(ctx context.Context) (*Response, error)
+	RequestShutdownCtx(ctx context.Context) (*Response, error)
+
+	GetUsersCtx(ctx context.Context) (*UsersResponse, error)
+	GetUserBooksCtx(ctx context.Context) (*UserBooksResponse, error)
+	AddUserCtx(ctx context.Context, username, display, password string) (*AddUserResponse, error)
+	DeleteUserCtx(ctx context.Context, username string) (*Response, error)
+	GetPasswordCtx(ctx context.Context, username string) (*AccountResponse, error)
+
+	GetBooksCtx(ctx context.Context, username string) (*BooksResponse, error)
+	GetBookCtx(ctx context.Context, username, bookname string) (*Book, error)
+	AddBookCtx(ctx context.Context, username, bookname, description string) (*AddBookResponse, error)
+	DeleteBookCtx(ctx context.Context, username, bookname string) (*Response, error)
+
+	AddressesCtx(ctx context.Context, username, bookname string) (*AddressesResponse, error)
+	CardsCtx(ctx context.Context, username, bookname string) (*CardsResponse, error)
+	SyncAddressBookCtx(ctx context.Context, username, bookname string) (*SyncResponse, error)
+	AddAddressCtx(ctx context.Context, username, bookname, email, name string) (*AddressResponse, error)
+	AddAddressIfCtx(ctx context.Context, username, bookname, email, name string, cond Precondition) (*AddressResponse, error)
+	DeleteAddressCtx(ctx context.Context, username, bookname, email string) (*AddressesResponse, error)
+	DeleteAddressIfCtx(ctx context.Context, username, bookname, email string, cond Precondition) (*AddressesResponse, error)
+	QueryAddressCtx(ctx context.Context, username, bookname, email string) (*AddressResponse, error)
+	FindAddressCtx(ctx context.Context, username, bookname, email string) (*AddressResponse, error)
+	ScanAddressCtx(ctx context.Context, username, email string) (*BooksResponse, error)
+	EmailAddress(addr carddav.AddressObject) (string, error)
+
+	GetContactCtx(ctx context.Context, username, bookname, id string) (*ContactResponse, error)
+	PutContactCtx(ctx context.Context, username, bookname string, contact *Contact) (*ContactResponse, error)
+	UpdateContactCtx(ctx context.Context, username, bookname, id string, update *Contact) (*ContactResponse, error)
+	PutCardCtx(ctx context.Context, username, bookname string, card vcard.Card, cond Precondition) (*AddressResponse, error)
+	DeleteCardCtx(ctx context.Context, username, bookname, uid string, cond Precondition) (*Response, error)
+	PutObjectCtx(ctx context.Context, username, bookname, path string, card vcard.Card, cond Precondition) (*AddressResponse, error)
+	DeleteObjectCtx(ctx context.Context, username, bookname, path string, cond Precondition) (*Response, error)
+
+	GetAccountsCtx(ctx context.Context) (*UserAccountsResponse, error)
+	SetAccountsCtx(ctx context.Context, request *UserAccountsRequest) (*UserAccountsResponse, error)
+
+	DumpCtx(ctx context.Context, dumpUser string) (*DumpResponse, error)
+	RestoreCtx(ctx context.Context, dump *DumpFile, restoreUser string, journal *RestoreJournal) (*RestoreResponse, error)
+	ClearCtx(ctx context.Context) (*Response, error)
+
+	// Events returns the emitter reporting the progress of long operations
+	Events() *Emitter
+}
+
+var _ AddressBookManager = (*Controller)(nil)
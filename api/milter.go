@@ -0,0 +1,346 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rstms/mabctl/util"
+	"github.com/spf13/viper"
+)
+
+const DEFAULT_MILTER_LISTEN = "127.0.0.1:10041"
+const DEFAULT_MILTER_HEADER = "X-Address-Book"
+
+// milter protocol commands sent by the MTA
+const (
+	milterAbort    = 'A'
+	milterBody     = 'B'
+	milterConnect  = 'C'
+	milterMacro    = 'D'
+	milterBodyEOB  = 'E'
+	milterHelo     = 'H'
+	milterQuitNC   = 'K'
+	milterHeader   = 'L'
+	milterMail     = 'M'
+	milterEOH      = 'N'
+	milterOptNeg   = 'O'
+	milterQuit     = 'Q'
+	milterRcpt     = 'R'
+	milterData     = 'T'
+	milterUnknown  = 'U'
+	milterContinue = 'c'
+	milterAddHdr   = 'h'
+	milterChgHdr   = 'm'
+)
+
+// milter protocol negotiation flags
+const (
+	milterVersion      = 6
+	milterActAddHdrs   = 0x01
+	milterActChgHdrs   = 0x10
+	milterNoConnect    = 0x01
+	milterNoHelo       = 0x02
+	milterNoBody       = 0x10
+	milterNoUnknown    = 0x100
+	milterNoData       = 0x200
+	milterSkipCommands = milterNoConnect | milterNoHelo | milterNoBody | milterNoUnknown | milterNoData
+)
+
+// the largest milter packet accepted
+const milterMaxPacket = 1024 * 1024
+
+// MilterConfig sets the header added by a MilterServer.  In Value, {book}
+// is replaced by the first of a recipient's books containing the sender,
+// {books} by all of them separated by commas, and {sender} and {recipient}
+// by the addresses.  Every recipient of a message sees all of its headers,
+// so that one recipient cannot learn the book names of another a header is
+// added only to a message with a single envelope recipient.  With Strip, headers named Header in
+// the incoming message are removed so senders cannot forge them.
+type MilterConfig struct {
+	Header    string
+	Value     string
+	Strip     bool
+	CacheTTL  time.Duration
+	CacheSize int
+}
+
+// NewMilterConfig returns the defaults
+func NewMilterConfig() MilterConfig {
+	return MilterConfig{
+		Header:    DEFAULT_MILTER_HEADER,
+		Value:     "{book}",
+		Strip:     true,
+		CacheTTL:  DEFAULT_POLICY_CACHE_TTL,
+		CacheSize: DEFAULT_POLICY_CACHE_SIZE,
+	}
+}
+
+// MilterServer is a Sendmail/Postfix milter adding a header to a message
+// with one envelope recipient whose address books contain the envelope sender or an
+// address of the From header.  Lookups, and the list of users, are cached
+// for CacheTTL.
+type MilterServer struct {
+	books  *senderLookup
+	config MilterConfig
+	mutex  sync.Mutex
+	conns  map[net.Conn]bool
+	wg     sync.WaitGroup
+}
+
+func NewMilterServer(mab AddressBookManager, config MilterConfig) *MilterServer {
+	return &MilterServer{
+		books:  newSenderLookup(mab, config.CacheTTL, config.CacheSize),
+		config: config,
+		conns:  make(map[net.Conn]bool),
+	}
+}
+
+// milterMessage is the state of the message being received
+type milterMessage struct {
+	sender     string
+	from       []string
+	recipients []string
+	headers    int
+}
+
+// Serve answers connections on listener until ctx is done
+func (s *MilterServer) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		s.mutex.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mutex.Unlock()
+	}()
+	defer s.wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return util.Fatalf("milter accept failed: %w", err)
+		}
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			err := s.handle(ctx, conn)
+			if err != nil && !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				log.Printf("milter: %v", err)
+			}
+			s.mutex.Lock()
+			delete(s.conns, conn)
+			s.mutex.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// readMilterPacket returns the command and data of the next packet
+func readMilterPacket(r io.Reader) (byte, []byte, error) {
+	var length uint32
+	err := binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length < 1 || length > milterMaxPacket {
+		return 0, nil, util.Fatalf("invalid milter packet length %d", length)
+	}
+	packet := make([]byte, length)
+	_, err = io.ReadFull(r, packet)
+	if err != nil {
+		return 0, nil, util.Fatalf("milter packet read failed: %w", err)
+	}
+	return packet[0], packet[1:], nil
+}
+
+func writeMilterPacket(w io.Writer, command byte, data []byte) error {
+	packet := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(data)))
+	packet[4] = command
+	_, err := w.Write(append(packet, data...))
+	return err
+}
+
+// milterStrings splits NUL terminated strings
+func milterStrings(data []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+}
+
+// milterAddress returns the address of a MAIL or RCPT command argument
+func milterAddress(data []byte) string {
+	address := milterStrings(data)[0]
+	return strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(address, "<"), ">"))
+}
+
+// handle answers the commands on a connection until the MTA closes it
+func (s *MilterServer) handle(ctx context.Context, conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	message := milterMessage{}
+	for {
+		command, data, err := readMilterPacket(reader)
+		if err != nil {
+			return err
+		}
+		switch command {
+		case milterOptNeg:
+			err = s.negotiate(conn, data)
+		case milterMacro:
+			// macros need no reply
+		case milterAbort, milterQuitNC:
+			message = milterMessage{}
+		case milterQuit:
+			return nil
+		case milterMail:
+			message = milterMessage{sender: milterAddress(data)}
+			err = writeMilterPacket(conn, milterContinue, nil)
+		case milterRcpt:
+			message.recipients = append(message.recipients, milterAddress(data))
+			err = writeMilterPacket(conn, milterContinue, nil)
+		case milterHeader:
+			fields := append(milterStrings(data), "")
+			switch {
+			case strings.EqualFold(fields[0], s.config.Header):
+				message.headers++
+			case strings.EqualFold(fields[0], "From"):
+				addrs, err := mail.ParseAddressList(fields[1])
+				if err == nil {
+					for _, addr := range addrs {
+						message.from = append(message.from, strings.ToLower(addr.Address))
+					}
+				}
+			}
+			err = writeMilterPacket(conn, milterContinue, nil)
+		case milterBodyEOB:
+			err = s.endMessage(ctx, conn, &message)
+			message = milterMessage{}
+		case milterConnect, milterHelo, milterEOH, milterBody, milterData, milterUnknown:
+			err = writeMilterPacket(conn, milterContinue, nil)
+		default:
+			return util.Fatalf("unknown milter command '%c'", command)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// negotiate replies to the MTA's options with the actions needed and the
+// commands that may be skipped
+func (s *MilterServer) negotiate(conn net.Conn, data []byte) error {
+	if len(data) < 12 {
+		return util.Fatalf("invalid milter option negotiation")
+	}
+	version := binary.BigEndian.Uint32(data[0:])
+	actions := binary.BigEndian.Uint32(data[4:])
+	protocol := binary.BigEndian.Uint32(data[8:])
+	if version < 2 {
+		return util.Fatalf("unsupported milter protocol version %d", version)
+	}
+	want := uint32(milterActAddHdrs)
+	if s.config.Strip {
+		want |= milterActChgHdrs
+	}
+	if actions&want != want {
+		return util.Fatalf("MTA does not permit adding and changing headers")
+	}
+	reply := make([]byte, 12)
+	binary.BigEndian.PutUint32(reply[0:], min(version, milterVersion))
+	binary.BigEndian.PutUint32(reply[4:], want)
+	binary.BigEndian.PutUint32(reply[8:], protocol&milterSkipCommands)
+	return writeMilterPacket(conn, milterOptNeg, reply)
+}
+
+// endMessage removes forged headers and adds a header if the recipient's
+// books contain a sender address
+func (s *MilterServer) endMessage(ctx context.Context, conn net.Conn, message *milterMessage) error {
+	if s.config.Strip {
+		for i := message.headers; i > 0; i-- {
+			data := binary.BigEndian.AppendUint32(nil, uint32(i))
+			data = append(data, s.config.Header+"\x00\x00"...)
+			err := writeMilterPacket(conn, milterChgHdr, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, value := range s.Values(ctx, message.sender, message.from, message.recipients) {
+		err := writeMilterPacket(conn, milterAddHdr, []byte(s.config.Header+"\x00"+value+"\x00"))
+		if err != nil {
+			return err
+		}
+	}
+	return writeMilterPacket(conn, milterContinue, nil)
+}
+
+// Values returns the header values for a message from sender, with the From
+// header addresses from, to recipients.  A message with several recipients
+// gets no headers, as one recipient must not learn the book names of
+// another.
+func (s *MilterServer) Values(ctx context.Context, sender string, from, recipients []string) []string {
+	senders := []string{}
+	for _, address := range append([]string{sender}, from...) {
+		if address != "" && !slices.Contains(senders, address) {
+			senders = append(senders, address)
+		}
+	}
+	distinct := []string{}
+	for _, recipient := range recipients {
+		if !slices.Contains(distinct, recipient) {
+			distinct = append(distinct, recipient)
+		}
+	}
+	values := []string{}
+	if len(distinct) != 1 {
+		if viper.GetBool("verbose") {
+			log.Printf("milter: sender=%s has %d recipients; not adding %s", sender, len(distinct), s.config.Header)
+		}
+		return values
+	}
+	recipient := distinct[0]
+	books := []string{}
+	matched := ""
+	for _, address := range senders {
+		found, err := s.books.lookup(ctx, recipient, address)
+		if err != nil {
+			log.Printf("milter: lookup %s in %s failed: %v", address, recipient, err)
+			continue
+		}
+		for _, book := range found {
+			if !slices.Contains(books, book) {
+				books = append(books, book)
+			}
+		}
+		if len(found) > 0 && matched == "" {
+			matched = address
+		}
+	}
+	if len(books) == 0 {
+		return values
+	}
+	value := strings.NewReplacer(
+		"{book}", books[0],
+		"{books}", strings.Join(books, ","),
+		"{sender}", matched,
+		"{recipient}", recipient,
+	).Replace(s.config.Value)
+	if viper.GetBool("verbose") {
+		log.Printf("milter: sender=%s recipient=%s %s: %s", matched, recipient, s.config.Header, value)
+	}
+	return append(values, value)
+}
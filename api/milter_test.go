@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMilterServer(t *testing.T) {
+
+	username := "user@example.org"
+	api, _ := initController(t, username, testBooks{"friends": {"friend@example.com"}, "family": {"mom@example.com"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listener, err := PolicyListen(filepath.Join(t.TempDir(), "milter.sock"))
+	require.Nil(t, err)
+	server := NewMilterServer(api, NewMilterConfig())
+	done := make(chan error)
+	go func() {
+		done <- server.Serve(ctx, listener)
+	}()
+
+	conn, err := net.Dial("unix", listener.Addr().String())
+	require.Nil(t, err)
+	send := func(command byte, fields ...string) {
+		data := []byte{}
+		for _, field := range fields {
+			data = append(data, field+"\x00"...)
+		}
+		require.Nil(t, writeMilterPacket(conn, command, data))
+	}
+	expect := func(command byte) []byte {
+		c, data, err := readMilterPacket(conn)
+		require.Nil(t, err)
+		require.Equal(t, string(command), string(c))
+		return data
+	}
+
+	options := []byte{0, 0, 0, 6, 0, 0, 0x01, 0xff, 0, 0, 0x03, 0xff}
+	require.Nil(t, writeMilterPacket(conn, milterOptNeg, options))
+	reply := expect(milterOptNeg)
+	require.Equal(t, []byte{0, 0, 0, 6, 0, 0, 0, 0x11, 0, 0, 0x03, 0x13}, reply)
+
+	message := func(sender, from string, recipients ...string) []string {
+		send(milterMacro, "M", "i", "ABC123")
+		send(milterMail, "<"+sender+">", "SIZE=100")
+		expect(milterContinue)
+		for _, recipient := range recipients {
+			send(milterRcpt, "<"+recipient+">")
+			expect(milterContinue)
+		}
+		send(milterHeader, "From", from)
+		expect(milterContinue)
+		send(milterHeader, "X-Address-Book", "forged")
+		expect(milterContinue)
+		send(milterEOH)
+		expect(milterContinue)
+		send(milterBodyEOB)
+		require.Equal(t, "\x00\x00\x00\x01X-Address-Book\x00\x00", string(expect(milterChgHdr)))
+		headers := []string{}
+		for {
+			c, data, err := readMilterPacket(conn)
+			require.Nil(t, err)
+			if c == milterContinue {
+				return headers
+			}
+			require.Equal(t, string(milterAddHdr), string(c))
+			headers = append(headers, strings.Join(milterStrings(data), ": "))
+		}
+	}
+
+	require.Equal(t, []string{"X-Address-Book: friends"}, message("Friend@example.com", "Someone <someone@example.net>", username))
+	// other recipients would see the books of username
+	require.Empty(t, message("friend@example.com", "friend@example.com", username, "other@example.org"))
+	require.Equal(t, []string{"X-Address-Book: family"}, message("bounces@list.example.com", "Mom <mom@example.com>", username))
+	require.Empty(t, message("stranger@example.com", "stranger@example.com", username))
+
+	send(milterMail, "<friend@example.com>")
+	expect(milterContinue)
+	send(milterAbort)
+	send(milterQuit)
+	_, _, err = readMilterPacket(conn)
+	require.ErrorIs(t, err, io.EOF)
+
+	conn.Close()
+	cancel()
+	require.Nil(t, <-done)
+}
+
+func TestMilterValues(t *testing.T) {
+
+	username := "user@example.org"
+	api, _ := initController(t, username, testBooks{"friends": {"friend@example.com"}})
+	addTestUser(t, api, "other@example.org", testBooks{"work": {"friend@example.com"}})
+	ctx := context.Background()
+	recipients := []string{username, "other@example.org", username}
+
+	server := NewMilterServer(api, NewMilterConfig())
+	require.Empty(t, server.Values(ctx, "friend@example.com", nil, recipients))
+	require.Equal(t, []string{"friends"}, server.Values(ctx, "friend@example.com", nil, recipients[2:]))
+
+	// naming the recipient in the value does not hide the headers of one
+	// recipient from another
+	config := NewMilterConfig()
+	config.Value = "{recipient} {book}"
+	server = NewMilterServer(api, config)
+	require.Empty(t, server.Values(ctx, "friend@example.com", nil, recipients))
+	require.Equal(t, []string{username + " friends"}, server.Values(ctx, "friend@example.com", nil, recipients[2:]))
+	require.Equal(t, []string{"other@example.org work"}, server.Values(ctx, "friend@example.com", nil, recipients[1:2]))
+}
@@ -0,0 +1,623 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-vcard"
+	"github.com/rstms/mabctl/util"
+	"github.com/spf13/viper"
+)
+
+const PLAN_FORMAT = "mabctl-plan"
+const PLAN_VERSION = 1
+
+// restore modes
+const (
+	RESTORE_MERGE   = "merge"
+	RESTORE_REPLACE = "replace"
+	RESTORE_SYNC    = "sync"
+)
+
+var RESTORE_MODES = []string{RESTORE_MERGE, RESTORE_REPLACE, RESTORE_SYNC}
+
+// plan step actions
+const (
+	PLAN_CREATE = "create"
+	PLAN_DELETE = "delete"
+	PLAN_UPDATE = "update"
+	PLAN_KEEP   = "keep"
+)
+
+// plan step kinds
+const (
+	PLAN_USER = "user"
+	PLAN_BOOK = "book"
+	PLAN_CARD = "card"
+)
+
+// PlanStep is a single change to the server; Emails identifies a card for
+// the reader and is not used when the step is applied.  Path and ETag
+// locate the live card a delete or update step changes, which need not be
+// stored at the path derived from its UID.
+type PlanStep struct {
+	Action   string   `json:"action"`
+	Kind     string   `json:"kind"`
+	Username string   `json:"username"`
+	Bookname string   `json:"bookname,omitempty"`
+	UID      string   `json:"uid,omitempty"`
+	Emails   []string `json:"emails,omitempty"`
+	Path     string   `json:"path,omitempty"`
+	ETag     string   `json:"etag,omitempty"`
+}
+
+// Plan is the ordered list of steps which restores Dump.  The dump is
+// embedded so a saved plan can be applied without the original file.
+type Plan struct {
+	Format  string     `json:"format"`
+	Version int        `json:"version"`
+	Created time.Time  `json:"created"`
+	Mode    string     `json:"mode"`
+	User    string     `json:"user,omitempty"`
+	Steps   []PlanStep `json:"steps"`
+	Dump    DumpFile   `json:"dump"`
+}
+
+// planBuilder accumulates steps while comparing the dump to the live state
+type planBuilder struct {
+	plan *Plan
+}
+
+func (b *planBuilder) add(action, kind, username, bookname string, card *DumpCard) error {
+	step := PlanStep{Action: action, Kind: kind, Username: username, Bookname: bookname}
+	if card != nil {
+		parsed, err := card.Card()
+		if err != nil {
+			return err
+		}
+		step.UID = card.UID
+		step.Emails = parsed.Values(vcard.FieldEmail)
+	}
+	b.plan.Steps = append(b.plan.Steps, step)
+	return nil
+}
+
+// locate sets the path and ETag of the live card changed by the last step
+func (b *planBuilder) locate(live DumpCard) {
+	step := &b.plan.Steps[len(b.plan.Steps)-1]
+	step.Path = live.Path
+	step.ETag = live.ETag
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func cardIndex(cards []DumpCard) map[string]DumpCard {
+	ret := make(map[string]DumpCard)
+	for _, card := range cards {
+		ret[card.UID] = card
+	}
+	return ret
+}
+
+// restoredBooks returns the sorted names of the books of a dump user which
+// are restored, leaving out the default book
+func restoredBooks(user DumpUser) []string {
+	ret := []string{}
+	for _, bookname := range sortedKeys(user.Books) {
+		if !IsDefaultBook(bookname) {
+			ret = append(ret, bookname)
+		}
+	}
+	return ret
+}
+
+// createUser adds the steps creating a user with all of its books and cards
+func (b *planBuilder) createUser(username string, user DumpUser) error {
+	err := b.add(PLAN_CREATE, PLAN_USER, username, "", nil)
+	if err != nil {
+		return err
+	}
+	for _, bookname := range restoredBooks(user) {
+		err := b.createBook(username, bookname, user.Books[bookname])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *planBuilder) createBook(username, bookname string, book DumpBook) error {
+	err := b.add(PLAN_CREATE, PLAN_BOOK, username, bookname, nil)
+	if err != nil {
+		return err
+	}
+	for _, card := range book.Cards {
+		err := b.add(PLAN_CREATE, PLAN_CARD, username, bookname, &card)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cardEmail returns the lowercased preferred email address of a card, or
+// an empty string if it has none or cannot be parsed
+func cardEmail(card DumpCard) string {
+	parsed, err := card.Card()
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.PreferredValue(vcard.FieldEmail))
+}
+
+// equalContent reports whether two cards have the same properties other
+// than the UID
+func equalContent(card, other DumpCard) bool {
+	parsed, err := other.Card()
+	if err != nil {
+		return false
+	}
+	parsed.SetValue(vcard.FieldUID, card.UID)
+	rewritten, err := NewDumpCard(parsed)
+	if err != nil {
+		return false
+	}
+	return card.Equal(rewritten)
+}
+
+// matchByEmail pairs the wanted cards whose UIDs are not live with the live
+// cards whose UIDs are not wanted and which have the same email address,
+// returning the live card of each paired wanted UID.  Each live card is
+// paired at most once.
+func matchByEmail(wanted, existing map[string]DumpCard) map[string]DumpCard {
+	unmatched := make(map[string][]DumpCard)
+	for _, uid := range sortedKeys(existing) {
+		if _, ok := wanted[uid]; ok {
+			continue
+		}
+		email := cardEmail(existing[uid])
+		if email != "" {
+			unmatched[email] = append(unmatched[email], existing[uid])
+		}
+	}
+	ret := make(map[string]DumpCard)
+	for _, uid := range sortedKeys(wanted) {
+		if _, ok := existing[uid]; ok {
+			continue
+		}
+		email := cardEmail(wanted[uid])
+		if candidates := unmatched[email]; email != "" && len(candidates) > 0 {
+			ret[uid] = candidates[0]
+			unmatched[email] = candidates[1:]
+		}
+	}
+	return ret
+}
+
+// compareBook adds the cards missing from a live book.  When sync is set,
+// surplus cards are deleted and changed cards are replaced; otherwise they
+// are left untouched.  Cards are matched by UID, and a card whose UID is not
+// live is matched to a live card having its email address, so a dump whose
+// UIDs were generated by Upgrade does not duplicate or recreate every card.
+// The cards of an upgraded dump hold nothing but the address, so a card
+// matched by address is kept; otherwise it is replaced when its other
+// properties differ.
+func (b *planBuilder) compareBook(username, bookname string, book, live DumpBook, sync, upgraded bool) error {
+	err := b.add(PLAN_KEEP, PLAN_BOOK, username, bookname, nil)
+	if err != nil {
+		return err
+	}
+	existing := cardIndex(live.Cards)
+	wanted := cardIndex(book.Cards)
+	byEmail := matchByEmail(wanted, existing)
+	paired := make(map[string]bool)
+	for _, liveCard := range byEmail {
+		paired[liveCard.UID] = true
+	}
+	uids := []string{}
+	for uid := range existing {
+		if !paired[uid] {
+			uids = append(uids, uid)
+		}
+	}
+	for uid := range wanted {
+		if _, ok := existing[uid]; !ok {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Strings(uids)
+	for _, uid := range uids {
+		card, isWanted := wanted[uid]
+		liveCard, isLive := existing[uid]
+		emailCard, isPaired := byEmail[uid]
+		switch {
+		case isPaired && sync && !upgraded && !equalContent(card, emailCard):
+			err = b.add(PLAN_UPDATE, PLAN_CARD, username, bookname, &card)
+			if err == nil {
+				b.locate(emailCard)
+			}
+		case isPaired:
+			err = b.add(PLAN_KEEP, PLAN_CARD, username, bookname, &emailCard)
+		case !isLive:
+			err = b.add(PLAN_CREATE, PLAN_CARD, username, bookname, &card)
+		case sync && !isWanted:
+			err = b.add(PLAN_DELETE, PLAN_CARD, username, bookname, &liveCard)
+			if err == nil {
+				b.locate(liveCard)
+			}
+		case sync && !card.Equal(liveCard):
+			err = b.add(PLAN_UPDATE, PLAN_CARD, username, bookname, &card)
+			if err == nil {
+				b.locate(liveCard)
+			}
+		default:
+			err = b.add(PLAN_KEEP, PLAN_CARD, username, bookname, &liveCard)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewPlan compares a dump with the live state returned by Dump and returns
+// the steps a restore in the given mode would perform.  If restoreUser is
+// set, only that user is considered.
+//
+// merge adds missing users, books and cards, leaving everything else as is.
+// replace deletes every user and recreates it from the dump.  sync makes the
+// server match the dump by deleting surplus users, books and cards, adding
+// missing ones and replacing changed cards; a user present in both is never
+// deleted, so its CardDAV clients keep their sync state.  In every mode the
+// default book of a dump is skipped, and a live default book is kept.
+func NewPlan(dump, live *DumpFile, mode, restoreUser string) (*Plan, error) {
+	if !slices.Contains(RESTORE_MODES, mode) {
+		return nil, util.Fatalf("unknown restore mode: %s", mode)
+	}
+	plan := Plan{
+		Format:  PLAN_FORMAT,
+		Version: PLAN_VERSION,
+		Created: time.Now().UTC().Truncate(time.Second),
+		Mode:    mode,
+		User:    restoreUser,
+		Steps:   []PlanStep{},
+		Dump:    *NewDumpFile(),
+	}
+	plan.Dump.Created = dump.Created
+	plan.Dump.Upgraded = dump.Upgraded
+	usernames := make(map[string]bool)
+	for username, user := range dump.Users {
+		if restoreUser == "" || username == restoreUser {
+			plan.Dump.Users[username] = user
+			usernames[username] = true
+		}
+	}
+	for username := range live.Users {
+		if restoreUser == "" || username == restoreUser {
+			usernames[username] = true
+		}
+	}
+	b := planBuilder{&plan}
+	for _, username := range sortedKeys(usernames) {
+		user, wanted := plan.Dump.Users[username]
+		liveUser, exists := live.Users[username]
+		var err error
+		switch {
+		case mode == RESTORE_REPLACE:
+			if exists {
+				err = b.add(PLAN_DELETE, PLAN_USER, username, "", nil)
+			}
+			if err == nil && wanted {
+				err = b.createUser(username, user)
+			}
+		case !exists:
+			err = b.createUser(username, user)
+		case !wanted && mode == RESTORE_SYNC:
+			err = b.add(PLAN_DELETE, PLAN_USER, username, "", nil)
+		case !wanted:
+			err = b.add(PLAN_KEEP, PLAN_USER, username, "", nil)
+		default:
+			err = b.add(PLAN_KEEP, PLAN_USER, username, "", nil)
+			for _, bookname := range restoredBooks(user) {
+				if err != nil {
+					break
+				}
+				if liveBook, ok := liveUser.Books[bookname]; ok {
+					err = b.compareBook(username, bookname, user.Books[bookname], liveBook, mode == RESTORE_SYNC, dump.Upgraded)
+				} else {
+					err = b.createBook(username, bookname, user.Books[bookname])
+				}
+			}
+			for _, bookname := range sortedKeys(liveUser.Books) {
+				if _, ok := user.Books[bookname]; (!ok || IsDefaultBook(bookname)) && err == nil {
+					if mode == RESTORE_SYNC && !IsDefaultBook(bookname) {
+						err = b.add(PLAN_DELETE, PLAN_BOOK, username, bookname, nil)
+					} else {
+						err = b.add(PLAN_KEEP, PLAN_BOOK, username, bookname, nil)
+					}
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &plan, nil
+}
+
+// ReadPlan decodes a plan written by restore --plan-out
+func ReadPlan(r io.Reader) (*Plan, error) {
+	plan := Plan{}
+	err := json.NewDecoder(r).Decode(&plan)
+	if err != nil {
+		return nil, util.Fatalf("failed decoding plan: %w", err)
+	}
+	if plan.Format != PLAN_FORMAT {
+		return nil, util.Fatalf("unrecognized plan format: '%s'", plan.Format)
+	}
+	if plan.Version > PLAN_VERSION {
+		return nil, util.Fatalf("unsupported plan version %d; maximum is %d", plan.Version, PLAN_VERSION)
+	}
+	if plan.Dump.Users == nil {
+		plan.Dump.Users = make(map[string]DumpUser)
+	}
+	err = plan.Dump.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// Count returns the number of steps with the given action and kind
+func (p *Plan) Count(action, kind string) int {
+	count := 0
+	for _, step := range p.Steps {
+		if step.Action == action && step.Kind == kind {
+			count++
+		}
+	}
+	return count
+}
+
+// Destructive reports whether the plan was made for a mode other than
+// merge or deletes anything, so applying it requires --force
+func (p *Plan) Destructive() bool {
+	if p.Mode != RESTORE_MERGE {
+		return true
+	}
+	for _, step := range p.Steps {
+		if step.Action == PLAN_DELETE {
+			return true
+		}
+	}
+	return false
+}
+
+// Changes returns the number of steps which modify the server
+func (p *Plan) Changes() int {
+	count := 0
+	for _, step := range p.Steps {
+		if step.Action != PLAN_KEEP {
+			count++
+		}
+	}
+	return count
+}
+
+func (s PlanStep) String() string {
+	var symbol string
+	switch s.Action {
+	case PLAN_CREATE:
+		symbol = "+"
+	case PLAN_DELETE:
+		symbol = "-"
+	case PLAN_UPDATE:
+		symbol = "~"
+	default:
+		symbol = " "
+	}
+	switch s.Kind {
+	case PLAN_USER:
+		return fmt.Sprintf("%s user %s", symbol, s.Username)
+	case PLAN_BOOK:
+		return fmt.Sprintf("%s   book %s", symbol, s.Bookname)
+	}
+	return fmt.Sprintf("%s     card %s %s", symbol, s.UID, strings.Join(s.Emails, ","))
+}
+
+// Text returns the plan in human readable form; unchanged cards are
+// counted but not listed
+func (p *Plan) Text() string {
+	lines := []string{fmt.Sprintf("restore plan (mode: %s)", p.Mode)}
+	for _, step := range p.Steps {
+		if step.Action == PLAN_KEEP && step.Kind == PLAN_CARD {
+			continue
+		}
+		lines = append(lines, step.String())
+	}
+	for _, kind := range []string{PLAN_USER, PLAN_BOOK} {
+		lines = append(lines, fmt.Sprintf("%ss: %d create, %d delete, %d keep", kind,
+			p.Count(PLAN_CREATE, kind), p.Count(PLAN_DELETE, kind), p.Count(PLAN_KEEP, kind)))
+	}
+	lines = append(lines, fmt.Sprintf("cards: %d create, %d delete, %d update, %d keep",
+		p.Count(PLAN_CREATE, PLAN_CARD), p.Count(PLAN_DELETE, PLAN_CARD), p.Count(PLAN_UPDATE, PLAN_CARD), p.Count(PLAN_KEEP, PLAN_CARD)))
+	return strings.Join(lines, "\n")
+}
+
+// PlanRestore returns the plan for restoring dump in the given mode,
+// comparing it to the live state returned by Dump
+func PlanRestore(ctx context.Context, mab AddressBookManager, dump *DumpFile, mode, restoreUser string) (*Plan, error) {
+	live, err := mab.DumpCtx(ctx, restoreUser)
+	if err != nil {
+		return nil, err
+	}
+	return NewPlan(dump, &live.Dump, mode, restoreUser)
+}
+
+// ApplyPlan performs the steps of plan in order.  The plan is first
+// recomputed against the live state, and nothing is changed if the server
+// no longer matches the state the plan was made from.
+func ApplyPlan(ctx context.Context, mab AddressBookManager, plan *Plan) (*RestoreResponse, error) {
+	live, err := mab.DumpCtx(ctx, plan.User)
+	if err != nil {
+		return nil, err
+	}
+	current, err := NewPlan(&plan.Dump, &live.Dump, plan.Mode, plan.User)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.EqualFunc(plan.Steps, current.Steps, func(a, b PlanStep) bool {
+		return a.Action == b.Action && a.Kind == b.Kind && a.Username == b.Username && a.Bookname == b.Bookname && a.UID == b.UID &&
+			a.Path == b.Path && a.ETag == b.ETag
+	}) {
+		return nil, util.Fatalf("%w: server state has changed since the plan was made", ErrConflict)
+	}
+	response, err := ExecutePlan(ctx, mab, plan, nil)
+	if err != nil {
+		return response, err
+	}
+	response.Request = "apply plan"
+	response.Message = fmt.Sprintf("applied %d changes", plan.Changes())
+	return response, nil
+}
+
+// ExecutePlan performs the steps of a plan just computed from the live state,
+// recording each in journal if not nil.  A plan recomputed after an
+// interruption omits the steps already made, so the journal is not consulted.
+// A failed user or book step skips the steps within it; every other step is
+// attempted, and the response lists all failures.
+func ExecutePlan(ctx context.Context, mab AddressBookManager, plan *Plan, journal *RestoreJournal) (*RestoreResponse, error) {
+	verbose := viper.GetBool("verbose")
+	report := NewRestoreReport(journal, fmt.Sprintf("restore mode=%s", plan.Mode))
+
+	cards := make(map[string]DumpCard)
+	for username, user := range plan.Dump.Users {
+		for bookname, book := range user.Books {
+			for _, card := range book.Cards {
+				cards[username+"/"+bookname+"/"+card.UID] = card
+			}
+		}
+	}
+	// steps are grouped by user, so a user is finished when the next begins
+	users := []string{}
+	for _, step := range plan.Steps {
+		if len(users) == 0 || users[len(users)-1] != step.Username {
+			users = append(users, step.Username)
+		}
+	}
+	op := mab.Events().Start(fmt.Sprintf("restore mode=%s", plan.Mode), len(users))
+	current := ""
+	var userErr error
+	failed := make(map[string]bool)
+	for _, step := range plan.Steps {
+		if step.Username != current {
+			if current != "" {
+				op.User(current, userErr)
+			}
+			current = step.Username
+			userErr = nil
+		}
+		if step.Action == PLAN_KEEP || failed[step.Username] || failed[step.Username+"/"+step.Bookname] {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if verbose {
+			log.Printf("apply: %s\n", strings.TrimSpace(step.String()))
+		}
+		err := applyStep(ctx, mab, plan, step, cards)
+		entry := JournalEntry{Action: step.Action, Kind: step.Kind, Username: step.Username, Bookname: step.Bookname, UID: step.UID}
+		switch step.Kind {
+		case PLAN_CARD:
+			op.Address(step.Username, step.Bookname, step.UID, strings.Join(step.Emails, ","), err)
+		case PLAN_BOOK:
+			op.Book(step.Username, step.Bookname, err)
+		}
+		if report.Record(entry, err) != nil {
+			switch step.Kind {
+			case PLAN_USER:
+				userErr = err
+				failed[step.Username] = true
+			case PLAN_BOOK:
+				failed[step.Username+"/"+step.Bookname] = true
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		op.Finish(ctx.Err())
+		return nil, ctx.Err()
+	}
+	if current != "" {
+		op.User(current, userErr)
+	}
+	response, err := report.Result()
+	op.Finish(err)
+	return response, err
+}
+
+func applyStep(ctx context.Context, mab AddressBookManager, plan *Plan, step PlanStep, cards map[string]DumpCard) error {
+	user := plan.Dump.Users[step.Username]
+	switch step.Kind + " " + step.Action {
+	case PLAN_USER + " " + PLAN_DELETE:
+		_, err := mab.DeleteUserCtx(ctx, step.Username)
+		return err
+	case PLAN_USER + " " + PLAN_CREATE:
+		display := user.DisplayName
+		if display == "" {
+			display = step.Username
+		}
+		_, err := mab.AddUserCtx(ctx, step.Username, display, user.Password)
+		return err
+	case PLAN_BOOK + " " + PLAN_DELETE:
+		_, err := mab.DeleteBookCtx(ctx, step.Username, step.Bookname)
+		return err
+	case PLAN_BOOK + " " + PLAN_CREATE:
+		_, err := mab.AddBookCtx(ctx, step.Username, step.Bookname, user.Books[step.Bookname].Description)
+		return err
+	}
+
+	switch step.Action {
+	case PLAN_DELETE:
+		// a card already gone was deleted by someone else since the plan
+		// was made, so it is reported rather than counted as deleted
+		var err error
+		if step.Path != "" {
+			_, err = mab.DeleteObjectCtx(ctx, step.Username, step.Bookname, step.Path, Precondition{IfMatch: step.ETag})
+		} else {
+			_, err = mab.DeleteCardCtx(ctx, step.Username, step.Bookname, step.UID, Precondition{})
+		}
+		return err
+	case PLAN_CREATE, PLAN_UPDATE:
+		card, ok := cards[step.Username+"/"+step.Bookname+"/"+step.UID]
+		if !ok {
+			return util.Fatalf("%w: card %s is not in the plan dump", ErrAddressNotFound, step.UID)
+		}
+		parsed, err := card.Card()
+		if err != nil {
+			return err
+		}
+		if step.Action == PLAN_UPDATE && step.Path != "" {
+			_, err = mab.PutObjectCtx(ctx, step.Username, step.Bookname, step.Path, parsed, Precondition{IfMatch: step.ETag})
+			return err
+		}
+		cond := Precondition{IfNoneMatch: step.Action == PLAN_CREATE}
+		_, err = mab.PutCardCtx(ctx, step.Username, step.Bookname, parsed, cond)
+		return err
+	}
+	return util.Fatalf("unknown plan step: %s %s", step.Action, step.Kind)
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+	"github.com/rstms/mabctl/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+
+	api, _ := initController(t, "user@example.org", testBooks{"work": nil})
+	boss, err := api.AddAddress(nil, "user@example.org", "work", "boss@example.com", "")
+	require.Nil(t, err)
+	saved, err := api.Dump("")
+	require.Nil(t, err)
+	dump := saved.Dump
+
+	_, err = api.DeleteAddress("user@example.org", "work", "boss@example.com")
+	require.Nil(t, err)
+	_, err = api.AddAddress(nil, "user@example.org", "work", "peer@example.com", "")
+	require.Nil(t, err)
+	_, err = api.AddUser("other@example.org", "", "")
+	require.Nil(t, err)
+	live, err := api.Dump("")
+	require.Nil(t, err)
+
+	plan, err := NewPlan(&dump, &live.Dump, RESTORE_MERGE, "")
+	require.Nil(t, err)
+	require.Equal(t, 1, plan.Changes())
+	require.Equal(t, 1, plan.Count(PLAN_CREATE, PLAN_CARD))
+	require.Equal(t, 2, plan.Count(PLAN_KEEP, PLAN_USER))
+	require.Contains(t, plan.Text(), "+     card "+boss.Address.Card.Value("UID")+" boss@example.com")
+
+	replace, err := NewPlan(&dump, &live.Dump, RESTORE_REPLACE, "user@example.org")
+	require.Nil(t, err)
+	require.Equal(t, 1, replace.Count(PLAN_DELETE, PLAN_USER))
+	require.Equal(t, 1, replace.Count(PLAN_CREATE, PLAN_USER))
+	require.Equal(t, 1, replace.Count(PLAN_CREATE, PLAN_BOOK))
+	require.NotContains(t, replace.Dump.Users, "other@example.org")
+
+	data, err := json.Marshal(plan)
+	require.Nil(t, err)
+	saved2, err := ReadPlan(bytes.NewReader(data))
+	require.Nil(t, err)
+	response, err := ApplyPlan(context.Background(), api, saved2)
+	require.Nil(t, err)
+	require.Equal(t, "applied 1 changes", response.Message)
+
+	addrs, err := api.Addresses(nil, "user@example.org", "work")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"boss@example.com", "peer@example.com"}, addrs.Addresses)
+
+	_, err = ApplyPlan(context.Background(), api, saved2)
+	require.ErrorIs(t, err, ErrConflict)
+}
+
+func TestSyncRestore(t *testing.T) {
+
+	api, _ := initController(t, "user@example.org", testBooks{"work": nil})
+	boss, err := api.AddAddress(nil, "user@example.org", "work", "boss@example.com", "")
+	require.Nil(t, err)
+	saved, err := api.Dump("")
+	require.Nil(t, err)
+	dump := saved.Dump
+
+	_, err = api.UpdateContact("user@example.org", "work", "boss@example.com", &Contact{Phones: []string{"+1 555 0100"}})
+	require.Nil(t, err)
+	_, err = api.AddAddress(nil, "user@example.org", "work", "peer@example.com", "")
+	require.Nil(t, err)
+	_, err = api.AddBook("user@example.org", "old", "")
+	require.Nil(t, err)
+	_, err = api.AddUser("other@example.org", "", "")
+	require.Nil(t, err)
+
+	ctx := context.Background()
+	plan, err := PlanRestore(ctx, api, &dump, RESTORE_SYNC, "")
+	require.Nil(t, err)
+	require.Equal(t, 1, plan.Count(PLAN_DELETE, PLAN_USER))
+	require.Equal(t, 1, plan.Count(PLAN_KEEP, PLAN_USER))
+	require.Equal(t, 1, plan.Count(PLAN_DELETE, PLAN_BOOK))
+	require.Equal(t, 1, plan.Count(PLAN_DELETE, PLAN_CARD))
+	require.Equal(t, 1, plan.Count(PLAN_UPDATE, PLAN_CARD))
+	for _, step := range plan.Steps {
+		if step.Username == "user@example.org" && step.Kind == PLAN_USER {
+			require.Equal(t, PLAN_KEEP, step.Action)
+		}
+	}
+
+	_, err = ExecutePlan(ctx, api, plan, nil)
+	require.Nil(t, err)
+	after, err := api.Dump("")
+	require.Nil(t, err)
+	require.Empty(t, DiffDumps(&dump, &after.Dump))
+
+	contact, err := api.GetContact("user@example.org", "work", boss.Address.Card.Value("UID"))
+	require.Nil(t, err)
+	require.Empty(t, contact.Contact.Phones)
+
+	plan, err = PlanRestore(ctx, api, &dump, RESTORE_SYNC, "")
+	require.Nil(t, err)
+	require.Zero(t, plan.Changes())
+}
+
+func TestPlanUpgradedDump(t *testing.T) {
+
+	api, _ := initController(t, "user@example.org", testBooks{"work": {"boss@example.com", "peer@example.com"}})
+	legacy := `{"Users": {"user@example.org": {"Password": "secret", "Books": {"work": ["Boss@example.com", "pal@example.com"]}}}}`
+	dump, err := ReadDump(strings.NewReader(legacy))
+	require.Nil(t, err)
+	require.True(t, dump.Upgraded)
+
+	// the generated UIDs are not live, so cards are matched by address
+	ctx := context.Background()
+	merge, err := PlanRestore(ctx, api, dump, RESTORE_MERGE, "")
+	require.Nil(t, err)
+	require.Equal(t, 1, merge.Changes())
+	require.Equal(t, 1, merge.Count(PLAN_CREATE, PLAN_CARD))
+	require.Equal(t, 2, merge.Count(PLAN_KEEP, PLAN_CARD))
+
+	sync, err := PlanRestore(ctx, api, dump, RESTORE_SYNC, "")
+	require.Nil(t, err)
+	require.Equal(t, 2, sync.Changes())
+	require.Equal(t, 1, sync.Count(PLAN_CREATE, PLAN_CARD))
+	require.Equal(t, 1, sync.Count(PLAN_DELETE, PLAN_CARD))
+	require.Equal(t, 1, sync.Count(PLAN_KEEP, PLAN_CARD))
+	require.Zero(t, sync.Count(PLAN_UPDATE, PLAN_CARD))
+
+	_, err = ExecutePlan(ctx, api, sync, nil)
+	require.Nil(t, err)
+	addrs, err := api.Addresses(nil, "user@example.org", "work")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"boss@example.com", "pal@example.com"}, addrs.Addresses)
+	sync, err = PlanRestore(ctx, api, dump, RESTORE_SYNC, "")
+	require.Nil(t, err)
+	require.Zero(t, sync.Changes())
+}
+
+func TestPlanDefaultBook(t *testing.T) {
+
+	api, _ := initController(t, "user@example.org", testBooks{"work": nil})
+	legacy := `{"Users": {
+		"user@example.org": {"Password": "secret", "Books": {"default address book": ["pal@example.com"], "work": ["boss@example.com"]}},
+		"new@example.org": {"Password": "secret", "Books": {"default address book": ["pal@example.com"], "work": ["boss@example.com"]}}}}`
+	dump, err := ReadDump(strings.NewReader(legacy))
+	require.Nil(t, err)
+
+	// the default book is skipped by every mode, as a replace restore skips it
+	for _, mode := range RESTORE_MODES {
+		plan, err := PlanRestore(context.Background(), api, dump, mode, "")
+		require.Nil(t, err)
+		require.Equal(t, 2, plan.Count(PLAN_CREATE, PLAN_CARD), mode)
+		for _, step := range plan.Steps {
+			require.False(t, IsDefaultBook(step.Bookname), "%s: %s", mode, step)
+		}
+	}
+
+	plan, err := PlanRestore(context.Background(), api, dump, RESTORE_MERGE, "")
+	require.Nil(t, err)
+	_, err = ExecutePlan(context.Background(), api, plan, nil)
+	require.Nil(t, err)
+	books, err := api.GetBooks("new@example.org")
+	require.Nil(t, err)
+	require.Len(t, books.Books, 1)
+	require.Equal(t, "work", books.Books[0].BookName)
+}
+
+func TestSyncRestoreForeignPath(t *testing.T) {
+
+	username := "user@example.org"
+	api, _ := initController(t, username, testBooks{"work": nil})
+	ctx := context.Background()
+	dav, err := api.davClient(ctx, username)
+	require.Nil(t, err)
+	saved, err := api.Dump("")
+	require.Nil(t, err)
+	dump := saved.Dump
+	boss := (&Contact{UID: "boss-uid", Emails: []string{"boss@example.com"}}).Card(nil)
+	card, err := NewDumpCard(boss)
+	require.Nil(t, err)
+	book := dump.Users[username].Books["work"]
+	book.Cards = []DumpCard{card}
+	dump.Users[username].Books["work"] = book
+
+	// cards written by another client, at paths unrelated to their UIDs
+	uri := util.BookURI(username, "work")
+	_, err = dav.PutObjectCtx(ctx, uri+"client-1.vcf", (&Contact{UID: "boss-uid", Title: "Boss", Emails: []string{"boss@example.com"}}).Card(nil), Precondition{})
+	require.Nil(t, err)
+	_, err = dav.PutObjectCtx(ctx, uri+"client-2.vcf", (&Contact{UID: "peer-uid", Emails: []string{"peer@example.com"}}).Card(nil), Precondition{})
+	require.Nil(t, err)
+
+	plan, err := PlanRestore(ctx, api, &dump, RESTORE_SYNC, "")
+	require.Nil(t, err)
+	require.Equal(t, 1, plan.Count(PLAN_DELETE, PLAN_CARD))
+	require.Equal(t, 1, plan.Count(PLAN_UPDATE, PLAN_CARD))
+	_, err = ExecutePlan(ctx, api, plan, nil)
+	require.Nil(t, err)
+
+	cards, err := api.Cards(username, "work")
+	require.Nil(t, err)
+	require.Len(t, cards.Cards, 1)
+	require.Equal(t, uri+"client-1.vcf", cards.Cards[0].Path)
+	require.Empty(t, cards.Cards[0].Card.Value(vcard.FieldTitle))
+
+	// a card deleted since the plan was made is reported, not counted
+	_, err = dav.PutObjectCtx(ctx, uri+"client-3.vcf", (&Contact{UID: "pal-uid", Emails: []string{"pal@example.com"}}).Card(nil), Precondition{})
+	require.Nil(t, err)
+	plan, err = PlanRestore(ctx, api, &dump, RESTORE_SYNC, "")
+	require.Nil(t, err)
+	require.Nil(t, dav.DeleteObjectCtx(ctx, uri+"client-3.vcf", Precondition{}))
+	response, err := ExecutePlan(ctx, api, plan, nil)
+	require.ErrorIs(t, err, ErrRestoreIncomplete)
+	require.Len(t, response.Failures, 1)
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rstms/mabctl/util"
+	"github.com/spf13/viper"
+)
+
+const DEFAULT_POLICY_LISTEN = "127.0.0.1:10040"
+const DEFAULT_POLICY_MATCH_ACTION = "PREPEND X-Address-Book: {book}"
+const DEFAULT_POLICY_CACHE_TTL = 5 * time.Minute
+const DEFAULT_POLICY_CACHE_SIZE = 10000
+
+// the longest policy request line accepted
+const policyMaxLine = 64 * 1024
+
+// PolicyConfig sets the actions returned by a PolicyServer.  In
+// MatchAction, {book} is replaced by the first book containing the sender,
+// {books} by all of them separated by commas, and {sender} and {recipient}
+// by the addresses.  ErrorAction is returned when the lookup fails.  The
+// MatchAction reaches every recipient of the message, so Decide returns it
+// only for a message with one recipient.
+type PolicyConfig struct {
+	MatchAction   string
+	NoMatchAction string
+	ErrorAction   string
+	CacheTTL      time.Duration
+	CacheSize     int
+}
+
+// NewPolicyConfig returns the defaults
+func NewPolicyConfig() PolicyConfig {
+	return PolicyConfig{
+		MatchAction:   DEFAULT_POLICY_MATCH_ACTION,
+		NoMatchAction: "DUNNO",
+		ErrorAction:   "DUNNO",
+		CacheTTL:      DEFAULT_POLICY_CACHE_TTL,
+		CacheSize:     DEFAULT_POLICY_CACHE_SIZE,
+	}
+}
+
+// PolicyServer answers Postfix SMTP access policy delegation requests,
+// checking whether the sender is in any address book of the recipient.
+// Lookups, and the list of users, are cached for CacheTTL.
+type PolicyServer struct {
+	books  *senderLookup
+	config PolicyConfig
+	mutex  sync.Mutex
+	conns  map[net.Conn]bool
+	wg     sync.WaitGroup
+}
+
+func NewPolicyServer(mab AddressBookManager, config PolicyConfig) *PolicyServer {
+	return &PolicyServer{
+		books:  newSenderLookup(mab, config.CacheTTL, config.CacheSize),
+		config: config,
+		conns:  make(map[net.Conn]bool),
+	}
+}
+
+// PolicyListen opens a policy or milter server socket.  address is "unix:PATH" or
+// an absolute path for a unix socket, replacing any stale socket file, or
+// "tcp:HOST:PORT" or "HOST:PORT".
+func PolicyListen(address string) (net.Listener, error) {
+	network := "tcp"
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		network = "unix"
+		address = strings.TrimPrefix(address, "unix:")
+	case strings.HasPrefix(address, "/"):
+		network = "unix"
+	case strings.HasPrefix(address, "tcp:"):
+		address = strings.TrimPrefix(address, "tcp:")
+	}
+	if network == "unix" {
+		info, err := os.Stat(address)
+		if err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, util.Fatalf("listen failed: %w", err)
+	}
+	return listener, nil
+}
+
+// Serve answers connections on listener until ctx is done
+func (s *PolicyServer) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		s.mutex.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mutex.Unlock()
+	}()
+	defer s.wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return util.Fatalf("policy server accept failed: %w", err)
+		}
+		s.mutex.Lock()
+		s.conns[conn] = true
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(ctx, conn)
+			s.mutex.Lock()
+			delete(s.conns, conn)
+			s.mutex.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// handle answers each request on a connection until the client closes it
+func (s *PolicyServer) handle(ctx context.Context, conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		request, err := ReadPolicyRequest(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				log.Printf("policy: %v", err)
+			}
+			return
+		}
+		action := s.Decide(ctx, request)
+		_, err = fmt.Fprintf(conn, "action=%s\n\n", action)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ReadPolicyRequest reads the name=value lines of one request, ending with
+// an empty line
+func ReadPolicyRequest(r *bufio.Reader) (map[string]string, error) {
+	request := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if len(line) > policyMaxLine {
+			return nil, util.Fatalf("policy request line too long")
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(request) == 0 && line == "" {
+				return nil, io.EOF
+			}
+			return nil, util.Fatalf("policy request read failed: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if len(request) == 0 {
+				continue
+			}
+			return request, nil
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, util.Fatalf("invalid policy request line: '%s'", line)
+		}
+		request[name] = value
+	}
+}
+
+// Decide returns the action for a policy request.  Only requests with a
+// sender and a recipient who is a user are looked up; others get the
+// NoMatchAction.  Postfix applies an action such as PREPEND to the message
+// delivered to every recipient, so that one recipient cannot learn the book
+// names of another the lookup is made only for the sole recipient of a
+// message.  Postfix reports recipient_count=1 for such a message in the
+// DATA and END-OF-MESSAGE states; in the RCPT state the count is not yet
+// known, and the NoMatchAction is returned.
+func (s *PolicyServer) Decide(ctx context.Context, request map[string]string) string {
+	sender := strings.ToLower(request["sender"])
+	recipient := strings.ToLower(request["recipient"])
+	if sender == "" || recipient == "" || request["recipient_count"] != "1" {
+		return s.config.NoMatchAction
+	}
+	books, err := s.books.lookup(ctx, recipient, sender)
+	if err != nil {
+		log.Printf("policy: lookup %s in %s failed: %v", sender, recipient, err)
+		return s.config.ErrorAction
+	}
+	action := s.config.NoMatchAction
+	if len(books) > 0 {
+		action = strings.NewReplacer(
+			"{book}", books[0],
+			"{books}", strings.Join(books, ","),
+			"{sender}", sender,
+			"{recipient}", recipient,
+		).Replace(s.config.MatchAction)
+	}
+	if viper.GetBool("verbose") {
+		log.Printf("policy: sender=%s recipient=%s action=%s", sender, recipient, action)
+	}
+	return action
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyServer(t *testing.T) {
+
+	username := "user@example.org"
+	api, _ := initController(t, username, testBooks{"friends": {"friend@example.com"}})
+	addTestUser(t, api, "Mixed@example.org", testBooks{"family": {"mom@example.com"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listener, err := PolicyListen(filepath.Join(t.TempDir(), "policy.sock"))
+	require.Nil(t, err)
+	config := NewPolicyConfig()
+	config.NoMatchAction = "OK"
+	server := NewPolicyServer(api, config)
+	done := make(chan error)
+	go func() {
+		done <- server.Serve(ctx, listener)
+	}()
+
+	conn, err := net.Dial("unix", listener.Addr().String())
+	require.Nil(t, err)
+	reader := bufio.NewReader(conn)
+	send := func(request string) string {
+		_, err := fmt.Fprintf(conn, "request=smtpd_access_policy\n%s\n\n", request)
+		require.Nil(t, err)
+		response, err := ReadPolicyRequest(reader)
+		require.Nil(t, err)
+		return response["action"]
+	}
+	query := func(sender, recipient string) string {
+		return send(fmt.Sprintf("protocol_state=END-OF-MESSAGE\nrecipient_count=1\nsender=%s\nrecipient=%s", sender, recipient))
+	}
+
+	require.Equal(t, "PREPEND X-Address-Book: friends", query("Friend@example.com", username))
+	require.Equal(t, "OK", query("stranger@example.com", username))
+	require.Equal(t, "OK", query("end@example.com", username))
+	require.Equal(t, "OK", query("friend@example.com", "nobody@example.org"))
+	require.Equal(t, "OK", query("", username))
+
+	// a username with capitals is found from the recipient address, which
+	// Postfix passes in lower case
+	require.Equal(t, "PREPEND X-Address-Book: family", query("mom@example.com", "mixed@example.org"))
+
+	// the action would reach every recipient, so only a sole recipient is
+	// looked up
+	require.Equal(t, "OK", send("protocol_state=RCPT\nrecipient_count=0\nsender=friend@example.com\nrecipient="+username))
+	require.Equal(t, "OK", send("protocol_state=DATA\nrecipient_count=2\nsender=friend@example.com"))
+	require.Equal(t, "PREPEND X-Address-Book: friends", send("protocol_state=DATA\nrecipient_count=1\nsender=friend@example.com\nrecipient="+username))
+
+	// the cached result is returned until it expires
+	_, err = api.DeleteAddress(username, "friends", "friend@example.com")
+	require.Nil(t, err)
+	require.Equal(t, "PREPEND X-Address-Book: friends", query("friend@example.com", username))
+
+	conn.Close()
+	cancel()
+	require.Nil(t, <-done)
+}
@@ -0,0 +1,420 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rstms/mabctl/util"
+	"github.com/spf13/viper"
+	"go.yaml.in/yaml/v3"
+)
+
+const DEFAULT_SERVER_LISTEN = "127.0.0.1:8480"
+
+// the largest request body accepted
+const serverMaxBody = 1024 * 1024
+
+//go:embed openapi.yaml
+var openAPIDocument []byte
+
+// errBadRequest marks errors caused by an invalid API request
+var errBadRequest = errors.New("bad request")
+
+// ServerConfig sets the authentication of an APIServer.  A request is
+// accepted if it carries one of Tokens as a bearer token, or, when
+// ClientCAFile is set, a TLS client certificate signed by that CA.  TLS is
+// served when CertFile and KeyFile are set; a client CA requires TLS.
+type ServerConfig struct {
+	Tokens       []string
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// ServerRoute is an API endpoint: an HTTP method and a path pattern whose
+// {name} elements match one path segment
+type ServerRoute struct {
+	Method string
+	Path   string
+}
+
+type serverHandler func(r *http.Request) (int, any, error)
+
+// APIServer serves the AddressBookManager operations as a REST API with
+// JSON responses; the OpenAPI description of the API is served without
+// authentication at /api/v1/openapi.yaml and /api/v1/openapi.json.
+type APIServer struct {
+	mab    AddressBookManager
+	tokens [][]byte
+	tls    *tls.Config
+	mux    *http.ServeMux
+	routes []ServerRoute
+}
+
+func NewAPIServer(mab AddressBookManager, config ServerConfig) (*APIServer, error) {
+	s := APIServer{mab: mab, mux: http.NewServeMux()}
+	for _, token := range config.Tokens {
+		if token != "" {
+			s.tokens = append(s.tokens, []byte(token))
+		}
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, util.Fatalf("failed loading server certificate: %w", err)
+		}
+		s.tls = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	if config.ClientCAFile != "" {
+		if s.tls == nil {
+			return nil, util.Fatalf("client certificate authentication requires a server certificate and key")
+		}
+		data, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, util.Fatalf("failed reading client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, util.Fatalf("no certificates found in client CA file '%s'", config.ClientCAFile)
+		}
+		s.tls.ClientCAs = pool
+		s.tls.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if len(s.tokens) == 0 && config.ClientCAFile == "" {
+		return nil, util.Fatalf("API server requires a bearer token or a client CA")
+	}
+
+	s.mux.HandleFunc("GET /api/v1/openapi.yaml", s.openAPIYAML)
+	s.mux.HandleFunc("GET /api/v1/openapi.json", s.openAPIJSON)
+	s.handle("GET /api/v1/status", s.getStatus)
+	s.handle("GET /api/v1/users", s.getUsers)
+	s.handle("POST /api/v1/users", s.addUser)
+	s.handle("DELETE /api/v1/users/{username}", s.deleteUser)
+	s.handle("GET /api/v1/users/{username}/books", s.getBooks)
+	s.handle("POST /api/v1/users/{username}/books", s.addBook)
+	s.handle("DELETE /api/v1/users/{username}/books/{bookname}", s.deleteBook)
+	s.handle("GET /api/v1/users/{username}/books/{bookname}/addresses", s.getAddresses)
+	s.handle("POST /api/v1/users/{username}/books/{bookname}/addresses", s.addAddress)
+	s.handle("GET /api/v1/users/{username}/books/{bookname}/addresses/{email}", s.queryAddress)
+	s.handle("DELETE /api/v1/users/{username}/books/{bookname}/addresses/{email}", s.deleteAddress)
+	s.handle("GET /api/v1/users/{username}/scan/{email}", s.scanAddress)
+	s.handle("GET /api/v1/dump", s.dump)
+	return &s, nil
+}
+
+// Routes returns the authenticated API endpoints
+func (s *APIServer) Routes() []ServerRoute {
+	return s.routes
+}
+
+// TLS reports whether the server requires TLS connections
+func (s *APIServer) TLS() bool {
+	return s.tls != nil
+}
+
+// Serve answers requests on listener until ctx is done
+func (s *APIServer) Serve(ctx context.Context, listener net.Listener) error {
+	server := http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 30 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	if s.tls != nil {
+		listener = tls.NewListener(listener, s.tls)
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			server.Shutdown(shutdownCtx)
+		case <-done:
+		}
+	}()
+	defer close(done)
+	err := server.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return util.Fatalf("API server failed: %w", err)
+	}
+	return nil
+}
+
+func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *APIServer) handle(pattern string, handler serverHandler) {
+	method, path, _ := strings.Cut(pattern, " ")
+	s.routes = append(s.routes, ServerRoute{Method: method, Path: path})
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		request := r.Method + " " + r.URL.Path
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mabctl"`)
+			writeJSON(w, http.StatusUnauthorized, ErrorResponse{
+				Response: Response{Request: request, Message: "unauthorized"},
+			})
+			return
+		}
+		status, response, err := handler(r)
+		if err != nil {
+			status = HTTPStatus(err)
+			detail := ""
+			var httpErr *HTTPError
+			if errors.As(err, &httpErr) {
+				detail = httpErr.Detail
+			}
+			response = ErrorResponse{
+				Response: Response{User: r.PathValue("username"), Request: request, Message: err.Error()},
+				Detail:   detail,
+			}
+		}
+		if viper.GetBool("verbose") {
+			log.Printf("serve: %s %s %d", r.Method, r.URL.Path, status)
+		}
+		writeJSON(w, status, response)
+	})
+}
+
+// authorized reports whether the request carries a verified client
+// certificate or a valid bearer token
+func (s *APIServer) authorized(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	valid := false
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), t) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// HTTPStatus returns the HTTP status code reporting err
+func HTTPStatus(err error) int {
+	var conflict *ConflictError
+	switch {
+	case errors.As(err, &conflict):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errBadRequest), errors.Is(err, ErrAddressInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrBookNotFound), errors.Is(err, ErrAddressNotFound), errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrUserExists), errors.Is(err, ErrBookExists), errors.Is(err, ErrAddressExists), errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrUnauthorized):
+		// the CardDAV or bcc server rejected our credentials
+		return http.StatusBadGateway
+	case errors.Is(err, context.Canceled), errors.Is(err, ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrServerError):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	buf, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(buf, '\n'))
+}
+
+// readBody decodes the JSON request body into v
+func readBody(r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, serverMaxBody))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err != nil {
+		return fmt.Errorf("%w: invalid request body: %v", errBadRequest, err)
+	}
+	return nil
+}
+
+// precondition returns the If-Match and If-None-Match request headers
+func precondition(r *http.Request) Precondition {
+	return Precondition{
+		IfMatch:     strings.Trim(r.Header.Get("If-Match"), `"`),
+		IfNoneMatch: r.Header.Get("If-None-Match") == "*",
+	}
+}
+
+func (s *APIServer) openAPIYAML(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPIDocument)
+}
+
+func (s *APIServer) openAPIJSON(w http.ResponseWriter, r *http.Request) {
+	var document any
+	err := yaml.Unmarshal(openAPIDocument, &document)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, document)
+}
+
+type serverAddUserRequest struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"displayname"`
+	Password    string `json:"password"`
+}
+
+type serverAddBookRequest struct {
+	BookName    string `json:"bookname"`
+	Description string `json:"description"`
+}
+
+type serverAddAddressRequest struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+func (s *APIServer) getStatus(r *http.Request) (int, any, error) {
+	response, err := s.mab.GetStatusCtx(r.Context())
+	return http.StatusOK, response, err
+}
+
+func (s *APIServer) getUsers(r *http.Request) (int, any, error) {
+	response, err := s.mab.GetUsersCtx(r.Context())
+	return http.StatusOK, response, err
+}
+
+func (s *APIServer) addUser(r *http.Request) (int, any, error) {
+	var request serverAddUserRequest
+	err := readBody(r, &request)
+	if err != nil {
+		return 0, nil, err
+	}
+	if request.Username == "" {
+		return 0, nil, fmt.Errorf("%w: username required", errBadRequest)
+	}
+	response, err := s.mab.AddUserCtx(r.Context(), request.Username, request.DisplayName, request.Password)
+	return http.StatusCreated, response, err
+}
+
+func (s *APIServer) deleteUser(r *http.Request) (int, any, error) {
+	response, err := s.mab.DeleteUserCtx(r.Context(), r.PathValue("username"))
+	return http.StatusOK, response, err
+}
+
+func (s *APIServer) getBooks(r *http.Request) (int, any, error) {
+	response, err := s.mab.GetBooksCtx(r.Context(), r.PathValue("username"))
+	return http.StatusOK, response, err
+}
+
+func (s *APIServer) addBook(r *http.Request) (int, any, error) {
+	var request serverAddBookRequest
+	err := readBody(r, &request)
+	if err != nil {
+		return 0, nil, err
+	}
+	if request.BookName == "" {
+		return 0, nil, fmt.Errorf("%w: bookname required", errBadRequest)
+	}
+	response, err := s.mab.AddBookCtx(r.Context(), r.PathValue("username"), request.BookName, request.Description)
+	return http.StatusCreated, response, err
+}
+
+func (s *APIServer) deleteBook(r *http.Request) (int, any, error) {
+	response, err := s.mab.DeleteBookCtx(r.Context(), r.PathValue("username"), r.PathValue("bookname"))
+	return http.StatusOK, response, err
+}
+
+func (s *APIServer) getAddresses(r *http.Request) (int, any, error) {
+	response, err := s.mab.AddressesCtx(r.Context(), r.PathValue("username"), r.PathValue("bookname"))
+	return http.StatusOK, response, err
+}
+
+func (s *APIServer) addAddress(r *http.Request) (int, any, error) {
+	var request serverAddAddressRequest
+	err := readBody(r, &request)
+	if err != nil {
+		return 0, nil, err
+	}
+	if request.Email == "" {
+		return 0, nil, fmt.Errorf("%w: email required", errBadRequest)
+	}
+	response, err := s.mab.AddAddressIfCtx(r.Context(), r.PathValue("username"), r.PathValue("bookname"), request.Email, request.Name, precondition(r))
+	if err != nil {
+		return 0, nil, err
+	}
+	status := http.StatusCreated
+	if strings.HasPrefix(response.Message, "existing") {
+		status = http.StatusOK
+	}
+	return status, response, nil
+}
+
+func (s *APIServer) queryAddress(r *http.Request) (int, any, error) {
+	email := r.PathValue("email")
+	response, err := s.mab.FindAddressCtx(r.Context(), r.PathValue("username"), r.PathValue("bookname"), email)
+	if err != nil {
+		return 0, nil, err
+	}
+	if response.Address == nil {
+		return 0, nil, fmt.Errorf("%w: %s", ErrAddressNotFound, email)
+	}
+	return http.StatusOK, response, nil
+}
+
+func (s *APIServer) deleteAddress(r *http.Request) (int, any, error) {
+	email := r.PathValue("email")
+	response, err := s.mab.DeleteAddressIfCtx(r.Context(), r.PathValue("username"), r.PathValue("bookname"), email, precondition(r))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(response.Addresses) == 0 {
+		return 0, nil, fmt.Errorf("%w: %s", ErrAddressNotFound, email)
+	}
+	return http.StatusOK, response, nil
+}
+
+func (s *APIServer) scanAddress(r *http.Request) (int, any, error) {
+	response, err := s.mab.ScanAddressCtx(r.Context(), r.PathValue("username"), r.PathValue("email"))
+	if err != nil {
+		return 0, nil, err
+	}
+	if !response.Success {
+		// the scan reports its failure in the response message
+		return 0, nil, fmt.Errorf("%w: %s", ErrServerError, response.Message)
+	}
+	return http.StatusOK, response, nil
+}
+
+// dump returns the dump without the user passwords, which the API does not
+// disclose
+func (s *APIServer) dump(r *http.Request) (int, any, error) {
+	response, err := s.mab.DumpCtx(r.Context(), r.URL.Query().Get("user"))
+	if err != nil {
+		return 0, nil, err
+	}
+	for username, user := range response.Dump.Users {
+		user.Password = ""
+		response.Dump.Users[username] = user
+	}
+	return http.StatusOK, response, nil
+}
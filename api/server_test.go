@@ -0,0 +1,149 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIServer(t *testing.T) {
+
+	api, _ := initController(t, "", nil)
+	_, err := NewAPIServer(api, ServerConfig{})
+	require.NotNil(t, err)
+	server, err := NewAPIServer(api, ServerConfig{Tokens: []string{"secret"}})
+	require.Nil(t, err)
+
+	// every route is described
+	var document struct {
+		Paths map[string]map[string]any `json:"paths"`
+	}
+	request := func(method, path, token string, body any, headers ...string) (int, map[string]any) {
+		var reader *bytes.Reader
+		if body != nil {
+			data, err := json.Marshal(body)
+			require.Nil(t, err)
+			reader = bytes.NewReader(data)
+		} else {
+			reader = bytes.NewReader(nil)
+		}
+		r, err := http.NewRequest(method, path, reader)
+		require.Nil(t, err)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		ret := map[string]any{}
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), &ret))
+		}
+		if path == "/api/v1/openapi.json" {
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), &document))
+		}
+		return w.Code, ret
+	}
+	status, _ := request("GET", "/api/v1/openapi.json", "", nil)
+	require.Equal(t, http.StatusOK, status)
+	for _, route := range server.Routes() {
+		_, ok := document.Paths[route.Path][strings.ToLower(route.Method)]
+		require.True(t, ok, "%s %s not described", route.Method, route.Path)
+	}
+
+	status, response := request("GET", "/api/v1/users", "", nil)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, false, response["success"])
+	status, _ = request("GET", "/api/v1/users", "wrong", nil)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	username := "user@example.org"
+	book := "/api/v1/users/" + username + "/books/friends"
+	status, response = request("POST", "/api/v1/users", "secret", map[string]string{"username": username, "password": "userpass"})
+	require.Equal(t, http.StatusCreated, status, response)
+	status, _ = request("POST", "/api/v1/users", "secret", map[string]string{"username": username})
+	require.Equal(t, http.StatusConflict, status)
+	status, _ = request("POST", "/api/v1/users", "secret", map[string]string{"user": username})
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = request("POST", "/api/v1/users/"+username+"/books", "secret", map[string]string{"bookname": "friends"})
+	require.Equal(t, http.StatusCreated, status)
+
+	status, _ = request("POST", book+"/addresses", "secret", map[string]string{"email": "friend@example.com", "name": "Good Friend"})
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = request("POST", book+"/addresses", "secret", map[string]string{"email": "friend@example.com"})
+	require.Equal(t, http.StatusOK, status)
+	status, _ = request("POST", book+"/addresses", "secret", map[string]string{"email": "friend@example.com"}, "If-None-Match", "*")
+	require.Equal(t, http.StatusPreconditionFailed, status)
+
+	status, response = request("GET", book+"/addresses", "secret", nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []any{"friend@example.com"}, response["addresses"])
+	status, response = request("GET", "/api/v1/users/"+username+"/scan/friend@example.com", "secret", nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, response["books"], 1)
+	status, response = request("GET", "/api/v1/users/"+username+"/scan/stranger@example.com", "secret", nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Empty(t, response["books"])
+	status, _ = request("GET", book+"/addresses/friend@example.com", "secret", nil)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = request("GET", book+"/addresses/stranger@example.com", "secret", nil)
+	require.Equal(t, http.StatusNotFound, status)
+
+	// the address returned is the one equal to the address requested, not
+	// one containing it
+	addressEmail := func(response map[string]any) any {
+		card := response["address"].(map[string]any)["Card"].(map[string]any)
+		return card["EMAIL"].([]any)[0].(map[string]any)["Value"]
+	}
+	for _, email := range []string{"jimbob@example.com", "bob@example.com"} {
+		status, _ = request("POST", book+"/addresses", "secret", map[string]string{"email": email})
+		require.Equal(t, http.StatusCreated, status)
+	}
+	for _, email := range []string{"bob@example.com", "jimbob@example.com"} {
+		status, response = request("GET", book+"/addresses/"+email, "secret", nil)
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, email, addressEmail(response))
+	}
+	status, _ = request("GET", book+"/addresses/ob@example.com", "secret", nil)
+	require.Equal(t, http.StatusNotFound, status)
+	for _, email := range []string{"jimbob@example.com", "bob@example.com"} {
+		status, _ = request("DELETE", book+"/addresses/"+email, "secret", nil)
+		require.Equal(t, http.StatusOK, status)
+	}
+
+	status, response = request("GET", "/api/v1/dump?user="+username, "secret", nil)
+	require.Equal(t, http.StatusOK, status)
+	users := response["Dump"].(map[string]any)["users"].(map[string]any)
+	require.Contains(t, users, username)
+	require.Empty(t, users[username].(map[string]any)["password"])
+	require.NotContains(t, fmt.Sprint(response), "userpass")
+
+	// an address containing the one deleted is not deleted
+	status, _ = request("POST", book+"/addresses", "secret", map[string]string{"email": "bestfriend@example.com"})
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = request("DELETE", book+"/addresses/end@example.com", "secret", nil)
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = request("DELETE", book+"/addresses/friend@example.com", "secret", nil)
+	require.Equal(t, http.StatusOK, status)
+	status, response = request("GET", book+"/addresses", "secret", nil)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []any{"bestfriend@example.com"}, response["addresses"])
+	status, _ = request("DELETE", book+"/addresses/friend@example.com", "secret", nil)
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = request("DELETE", book, "secret", nil)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = request("GET", book+"/addresses", "secret", nil)
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = request("DELETE", "/api/v1/users/"+username, "secret", nil)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = request("GET", "/api/v1/users/"+username+"/books", "secret", nil)
+	require.Equal(t, http.StatusNotFound, status)
+}
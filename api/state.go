@@ -0,0 +1,235 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"strings"
+
+	"github.com/rstms/mabctl/util"
+	"github.com/spf13/viper"
+	"go.yaml.in/yaml/v3"
+)
+
+const STATE_ADDRESS = "address"
+
+// State declares the users, books and addresses which should exist
+type State struct {
+	Users map[string]StateUser `yaml:"users" json:"users"`
+}
+
+// StateUser declares a user; Password is only used when the user is created
+type StateUser struct {
+	DisplayName string               `yaml:"displayname" json:"displayname"`
+	Password    string               `yaml:"password,omitempty" json:"password,omitempty"`
+	Books       map[string]StateBook `yaml:"books" json:"books"`
+}
+
+type StateBook struct {
+	Description string         `yaml:"description" json:"description"`
+	Addresses   []StateAddress `yaml:"addresses" json:"addresses"`
+}
+
+// StateAddress is written either as a string, "email" or "Name <email>",
+// or as a mapping with email and name keys
+type StateAddress struct {
+	Email string `yaml:"email" json:"email"`
+	Name  string `yaml:"name,omitempty" json:"name,omitempty"`
+}
+
+func (a *StateAddress) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		type plain StateAddress
+		return value.Decode((*plain)(a))
+	}
+	parsed, err := mail.ParseAddress(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w: %s", value.Line, ErrAddressInvalid, value.Value)
+	}
+	a.Email = parsed.Address
+	a.Name = parsed.Name
+	return nil
+}
+
+// ReadState decodes a YAML (or JSON) state file
+func ReadState(r io.Reader) (*State, error) {
+	state := State{}
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	err := decoder.Decode(&state)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, util.Fatalf("failed decoding state: %w", err)
+	}
+	for username, user := range state.Users {
+		for bookname, book := range user.Books {
+			for _, address := range book.Addresses {
+				if !strings.Contains(address.Email, "@") {
+					return nil, util.Fatalf("%w: %s/%s: '%s'", ErrAddressInvalid, username, bookname, address.Email)
+				}
+			}
+		}
+	}
+	return &state, nil
+}
+
+// StateChange is one difference between the declared and the live state
+type StateChange struct {
+	Action   string `json:"action"`
+	Kind     string `json:"kind"`
+	Username string `json:"username"`
+	Bookname string `json:"bookname,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Name     string `json:"name,omitempty"`
+}
+
+func (s StateChange) String() string {
+	symbol := "+"
+	if s.Action == PLAN_DELETE {
+		symbol = "-"
+	}
+	switch s.Kind {
+	case PLAN_USER:
+		return fmt.Sprintf("%s user %s", symbol, s.Username)
+	case PLAN_BOOK:
+		return fmt.Sprintf("%s book %s/%s", symbol, s.Username, s.Bookname)
+	}
+	return fmt.Sprintf("%s address %s/%s/%s", symbol, s.Username, s.Bookname, s.Email)
+}
+
+// StateDiff lists the changes which reconcile the server with a State.
+// Unmanaged items are those present on the server for a declared user but
+// absent from the state; they are deleted only when pruning.
+type StateDiff struct {
+	Changes   []StateChange `json:"changes"`
+	Unmanaged []StateChange `json:"unmanaged"`
+	Prune     bool          `json:"prune"`
+	state     *State
+}
+
+// Text returns the diff in human readable form
+func (d *StateDiff) Text() string {
+	lines := []string{}
+	for _, change := range d.Changes {
+		lines = append(lines, change.String())
+	}
+	if len(d.Changes) == 0 {
+		lines = append(lines, "no changes")
+	}
+	if !d.Prune && len(d.Unmanaged) > 0 {
+		lines = append(lines, fmt.Sprintf("%d unmanaged items (use --prune to remove)", len(d.Unmanaged)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DiffState compares state with the server.  Users absent from the state
+// are never changed.  The display name and password of an existing user
+// and the description of an existing book are not compared, as the server
+// API cannot change them.
+func DiffState(ctx context.Context, mab AddressBookManager, state *State, prune bool) (*StateDiff, error) {
+	diff := StateDiff{Changes: []StateChange{}, Unmanaged: []StateChange{}, Prune: prune, state: state}
+	usersResponse, err := mab.GetUsersCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	liveUsers := make(map[string]bool)
+	for _, user := range usersResponse.Users {
+		liveUsers[user.UserName] = true
+	}
+	for _, username := range sortedKeys(state.Users) {
+		user := state.Users[username]
+		liveBooks := make(map[string]bool)
+		if liveUsers[username] {
+			booksResponse, err := mab.GetBooksCtx(ctx, username)
+			if err != nil {
+				return nil, err
+			}
+			for _, book := range booksResponse.Books {
+				liveBooks[book.BookName] = true
+			}
+		} else {
+			diff.Changes = append(diff.Changes, StateChange{Action: PLAN_CREATE, Kind: PLAN_USER, Username: username})
+		}
+		for _, bookname := range sortedKeys(user.Books) {
+			liveAddresses := make(map[string]bool)
+			if liveBooks[bookname] {
+				addressesResponse, err := mab.AddressesCtx(ctx, username, bookname)
+				if err != nil {
+					return nil, err
+				}
+				for _, email := range addressesResponse.Addresses {
+					liveAddresses[strings.ToLower(email)] = true
+				}
+			} else {
+				diff.Changes = append(diff.Changes, StateChange{Action: PLAN_CREATE, Kind: PLAN_BOOK, Username: username, Bookname: bookname})
+			}
+			declared := make(map[string]bool)
+			for _, address := range user.Books[bookname].Addresses {
+				email := strings.ToLower(address.Email)
+				if declared[email] {
+					continue
+				}
+				declared[email] = true
+				if !liveAddresses[email] {
+					diff.Changes = append(diff.Changes, StateChange{Action: PLAN_CREATE, Kind: STATE_ADDRESS, Username: username, Bookname: bookname, Email: address.Email, Name: address.Name})
+				}
+			}
+			for _, email := range sortedKeys(liveAddresses) {
+				if !declared[email] {
+					diff.unmanaged(StateChange{Action: PLAN_DELETE, Kind: STATE_ADDRESS, Username: username, Bookname: bookname, Email: email})
+				}
+			}
+		}
+		for _, bookname := range sortedKeys(liveBooks) {
+			if _, ok := user.Books[bookname]; !ok && !IsDefaultBook(bookname) {
+				diff.unmanaged(StateChange{Action: PLAN_DELETE, Kind: PLAN_BOOK, Username: username, Bookname: bookname})
+			}
+		}
+	}
+	return &diff, nil
+}
+
+func (d *StateDiff) unmanaged(change StateChange) {
+	d.Unmanaged = append(d.Unmanaged, change)
+	if d.Prune {
+		d.Changes = append(d.Changes, change)
+	}
+}
+
+// ApplyState makes the changes listed by a diff returned by DiffState
+func ApplyState(ctx context.Context, mab AddressBookManager, diff *StateDiff) (*Response, error) {
+	verbose := viper.GetBool("verbose")
+	for _, change := range diff.Changes {
+		if verbose {
+			log.Printf("apply: %s\n", change)
+		}
+		var err error
+		switch change.Kind + " " + change.Action {
+		case PLAN_USER + " " + PLAN_CREATE:
+			user := diff.state.Users[change.Username]
+			_, err = mab.AddUserCtx(ctx, change.Username, user.DisplayName, user.Password)
+		case PLAN_BOOK + " " + PLAN_CREATE:
+			book := diff.state.Users[change.Username].Books[change.Bookname]
+			_, err = mab.AddBookCtx(ctx, change.Username, change.Bookname, book.Description)
+		case PLAN_BOOK + " " + PLAN_DELETE:
+			_, err = mab.DeleteBookCtx(ctx, change.Username, change.Bookname)
+		case STATE_ADDRESS + " " + PLAN_CREATE:
+			name := change.Name
+			if name == "" {
+				name = change.Email
+			}
+			_, err = mab.AddAddressCtx(ctx, change.Username, change.Bookname, change.Email, name)
+		case STATE_ADDRESS + " " + PLAN_DELETE:
+			_, err = mab.DeleteAddressCtx(ctx, change.Username, change.Bookname, change.Email)
+		default:
+			err = fmt.Errorf("unknown change: %s %s", change.Action, change.Kind)
+		}
+		if err != nil {
+			return nil, util.Fatalf("failed applying '%s': %w", change, err)
+		}
+	}
+	ret := Response{Success: true, Request: "apply", Message: fmt.Sprintf("applied %d changes", len(diff.Changes))}
+	return &ret, nil
+}
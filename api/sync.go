@@ -0,0 +1,331 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/emersion/go-webdav/carddav"
+	davapi "github.com/rstms/mabctl/carddav"
+	"github.com/rstms/mabctl/util"
+	"github.com/spf13/viper"
+)
+
+type SyncResponse struct {
+	Response
+	SyncToken string                  `json:"sync_token"`
+	Full      bool                    `json:"full"`
+	Added     []carddav.AddressObject `json:"added"`
+	Changed   []carddav.AddressObject `json:"changed"`
+	Deleted   []carddav.AddressObject `json:"deleted"`
+}
+
+// the consumers of sync state; each has its own state so that reading a
+// book does not consume the changes reported by watch.  The mirror state
+// keeps a copy of the cards so that listing and dumping a book transfers
+// only the changes; the watch state keeps only paths and ETags.  Both are
+// persisted readable only by their owner.
+const (
+	syncMirror = "mirror"
+	syncWatch  = "watch"
+)
+
+// syncState is the contents of a book as of SyncToken.  Objects holds the
+// cards of a mirror state; a watch state has only their ETags.
+type syncState struct {
+	SyncToken string                           `json:"sync_token"`
+	ETags     map[string]string                `json:"etags"`
+	Objects   map[string]carddav.AddressObject `json:"objects,omitempty"`
+}
+
+func newSyncState() *syncState {
+	return &syncState{ETags: make(map[string]string), Objects: make(map[string]carddav.AddressObject)}
+}
+
+// clone returns a copy of the state which may be updated independently
+func (s *syncState) clone() *syncState {
+	ret := newSyncState()
+	ret.SyncToken = s.SyncToken
+	for path, etag := range s.ETags {
+		ret.ETags[path] = etag
+	}
+	for path, addr := range s.Objects {
+		ret.Objects[path] = addr
+	}
+	return ret
+}
+
+// syncStates holds the states of the books synchronized by this process;
+// they do not expire, since each use brings them up to date
+type syncStates struct {
+	mutex  sync.Mutex
+	states *lruCache[*syncState]
+}
+
+func newSyncStates() *syncStates {
+	return &syncStates{states: newLRUCache[*syncState](DEFAULT_CACHE_SIZE, 0)}
+}
+
+// get returns a copy of the state kept under key, or nil if there is none
+func (s *syncStates) get(key string) *syncState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, _, ok := s.states.get(key)
+	if !ok {
+		return nil
+	}
+	return state.clone()
+}
+
+func (s *syncStates) put(key string, state *syncState) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.states.put(key, state)
+}
+
+// SyncDir returns the directory holding persisted sync state
+func SyncDir() (string, error) {
+	dir := viper.GetString("mabctl.sync_dir")
+	if dir != "" {
+		return dir, nil
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", util.Fatalf("failed locating cache directory: %w", err)
+	}
+	return filepath.Join(cache, "mabctl", "sync"), nil
+}
+
+// syncStateFile returns the state filename kept by consumer for a book on the
+// configured server
+func syncStateFile(consumer, username, bookname string) (string, error) {
+	dir, err := SyncDir()
+	if err != nil {
+		return "", err
+	}
+	server, err := url.Parse(viper.GetString("mabctl.dav_url"))
+	if err != nil {
+		return "", util.Fatalf("failed parsing dav_url: %w", err)
+	}
+	return filepath.Join(dir, consumer, server.Host, username, util.BookToken(username, bookname)+".json"), nil
+}
+
+// loadSyncState returns the state persisted for consumer, or an empty state
+// if none is usable.  A state written by an earlier version has cards but no
+// ETags; the ETags are taken from the cards.  A mirror state must hold the
+// card for each ETag, and a watch state discards its cards.
+func loadSyncState(consumer, filename string) *syncState {
+	state := newSyncState()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return state
+	}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return newSyncState()
+	}
+	if state.Objects == nil {
+		state.Objects = make(map[string]carddav.AddressObject)
+	}
+	if state.ETags == nil {
+		state.ETags = make(map[string]string)
+		for path, addr := range state.Objects {
+			state.ETags[path] = addr.ETag
+		}
+	}
+	switch consumer {
+	case syncMirror:
+		for path := range state.ETags {
+			if _, ok := state.Objects[path]; !ok {
+				return newSyncState()
+			}
+		}
+	default:
+		state.Objects = make(map[string]carddav.AddressObject)
+	}
+	return state
+}
+
+// save writes the state for consumer, with mode 0600 since a mirror state
+// holds the cards
+func (s *syncState) save(consumer, filename string) error {
+	if consumer != syncMirror {
+		s = &syncState{SyncToken: s.SyncToken, ETags: s.ETags}
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return util.Fatalf("failed encoding sync state: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return util.Fatalf("failed creating sync state directory: %w", err)
+	}
+	// a unique temporary file, so concurrent processes cannot interleave
+	// their writes; CreateTemp uses mode 0600
+	file, err := os.CreateTemp(filepath.Dir(filename), ".tmp-*")
+	if err != nil {
+		return util.Fatalf("failed creating sync state: %w", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		return util.Fatalf("failed writing sync state: %w", err)
+	}
+	return nil
+}
+
+// sortedObjects returns the book contents ordered by path
+func (s *syncState) sortedObjects() []carddav.AddressObject {
+	paths := make([]string, 0, len(s.Objects))
+	for path := range s.Objects {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	ret := make([]carddav.AddressObject, len(paths))
+	for i, path := range paths {
+		ret[i] = s.Objects[path]
+	}
+	return ret
+}
+
+// apply updates the state with objects reported by the server; when
+// complete is set, objects absent from updated have been deleted.  A deleted
+// object whose card is not held in memory is reported by path and ETag.
+func (s *syncState) apply(response *SyncResponse, updated []carddav.AddressObject, deleted []string, complete bool) {
+	seen := make(map[string]bool)
+	for _, addr := range updated {
+		seen[addr.Path] = true
+		etag, exists := s.ETags[addr.Path]
+		switch {
+		case !exists:
+			response.Added = append(response.Added, addr)
+		case complete && etag == addr.ETag:
+		default:
+			response.Changed = append(response.Changed, addr)
+		}
+		s.ETags[addr.Path] = addr.ETag
+		s.Objects[addr.Path] = addr
+	}
+	if complete {
+		for path := range s.ETags {
+			if !seen[path] {
+				deleted = append(deleted, path)
+			}
+		}
+	}
+	sort.Strings(deleted)
+	for _, path := range deleted {
+		etag, exists := s.ETags[path]
+		if !exists {
+			continue
+		}
+		previous, ok := s.Objects[path]
+		if !ok {
+			previous = carddav.AddressObject{Path: path, ETag: etag}
+		}
+		response.Deleted = append(response.Deleted, previous)
+		delete(s.ETags, path)
+		delete(s.Objects, path)
+	}
+}
+
+// syncBook brings the state of a book persisted for consumer up to date,
+// transferring only the changes when the server supports sync-collection
+func (c *Controller) syncBook(ctx context.Context, dav *davapi.CardClient, consumer, username, bookname string) (*SyncResponse, *syncState, error) {
+	book, err := c.GetBookCtx(ctx, username, bookname)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.syncBookURI(ctx, dav, consumer, username, book)
+}
+
+// syncBookURI is syncBook for a book already looked up
+func (c *Controller) syncBookURI(ctx context.Context, dav *davapi.CardClient, consumer, username string, book *Book) (*SyncResponse, *syncState, error) {
+	verbose := viper.GetBool("verbose")
+	bookname := book.BookName
+	path, err := URIPath(book.URI)
+	if err != nil {
+		return nil, nil, err
+	}
+	filename, err := syncStateFile(consumer, username, bookname)
+	if err != nil {
+		return nil, nil, err
+	}
+	state := c.syncStates.get(filename)
+	if state == nil {
+		state = loadSyncState(consumer, filename)
+	}
+
+	response := SyncResponse{}
+	response.Success = true
+	response.Request = fmt.Sprintf("sync %s %s", username, bookname)
+	changes, err := dav.SyncAddressBookCtx(ctx, path, state.SyncToken)
+	if errors.Is(err, ErrSyncTokenInvalid) {
+		if verbose {
+			log.Printf("syncBook: %v; resyncing %s\n", err, path)
+		}
+		state.SyncToken = ""
+		changes, err = dav.SyncAddressBookCtx(ctx, path, "")
+	}
+	switch {
+	case errors.Is(err, ErrSyncUnsupported):
+		if verbose {
+			log.Printf("syncBook: %v; fetching %s\n", err, path)
+		}
+		addrs, err := dav.AddressesCtx(ctx, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		response.Full = true
+		state.SyncToken = ""
+		state.apply(&response, *addrs, nil, true)
+	case err != nil:
+		return nil, nil, err
+	default:
+		response.Full = state.SyncToken == ""
+		state.apply(&response, changes.Updated, changes.Deleted, response.Full)
+		state.SyncToken = changes.SyncToken
+	}
+	response.SyncToken = state.SyncToken
+	response.Message = fmt.Sprintf("added: %d, changed: %d, deleted: %d", len(response.Added), len(response.Changed), len(response.Deleted))
+
+	c.syncStates.put(filename, state.clone())
+	err = state.save(consumer, filename)
+	if err != nil && verbose {
+		log.Printf("syncBook: %v\n", err)
+	}
+	return &response, state, nil
+}
+
+func (c *Controller) SyncAddressBook(username, bookname string) (*SyncResponse, error) {
+	return c.SyncAddressBookCtx(context.Background(), username, bookname)
+}
+
+// SyncAddressBookCtx returns the changes to a book since the previous call
+// on this host.  Its state is kept apart from the copy used to list books,
+// so other commands do not consume the changes.
+func (c *Controller) SyncAddressBookCtx(ctx context.Context, username, bookname string) (*SyncResponse, error) {
+	dav, err := c.davClient(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	response, _, err := c.syncBook(ctx, dav, syncWatch, username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSync(t *testing.T) {
+
+	api, server := initController(t, "user@example.org", testBooks{"friends": {"one@example.com", "two@example.com"}})
+
+	response, err := api.SyncAddressBook("user@example.org", "friends")
+	require.Nil(t, err)
+	require.True(t, response.Full)
+	require.Len(t, response.Added, 2)
+	require.NotEmpty(t, response.SyncToken)
+
+	response, err = api.SyncAddressBook("user@example.org", "friends")
+	require.Nil(t, err)
+	require.False(t, response.Full)
+	require.Empty(t, response.Added)
+
+	_, err = api.AddAddress(nil, "user@example.org", "friends", "three@example.com", "")
+	require.Nil(t, err)
+	_, err = api.DeleteAddress("user@example.org", "friends", "one@example.com")
+	require.Nil(t, err)
+	_, err = api.UpdateContact("user@example.org", "friends", "two@example.com", &Contact{Title: "Boss"})
+	require.Nil(t, err)
+
+	// listing the book does not consume the changes
+	_, err = api.Addresses(nil, "user@example.org", "friends")
+	require.Nil(t, err)
+	response, err = api.SyncAddressBook("user@example.org", "friends")
+	require.Nil(t, err)
+	require.False(t, response.Full)
+	require.Len(t, response.Added, 1)
+	require.Equal(t, "three@example.com", response.Added[0].Card.Value("EMAIL"))
+	require.Len(t, response.Changed, 1)
+	require.Equal(t, "Boss", response.Changed[0].Card.Value("TITLE"))
+	require.Len(t, response.Deleted, 1)
+	require.Equal(t, "one@example.com", response.Deleted[0].Card.Value("EMAIL"))
+
+	addrs, err := api.Addresses(nil, "user@example.org", "friends")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"two@example.com", "three@example.com"}, addrs.Addresses)
+
+	// a rejected token forces a complete resync
+	_, err = api.DeleteAddress("user@example.org", "friends", "three@example.com")
+	require.Nil(t, err)
+	server.FailNextMethod("REPORT", 403)
+	response, err = api.SyncAddressBook("user@example.org", "friends")
+	require.Nil(t, err)
+	require.True(t, response.Full)
+	require.Empty(t, response.Added)
+	require.Len(t, response.Deleted, 1)
+
+	// servers without sync-collection are queried in full
+	_, err = api.AddAddress(nil, "user@example.org", "friends", "four@example.com", "")
+	require.Nil(t, err)
+	server.FailNextMethod("REPORT", 501)
+	response, err = api.SyncAddressBook("user@example.org", "friends")
+	require.Nil(t, err)
+	require.True(t, response.Full)
+	require.Len(t, response.Added, 1)
+	require.Empty(t, response.SyncToken)
+
+	// the watch state holds no card contents, and the mirror state is
+	// readable only by its owner
+	dir, err := SyncDir()
+	require.Nil(t, err)
+	files := map[string]string{}
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		require.Nil(t, err)
+		if !entry.IsDir() {
+			info, err := entry.Info()
+			require.Nil(t, err)
+			require.Equal(t, fs.FileMode(0600), info.Mode().Perm())
+			data, err := os.ReadFile(path)
+			require.Nil(t, err)
+			rel, err := filepath.Rel(dir, path)
+			require.Nil(t, err)
+			files[strings.Split(rel, string(filepath.Separator))[0]] = string(data)
+		}
+		return nil
+	})
+	require.Nil(t, err)
+	require.Len(t, files, 2)
+	require.NotContains(t, files[syncWatch], "@example.com")
+	require.Contains(t, files[syncMirror], "two@example.com")
+
+	// a later process lists the book from the persisted mirror, transferring
+	// only the changes
+	_, err = api.AddAddress(nil, "user@example.org", "friends", "five@example.com", "")
+	require.Nil(t, err)
+	later, err := NewAddressBookController()
+	require.Nil(t, err)
+	ctx := context.Background()
+	dav, err := later.davClient(ctx, "user@example.org")
+	require.Nil(t, err)
+	response, state, err := later.syncBook(ctx, dav, syncMirror, "user@example.org", "friends")
+	require.Nil(t, err)
+	require.False(t, response.Full)
+	added := []string{}
+	for _, addr := range response.Added {
+		added = append(added, addr.Card.Value("EMAIL"))
+	}
+	require.ElementsMatch(t, []string{"four@example.com", "five@example.com"}, added)
+	require.Len(t, response.Deleted, 1)
+	require.Len(t, state.Objects, 3)
+}
@@ -1,9 +1,12 @@
 package carddav
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"time"
 	"github.com/emersion/go-vcard"
 	"github.com/emersion/go-webdav/carddav"
@@ -11,7 +14,9 @@ import (
 	"github.com/rstms/mabctl/util"
 	"github.com/studio-b12/gowebdav"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"log"
 	"github.com/spf13/viper"
 )
@@ -22,11 +27,15 @@ type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// DigestAuthorizedClient may be shared by goroutines; mutex guards the
+// digest state, whose nonce count is advanced by each request
 type DigestAuthorizedClient struct {
 	c        HTTPClient
 	username string
 	password string
 	auth     gowebdav.Authenticator
+	retry    *util.RetryPolicy
+	mutex    sync.Mutex
 }
 
 func (c *DigestAuthorizedClient) client() *http.Client {
@@ -37,37 +46,107 @@ func (c *DigestAuthorizedClient) client() *http.Client {
 	return ret
 }
 
+// Do sends the request, repeating it according to the retry policy; a
+// request body is only resent if it can be rewound
 func (c *DigestAuthorizedClient) Do(req *http.Request) (*http.Response, error) {
-	client := c.client()
-	if c.auth != nil {
-		err := c.auth.Authorize(client, req, req.URL.Path)
+	if c.retry == nil || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return c.do(req)
+	}
+	var resp *http.Response
+	sent := false
+	err := c.retry.Do(req.Context(), util.IdempotentMethod(req.Method), func() error {
+		if sent {
+			err := rewind(req)
+			if err != nil {
+				return err
+			}
+		}
+		sent = true
+		var err error
+		resp, err = c.do(req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// rewind resets the request body before it is sent again
+func rewind(req *http.Request) error {
+	if req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return fmt.Errorf("DigestAuthClient: rewind body: %w", err)
+	}
+	req.Body = body
+	return nil
+}
+
+// authorize adds the authorization header to req, first replacing the
+// digest state from the challenge in resp if given
+func (c *DigestAuthorizedClient) authorize(req *http.Request, resp *http.Response) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if resp != nil {
+		auth, err := gowebdav.NewDigestAuth(c.username, c.password, resp)
 		if err != nil {
-			return nil, fmt.Errorf("DigestAuthClient: preauth: %v", err)
+			return fmt.Errorf("DigestAuthClient: digest auth create: %w", err)
 		}
+		c.auth = auth
+	}
+	if c.auth == nil {
+		return nil
+	}
+	return c.auth.Authorize(c.client(), req, req.URL.Path)
+}
+
+func (c *DigestAuthorizedClient) do(req *http.Request) (*http.Response, error) {
+	client := c.client()
+	err := c.authorize(req, nil)
+	if err != nil {
+		return nil, fmt.Errorf("DigestAuthClient: preauth: %w", err)
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("DigestAuthClient: Do: %v", err)
+		return nil, util.RequestError(req.Method, req.URL.Path, err)
 	}
 	if resp.StatusCode == http.StatusUnauthorized {
-		var err error
 		defer resp.Body.Close()
-		c.auth, err = gowebdav.NewDigestAuth(c.username, c.password, resp)
+		err = c.authorize(req, resp)
 		if err != nil {
-			return nil, fmt.Errorf("DigestAuthClient: digest auth create: %v", err)
+			return nil, fmt.Errorf("DigestAuthClient: postauth: %w", err)
 		}
-		err = c.auth.Authorize(client, req, req.URL.Path)
+		err = rewind(req)
 		if err != nil {
-			return nil, fmt.Errorf("DigestAuthClient: postauth: %v", err)
+			return nil, err
 		}
 		response, err := client.Do(req)
 		if err != nil {
-			return nil, util.Fatalf("postauth Do failed: %v", err)
+			return nil, util.RequestError(req.Method, req.URL.Path, err)
 		}
-		return response, nil
+		return checkStatus(req, response)
 
 	}
-	return resp, nil
+	return checkStatus(req, resp)
+}
+
+// checkStatus converts a non-2xx response into a *util.HTTPError
+func checkStatus(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, &util.HTTPError{
+		Method:     req.Method,
+		Path:       req.URL.Path,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Detail:     strings.TrimSpace(string(body)),
+	}
 }
 
 type CardClient struct {
@@ -78,34 +157,38 @@ type CardClient struct {
 }
 
 func NewClient(username, password, url, cert, key string, insecure bool) (*CardClient, error) {
+	return NewClientCtx(context.Background(), username, password, url, cert, key, insecure)
+}
+
+func NewClientCtx(ctx context.Context, username, password, url, cert, key string, insecure bool) (*CardClient, error) {
 	if url == "" {
 		var err error
-		url, err = discover(username)
+		url, err = discover(ctx, username)
 		if err != nil {
 			return nil, err
 		}
 	}
 	clientCert, err := tls.LoadX509KeyPair(cert, key)
 	if err != nil {
-		return nil, util.Fatalf("failed loading client certificate: %v", err)
+		return nil, util.Fatalf("failed loading client certificate: %w", err)
 	}
 	tlsConfig := &tls.Config{Certificates: []tls.Certificate{clientCert},
 		InsecureSkipVerify: insecure,
 	}
 	httpClient := &http.Client{
-		Transport: &http.Transport{
+		Transport: util.NewRateLimitedTransport(&http.Transport{
 			TLSClientConfig: tlsConfig,
 			IdleConnTimeout: 5 * time.Second,
-		},
+		}),
 	}
 
-	client := &DigestAuthorizedClient{httpClient, username, password, nil}
+	client := &DigestAuthorizedClient{c: httpClient, username: username, password: password, retry: util.NewRetryPolicy()}
 	dav, err := carddav.NewClient(client, url)
 	if err != nil {
-		return nil, util.Fatalf("failed creating webdav client: %v", err)
+		return nil, util.Fatalf("failed creating webdav client: %w", err)
 	}
 	c := CardClient{url, username, client, dav}
-	err = c.dav.HasSupport(context.Background())
+	err = c.dav.HasSupport(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -113,44 +196,50 @@ func NewClient(username, password, url, cert, key string, insecure bool) (*CardC
 }
 
 
-func discover(username string) (string, error) {
+func discover(ctx context.Context, username string) (string, error) {
 
 	fields := strings.Split(username, "@")
 	if len(fields) != 2 {
 		return "", util.Fatalf("invalid email address format: %s", username)
 	}
 	domain := fields[1]
-	url, err := carddav.DiscoverContextURL(context.Background(), domain)
+	url, err := carddav.DiscoverContextURL(ctx, domain)
 	if err != nil {
-		return "", util.Fatalf("failed carddav URL discovery for domain %s :%v", domain, err)
+		return "", util.Fatalf("failed carddav URL discovery for domain %s :%w", domain, err)
 	}
 	fmt.Printf("discovered url: %s\n", url)
 	return url, nil
 }
 
 func (c *CardClient) List() (*[]carddav.AddressBook, error) {
-	ctx := context.Background()
+	return c.ListCtx(context.Background())
+}
+
+func (c *CardClient) ListCtx(ctx context.Context) (*[]carddav.AddressBook, error) {
 	cup, err := c.dav.FindCurrentUserPrincipal(ctx)
 	if err != nil {
-		return nil, util.Fatalf("FindCurrentUserPrincipal failed: %v", err)
+		return nil, util.Fatalf("FindCurrentUserPrincipal failed: %w", err)
 	}
 	homeSet, err := c.dav.FindAddressBookHomeSet(ctx, cup)
 	if err != nil {
-		return nil, util.Fatalf("FindAddressBookHomeSet failed: %v", err)
+		return nil, util.Fatalf("FindAddressBookHomeSet failed: %w", err)
 	}
 	books, err := c.dav.FindAddressBooks(ctx, homeSet)
 	if err != nil {
-		return nil, util.Fatalf("FindAddressBookHomeSet failed: %v", err)
+		return nil, util.Fatalf("FindAddressBookHomeSet failed: %w", err)
 	}
 	return &books, nil
 }
 
 func (c *CardClient) Addresses(path string) (*[]carddav.AddressObject, error) {
-	ctx := context.Background()
+	return c.AddressesCtx(context.Background(), path)
+}
+
+func (c *CardClient) AddressesCtx(ctx context.Context, path string) (*[]carddav.AddressObject, error) {
 	query := carddav.AddressBookQuery{}
 	addrs, err := c.dav.QueryAddressBook(ctx, path, &query)
 	if err != nil {
-		return nil, util.Fatalf("QueryAddressBook failed: %v", err)
+		return nil, util.Fatalf("QueryAddressBook failed: %w", util.Classify(err, util.ErrBookNotFound, nil))
 	}
 	return &addrs, nil
 }
@@ -161,7 +250,7 @@ func GetAddressEmail(address carddav.AddressObject) (string, error) {
 	if field != nil {
 		return field.Value, nil
 	}
-	return "", util.Fatalf("null email address in %+v", address)
+	return "", util.Fatalf("%w: null email address in %+v", util.ErrAddressInvalid, address)
 }
 
 func GetAddressUUID(address carddav.AddressObject) (string, error) {
@@ -170,12 +259,15 @@ func GetAddressUUID(address carddav.AddressObject) (string, error) {
 	if field != nil {
 		return field.Value, nil
 	}
-	return "", util.Fatalf("null UUID in %+v", address)
+	return "", util.Fatalf("%w: null UUID in %+v", util.ErrAddressInvalid, address)
 }
 
 func (c *CardClient) AddAddress(bookname, email, name string) (*carddav.AddressObject, error) {
+	return c.AddAddressCtx(context.Background(), bookname, email, name)
+}
+
+func (c *CardClient) AddAddressCtx(ctx context.Context, bookname, email, name string) (*carddav.AddressObject, error) {
 	verbose := viper.GetBool("verbose")
-	ctx := context.Background()
 	uuid := uuid.New()
 	uri := util.BookURI(c.Username, bookname)
 	path := uri + uuid.String() + ".vcf"
@@ -192,12 +284,12 @@ func (c *CardClient) AddAddress(bookname, email, name string) (*carddav.AddressO
 		nameField.AdditionalName = name
 	}
 	card.SetName(&nameField)
-	result, err := c.dav.PutAddressObject(ctx, path, card)
+	err := c.put(ctx, path, card, Precondition{IfNoneMatch: true})
 	if err != nil {
 		return nil, err
 	}
 	if verbose {
-	    log.Printf("PutAddressObject: %+v\n", result)
+	    log.Printf("PutAddressObject: %s\n", path)
 	}
 	query := carddav.AddressBookQuery{
 		PropFilters: []carddav.PropFilter{
@@ -222,19 +314,33 @@ func (c *CardClient) AddAddress(bookname, email, name string) (*carddav.AddressO
 }
 
 func (c *CardClient) DeleteAddress(bookname, email string) (*[]carddav.AddressObject, error) {
-	ctx := context.Background()
-	uri := util.BookURI(c.Username, bookname)
-	addrs, err := c.QueryAddress(bookname, email)
+	return c.DeleteAddressCtx(context.Background(), bookname, email)
+}
+
+func (c *CardClient) DeleteAddressCtx(ctx context.Context, bookname, email string) (*[]carddav.AddressObject, error) {
+	return c.DeleteAddressIfCtx(ctx, bookname, email, Precondition{})
+}
+
+// DeleteAddressIfCtx deletes the address objects having an EMAIL equal to
+// email.  Each
+// delete is conditional on the ETag returned by the query, or on
+// cond.IfMatch if set, so an object modified concurrently is not removed.
+// An ETag identifies a single object, so cond.IfMatch is refused when more
+// than one object matches rather than deleting some of them.
+func (c *CardClient) DeleteAddressIfCtx(ctx context.Context, bookname, email string, cond Precondition) (*[]carddav.AddressObject, error) {
+	addrs, err := c.FindCardCtx(ctx, bookname, email)
 	if err != nil {
 		return nil, err
 	}
+	if cond.IfMatch != "" && len(*addrs) > 1 {
+		return nil, util.Fatalf("%w: If-Match applies to a single address, but %d match %s", util.ErrConflict, len(*addrs), email)
+	}
 	for _, addr := range *addrs {
-		uuid, err := GetAddressUUID(addr)
-		if err != nil {
-			return nil, err
+		ifMatch := cond.IfMatch
+		if ifMatch == "" {
+			ifMatch = addr.ETag
 		}
-		path := uri + uuid + ".vcf"
-		err = c.dav.RemoveAll(ctx, path)
+		err = c.delete(ctx, addr.Path, ifMatch)
 		if err != nil {
 			return nil, err
 		}
@@ -243,7 +349,10 @@ func (c *CardClient) DeleteAddress(bookname, email string) (*[]carddav.AddressOb
 }
 
 func (c *CardClient) QueryAddress(bookname, email string) (*[]carddav.AddressObject, error) {
-	ctx := context.Background()
+	return c.QueryAddressCtx(context.Background(), bookname, email)
+}
+
+func (c *CardClient) QueryAddressCtx(ctx context.Context, bookname, email string) (*[]carddav.AddressObject, error) {
 	uri := util.BookURI(c.Username, bookname)
 	query := carddav.AddressBookQuery{
 		PropFilters: []carddav.PropFilter{
@@ -259,14 +368,260 @@ func (c *CardClient) QueryAddress(bookname, email string) (*[]carddav.AddressObj
 	}
 	addrs, err := c.dav.QueryAddressBook(ctx, uri, &query)
 	if err != nil {
+		return nil, util.Classify(err, util.ErrBookNotFound, nil)
+	}
+	return &addrs, nil
+}
+
+func (c *CardClient) GetCard(bookname, uid string) (*carddav.AddressObject, error) {
+	return c.GetCardCtx(context.Background(), bookname, uid)
+}
+
+// GetCardCtx returns the address object with the given UID.  Cards written
+// by other clients may be stored at a path unrelated to the UID, so if the
+// path derived from the UID does not exist the book is queried for the UID.
+func (c *CardClient) GetCardCtx(ctx context.Context, bookname, uid string) (*carddav.AddressObject, error) {
+	path := util.BookURI(c.Username, bookname) + uid + ".vcf"
+	addr, err := c.dav.GetAddressObject(ctx, path)
+	if err == nil {
+		return addr, nil
+	}
+	err = util.Classify(err, util.ErrAddressNotFound, nil)
+	if !errors.Is(err, util.ErrAddressNotFound) {
 		return nil, err
 	}
+	query := carddav.AddressBookQuery{
+		PropFilters: []carddav.PropFilter{
+			carddav.PropFilter{
+				Name: "UID",
+				TextMatches: []carddav.TextMatch{
+					carddav.TextMatch{
+						Text:      uid,
+						MatchType: carddav.MatchEquals,
+					},
+				},
+			},
+		},
+	}
+	addrs, qerr := c.dav.QueryAddressBook(ctx, util.BookURI(c.Username, bookname), &query)
+	if qerr != nil {
+		return nil, util.Classify(qerr, util.ErrBookNotFound, nil)
+	}
+	if len(addrs) == 0 {
+		return nil, err
+	}
+	return &addrs[0], nil
+}
+
+func (c *CardClient) FindCard(bookname, email string) (*[]carddav.AddressObject, error) {
+	return c.FindCardCtx(context.Background(), bookname, email)
+}
+
+// FindCardCtx returns the address objects having an EMAIL equal to email
+func (c *CardClient) FindCardCtx(ctx context.Context, bookname, email string) (*[]carddav.AddressObject, error) {
+	uri := util.BookURI(c.Username, bookname)
+	query := carddav.AddressBookQuery{
+		PropFilters: []carddav.PropFilter{
+			carddav.PropFilter{
+				Name: "EMAIL",
+				TextMatches: []carddav.TextMatch{
+					carddav.TextMatch{
+						Text:      email,
+						MatchType: carddav.MatchEquals,
+					},
+				},
+			},
+		},
+	}
+	addrs, err := c.dav.QueryAddressBook(ctx, uri, &query)
+	if err != nil {
+		return nil, util.Classify(err, util.ErrBookNotFound, nil)
+	}
 	return &addrs, nil
 }
 
+func (c *CardClient) PutCard(bookname string, card vcard.Card, cond Precondition) (*carddav.AddressObject, error) {
+	return c.PutCardCtx(context.Background(), bookname, card, cond)
+}
+
+// PutCardCtx writes card to the path derived from its UID subject to cond,
+// returning the stored address object
+func (c *CardClient) PutCardCtx(ctx context.Context, bookname string, card vcard.Card, cond Precondition) (*carddav.AddressObject, error) {
+	uid := card.Value("UID")
+	if uid == "" {
+		return nil, util.Fatalf("%w: card has no UID", util.ErrAddressInvalid)
+	}
+	path := util.BookURI(c.Username, bookname) + uid + ".vcf"
+	return c.PutObjectCtx(ctx, path, card, cond)
+}
+
+func (c *CardClient) PutObject(path string, card vcard.Card, cond Precondition) (*carddav.AddressObject, error) {
+	return c.PutObjectCtx(context.Background(), path, card, cond)
+}
+
+// PutObjectCtx writes card to the address object at path subject to cond,
+// returning the stored address object.  Use it to replace a card read from
+// the server, whose path need not be derived from its UID.
+func (c *CardClient) PutObjectCtx(ctx context.Context, path string, card vcard.Card, cond Precondition) (*carddav.AddressObject, error) {
+	err := c.put(ctx, path, card, cond)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := c.dav.GetAddressObject(ctx, path)
+	if err != nil {
+		return nil, util.Classify(err, util.ErrAddressNotFound, nil)
+	}
+	return addr, nil
+}
+
+func (c *CardClient) DeleteCard(bookname, uid string, cond Precondition) error {
+	return c.DeleteCardCtx(context.Background(), bookname, uid, cond)
+}
+
+// DeleteCardCtx deletes the address object with the given UID subject to cond
+func (c *CardClient) DeleteCardCtx(ctx context.Context, bookname, uid string, cond Precondition) error {
+	path := util.BookURI(c.Username, bookname) + uid + ".vcf"
+	return c.delete(ctx, path, cond.IfMatch)
+}
+
+func (c *CardClient) DeleteObject(path string, cond Precondition) error {
+	return c.DeleteObjectCtx(context.Background(), path, cond)
+}
+
+// DeleteObjectCtx deletes the address object at path subject to cond
+func (c *CardClient) DeleteObjectCtx(ctx context.Context, path string, cond Precondition) error {
+	return c.delete(ctx, path, cond.IfMatch)
+}
+
+// Precondition restricts a write to a known state of the address object
+type Precondition struct {
+	IfMatch     string // ETag the object must currently have
+	IfNoneMatch bool   // the object must not exist
+}
+
+func quoteETag(etag string) string {
+	if strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
+// conditionalRequest returns a request for path with precondition headers
+func (c *CardClient) conditionalRequest(ctx context.Context, method, path string, body io.Reader, cond Precondition) (*http.Request, error) {
+	endpoint, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, util.Fatalf("failed parsing URL %s: %w", c.URL, err)
+	}
+	endpoint.Path = path
+	req, err := http.NewRequestWithContext(ctx, method, endpoint.String(), body)
+	if err != nil {
+		return nil, util.Fatalf("failed creating %s request: %w", method, err)
+	}
+	if cond.IfMatch != "" {
+		req.Header.Set("If-Match", quoteETag(cond.IfMatch))
+	}
+	if cond.IfNoneMatch {
+		req.Header.Set("If-None-Match", "*")
+	}
+	return req, nil
+}
+
+// conflict converts a failed precondition into a *util.ConflictError
+func conflict(err error, path string, cond Precondition) error {
+	var httpErr *util.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusPreconditionFailed {
+		ret := util.ConflictError{Path: path, ETag: cond.IfMatch, Err: err}
+		if cond.IfNoneMatch {
+			ret.Err = fmt.Errorf("%w: %w", util.ErrAddressExists, err)
+		}
+		return &ret
+	}
+	return err
+}
+
+func (c *CardClient) put(ctx context.Context, path string, card vcard.Card, cond Precondition) error {
+	var buf bytes.Buffer
+	err := vcard.NewEncoder(&buf).Encode(card)
+	if err != nil {
+		return util.Fatalf("failed encoding vCard: %w", err)
+	}
+	req, err := c.conditionalRequest(ctx, http.MethodPut, path, &buf, cond)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", vcard.MIMEType)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return conflict(util.Classify(err, util.ErrBookNotFound, util.ErrAddressExists), path, cond)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *CardClient) delete(ctx context.Context, path, ifMatch string) error {
+	cond := Precondition{IfMatch: ifMatch}
+	req, err := c.conditionalRequest(ctx, http.MethodDelete, path, nil, cond)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return conflict(util.Classify(err, util.ErrAddressNotFound, nil), path, cond)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *CardClient) SyncAddressBook(path, token string) (*carddav.SyncResponse, error) {
+	return c.SyncAddressBookCtx(context.Background(), path, token)
+}
+
+// SyncAddressBookCtx returns the address objects added or changed and the
+// paths of those deleted since token was issued.  An empty token returns the
+// entire book.  Errors wrap ErrSyncTokenInvalid when the server rejects the
+// token and ErrSyncUnsupported when it does not implement sync-collection.
+func (c *CardClient) SyncAddressBookCtx(ctx context.Context, path, token string) (*carddav.SyncResponse, error) {
+	response, err := c.dav.SyncCollection(ctx, path, &carddav.SyncQuery{SyncToken: token})
+	if err != nil {
+		var httpErr *util.HTTPError
+		if errors.As(err, &httpErr) {
+			switch httpErr.StatusCode {
+			case http.StatusForbidden, http.StatusConflict:
+				if token != "" {
+					return nil, fmt.Errorf("%w: %w", util.ErrSyncTokenInvalid, err)
+				}
+			case http.StatusNotFound:
+				return nil, util.Classify(err, util.ErrBookNotFound, nil)
+			case http.StatusBadRequest, http.StatusMethodNotAllowed, http.StatusNotImplemented, http.StatusUnsupportedMediaType:
+				return nil, fmt.Errorf("%w: %w", util.ErrSyncUnsupported, err)
+			}
+		}
+		return nil, err
+	}
+	if len(response.Updated) == 0 {
+		return response, nil
+	}
+	paths := make([]string, len(response.Updated))
+	for i, addr := range response.Updated {
+		paths[i] = addr.Path
+	}
+	updated, err := c.dav.MultiGetAddressBook(ctx, path, &carddav.AddressBookMultiGet{Paths: paths})
+	if err != nil {
+		return nil, err
+	}
+	response.Updated = updated
+	return response, nil
+}
+
 func (c *CardClient) ScanAddress(email string) (*[]carddav.AddressBook, error) {
+	return c.ScanAddressCtx(context.Background(), email)
+}
+
+// ScanAddressCtx returns the books holding a card with an EMAIL equal to
+// email
+func (c *CardClient) ScanAddressCtx(ctx context.Context, email string) (*[]carddav.AddressBook, error) {
 	result := []carddav.AddressBook{}
-	books, err := c.List()
+	books, err := c.ListCtx(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -276,7 +631,7 @@ func (c *CardClient) ScanAddress(email string) (*[]carddav.AddressBook, error) {
 		if err != nil {
 			return nil, err
 		}
-		addrs, err := c.QueryAddress(bookname, email)
+		addrs, err := c.FindCardCtx(ctx, bookname, email)
 		if err != nil {
 			return nil, err
 		}
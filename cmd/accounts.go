@@ -22,6 +22,7 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/rstms/mabctl/api"
@@ -30,41 +31,45 @@ import (
 )
 
 var resetFile string
+var accountsEncrypt bool
 
 var accountsCmd = &cobra.Command{
 	Use:   "accounts",
 	Short: "get user accounts",
 	Long: `
 Write the set of CardDAV usernames and passwords to stdout
+
+--reset sets the passwords from a JSON dict of username to password, or
+from the users of a dump file.  Files written with --encrypt, here or by
+dump, are decrypted using the --passphrase-fd or --passphrase-env
+passphrase.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 
 		var response *api.UserAccountsResponse
 		if resetFile != "" {
-			// reset accounts from JSON dict
-			var file *os.File
-			var err error
-			if resetFile == "-" {
-				// read from STDIN
-				file = os.Stdin
-			} else {
-				// read from file
-				file, err = os.Open(resetFile)
-				cobra.CheckErr(err)
-				defer file.Close()
-			}
-			var accounts map[string]string
-			decoder := json.NewDecoder(file)
-			err = decoder.Decode(&accounts)
-			cobra.CheckErr(err)
+			// reset accounts from JSON dict or dump file
+			data, err := readDecrypted(resetFile)
+			CheckErr(err)
+			accounts, err := readAccounts(data)
+			CheckErr(err)
 			request := api.UserAccountsRequest{Accounts: accounts}
-			response, err = MAB.SetAccounts(&request)
-			cobra.CheckErr(err)
+			response, err = MAB.SetAccountsCtx(cmd.Context(), &request)
+			CheckErr(err)
 		} else {
 			// don't set accounts, just get them
 			var err error
-			response, err = MAB.GetAccounts()
-			cobra.CheckErr(err)
+			response, err = MAB.GetAccountsCtx(cmd.Context())
+			CheckErr(err)
+		}
+		if accountsEncrypt {
+			data, err := json.MarshalIndent(response.Accounts, "", "  ")
+			CheckErr(err)
+			data, err = encryptOutput(data)
+			CheckErr(err)
+			_, err = os.Stdout.Write(data)
+			CheckErr(err)
+			return
 		}
 		if !HandleResponse(response, response.Accounts) {
 			for username, password := range response.Accounts {
@@ -75,6 +80,32 @@ Write the set of CardDAV usernames and passwords to stdout
 }
 
 func init() {
-	accountsCmd.Flags().StringVarP(&resetFile, "reset", "r", "", "reset accounts from JSON dict file (- reads from stdin)")
+	accountsCmd.Flags().StringVarP(&resetFile, "reset", "r", "", "reset accounts from JSON dict or dump file (- reads from stdin)")
+	accountsCmd.Flags().BoolVar(&accountsEncrypt, "encrypt", false, "encrypt the JSON output with the passphrase")
 	rootCmd.AddCommand(accountsCmd)
 }
+
+// readAccounts decodes a JSON dict of username to password; a dump file
+// yields the password of each user in the dump
+func readAccounts(data []byte) (map[string]string, error) {
+	var header struct {
+		Format string `json:"format"`
+	}
+	if json.Unmarshal(data, &header) == nil && header.Format == api.DUMP_FORMAT {
+		dump, err := api.ReadDump(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		accounts := make(map[string]string)
+		for username, user := range dump.Users {
+			accounts[username] = user.Password
+		}
+		return accounts, nil
+	}
+	var accounts map[string]string
+	err := json.Unmarshal(data, &accounts)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding accounts: %w", err)
+	}
+	return accounts, nil
+}
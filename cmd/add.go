@@ -23,15 +23,21 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/rstms/mabctl/api"
 	"github.com/spf13/cobra"
 )
 
+var addCondition api.Precondition
+
 var addCmd = &cobra.Command{
 	Use:   "add USERNAME BOOKNAME EMAIL [NAME]",
 	Short: "add email adddress",
 	Long: `
 Add an email address to the CardDAV address book BOOKNAME under the user
-account USERNAME
+account USERNAME.  The address exists if the book has an address equal to
+EMAIL, ignoring case; an address merely containing EMAIL does not count.
+With --if-none-match, fail if the address exists.  With --if-match, fail
+unless the address exists with the given ETag.
 `,
 	Args: cobra.RangeArgs(3, 4),
 	Run: func(cmd *cobra.Command, args []string) {
@@ -42,8 +48,8 @@ account USERNAME
 		if len(args) > 3 {
 			name = args[3]
 		}
-		response, err := MAB.AddAddress(nil, username, bookname, email, name)
-		cobra.CheckErr(err)
+		response, err := MAB.AddAddressIfCtx(cmd.Context(), username, bookname, email, name, addCondition)
+		CheckErr(err)
 		if !HandleResponse(response, response.Address) {
 			fmt.Println(response.Address.Path)
 		}
@@ -51,5 +57,7 @@ account USERNAME
 }
 
 func init() {
+	addCmd.Flags().StringVar(&addCondition.IfMatch, "if-match", "", "require existing address ETag")
+	addCmd.Flags().BoolVar(&addCondition.IfNoneMatch, "if-none-match", false, "require address not to exist")
 	rootCmd.AddCommand(addCmd)
 }
@@ -41,8 +41,8 @@ The exit code is 0 if the address exists in the address book.
 		username := args[0]
 		bookname := args[1]
 		email := args[2]
-		response, err := MAB.QueryAddress(username, bookname, email)
-		cobra.CheckErr(err)
+		response, err := MAB.QueryAddressCtx(cmd.Context(), username, bookname, email)
+		CheckErr(err)
 		exitCode := 1
 		if response.Address == nil {
 		    exitCode = 1
@@ -51,7 +51,7 @@ The exit code is 0 if the address exists in the address book.
 			if !viper.GetBool("quiet") {
 			    if response.Address != nil {
 			    email, err := MAB.EmailAddress(*response.Address)
-			    cobra.CheckErr(err)
+			    CheckErr(err)
 			    fmt.Println(email)
 			    }
 			}
@@ -37,8 +37,8 @@ Output email addresses from address book identified by USERNAME and BOOK_NAME.
 	Run: func(cmd *cobra.Command, args []string) {
 		username := args[0]
 		booktoken := args[1]
-		response, err := MAB.Addresses(nil, username, booktoken)
-		cobra.CheckErr(err)
+		response, err := MAB.AddressesCtx(cmd.Context(), username, booktoken)
+		CheckErr(err)
 		if !HandleResponse(response, response.Addresses) {
 			for _, addr := range response.Addresses {
 				fmt.Println(addr)
@@ -0,0 +1,99 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var applyFile string
+var applyPrune bool
+var applyDryRun bool
+
+var applyCmd = &cobra.Command{
+	Use:   "apply -f FILE",
+	Short: "reconcile the server with a declared state",
+	Long: `
+Read the desired users, books and addresses from a YAML state file ('-'
+reads from STDIN), print the differences from the server, then make the
+changes.  Applying the same file again makes no changes.
+
+  users:
+    alice@example.org:
+      displayname: Alice Example
+      password: secret        # optional; only used when creating the user
+      books:
+        work:
+          description: Work Contacts
+          addresses:
+            - boss@example.com
+            - Peer Person <peer@example.com>
+            - email: other@example.com
+              name: Other Person
+
+Users which are not declared are never changed.  Books and addresses of a
+declared user which are not declared are left in place unless --prune is
+given, which requires --force.  The display name and password of existing
+users and the description of existing books are not updated.
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if applyFile == "" {
+			CheckErr(fmt.Errorf("state file required: -f FILE"))
+		}
+		data, err := readInput(applyFile)
+		CheckErr(err)
+		state, err := api.ReadState(bytes.NewReader(data))
+		CheckErr(err)
+		diff, err := api.DiffState(cmd.Context(), MAB, state, applyPrune)
+		CheckErr(err)
+		if applyDryRun {
+			if !HandleResponse(diff, diff) {
+				fmt.Println(diff.Text())
+			}
+			return
+		}
+		if applyPrune && !viper.GetBool("force") {
+			CheckErr(fmt.Errorf("--prune requires --force"))
+		}
+		if !viper.GetBool("json") && !viper.GetBool("verbose") && !viper.GetBool("quiet") {
+			fmt.Println(diff.Text())
+		}
+		response, err := api.ApplyState(cmd.Context(), MAB, diff)
+		CheckErr(err)
+		if !HandleResponse(response, diff) {
+			fmt.Println(response.Message)
+		}
+	},
+}
+
+func init() {
+	applyCmd.Flags().StringVarP(&applyFile, "file", "f", "", "state file (- reads from stdin)")
+	applyCmd.Flags().BoolVar(&applyPrune, "prune", false, "delete books and addresses of declared users which are not declared")
+	applyCmd.Flags().BoolVar(&applyDryRun, "dry-run", false, "print the differences without changing the server")
+	rootCmd.AddCommand(applyCmd)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var backupUser string
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "write a rotated backup",
+	Long: `
+Dump all users, or the --user, into a compressed, timestamped file in the
+backup directory, verify it by reading it back, add it to the directory's
+index, and prune old backups according to the retention policy.
+
+The policy keeps the newest backup of each of the most recent --keep-daily
+days, --keep-weekly ISO weeks and --keep-monthly months, separately for the
+backups of all users and for the backups of each --user.  The newest backup
+of each is always kept; setting all three to 0 disables pruning.  The directory,
+policy and encryption may be set in the config file as mabctl.backup.dir,
+mabctl.backup.daily, mabctl.backup.weekly, mabctl.backup.monthly and
+mabctl.backup.encrypt.  With --encrypt, backups are encrypted with the
+--passphrase-fd or --passphrase-env passphrase.
+
+Use the list, restore and prune subcommands to manage the backups.
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		store := backupStore()
+		var key []byte
+		if viper.GetBool("mabctl.backup.encrypt") {
+			var err error
+			key, err = readPassphrase()
+			CheckErr(err)
+		}
+		response, err := api.Backup(cmd.Context(), MAB, store, backupUser, key, backupPolicy())
+		CheckErr(err)
+		if !HandleResponse(response, response) {
+			PrintResponse(response.Message)
+			for _, backup := range response.Pruned {
+				PrintResponse(fmt.Sprintf("pruned %s", backup.ID))
+			}
+		}
+	},
+}
+
+// backupStore returns the configured backup directory
+func backupStore() *api.BackupStore {
+	dir := viper.GetString("mabctl.backup.dir")
+	if dir == "" {
+		CheckErr(fmt.Errorf("no backup directory: set mabctl.backup.dir or use --dir"))
+	}
+	store, err := api.NewBackupStore(pathname(dir))
+	CheckErr(err)
+	return store
+}
+
+// backupPolicy returns the configured retention policy
+func backupPolicy() api.BackupPolicy {
+	return api.BackupPolicy{
+		Daily:   viper.GetInt("mabctl.backup.daily"),
+		Weekly:  viper.GetInt("mabctl.backup.weekly"),
+		Monthly: viper.GetInt("mabctl.backup.monthly"),
+	}
+}
+
+func init() {
+	flags := backupCmd.PersistentFlags()
+	flags.String("dir", "", "backup directory")
+	flags.Int("keep-daily", 7, "number of daily backups to keep")
+	flags.Int("keep-weekly", 4, "number of weekly backups to keep")
+	flags.Int("keep-monthly", 12, "number of monthly backups to keep")
+	backupCmd.Flags().Bool("encrypt", false, "encrypt the backup with the passphrase")
+	backupCmd.Flags().StringVar(&backupUser, "user", "", "backup username")
+	keys := map[string]string{
+		"dir":          "mabctl.backup.dir",
+		"keep-daily":   "mabctl.backup.daily",
+		"keep-weekly":  "mabctl.backup.weekly",
+		"keep-monthly": "mabctl.backup.monthly",
+	}
+	for name, key := range keys {
+		viper.BindPFlag(key, flags.Lookup(name))
+	}
+	viper.BindPFlag("mabctl.backup.encrypt", backupCmd.Flags().Lookup("encrypt"))
+	rootCmd.AddCommand(backupCmd)
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var backupPruneDryRun bool
+
+var backupPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "delete expired backups",
+	Long: `
+Delete the backups which the retention policy does not keep, as backup does
+after writing each backup.  With --dry-run the expired backups are listed
+but not deleted.
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		pruned, err := backupStore().Prune(backupPolicy(), backupPruneDryRun)
+		CheckErr(err)
+		if !HandleResponse(pruned, pruned) {
+			verb := "pruned"
+			if backupPruneDryRun {
+				verb = "expired"
+			}
+			for _, backup := range pruned {
+				PrintResponse(fmt.Sprintf("%s %s", verb, backup.ID))
+			}
+		}
+	},
+}
+
+func init() {
+	backupPruneCmd.Flags().BoolVar(&backupPruneDryRun, "dry-run", false, "list expired backups without deleting them")
+	backupCmd.AddCommand(backupPruneCmd)
+}
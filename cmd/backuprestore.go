@@ -0,0 +1,61 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var backupRestoreCmd = &cobra.Command{
+	Use:   "restore ID",
+	Short: "restore a backup",
+	Long: `
+Restore the backup ID, as shown by backup list, or 'latest' for the newest
+backup.  The backup's checksum is verified before it is read.  Encrypted
+backups use the --passphrase-fd or --passphrase-env passphrase.  The flags
+and modes are those of the restore command; an interrupted restore recorded
+with --journal is continued with restore --resume.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store := backupStore()
+		entry, err := store.Find(args[0])
+		CheckErr(err)
+		var key []byte
+		if entry.Encrypted {
+			key, err = readPassphrase()
+			CheckErr(err)
+		}
+		dump, err := store.Load(entry, key)
+		CheckErr(err)
+		restoreDump(cmd, dump)
+	},
+}
+
+func init() {
+	backupRestoreCmd.Flags().StringVar(&restoreUser, "user", "", "restore username")
+	backupRestoreCmd.Flags().StringVar(&restoreMode, "mode", "", "restore mode: merge, replace or sync")
+	backupRestoreCmd.Flags().BoolVar(&restoreDryRun, "dry-run", false, "print the restore plan without changing the server")
+	backupRestoreCmd.Flags().StringVar(&restorePlanOut, "plan-out", "", "write the restore plan to a file (implies --dry-run)")
+	backupRestoreCmd.Flags().StringVar(&restoreJournal, "journal", "", "record restore progress in a new journal file")
+	backupCmd.AddCommand(backupRestoreCmd)
+}
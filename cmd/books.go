@@ -35,8 +35,8 @@ List address boooks for a user account.
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		username := args[0]
-		response, err := MAB.GetBooks(username)
-		cobra.CheckErr(err)
+		response, err := MAB.GetBooksCtx(cmd.Context(), username)
+		CheckErr(err)
 		if !HandleResponse(response, response.Books) {
 			for _, book := range response.Books {
 				fmt.Println(book.BookName)
@@ -0,0 +1,343 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/rstms/mabctl/memory"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func initMemory(t *testing.T) *memory.Controller {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte("mabctl:\n  domain: example.org\n"), 0600)
+	require.Nil(t, err)
+	cfgFile = configFile
+	mab := memory.NewAddressBookController()
+	newController = func() (api.AddressBookManager, error) {
+		return mab, nil
+	}
+	return mab
+}
+
+func resetFlags(flag *pflag.Flag) {
+	if flag.Name != "config" {
+		value := flag.DefValue
+		if _, ok := flag.Value.(pflag.SliceValue); ok {
+			// slice defaults are formatted as [a,b]
+			value = strings.Trim(value, "[]")
+		}
+		flag.Value.Set(value)
+		flag.Changed = false
+	}
+}
+
+func run(t *testing.T, args ...string) string {
+	rootCmd.PersistentFlags().VisitAll(resetFlags)
+	for _, cmd := range rootCmd.Commands() {
+		cmd.Flags().VisitAll(resetFlags)
+	}
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	require.Nil(t, err)
+	os.Stdout = w
+	rootCmd.SetArgs(append([]string{"--config", cfgFile}, args...))
+	err = rootCmd.Execute()
+	w.Close()
+	os.Stdout = stdout
+	viper.Set("json", nil)
+	require.Nil(t, err)
+	output, err := io.ReadAll(r)
+	require.Nil(t, err)
+	return string(output)
+}
+
+func TestCommandTimeout(t *testing.T) {
+	initMemory(t)
+	viper.Set("mabctl.timeout", time.Second)
+	defer viper.Set("mabctl.timeout", nil)
+	for _, name := range []string{"policyd", "milter", "serve", "watch"} {
+		cmd, _, err := rootCmd.Find([]string{name})
+		require.Nil(t, err)
+		require.Zero(t, commandTimeout(cmd), name)
+	}
+	cmd, _, err := rootCmd.Find([]string{"dump"})
+	require.Nil(t, err)
+	require.Equal(t, time.Second, commandTimeout(cmd))
+}
+
+func TestUserBookAddress(t *testing.T) {
+	initMemory(t)
+
+	output := run(t, "mkuser", "user@example.org", "Test User", "secret")
+	require.Equal(t, "created: user@example.org\n", output)
+
+	output = run(t, "mkbook", "user@example.org", "friends")
+	require.Contains(t, output, "/dav.php/addressbooks/user@example.org/user-example-org-friends/")
+
+	run(t, "add", "user@example.org", "friends", "friend@example.com", "Good Friend")
+	run(t, "add", "user@example.org", "friends", "pal@example.com")
+
+	output = run(t, "addrs", "user@example.org", "friends")
+	require.ElementsMatch(t, []string{"friend@example.com", "pal@example.com"}, strings.Fields(output))
+
+	output = run(t, "delete", "user@example.org", "friends", "pal@example.com")
+	require.Equal(t, "Deleted: pal@example.com\n", output)
+
+	output = run(t, "--json", "books", "user@example.org")
+	var books []api.Book
+	err := json.Unmarshal([]byte(output), &books)
+	require.Nil(t, err)
+	require.Len(t, books, 1)
+	require.Equal(t, "friends", books[0].BookName)
+	require.Equal(t, 1, books[0].Contacts)
+
+	output = run(t, "passwd", "user@example.org")
+	require.Equal(t, "secret\n", output)
+}
+
+func TestDumpRestore(t *testing.T) {
+	mab := initMemory(t)
+
+	run(t, "mkuser", "user@example.org")
+	run(t, "mkbook", "user@example.org", "work")
+	run(t, "add", "user@example.org", "work", "boss@example.com")
+
+	output := run(t, "dump")
+	dump, err := api.ReadDump(strings.NewReader(output))
+	require.Nil(t, err)
+	emails, err := dump.Users["user@example.org"].Books["work"].Emails()
+	require.Nil(t, err)
+	require.Equal(t, []string{"boss@example.com"}, emails)
+
+	dumpFile := filepath.Join(t.TempDir(), "dump.json")
+	err = os.WriteFile(dumpFile, []byte(output), 0600)
+	require.Nil(t, err)
+
+	run(t, "destroy")
+	users, err := mab.GetUsersCtx(context.Background())
+	require.Nil(t, err)
+	require.Empty(t, users.Users)
+
+	run(t, "restore", dumpFile)
+	output = run(t, "addrs", "user@example.org", "work")
+	require.Equal(t, "boss@example.com\n", output)
+}
+
+func TestRestoreDefaultBook(t *testing.T) {
+	mab := initMemory(t)
+	ctx := context.Background()
+
+	legacy := `{"Users": {"user@example.org": {"Password": "secret", "Books": {"default address book": ["pal@example.com"], "work": ["boss@example.com"]}}}}`
+	dump, err := api.ReadDump(strings.NewReader(legacy))
+	require.Nil(t, err)
+	_, err = mab.RestoreCtx(ctx, dump, "", nil)
+	require.Nil(t, err)
+	books, err := mab.GetBooksCtx(ctx, "user@example.org")
+	require.Nil(t, err)
+	require.Len(t, books.Books, 1)
+	require.Equal(t, "work", books.Books[0].BookName)
+}
+
+func TestRestoreJournalMissingBook(t *testing.T) {
+	mab := initMemory(t)
+	ctx := context.Background()
+
+	run(t, "mkuser", "user@example.org")
+	run(t, "mkbook", "user@example.org", "work")
+	run(t, "add", "user@example.org", "work", "boss@example.com")
+	response, err := mab.DumpCtx(ctx, "")
+	require.Nil(t, err)
+
+	// the journal shows the book restored, but it was deleted since
+	journal, err := api.CreateJournal(filepath.Join(t.TempDir(), "journal"), &response.Dump, api.RESTORE_MERGE, "")
+	require.Nil(t, err)
+	defer journal.Close()
+	for _, entry := range []api.JournalEntry{
+		{Action: api.PLAN_CREATE, Kind: api.PLAN_USER, Username: "user@example.org"},
+		{Action: api.PLAN_CREATE, Kind: api.PLAN_BOOK, Username: "user@example.org", Bookname: "work"},
+	} {
+		require.Nil(t, journal.Record(entry))
+	}
+	run(t, "rmbook", "user@example.org", "work")
+
+	restored, err := mab.RestoreCtx(ctx, &response.Dump, "", journal)
+	require.ErrorIs(t, err, api.ErrRestoreIncomplete)
+	require.Len(t, restored.Failures, 1)
+	require.Contains(t, restored.Failures[0].Error, "work")
+}
+
+func TestApply(t *testing.T) {
+	mab := initMemory(t)
+
+	run(t, "mkuser", "user@example.org")
+	run(t, "mkbook", "user@example.org", "old")
+	run(t, "mkbook", "user@example.org", "work")
+	run(t, "add", "user@example.org", "work", "stale@example.com")
+	// unmanaged addresses containing the declared ones
+	run(t, "add", "user@example.org", "work", "bigboss@example.com")
+	run(t, "add", "user@example.org", "work", "eer@example.com")
+	run(t, "mkuser", "other@example.org")
+
+	stateFile := filepath.Join(t.TempDir(), "state.yaml")
+	err := os.WriteFile(stateFile, []byte(`
+users:
+  user@example.org:
+    books:
+      work:
+        addresses:
+          - boss@example.com
+          - Peer Person <peer@example.com>
+  new@example.org:
+    displayname: New User
+    password: secret
+    books:
+      friends:
+        description: Good Friends
+        addresses:
+          - email: pal@example.com
+            name: Best Pal
+`), 0600)
+	require.Nil(t, err)
+
+	output := run(t, "apply", "--dry-run", "-f", stateFile)
+	require.Equal(t, `+ user new@example.org
++ book new@example.org/friends
++ address new@example.org/friends/pal@example.com
++ address user@example.org/work/boss@example.com
++ address user@example.org/work/peer@example.com
+4 unmanaged items (use --prune to remove)
+`, output)
+
+	output = run(t, "apply", "-f", stateFile)
+	require.Contains(t, output, "applied 5 changes\n")
+	require.Equal(t, "secret\n", run(t, "passwd", "new@example.org"))
+	contact, err := mab.GetContactCtx(context.Background(), "new@example.org", "friends", "pal@example.com")
+	require.Nil(t, err)
+	require.Equal(t, "Best", contact.Contact.GivenName)
+
+	output = run(t, "apply", "-f", stateFile)
+	require.Equal(t, "no changes\n4 unmanaged items (use --prune to remove)\napplied 0 changes\n", output)
+
+	output = run(t, "--force", "apply", "--prune", "-f", stateFile)
+	require.Contains(t, output, "- address user@example.org/work/stale@example.com\n")
+	require.Contains(t, output, "- book user@example.org/old\n")
+	require.Contains(t, output, "- address user@example.org/work/eer@example.com\n")
+	require.ElementsMatch(t, []string{"boss@example.com", "peer@example.com"}, strings.Fields(run(t, "addrs", "user@example.org", "work")))
+	require.Equal(t, "new@example.org\nother@example.org\nuser@example.org\n", run(t, "users"))
+
+	output = run(t, "--force", "apply", "--prune", "-f", stateFile)
+	require.Equal(t, "no changes\napplied 0 changes\n", output)
+}
+
+func TestEvents(t *testing.T) {
+	initMemory(t)
+
+	run(t, "mkuser", "user@example.org")
+	run(t, "mkbook", "user@example.org", "work")
+	run(t, "add", "user@example.org", "work", "boss@example.com")
+
+	stderr := os.Stderr
+	r, w, err := os.Pipe()
+	require.Nil(t, err)
+	os.Stderr = w
+	run(t, "--events", "jsonl", "dump")
+	run(t, "--progress", "dump")
+	w.Close()
+	os.Stderr = stderr
+	output, err := io.ReadAll(r)
+	require.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	types := []string{}
+	for _, line := range lines[:len(lines)-1] {
+		var event api.Event
+		err := json.Unmarshal([]byte(line), &event)
+		require.Nil(t, err)
+		require.Equal(t, "dump", event.Operation)
+		types = append(types, event.Type)
+	}
+	require.Equal(t, []string{api.EVENT_START, api.EVENT_ADDRESS, api.EVENT_BOOK, api.EVENT_USER, api.EVENT_DONE}, types)
+	require.Equal(t, "dump [1/1] user@example.org: 1 books, 1 addresses", lines[len(lines)-1])
+}
+
+func TestImport(t *testing.T) {
+	initMemory(t)
+
+	run(t, "mkuser", "user@example.org")
+	run(t, "mkbook", "user@example.org", "friends")
+	run(t, "add", "user@example.org", "friends", "friend@example.com")
+
+	filename := filepath.Join(t.TempDir(), "friends.csv")
+	err := os.WriteFile(filename, []byte("Display Name,E-mail Address\nFriend,friend@example.com\nPal,pal@example.com\n"), 0600)
+	require.Nil(t, err)
+	output := run(t, "import", "user@example.org", "friends", filename)
+	require.Equal(t, "added 1, skipped 1, invalid 0\n", output)
+
+	output = run(t, "addrs", "user@example.org", "friends")
+	require.ElementsMatch(t, []string{"friend@example.com", "pal@example.com"}, strings.Fields(output))
+}
+
+func TestExport(t *testing.T) {
+	initMemory(t)
+
+	run(t, "mkuser", "user@example.org")
+	run(t, "mkbook", "user@example.org", "friends")
+	run(t, "mkbook", "user@example.org", "work")
+	run(t, "add", "user@example.org", "friends", "friend@example.com", "Good Friend")
+	run(t, "add", "user@example.org", "work", "boss@example.com")
+
+	output := run(t, "export", "user@example.org", "friends", "--format", "csv")
+	require.Contains(t, output, "Good,Friend,Good Friend,,friend@example.com,")
+
+	dir := filepath.Join(t.TempDir(), "books")
+	output = run(t, "export", "user@example.org", "--all", "--format", "ldif", "--output", dir)
+	require.Contains(t, output, "work: 1 cards -> "+filepath.Join(dir, "work.ldif"))
+	data, err := os.ReadFile(filepath.Join(dir, "friends.ldif"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "mail: friend@example.com\n")
+}
+
+func TestLearn(t *testing.T) {
+	initMemory(t)
+
+	run(t, "mkuser", "user@example.org")
+	run(t, "mkbook", "user@example.org", "friends")
+	run(t, "add", "user@example.org", "friends", "friend@example.com")
+
+	maildir := filepath.Join(t.TempDir(), ".Sent")
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		require.Nil(t, os.MkdirAll(filepath.Join(maildir, sub), 0700))
+	}
+	messages := []string{
+		"From: User <user@example.org>\r\nTo: \"Good Friend\" <friend@example.com>, Pal <pal@example.com>\r\nCc: noreply@example.net\r\nSubject: hi\r\n\r\nhello\r\n",
+		"From: user@example.org\nTo: pal@example.com\nBcc: =?utf-8?q?J=C3=BCrgen?= <jurgen@example.de>, user@example.org\nSubject: again\n\nhello\n",
+	}
+	for i, message := range messages {
+		err := os.WriteFile(filepath.Join(maildir, "cur", fmt.Sprintf("%d.msg:2,S", i)), []byte(message), 0600)
+		require.Nil(t, err)
+	}
+
+	output := run(t, "learn", "user@example.org", "--book", "friends", "--maildir", maildir, "--dry-run")
+	require.Equal(t, "would add 2, skipped 4, invalid 0\n", output)
+	output = run(t, "learn", "user@example.org", "--book", "sent", "--maildir", maildir, "--create", "--dry-run")
+	require.Equal(t, "would add 3, skipped 3, invalid 0\n", output)
+
+	output = run(t, "learn", "user@example.org", "--book", "friends", "--maildir", maildir)
+	require.Equal(t, "added 2, skipped 4, invalid 0\n", output)
+	output = run(t, "addrs", "user@example.org", "friends")
+	require.ElementsMatch(t, []string{"friend@example.com", "pal@example.com", "jurgen@example.de"}, strings.Fields(output))
+
+	output = run(t, "learn", "user@example.org", "--book", "friends", "--maildir", maildir, "--exclude", "*.de,noreply@*")
+	require.Equal(t, "added 0, skipped 6, invalid 0\n", output)
+}
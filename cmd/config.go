@@ -38,14 +38,14 @@ Output configuration in YAML format."
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		tempfile, err := os.CreateTemp("", "temp-config-*")
-		cobra.CheckErr(err)
+		CheckErr(err)
 		defer os.Remove(tempfile.Name())
 		err = api.SetDefaults()
-		cobra.CheckErr(err)
+		CheckErr(err)
 		err = viper.WriteConfigAs(tempfile.Name())
-		cobra.CheckErr(err)
+		CheckErr(err)
 		data, err := os.ReadFile(tempfile.Name())
-		cobra.CheckErr(err)
+		CheckErr(err)
 		fmt.Println(string(data))
 	},
 }
@@ -0,0 +1,76 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/cobra"
+)
+
+var contactCmd = &cobra.Command{
+	Use:   "contact",
+	Short: "manage vCard contacts",
+	Long: `
+Display and modify the full vCard contact data of address book entries.
+Contacts are identified by email address or vCard UID.
+`,
+}
+
+func init() {
+	rootCmd.AddCommand(contactCmd)
+}
+
+// PrintContact writes a contact in human readable form
+func PrintContact(contact *api.Contact) {
+	fields := []struct {
+		label string
+		value string
+	}{
+		{"uid", contact.UID},
+		{"name", contact.FullName},
+		{"given", contact.GivenName},
+		{"family", contact.FamilyName},
+		{"org", contact.Organization},
+		{"title", contact.Title},
+		{"categories", strings.Join(contact.Categories, ",")},
+		{"etag", contact.ETag},
+	}
+	for _, field := range fields {
+		if field.value != "" {
+			fmt.Printf("%s: %s\n", field.label, field.value)
+		}
+	}
+	for _, email := range contact.Emails {
+		fmt.Printf("email: %s\n", email)
+	}
+	for _, phone := range contact.Phones {
+		fmt.Printf("phone: %s\n", phone)
+	}
+	for _, line := range strings.Split(contact.Notes, "\n") {
+		if line != "" {
+			fmt.Printf("note: %s\n", line)
+		}
+	}
+}
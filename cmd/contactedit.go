@@ -0,0 +1,131 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/cobra"
+)
+
+var contactFile string
+
+var contactEditCmd = &cobra.Command{
+	Use:   "edit USERNAME BOOKNAME EMAIL|UID",
+	Short: "edit a contact",
+	Long: `
+Edit the vCard contact identified by EMAIL or UID as JSON using $VISUAL or
+$EDITOR, then write the result back to the address book.  Fields removed
+in the editor are removed from the contact.  With --file, read the edited
+JSON from FILE ('-' reads from STDIN) instead of running an editor.  The
+write fails if the contact was modified elsewhere while being edited.
+`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+		bookname := args[1]
+		response, err := MAB.GetContactCtx(cmd.Context(), username, bookname, args[2])
+		CheckErr(err)
+		original := *response.Contact
+		original.Path = ""
+		original.ETag = ""
+
+		var data []byte
+		if contactFile != "" {
+			data, err = readInput(contactFile)
+		} else {
+			data, err = editContact(&original)
+		}
+		CheckErr(err)
+		var edited api.Contact
+		err = json.Unmarshal(data, &edited)
+		CheckErr(err)
+		if edited.UID == "" {
+			edited.UID = original.UID
+		}
+		if edited.UID != original.UID {
+			CheckErr(fmt.Errorf("UID may not be changed: %s", edited.UID))
+		}
+		if reflect.DeepEqual(edited, original) {
+			fmt.Println("unchanged")
+			return
+		}
+		edited.ETag = response.Contact.ETag
+		response, err = MAB.PutContactCtx(cmd.Context(), username, bookname, &edited)
+		CheckErr(err)
+		if !HandleResponse(response, response.Contact) {
+			fmt.Println(response.Message)
+		}
+	},
+}
+
+func init() {
+	contactEditCmd.Flags().StringVarP(&contactFile, "file", "f", "", "read edited contact JSON from file (- reads from stdin)")
+	contactCmd.AddCommand(contactEditCmd)
+}
+
+func readInput(filename string) ([]byte, error) {
+	if filename == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(filename)
+}
+
+// editContact runs the user's editor on the contact's JSON representation
+func editContact(contact *api.Contact) ([]byte, error) {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	file, err := os.CreateTemp("", "mabctl-contact-*.json")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(contact)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	command := strings.Fields(editor)
+	editCmd := exec.Command(command[0], append(command[1:], file.Name())...)
+	editCmd.Stdin = os.Stdin
+	editCmd.Stdout = os.Stdout
+	editCmd.Stderr = os.Stderr
+	err = editCmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("editor failed: %w", err)
+	}
+	return os.ReadFile(file.Name())
+}
@@ -0,0 +1,77 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/cobra"
+)
+
+var contactUpdate api.Contact
+
+var contactSetCmd = &cobra.Command{
+	Use:   "set USERNAME BOOKNAME EMAIL|UID",
+	Short: "create or update a contact",
+	Long: `
+Set fields of the vCard contact identified by EMAIL or UID.  Only the fields
+given as options are changed; list options replace the existing list.  If
+no contact matches EMAIL, a new contact with that address is created.
+With --if-match, the update fails unless the contact has the given ETag.
+`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+		bookname := args[1]
+		id := args[2]
+		response, err := MAB.UpdateContactCtx(cmd.Context(), username, bookname, id, &contactUpdate)
+		if errors.Is(err, api.ErrAddressNotFound) && strings.Contains(id, "@") {
+			contact := contactUpdate
+			if len(contact.Emails) == 0 {
+				contact.Emails = []string{id}
+			}
+			response, err = MAB.PutContactCtx(cmd.Context(), username, bookname, &contact)
+		}
+		CheckErr(err)
+		if !HandleResponse(response, response.Contact) {
+			fmt.Println(response.Message)
+		}
+	},
+}
+
+func init() {
+	flags := contactSetCmd.Flags()
+	flags.StringVar(&contactUpdate.FullName, "name", "", "formatted name")
+	flags.StringVar(&contactUpdate.GivenName, "given", "", "given name")
+	flags.StringVar(&contactUpdate.FamilyName, "family", "", "family name")
+	flags.StringSliceVar(&contactUpdate.Emails, "email", nil, "email addresses")
+	flags.StringSliceVar(&contactUpdate.Phones, "phone", nil, "telephone numbers")
+	flags.StringVar(&contactUpdate.Organization, "org", "", "organization")
+	flags.StringVar(&contactUpdate.Title, "title", "", "job title")
+	flags.StringVar(&contactUpdate.Notes, "note", "", "notes")
+	flags.StringSliceVar(&contactUpdate.Categories, "category", nil, "categories")
+	flags.StringVar(&contactUpdate.ETag, "if-match", "", "require contact ETag")
+	contactCmd.AddCommand(contactSetCmd)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rstms/mabctl/util"
+	"github.com/spf13/viper"
+)
+
+// passphrase is cached so that several encrypted inputs read a passphrase
+// file descriptor only once
+var passphrase []byte
+
+// readPassphrase returns the dump passphrase, read from the first line of
+// --passphrase-fd if set, otherwise from the variable named by
+// --passphrase-env
+func readPassphrase() ([]byte, error) {
+	if passphrase != nil {
+		return passphrase, nil
+	}
+	fd := viper.GetInt("mabctl.passphrase_fd")
+	if fd >= 0 {
+		file := os.NewFile(uintptr(fd), "passphrase")
+		if file == nil {
+			return nil, fmt.Errorf("invalid passphrase file descriptor %d", fd)
+		}
+		defer file.Close()
+		line, err := bufio.NewReader(file).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed reading passphrase from fd %d: %w", fd, err)
+		}
+		passphrase = []byte(strings.TrimRight(line, "\r\n"))
+	} else {
+		name := viper.GetString("mabctl.passphrase_env")
+		passphrase = []byte(os.Getenv(name))
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("no passphrase: set %s or use --passphrase-fd", name)
+		}
+	}
+	if len(passphrase) == 0 {
+		passphrase = nil
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	return passphrase, nil
+}
+
+// encryptOutput seals data with the dump passphrase
+func encryptOutput(data []byte) ([]byte, error) {
+	key, err := readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return util.Encrypt(data, key)
+}
+
+// readDecrypted reads a file, or stdin for "" or "-", decrypting it if it
+// was written with --encrypt
+func readDecrypted(filename string) ([]byte, error) {
+	if filename == "" {
+		filename = "-"
+	}
+	data, err := readInput(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !util.IsEncrypted(data) {
+		return data, nil
+	}
+	key, err := readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return util.Decrypt(data, key)
+}
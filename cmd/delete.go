@@ -23,23 +23,29 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/rstms/mabctl/api"
 	"github.com/spf13/cobra"
 )
 
+var deleteCondition api.Precondition
+
 var deleteCmd = &cobra.Command{
 	Use:   "delete USERNAME BOOKNAME EMAIL",
 	Short: "delete email adddress",
 	Long: `
 Delete an email address from the CardDAV address book BOOKNAME under the user
-account USERNAME
+account USERNAME.  Only addresses equal to EMAIL, ignoring case, are
+deleted.  An address modified since it was read is not deleted.
+With --if-match, delete only if the address has the given ETag; it fails
+without deleting anything if EMAIL matches more than one address.
 `,
 	Args: cobra.ExactArgs(3),
 	Run: func(cmd *cobra.Command, args []string) {
 		username := args[0]
 		bookname := args[1]
 		email := args[2]
-		response, err := MAB.DeleteAddress(username, bookname, email)
-		cobra.CheckErr(err)
+		response, err := MAB.DeleteAddressIfCtx(cmd.Context(), username, bookname, email, deleteCondition)
+		CheckErr(err)
 		if !HandleResponse(response, response.Addresses) {
 			for _, address := range response.Addresses {
 				fmt.Printf("Deleted: %s\n", address)
@@ -49,5 +55,6 @@ account USERNAME
 }
 
 func init() {
+	deleteCmd.Flags().StringVar(&deleteCondition.IfMatch, "if-match", "", "require address ETag")
 	rootCmd.AddCommand(deleteCmd)
 }
@@ -32,8 +32,8 @@ var destroyCmd = &cobra.Command{
 DESTRUCTIVELY delete all users, books, and addresses on the CardDAV server
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		response, err := MAB.Clear()
-		cobra.CheckErr(err)
+		response, err := MAB.ClearCtx(cmd.Context())
+		CheckErr(err)
 
 		if !HandleResponse(response, response) {
 			PrintResponse(response.Message)
@@ -0,0 +1,120 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var diffUnified bool
+
+var diffCmd = &cobra.Command{
+	Use:   "diff A B",
+	Short: "compare dumps or server state",
+	Long: `
+Compare two sets of users, books and cards.  Each of A and B is either a
+dump file ('-' reads from STDIN), 'live' for the current server state, or
+'live:USERNAME' for a single user on the server.  When either side names a
+user, only that user is compared; both sides may not name different users.
+Encrypted dumps are decrypted using the
+--passphrase-fd or --passphrase-env passphrase.
+
+The differences are listed as changes from A to B; --json selects JSON
+output and --unified a unified diff of the complete contents.  Passwords
+are never shown.  Exits with status 2 if there are differences.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		userA, userB := diffSourceUser(args[0]), diffSourceUser(args[1])
+		if userA != "" && userB != "" && userA != userB {
+			CheckErr(fmt.Errorf("cannot compare different users: %s and %s", userA, userB))
+		}
+		a, userA, err := loadDiffSource(cmd, args[0])
+		CheckErr(err)
+		b, userB, err := loadDiffSource(cmd, args[1])
+		CheckErr(err)
+		for _, username := range []string{userA, userB} {
+			a = api.ScopeDump(a, username)
+			b = api.ScopeDump(b, username)
+		}
+		diffs := api.DiffDumps(a, b)
+		switch {
+		case viper.GetBool("json"):
+			PrintResponse(diffs)
+		case diffUnified:
+			output, err := api.UnifiedDiff(a, b, args[0], args[1])
+			CheckErr(err)
+			if !viper.GetBool("quiet") {
+				fmt.Print(output)
+			}
+		default:
+			for _, diff := range diffs {
+				PrintResponse(diff.String())
+			}
+		}
+		if len(diffs) > 0 {
+			os.Exit(EXIT_DIFFERENT)
+		}
+	},
+}
+
+// diffSourceUser returns the user a diff argument is limited to, if any
+func diffSourceUser(source string) string {
+	if strings.HasPrefix(source, "live:") {
+		return strings.TrimPrefix(source, "live:")
+	}
+	return ""
+}
+
+// loadDiffSource returns the dump named by a diff argument and the user it
+// is limited to
+func loadDiffSource(cmd *cobra.Command, source string) (*api.DumpFile, string, error) {
+	if source == "live" || strings.HasPrefix(source, "live:") {
+		username := diffSourceUser(source)
+		response, err := MAB.DumpCtx(cmd.Context(), username)
+		if err != nil {
+			return nil, "", err
+		}
+		return &response.Dump, username, nil
+	}
+	data, err := readDecrypted(source)
+	if err != nil {
+		return nil, "", err
+	}
+	dump, err := api.ReadDump(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	return dump, "", nil
+}
+
+func init() {
+	diffCmd.Flags().BoolVarP(&diffUnified, "unified", "u", false, "output a unified diff")
+	rootCmd.AddCommand(diffCmd)
+}
@@ -22,17 +22,27 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"encoding/json"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"os"
 )
 
 var dumpUser string
+var dumpEncrypt bool
 
 var dumpCmd = &cobra.Command{
 	Use:   "dump [USERNAME]",
 	Short: "dump CardDAV config",
 	Long: `
 Output all cardDAV data for USERNAME.  If USERNAME is not specified, output data for all users.
+The dump is versioned JSON holding each user's display name and password, each book's
+description, and the complete vCard of every contact, so that restore is lossless.
+
+With --encrypt the dump is sealed with AES-256-GCM under a key derived from a passphrase
+with scrypt.  The passphrase is read from the first line of --passphrase-fd, or else from
+the environment variable named by --passphrase-env (default MABCTL_PASSPHRASE).  restore,
+diff and accounts --reset decrypt such files transparently using the same passphrase.
 `,
 	Args: cobra.RangeArgs(0, 1),
 	Run: func(cmd *cobra.Command, args []string) {
@@ -43,8 +53,18 @@ Output all cardDAV data for USERNAME.  If USERNAME is not specified, output data
 		if dumpUser != "" {
 		    user = dumpUser
 		}
-		response, err := MAB.Dump(user)
-		cobra.CheckErr(err)
+		response, err := MAB.DumpCtx(cmd.Context(), user)
+		CheckErr(err)
+
+		if dumpEncrypt {
+			data, err := json.MarshalIndent(response.Dump, "", "  ")
+			CheckErr(err)
+			data, err = encryptOutput(data)
+			CheckErr(err)
+			_, err = os.Stdout.Write(data)
+			CheckErr(err)
+			return
+		}
 
 		if !HandleResponse(response, response.Dump) {
 			viper.Set("json", true)
@@ -55,5 +75,6 @@ Output all cardDAV data for USERNAME.  If USERNAME is not specified, output data
 
 func init() {
 	dumpCmd.Flags().StringVar(&dumpUser, "user", "", "dump username")
+	dumpCmd.Flags().BoolVar(&dumpEncrypt, "encrypt", false, "encrypt the dump with the passphrase")
 	rootCmd.AddCommand(dumpCmd)
 }
@@ -0,0 +1,730 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/rstms/mabctl/testserver"
+	"github.com/stretchr/testify/require"
+)
+
+const execArgsEnv = "MABCTL_TEST_EXEC_ARGS"
+
+// TestMain runs the CLI instead of the tests when re-executed by mabctl()
+func TestMain(m *testing.M) {
+	if encoded := os.Getenv(execArgsEnv); encoded != "" {
+		var args []string
+		err := json.Unmarshal([]byte(encoded), &args)
+		if err != nil {
+			panic(err)
+		}
+		os.Args = append([]string{ProgramName}, args...)
+		Execute()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type cli struct {
+	t          *testing.T
+	server     *testserver.Server
+	configFile string
+}
+
+func startServer(t *testing.T) *cli {
+	dir := t.TempDir()
+	server, err := testserver.Start(dir)
+	require.Nil(t, err)
+	t.Cleanup(server.Close)
+	configFile := filepath.Join(dir, "config.yaml")
+	err = server.WriteConfig(configFile)
+	require.Nil(t, err)
+	return &cli{t, server, configFile}
+}
+
+// command returns a subprocess running mabctl and its output buffers
+func (c *cli) command(stdin string, args ...string) (*exec.Cmd, *bytes.Buffer, *bytes.Buffer) {
+	encoded, err := json.Marshal(append([]string{"--config", c.configFile}, args...))
+	require.Nil(c.t, err)
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), execArgsEnv+"="+string(encoded))
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	return cmd, &stdout, &stderr
+}
+
+// exec runs mabctl in a subprocess, returning stdout and the exit code
+func (c *cli) exec(stdin string, args ...string) (string, int) {
+	cmd, stdout, stderr := c.command(stdin, args...)
+	err := cmd.Run()
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	} else {
+		require.Nil(c.t, err)
+	}
+	c.t.Logf("mabctl %s -> %d\n%s%s", strings.Join(args, " "), exitCode, stdout.String(), stderr.String())
+	return stdout.String(), exitCode
+}
+
+// terminate runs mabctl for the given time and then sends it SIGTERM,
+// requiring it to be still running and then to exit cleanly
+func (c *cli) terminate(after time.Duration, args ...string) string {
+	cmd, stdout, stderr := c.command("", args...)
+	require.Nil(c.t, cmd.Start())
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		require.Fail(c.t, "exited before terminated", "mabctl %v: %v\n%s", args, err, stderr.String())
+	case <-time.After(after):
+	}
+	require.Nil(c.t, cmd.Process.Signal(syscall.SIGTERM))
+	err := <-done
+	c.t.Logf("mabctl %s -> terminated\n%s%s", strings.Join(args, " "), stdout.String(), stderr.String())
+	require.Nil(c.t, err)
+	return stdout.String()
+}
+
+// start runs mabctl in the background, returning a function which sends it
+// SIGTERM, requires it to exit cleanly and returns stdout
+func (c *cli) start(args ...string) func() string {
+	cmd, stdout, stderr := c.command("", args...)
+	require.Nil(c.t, cmd.Start())
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	stopped := false
+	stop := func() string {
+		if stopped {
+			return stdout.String()
+		}
+		stopped = true
+		require.Nil(c.t, cmd.Process.Signal(syscall.SIGTERM))
+		err := <-done
+		c.t.Logf("mabctl %s -> terminated\n%s%s", strings.Join(args, " "), stdout.String(), stderr.String())
+		require.Nil(c.t, err)
+		return stdout.String()
+	}
+	c.t.Cleanup(func() { stop() })
+	return stop
+}
+
+// dial connects to a server started by start, waiting for it to listen
+func (c *cli) dial(network, address string) net.Conn {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.Dial(network, address)
+		if err == nil {
+			c.t.Cleanup(func() { conn.Close() })
+			return conn
+		}
+		require.True(c.t, time.Now().Before(deadline), "dial %s: %v", address, err)
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// run requires mabctl to succeed and returns stdout
+func (c *cli) run(args ...string) string {
+	output, exitCode := c.exec("", args...)
+	require.Equal(c.t, 0, exitCode, "mabctl %v", args)
+	return output
+}
+
+func TestE2EServer(t *testing.T) {
+	c := startServer(t)
+	require.Contains(t, c.run("version"), "mabctl version")
+	require.Contains(t, c.run("config"), "bcc_url: "+c.server.BCCURL)
+	require.Equal(t, "initialized\n", c.run("init"))
+	require.Equal(t, "reset\n", c.run("reset"))
+	require.Contains(t, c.run("status"), `"version": "testserver"`)
+	require.NotEmpty(t, c.run("uptime"))
+	require.Equal(t, "shutdown requested\n", c.run("shutdown"))
+}
+
+func TestE2EUsers(t *testing.T) {
+	c := startServer(t)
+	require.Equal(t, "created: user@example.org\n", c.run("mkuser", "user@example.org", "Test User", "secret"))
+	require.Equal(t, "user@example.org\n", c.run("users"))
+	require.Equal(t, "user@example.org\n", c.run("user", "user@example.org"))
+	_, exitCode := c.exec("", "user", "nobody@example.org")
+	require.Equal(t, EXIT_NOT_FOUND, exitCode)
+	require.Equal(t, "secret\n", c.run("passwd", "user@example.org"))
+	require.Equal(t, "user@example.org\tsecret\n", c.run("accounts"))
+
+	output, exitCode := c.exec(`{"user@example.org": "changed"}`, "accounts", "--reset", "-")
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "user@example.org\tchanged\n", output)
+
+	require.Equal(t, "deleted: user@example.org\n", c.run("rmuser", "user@example.org"))
+	require.Empty(t, c.run("users"))
+}
+
+func TestE2EBooksAndAddresses(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	require.Empty(t, c.run("books", "user@example.org"))
+
+	output := c.run("mkbook", "user@example.org", "friends", "my friends")
+	require.Equal(t, c.server.DAVURL+"/addressbooks/user@example.org/user-example-org-friends/\n", output)
+	c.run("mkbook", "user@example.org", "work")
+	require.Equal(t, "friends\nwork\n", c.run("books", "user@example.org"))
+	require.Equal(t, "user@example.org\tfriends,work\n", c.run("userbooks"))
+
+	output = c.run("add", "user@example.org", "friends", "friend@example.com", "Good Friend")
+	require.True(t, strings.HasPrefix(output, "/dav.php/addressbooks/user@example.org/user-example-org-friends/"))
+	c.run("add", "user@example.org", "work", "boss@example.com")
+	require.Equal(t, "friend@example.com\n", c.run("addrs", "user@example.org", "friends"))
+
+	output, exitCode := c.exec("", "scan", "user@example.org", "boss@example.com")
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "work\n", output)
+	_, exitCode = c.exec("", "scan", "user@example.org", "stranger@example.com")
+	require.Equal(t, 1, exitCode)
+	// addresses are matched exactly, not as substrings
+	_, exitCode = c.exec("", "scan", "user@example.org", "oss@example.com")
+	require.Equal(t, 1, exitCode)
+
+	output, _ = c.exec("", "addr", "user@example.org", "friends", "friend@example.com")
+	require.Equal(t, "friend@example.com\n", output)
+
+	c.run("add", "user@example.org", "friends", "bestfriend@example.com")
+	require.Equal(t, "Deleted: friend@example.com\n", c.run("delete", "user@example.org", "friends", "friend@example.com"))
+	require.Equal(t, "bestfriend@example.com\n", c.run("addrs", "user@example.org", "friends"))
+
+	require.Equal(t, "deleted: user-example-org-work\n", c.run("rmbook", "user@example.org", "work"))
+	require.Equal(t, "friends\n", c.run("books", "user@example.org"))
+}
+
+func TestE2EContacts(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	c.run("mkbook", "user@example.org", "friends")
+
+	output := c.run("contact", "set", "user@example.org", "friends", "friend@example.com", "--given", "Good", "--family", "Friend", "--phone", "+1 555 0100")
+	require.True(t, strings.HasPrefix(output, "created "))
+	c.run("contact", "set", "user@example.org", "friends", "friend@example.com", "--org", "Example Inc")
+	output = c.run("contact", "show", "user@example.org", "friends", "friend@example.com")
+	require.Contains(t, output, "given: Good\n")
+	require.Contains(t, output, "org: Example Inc\n")
+	require.Contains(t, output, "phone: +1 555 0100\n")
+	require.Equal(t, "friend@example.com\n", c.run("addrs", "user@example.org", "friends"))
+
+	output, exitCode := c.exec(`{"fullname": "Best Friend", "emails": ["friend@example.com"]}`, "contact", "edit", "user@example.org", "friends", "friend@example.com", "--file", "-")
+	require.Equal(t, 0, exitCode)
+	require.True(t, strings.HasPrefix(output, "updated "))
+	output = c.run("contact", "show", "user@example.org", "friends", "friend@example.com")
+	require.Contains(t, output, "name: Best Friend\n")
+	require.NotContains(t, output, "org:")
+
+	_, exitCode = c.exec("", "contact", "show", "user@example.org", "friends", "stranger@example.com")
+	require.Equal(t, EXIT_NOT_FOUND, exitCode)
+}
+
+func TestE2EWatch(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	c.run("mkbook", "user@example.org", "friends")
+	path := c.run("add", "user@example.org", "friends", "friend@example.com")
+	// the timeout does not apply to watch, which runs until terminated
+	output := c.terminate(500*time.Millisecond, "--timeout", "100ms", "watch", "user@example.org", "friends", "--initial", "--interval", "100ms")
+	require.Equal(t, "added\tfriend@example.com\n", output)
+	c.run("delete", "user@example.org", "friends", "friend@example.com")
+	require.Empty(t, c.run("addrs", "user@example.org", "friends"))
+	// only the paths of watched cards are kept between runs
+	output = c.terminate(500*time.Millisecond, "watch", "user@example.org", "friends", "--initial", "--interval", "100ms")
+	require.Equal(t, "deleted\t"+path, output)
+}
+
+func TestE2EExitCodes(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	_, exitCode := c.exec("", "mkuser", "user@example.org")
+	require.Equal(t, EXIT_EXISTS, exitCode)
+	_, exitCode = c.exec("", "books", "nobody@example.org")
+	require.Equal(t, EXIT_NOT_FOUND, exitCode)
+	_, exitCode = c.exec("", "addrs", "user@example.org", "missing")
+	require.Equal(t, EXIT_NOT_FOUND, exitCode)
+	c.run("mkbook", "user@example.org", "friends")
+	c.run("add", "user@example.org", "friends", "friend@example.com")
+	_, exitCode = c.exec("", "add", "--if-none-match", "user@example.org", "friends", "friend@example.com")
+	require.Equal(t, EXIT_CONFLICT, exitCode)
+	_, exitCode = c.exec("", "add", "--if-match", "stale", "user@example.org", "friends", "pal@example.com")
+	require.Equal(t, EXIT_CONFLICT, exitCode)
+	_, exitCode = c.exec("", "delete", "--if-match", "stale", "user@example.org", "friends", "friend@example.com")
+	require.Equal(t, EXIT_CONFLICT, exitCode)
+	_, exitCode = c.exec("", "--api-key", "invalid", "users")
+	require.Equal(t, EXIT_UNAUTHORIZED, exitCode)
+}
+
+func TestE2EDumpRestore(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org", "", "secret")
+	c.run("mkbook", "user@example.org", "work")
+	c.run("add", "user@example.org", "work", "boss@example.com")
+	c.run("add", "user@example.org", "work", "peer@example.com")
+	c.run("mkuser", "other@example.org")
+
+	dump := c.run("dump")
+	require.Contains(t, dump, "boss@example.com")
+	require.Contains(t, c.run("dump", "other@example.org"), "other@example.org")
+	require.Contains(t, c.run("--jobs", "1", "--rate-limit", "100", "--progress", "dump"), "boss@example.com")
+
+	require.Equal(t, "cleared\n", c.run("destroy"))
+	require.Empty(t, c.run("users"))
+
+	output, exitCode := c.exec(dump, "restore", "-")
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "restored\n", output)
+	require.Equal(t, "other@example.org\nuser@example.org\n", c.run("users"))
+	require.Equal(t, "secret\n", c.run("passwd", "user@example.org"))
+	require.ElementsMatch(t, []string{"boss@example.com", "peer@example.com"}, strings.Fields(c.run("addrs", "user@example.org", "work")))
+
+	output, exitCode = c.exec(dump, "--force", "restore", "--user", "user@example.org", "-")
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "restored\n", output)
+
+	c.run("contact", "set", "--phone", "+1 555 0100", "--note", "the boss", "user@example.org", "work", "boss@example.com")
+	dump = c.run("dump", "user@example.org")
+	_, exitCode = c.exec(dump, "--force", "restore", "--user", "user@example.org", "-")
+	require.Equal(t, 0, exitCode)
+	require.Contains(t, c.run("contact", "show", "user@example.org", "work", "boss@example.com"), "+1 555 0100")
+
+	legacy := `{"Users": {"legacy@example.org": {"Password": "old", "Books": {"work": ["one@example.com"]}}}}`
+	_, exitCode = c.exec(legacy, "restore", "-")
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "old\n", c.run("passwd", "legacy@example.org"))
+	require.Equal(t, "one@example.com\n", c.run("addrs", "legacy@example.org", "work"))
+}
+
+func TestE2ERestorePlan(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	c.run("mkbook", "user@example.org", "work")
+	c.run("add", "user@example.org", "work", "boss@example.com")
+	dump := c.run("dump")
+	c.run("delete", "user@example.org", "work", "boss@example.com")
+	c.run("add", "user@example.org", "work", "peer@example.com")
+
+	output, exitCode := c.exec(dump, "restore", "--dry-run", "-")
+	require.Equal(t, 0, exitCode)
+	require.Contains(t, output, "restore plan (mode: merge)")
+	require.Contains(t, output, "boss@example.com")
+	require.Contains(t, output, "cards: 1 create, 0 delete, 0 update, 1 keep")
+	require.Equal(t, "peer@example.com\n", c.run("addrs", "user@example.org", "work"))
+
+	output, exitCode = c.exec(dump, "--json", "--force", "restore", "--dry-run", "-")
+	require.Equal(t, 0, exitCode)
+	var plan api.Plan
+	require.Nil(t, json.Unmarshal([]byte(output), &plan))
+	require.Equal(t, api.RESTORE_REPLACE, plan.Mode)
+	require.Equal(t, 1, plan.Count(api.PLAN_DELETE, api.PLAN_USER))
+
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+	_, exitCode = c.exec(dump, "restore", "--plan-out", planFile, "-")
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "peer@example.com\n", c.run("addrs", "user@example.org", "work"))
+	require.Equal(t, "applied 1 changes\n", c.run("restore", "--apply-plan", planFile))
+	require.ElementsMatch(t, []string{"boss@example.com", "peer@example.com"}, strings.Fields(c.run("addrs", "user@example.org", "work")))
+
+	_, exitCode = c.exec("", "restore", "--apply-plan", planFile)
+	require.Equal(t, EXIT_CONFLICT, exitCode)
+
+	// a plan written without --force may not delete when applied without it
+	c.run("mkbook", "user@example.org", "extra")
+	_, exitCode = c.exec(dump, "restore", "--mode", "sync", "--plan-out", planFile, "-")
+	require.Equal(t, 0, exitCode)
+	_, exitCode = c.exec("", "restore", "--apply-plan", planFile)
+	require.Equal(t, EXIT_ERROR, exitCode)
+	require.Equal(t, "extra\nwork\n", c.run("books", "user@example.org"))
+	c.run("--force", "restore", "--apply-plan", planFile)
+	require.Equal(t, "work\n", c.run("books", "user@example.org"))
+}
+
+func TestE2ERestoreSync(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	c.run("mkbook", "user@example.org", "work")
+	c.run("add", "user@example.org", "work", "boss@example.com")
+	dump := c.run("dump")
+	c.run("add", "user@example.org", "work", "peer@example.com")
+	c.run("mkuser", "other@example.org")
+
+	_, exitCode := c.exec(dump, "restore", "--mode", "sync", "-")
+	require.Equal(t, EXIT_ERROR, exitCode)
+	_, exitCode = c.exec(dump, "restore", "--mode", "bogus", "--dry-run", "-")
+	require.Equal(t, EXIT_ERROR, exitCode)
+
+	output, exitCode := c.exec(dump, "--force", "restore", "--mode", "sync", "-")
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "restored\n", output)
+	require.Equal(t, "user@example.org\n", c.run("users"))
+	require.Equal(t, "boss@example.com\n", c.run("addrs", "user@example.org", "work"))
+}
+
+func TestE2EApply(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	c.run("mkbook", "user@example.org", "old")
+	state := `
+users:
+  user@example.org:
+    books:
+      work:
+        description: Work
+        addresses: [boss@example.com]
+`
+	output, exitCode := c.exec(state, "apply", "-f", "-")
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "+ book user@example.org/work\n+ address user@example.org/work/boss@example.com\n1 unmanaged items (use --prune to remove)\napplied 2 changes\n", output)
+
+	_, exitCode = c.exec(state, "apply", "--prune", "-f", "-")
+	require.Equal(t, EXIT_ERROR, exitCode)
+	output, exitCode = c.exec(state, "--force", "apply", "--prune", "-f", "-")
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "- book user@example.org/old\napplied 1 changes\n", output)
+
+	output, exitCode = c.exec(state, "apply", "-f", "-")
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "no changes\napplied 0 changes\n", output)
+	require.Equal(t, "boss@example.com\n", c.run("addrs", "user@example.org", "work"))
+}
+
+func TestE2EDiff(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	c.run("mkbook", "user@example.org", "work")
+	c.run("add", "user@example.org", "work", "boss@example.com")
+	c.run("mkuser", "other@example.org")
+	dumpFile := filepath.Join(t.TempDir(), "dump.json")
+	require.Nil(t, os.WriteFile(dumpFile, []byte(c.run("dump")), 0600))
+
+	require.Empty(t, c.run("diff", dumpFile, "live"))
+
+	c.run("add", "user@example.org", "work", "peer@example.com")
+	c.run("contact", "set", "--phone", "+1 555 0100", "user@example.org", "work", "boss@example.com")
+	c.run("rmuser", "other@example.org")
+
+	output, exitCode := c.exec("", "diff", dumpFile, "live")
+	require.Equal(t, EXIT_DIFFERENT, exitCode)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, "- user other@example.org", lines[0])
+	require.Contains(t, output, "boss@example.com: FN, N, TEL\n")
+	require.Contains(t, output, "peer@example.com\n")
+
+	output, exitCode = c.exec("", "diff", dumpFile, "live:user@example.org")
+	require.Equal(t, EXIT_DIFFERENT, exitCode)
+	require.NotContains(t, output, "other@example.org")
+	_, exitCode = c.exec("", "diff", "live:user@example.org", "live:other@example.org")
+	require.Equal(t, EXIT_ERROR, exitCode)
+
+	output, exitCode = c.exec("", "--json", "diff", "live", dumpFile)
+	require.Equal(t, EXIT_DIFFERENT, exitCode)
+	var diffs []api.Difference
+	require.Nil(t, json.Unmarshal([]byte(output), &diffs))
+	require.Len(t, diffs, 3)
+	require.Equal(t, api.DIFF_ADDED, diffs[0].Change)
+
+	output, exitCode = c.exec("", "diff", "-u", dumpFile, "live")
+	require.Equal(t, EXIT_DIFFERENT, exitCode)
+	require.Contains(t, output, "--- "+dumpFile+"\n+++ live\n")
+	require.Contains(t, output, "\n+      EMAIL:peer@example.com\n")
+	require.NotContains(t, output, "password: \n")
+}
+
+func TestE2EEncryptedDump(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org", "", "secret")
+	c.run("mkbook", "user@example.org", "work")
+	c.run("add", "user@example.org", "work", "boss@example.com")
+
+	_, exitCode := c.exec("", "dump", "--encrypt", "--passphrase-env", "MABCTL_TEST_UNSET_PASSPHRASE")
+	require.Equal(t, EXIT_ERROR, exitCode)
+
+	t.Setenv("MABCTL_PASSPHRASE", "correct horse")
+	dump := c.run("dump", "--encrypt")
+	require.Contains(t, dump, `"format": "mabctl-encrypted"`)
+	require.NotContains(t, dump, "secret")
+	require.NotContains(t, dump, "boss@example.com")
+	dumpFile := filepath.Join(t.TempDir(), "dump.json")
+	require.Nil(t, os.WriteFile(dumpFile, []byte(dump), 0600))
+	require.Empty(t, c.run("diff", dumpFile, "live"))
+
+	c.run("destroy")
+	_, exitCode = c.exec("wrong horse\n", "restore", "--passphrase-fd", "0", dumpFile)
+	require.Equal(t, EXIT_ERROR, exitCode)
+	require.Empty(t, c.run("users"))
+
+	output, exitCode := c.exec("correct horse\n", "restore", "--passphrase-fd", "0", dumpFile)
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "restored\n", output)
+	require.Equal(t, "boss@example.com\n", c.run("addrs", "user@example.org", "work"))
+
+	accounts := c.run("accounts", "--encrypt")
+	require.NotContains(t, accounts, "secret")
+	changed := `{"user@example.org": "changed"}`
+	_, exitCode = c.exec(changed, "accounts", "--reset", "-")
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "changed\n", c.run("passwd", "user@example.org"))
+	_, exitCode = c.exec(accounts, "accounts", "--reset", "-")
+	require.Equal(t, 0, exitCode)
+	require.Equal(t, "secret\n", c.run("passwd", "user@example.org"))
+
+	_, exitCode = c.exec(changed, "accounts", "--reset", "-")
+	require.Equal(t, 0, exitCode)
+	c.run("accounts", "--reset", dumpFile)
+	require.Equal(t, "secret\n", c.run("passwd", "user@example.org"))
+}
+
+func TestE2EBackup(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org", "", "secret")
+	c.run("mkbook", "user@example.org", "work")
+	c.run("add", "user@example.org", "work", "boss@example.com")
+	dir := filepath.Join(t.TempDir(), "backup")
+
+	_, exitCode := c.exec("", "backup")
+	require.Equal(t, EXIT_ERROR, exitCode)
+
+	output := c.run("backup", "--dir", dir)
+	require.Regexp(t, `^backup \d{8}T\d{6}Z: 1 users, 1 books, 1 cards\n$`, output)
+	first := strings.TrimSuffix(strings.Fields(output)[1], ":")
+
+	output = c.run("backup", "--dir", dir, "--keep-daily", "0", "--keep-weekly", "0", "--keep-monthly", "0")
+	require.NotContains(t, output, "pruned")
+	lines := strings.Split(strings.TrimSpace(c.run("backup", "list", "--dir", dir)), "\n")
+	require.Len(t, lines, 2)
+	require.True(t, strings.HasPrefix(lines[0], first+" "))
+
+	require.Equal(t, "expired "+first+"\n", c.run("backup", "prune", "--dir", dir, "--dry-run"))
+	require.Equal(t, "pruned "+first+"\n", c.run("backup", "prune", "--dir", dir))
+	require.Len(t, strings.Split(strings.TrimSpace(c.run("backup", "list", "--dir", dir)), "\n"), 1)
+	_, exitCode = c.exec("", "backup", "restore", "--dir", dir, first)
+	require.Equal(t, EXIT_NOT_FOUND, exitCode)
+
+	t.Setenv("MABCTL_PASSPHRASE", "correct horse")
+	// a user backup is a series of its own and does not prune full backups
+	output = c.run("backup", "--dir", dir, "--encrypt", "--user", "user@example.org")
+	require.NotContains(t, output, "pruned")
+	lines = strings.Split(strings.TrimSpace(c.run("backup", "list", "--dir", dir)), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[1], "encrypted")
+
+	c.run("destroy")
+	require.Equal(t, "restored\n", c.run("backup", "restore", "--dir", dir, "latest"))
+	require.Equal(t, "secret\n", c.run("passwd", "user@example.org"))
+	require.Equal(t, "boss@example.com\n", c.run("addrs", "user@example.org", "work"))
+}
+
+func TestE2ERestoreResume(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	c.run("mkbook", "user@example.org", "work")
+	c.run("add", "user@example.org", "work", "boss@example.com")
+	c.run("add", "user@example.org", "work", "peer@example.com")
+	dir := t.TempDir()
+	dumpFile := filepath.Join(dir, "dump.json")
+	require.Nil(t, os.WriteFile(dumpFile, []byte(c.run("dump")), 0600))
+	journal := filepath.Join(dir, "journal")
+
+	c.server.FailNextMethod(http.MethodPut, 400)
+	_, exitCode := c.exec("", "--force", "restore", "--mode", "replace", "--journal", journal, dumpFile)
+	require.Equal(t, EXIT_ERROR, exitCode)
+	require.Len(t, strings.Fields(c.run("addrs", "user@example.org", "work")), 1)
+
+	_, exitCode = c.exec("", "restore", "--resume", journal)
+	require.Equal(t, EXIT_ERROR, exitCode)
+	_, exitCode = c.exec("", "--force", "restore", "--resume", journal, dumpFile)
+	require.Equal(t, EXIT_ERROR, exitCode)
+
+	require.Equal(t, "restored\n", c.run("--force", "restore", "--resume", journal))
+	require.ElementsMatch(t, []string{"boss@example.com", "peer@example.com"}, strings.Fields(c.run("addrs", "user@example.org", "work")))
+
+	output := c.run("--json", "--force", "restore", "--resume", journal)
+	var response api.RestoreResponse
+	require.Nil(t, json.Unmarshal([]byte(output), &response))
+	require.Equal(t, 0, response.Restored)
+	require.Equal(t, 4, response.Skipped)
+}
+
+func TestE2EImportExport(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	c.run("mkbook", "user@example.org", "friends")
+	c.run("mkbook", "user@example.org", "work")
+	c.run("add", "user@example.org", "friends", "friend@example.com")
+	c.run("add", "user@example.org", "work", "boss@example.com")
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "friends.csv")
+	err := os.WriteFile(filename, []byte("Display Name,E-mail Address\nFriend,friend@example.com\nGood Pal,pal@example.com\n"), 0600)
+	require.Nil(t, err)
+	require.Equal(t, "would add 1, skipped 1, invalid 0\n", c.run("import", "--dry-run", "user@example.org", "friends", filename))
+	require.Equal(t, "added 1, skipped 1, invalid 0\n", c.run("import", "user@example.org", "friends", filename))
+	require.ElementsMatch(t, []string{"friend@example.com", "pal@example.com"}, strings.Fields(c.run("addrs", "user@example.org", "friends")))
+	_, exitCode := c.exec("", "import", "user@example.org", "missing", filename)
+	require.Equal(t, EXIT_NOT_FOUND, exitCode)
+
+	output := c.run("export", "user@example.org", "friends", "--format", "csv")
+	require.Contains(t, output, "Good Pal,,pal@example.com,")
+
+	books := filepath.Join(dir, "books")
+	output = c.run("export", "user@example.org", "--all", "--format", "ldif", "--output", books)
+	require.Contains(t, output, "work: 1 cards -> "+filepath.Join(books, "work.ldif"))
+	data, err := os.ReadFile(filepath.Join(books, "friends.ldif"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), "mail: pal@example.com\n")
+}
+
+func TestE2ELearn(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	c.run("mkbook", "user@example.org", "friends")
+	c.run("add", "user@example.org", "friends", "friend@example.com")
+
+	maildir := filepath.Join(t.TempDir(), ".Sent")
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		require.Nil(t, os.MkdirAll(filepath.Join(maildir, sub), 0700))
+	}
+	message := "From: user@example.org\r\nTo: Friend <friend@example.com>, Pal <pal@example.com>\r\nSubject: hi\r\n\r\nhello\r\n"
+	require.Nil(t, os.WriteFile(filepath.Join(maildir, "cur", "1.msg:2,S"), []byte(message), 0600))
+
+	require.Equal(t, "would add 1, skipped 1, invalid 0\n", c.run("learn", "user@example.org", "--book", "friends", "--maildir", maildir, "--dry-run"))
+	require.Equal(t, "added 1, skipped 1, invalid 0\n", c.run("learn", "user@example.org", "--book", "friends", "--maildir", maildir))
+	require.ElementsMatch(t, []string{"friend@example.com", "pal@example.com"}, strings.Fields(c.run("addrs", "user@example.org", "friends")))
+	_, exitCode := c.exec("", "learn", "user@example.org", "--book", "sent", "--maildir", maildir)
+	require.Equal(t, EXIT_NOT_FOUND, exitCode)
+}
+
+func TestE2EPolicyd(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	c.run("mkbook", "user@example.org", "friends")
+	c.run("add", "user@example.org", "friends", "friend@example.com")
+
+	socket := filepath.Join(t.TempDir(), "policy.sock")
+	stop := c.start("policyd", "--listen", socket, "--nomatch-action", "OK")
+	conn := c.dial("unix", socket)
+	reader := bufio.NewReader(conn)
+	query := func(sender string) string {
+		_, err := fmt.Fprintf(conn, "request=smtpd_access_policy\nprotocol_state=END-OF-MESSAGE\nrecipient_count=1\nsender=%s\nrecipient=user@example.org\n\n", sender)
+		require.Nil(t, err)
+		response, err := api.ReadPolicyRequest(reader)
+		require.Nil(t, err)
+		return response["action"]
+	}
+	require.Equal(t, "PREPEND X-Address-Book: friends", query("friend@example.com"))
+	require.Equal(t, "OK", query("stranger@example.com"))
+	stop()
+}
+
+func TestE2EMilter(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	c.run("mkbook", "user@example.org", "friends")
+	c.run("add", "user@example.org", "friends", "friend@example.com")
+
+	socket := filepath.Join(t.TempDir(), "milter.sock")
+	stop := c.start("milter", "--listen", socket)
+	conn := c.dial("unix", socket)
+	send := func(command byte, data string) {
+		packet := binary.BigEndian.AppendUint32(nil, uint32(len(data)+1))
+		packet = append(packet, command)
+		_, err := conn.Write(append(packet, data...))
+		require.Nil(t, err)
+	}
+	receive := func() (byte, string) {
+		header := make([]byte, 4)
+		_, err := io.ReadFull(conn, header)
+		require.Nil(t, err)
+		packet := make([]byte, binary.BigEndian.Uint32(header))
+		_, err = io.ReadFull(conn, packet)
+		require.Nil(t, err)
+		return packet[0], string(packet[1:])
+	}
+	expect := func(command byte) string {
+		c, data := receive()
+		require.Equal(t, string(command), string(c))
+		return data
+	}
+
+	send('O', "\x00\x00\x00\x06\x00\x00\x01\xff\x00\x00\x03\xff")
+	expect('O')
+	send('M', "<friend@example.com>\x00")
+	expect('c')
+	send('R', "<user@example.org>\x00")
+	expect('c')
+	send('L', "From\x00Friend <friend@example.com>\x00")
+	expect('c')
+	send('L', "X-Address-Book\x00forged\x00")
+	expect('c')
+	send('N', "")
+	expect('c')
+	// the forged header is removed and the book of the recipient added
+	send('E', "")
+	require.Equal(t, "\x00\x00\x00\x01X-Address-Book\x00\x00", expect('m'))
+	require.Equal(t, "X-Address-Book\x00friends\x00", expect('h'))
+	expect('c')
+	send('Q', "")
+	stop()
+}
+
+func TestE2EServe(t *testing.T) {
+	c := startServer(t)
+	c.run("mkuser", "user@example.org")
+	c.run("mkbook", "user@example.org", "friends")
+	c.run("add", "user@example.org", "friends", "friend@example.com")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	address := listener.Addr().String()
+	require.Nil(t, listener.Close())
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	require.Nil(t, os.WriteFile(tokenFile, []byte("# test\nsecret\n"), 0600))
+	stop := c.start("serve", "--listen", address, "--token-file", tokenFile)
+	c.dial("tcp", address)
+
+	get := func(path, token string) (int, map[string]any) {
+		request, err := http.NewRequest(http.MethodGet, "http://"+address+path, nil)
+		require.Nil(t, err)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		require.Nil(t, err)
+		defer response.Body.Close()
+		ret := map[string]any{}
+		require.Nil(t, json.NewDecoder(response.Body).Decode(&ret))
+		return response.StatusCode, ret
+	}
+	status, _ := get("/api/v1/users/user@example.org/books/friends/addresses", "")
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, response := get("/api/v1/users/user@example.org/books/friends/addresses", "secret")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []any{"friend@example.com"}, response["addresses"])
+	status, _ = get("/api/v1/users/user@example.org/books/missing/addresses", "secret")
+	require.Equal(t, http.StatusNotFound, status)
+	stop()
+}
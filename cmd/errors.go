@@ -0,0 +1,79 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/rstms/mabctl/api"
+)
+
+// process exit codes returned for each class of error
+const (
+	EXIT_ERROR        = 1
+	EXIT_DIFFERENT    = 2
+	EXIT_NOT_FOUND    = 3
+	EXIT_EXISTS       = 4
+	EXIT_UNAUTHORIZED = 5
+	EXIT_UNAVAILABLE  = 6
+	EXIT_CONFLICT     = 7
+	EXIT_TIMEOUT      = 8
+	EXIT_CANCELED     = 130
+)
+
+// ExitCode returns the process exit code for err
+func ExitCode(err error) int {
+	var conflict *api.ConflictError
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, context.Canceled):
+		return EXIT_CANCELED
+	case errors.Is(err, context.DeadlineExceeded):
+		return EXIT_TIMEOUT
+	case errors.Is(err, api.ErrUnauthorized):
+		return EXIT_UNAUTHORIZED
+	case errors.As(err, &conflict):
+		// a failed precondition wraps the not found or exists condition
+		return EXIT_CONFLICT
+	case errors.Is(err, api.ErrUserNotFound), errors.Is(err, api.ErrBookNotFound), errors.Is(err, api.ErrAddressNotFound), errors.Is(err, api.ErrNotFound):
+		return EXIT_NOT_FOUND
+	case errors.Is(err, api.ErrUserExists), errors.Is(err, api.ErrBookExists), errors.Is(err, api.ErrAddressExists):
+		return EXIT_EXISTS
+	case errors.Is(err, api.ErrConflict):
+		return EXIT_CONFLICT
+	case errors.Is(err, api.ErrUnavailable), errors.Is(err, api.ErrServerError):
+		return EXIT_UNAVAILABLE
+	}
+	return EXIT_ERROR
+}
+
+// CheckErr prints err and exits with the code selected by ExitCode
+func CheckErr(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(ExitCode(err))
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/viper"
+)
+
+const EVENTS_JSONL = "jsonl"
+
+const progressBarWidth = 30
+const progressBarInterval = 100 * time.Millisecond
+
+// installEventHandler selects how the progress of long operations is
+// reported on stderr: --events jsonl writes each event as a JSON line,
+// --progress writes a line as each user finishes, and otherwise a progress
+// bar is drawn if stderr is a terminal
+func installEventHandler(mab api.AddressBookManager) {
+	var handler api.EventHandler
+	events := viper.GetString("mabctl.events")
+	switch {
+	case events == EVENTS_JSONL:
+		encoder := json.NewEncoder(os.Stderr)
+		handler = func(event api.Event) {
+			encoder.Encode(event)
+		}
+	case events != "":
+		CheckErr(fmt.Errorf("unknown events format '%s'; expected %s", events, EVENTS_JSONL))
+	case viper.GetBool("progress"):
+		handler = newProgressLines(os.Stderr).handle
+	case isTerminal(os.Stderr) && !viper.GetBool("quiet") && !viper.GetBool("verbose"):
+		handler = newProgressBar(os.Stderr).handle
+	}
+	mab.Events().SetEventHandler(handler)
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// userCounts totals the books and addresses reported for each user
+type userCounts map[string]*[2]int
+
+func (c userCounts) add(event api.Event) *[2]int {
+	counts, ok := c[event.Username]
+	if !ok {
+		counts = &[2]int{}
+		c[event.Username] = counts
+	}
+	switch event.Type {
+	case api.EVENT_BOOK:
+		counts[0]++
+	case api.EVENT_ADDRESS:
+		counts[1]++
+	}
+	return counts
+}
+
+// progressLines writes a line as each user is finished
+type progressLines struct {
+	output io.Writer
+	counts userCounts
+}
+
+func newProgressLines(output io.Writer) *progressLines {
+	return &progressLines{output: output, counts: make(userCounts)}
+}
+
+func (p *progressLines) handle(event api.Event) {
+	switch event.Type {
+	case api.EVENT_START:
+		p.counts = make(userCounts)
+	case api.EVENT_BOOK, api.EVENT_ADDRESS:
+		p.counts.add(event)
+	case api.EVENT_USER:
+		counts := p.counts.add(event)
+		detail := fmt.Sprintf("%d books, %d addresses", counts[0], counts[1])
+		if event.Error != "" {
+			detail = "failed: " + event.Error
+		}
+		fmt.Fprintf(p.output, "%s [%d/%d] %s: %s\n", event.Operation, event.Done, event.Total, event.Username, detail)
+	}
+}
+
+// progressBar redraws a single terminal line as events arrive, writing
+// errors on lines of their own above it
+type progressBar struct {
+	output    io.Writer
+	addresses int
+	drawn     time.Time
+}
+
+func newProgressBar(output io.Writer) *progressBar {
+	return &progressBar{output: output}
+}
+
+func (p *progressBar) handle(event api.Event) {
+	switch event.Type {
+	case api.EVENT_START:
+		p.addresses = 0
+	case api.EVENT_ADDRESS:
+		p.addresses++
+		if time.Since(p.drawn) < progressBarInterval {
+			return
+		}
+	case api.EVENT_ERROR:
+		fmt.Fprintf(p.output, "\r\033[K%s: %s\n", eventSubject(event), event.Error)
+	}
+	p.draw(event)
+	if event.Type == api.EVENT_DONE {
+		fmt.Fprintln(p.output)
+	}
+}
+
+func (p *progressBar) draw(event api.Event) {
+	filled := 0
+	if event.Total > 0 {
+		filled = progressBarWidth * event.Done / event.Total
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	fmt.Fprintf(p.output, "\r\033[K%s [%s] %d/%d users, %d addresses", event.Operation, bar, event.Done, event.Total, p.addresses)
+	p.drawn = time.Now()
+}
+
+// eventSubject names the user, book or address an event refers to
+func eventSubject(event api.Event) string {
+	subject := []string{}
+	for _, field := range []string{event.Username, event.Bookname, event.Address} {
+		if field != "" {
+			subject = append(subject, field)
+		}
+	}
+	if len(subject) == 0 {
+		return event.Operation
+	}
+	return strings.Join(subject, " ")
+}
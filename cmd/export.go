@@ -0,0 +1,99 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/cobra"
+)
+
+var exportFormat string
+var exportAll bool
+var exportOutput string
+
+var exportCmd = &cobra.Command{
+	Use:   "export USERNAME [BOOKNAME]",
+	Short: "write address book contacts to a vCard, CSV, LDIF or JSON file",
+	Long: `
+Write the contacts in the CardDAV address book BOOKNAME under the user
+account USERNAME to STDOUT, or to the --output file.
+
+--format selects the output format:
+  vcf   vCards, for another CardDAV server or most contact applications (default)
+  csv   Thunderbird address book CSV, also accepted by Outlook and Google
+  ldif  LDAP directory entries, as Thunderbird imports and exports them
+  json  contacts in the form shown by 'contact show'
+
+With --all, every book of USERNAME is written to its own file named
+BOOKNAME.FORMAT in the --output directory, which is created if needed, or
+in a zip archive if --output ends with .zip.  The files written by export
+can be read by import.
+`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+		if exportAll {
+			if len(args) > 1 {
+				CheckErr(fmt.Errorf("--all exports every book; BOOKNAME is not allowed"))
+			}
+			output := exportOutput
+			if output == "" {
+				output = "."
+			}
+			response, err := api.ExportAll(cmd.Context(), MAB, username, exportFormat, output)
+			CheckErr(err)
+			if !HandleResponse(response, response) {
+				for _, file := range response.Files {
+					fmt.Println(file)
+				}
+			}
+			return
+		}
+		if len(args) < 2 {
+			CheckErr(fmt.Errorf("BOOKNAME is required unless --all is given"))
+		}
+		bookname := args[1]
+		if exportOutput == "" || exportOutput == "-" {
+			_, err := api.ExportBook(cmd.Context(), MAB, username, bookname, exportFormat, os.Stdout)
+			CheckErr(err)
+			return
+		}
+		file, err := os.OpenFile(exportOutput, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		CheckErr(err)
+		_, err = api.ExportBook(cmd.Context(), MAB, username, bookname, exportFormat, file)
+		if err != nil {
+			file.Close()
+			CheckErr(err)
+		}
+		CheckErr(file.Close())
+	},
+}
+
+func init() {
+	exportCmd.Flags().StringVar(&exportFormat, "format", api.EXPORT_VCF, "output format: vcf, csv, ldif or json")
+	exportCmd.Flags().BoolVar(&exportAll, "all", false, "export every book of USERNAME")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "output file, or directory or .zip archive with --all")
+	rootCmd.AddCommand(exportCmd)
+}
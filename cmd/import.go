@@ -0,0 +1,86 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/cobra"
+)
+
+var importOptions api.ImportOptions
+var importDryRun bool
+
+var importCmd = &cobra.Command{
+	Use:   "import USERNAME BOOKNAME FILE",
+	Short: "add addresses from a CSV, vCard or LDIF file",
+	Long: `
+Add the email addresses in FILE to the CardDAV address book BOOKNAME under
+the user account USERNAME.  If FILE is '-' read from STDIN.
+
+--format selects the file format; by default it is detected from the
+filename extension and content:
+  csv          comma separated values with a header row
+  vcf          one or more vCards; each card is stored whole
+  ldif         LDAP directory entries, as exported by Thunderbird
+  thunderbird  Thunderbird address book CSV export
+  google       Google Contacts CSV export
+
+For csv, the email and name columns are found by their header, or can be
+given by header name or 1-based column number with --email-column and
+--name-column.  With --no-header the first row is data, the email address
+is in column 1 and the name in column 2 unless other columns are given.
+
+Addresses already in the book, or repeated in the file, are skipped.
+Rows without a valid email address are listed on stderr as invalid.
+--dry-run reports what would be added without changing the book.
+`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+		bookname := args[1]
+		filename := args[2]
+		data, err := readInput(filename)
+		CheckErr(err)
+		records, err := api.ReadImport(filename, data, importOptions)
+		CheckErr(err)
+		response, err := api.Import(cmd.Context(), MAB, username, bookname, records, importDryRun)
+		CheckErr(err)
+		if !HandleResponse(response, response) {
+			for _, record := range response.Invalid {
+				fmt.Fprintf(os.Stderr, "invalid %s\n", record)
+			}
+			fmt.Println(response.Message)
+		}
+	},
+}
+
+func init() {
+	importCmd.Flags().StringVar(&importOptions.Format, "format", "", "file format: csv, vcf, ldif, thunderbird or google (default detected)")
+	importCmd.Flags().StringVar(&importOptions.EmailColumn, "email-column", "", "CSV email address column name or number")
+	importCmd.Flags().StringVar(&importOptions.NameColumn, "name-column", "", "CSV name column name or number")
+	importCmd.Flags().BoolVar(&importOptions.NoHeader, "no-header", false, "CSV file has no header row")
+	importCmd.Flags().BoolVar(&importDryRun, "dry-run", false, "report what would be added without changing the book")
+	rootCmd.AddCommand(importCmd)
+}
@@ -33,8 +33,8 @@ var initCmd = &cobra.Command{
 Initialize and configure a newly installed Baikal server instance.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		response, err := MAB.Initialize()
-		cobra.CheckErr(err)
+		response, err := MAB.InitializeCtx(cmd.Context())
+		CheckErr(err)
 		PrintMessage(response)
 	},
 }
@@ -0,0 +1,101 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var learnCmd = &cobra.Command{
+	Use:   "learn USERNAME",
+	Short: "add the recipients of sent mail to an address book",
+	Long: `
+Read an RFC 5322 message from STDIN, or with --maildir every message in
+the cur and new directories of a Maildir folder such as ~/Maildir/.Sent,
+and add the To, Cc and Bcc recipients, with their display names, to the
+--book of the sending user USERNAME.  With --since only Maildir messages
+modified within that duration are read.  --create creates the book if it
+does not exist.
+
+The user's own address, addresses matching an --exclude glob pattern such
+as '*@lists.example.com', addresses already in the book and repeated
+addresses are skipped; --dry-run reports what would be added without
+changing the book.  The book and exclude patterns may be set in the config
+file as mabctl.learn.book and mabctl.learn.exclude.
+
+Example Postfix pipe transport in master.cf, fed by a sender_bcc_maps
+entry copying outgoing mail of local senders to the learn transport:
+  learn unix - n n - - pipe
+    flags=q user=mabctl argv=/usr/local/bin/mabctl -q learn --create ${sender}
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+		var records []api.ImportRecord
+		var err error
+		if maildir := viper.GetString("mabctl.learn.maildir"); maildir != "" {
+			since := time.Time{}
+			if age := viper.GetDuration("mabctl.learn.since"); age > 0 {
+				since = time.Now().Add(-age)
+			}
+			records, err = api.ReadMaildir(pathname(maildir), since)
+		} else {
+			records, err = api.ReadRecipients(os.Stdin, 1)
+		}
+		CheckErr(err)
+		options := api.LearnOptions{
+			Exclude: viper.GetStringSlice("mabctl.learn.exclude"),
+			Create:  viper.GetBool("mabctl.learn.create"),
+			DryRun:  viper.GetBool("mabctl.learn.dry_run"),
+		}
+		response, err := api.Learn(cmd.Context(), MAB, username, viper.GetString("mabctl.learn.book"), records, options)
+		CheckErr(err)
+		if !HandleResponse(response, response) {
+			for _, record := range response.Invalid {
+				fmt.Fprintf(os.Stderr, "invalid %s\n", record)
+			}
+			if !viper.GetBool("quiet") {
+				fmt.Println(response.Message)
+			}
+		}
+	},
+}
+
+func init() {
+	flags := learnCmd.Flags()
+	flags.String("book", api.DEFAULT_LEARN_BOOK, "address book receiving the recipients")
+	flags.String("maildir", "", "read the messages of a Maildir folder instead of STDIN")
+	flags.Duration("since", 0, "read only Maildir messages modified within this duration")
+	flags.StringSlice("exclude", api.DEFAULT_LEARN_EXCLUDE, "glob pattern of addresses never added")
+	flags.Bool("create", false, "create the book if it does not exist")
+	flags.Bool("dry-run", false, "report what would be added without changing the book")
+	for _, name := range []string{"book", "maildir", "since", "exclude", "create", "dry-run"} {
+		viper.BindPFlag("mabctl.learn."+viperKey(name), flags.Lookup(name))
+	}
+	rootCmd.AddCommand(learnCmd)
+}
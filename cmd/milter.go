@@ -0,0 +1,97 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var milterCmd = &cobra.Command{
+	Use:   "milter",
+	Short: "run a milter adding a header naming the address book of the sender",
+	Long: `
+Run a Sendmail/Postfix milter on --listen, a TCP HOST:PORT or a unix socket
+given as unix:PATH or an absolute path.  For a message whose envelope
+recipient is a user, the recipient's address books are scanned for the
+envelope sender and the addresses of the From header.  If any contain a
+sender, a --header is added to the message with the --value, where {book}
+is replaced by the first such book, {books} by all of them separated by
+commas, and {sender} and {recipient} by the addresses.  Headers with the
+--header name already in the message are removed unless --strip=false is
+given.
+
+Limitation: a message with several envelope recipients gets no header.  A
+milter changes the one copy of the message which every recipient receives,
+so a header for one recipient would show the book names of that recipient
+to all of the others.  To tag each recipient of such messages, have Postfix
+split them before the milter sees them: deliver through a content_filter
+transport with a destination_recipient_limit of 1 to a second smtpd which
+runs the milter.
+
+Lookups and the list of users are cached for --cache-ttl, holding at most
+--cache-size results; a --cache-ttl of 0 disables caching.  The settings
+may be set in the config file as mabctl.milter.listen, header, value,
+strip, cache_ttl and cache_size.  Runs until interrupted.
+
+Example main.cf entries for a milter on the default --listen address:
+  smtpd_milters = inet:127.0.0.1:10041
+  milter_default_action = accept
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		config := api.MilterConfig{
+			Header:    viper.GetString("mabctl.milter.header"),
+			Value:     viper.GetString("mabctl.milter.value"),
+			Strip:     viper.GetBool("mabctl.milter.strip"),
+			CacheTTL:  viper.GetDuration("mabctl.milter.cache_ttl"),
+			CacheSize: viper.GetInt("mabctl.milter.cache_size"),
+		}
+		address := viper.GetString("mabctl.milter.listen")
+		listener, err := api.PolicyListen(pathname(address))
+		CheckErr(err)
+		if !viper.GetBool("quiet") {
+			fmt.Fprintf(os.Stderr, "milter listening on %s\n", listener.Addr())
+		}
+		server := api.NewMilterServer(MAB, config)
+		CheckErr(server.Serve(cmd.Context(), listener))
+	},
+}
+
+func init() {
+	defaults := api.NewMilterConfig()
+	flags := milterCmd.Flags()
+	flags.String("listen", api.DEFAULT_MILTER_LISTEN, "listen address: HOST:PORT, unix:PATH or an absolute socket path")
+	flags.String("header", defaults.Header, "name of the header added")
+	flags.String("value", defaults.Value, "value of the header added")
+	flags.Bool("strip", defaults.Strip, "remove headers with the same name from incoming messages")
+	flags.Duration("cache-ttl", defaults.CacheTTL, "lookup cache lifetime (0 disables)")
+	flags.Int("cache-size", defaults.CacheSize, "maximum number of cached lookups")
+	for _, name := range []string{"listen", "header", "value", "strip", "cache-ttl", "cache-size"} {
+		viper.BindPFlag("mabctl.milter."+viperKey(name), flags.Lookup(name))
+	}
+	rootCmd.AddCommand(milterCmd)
+}
@@ -40,8 +40,8 @@ Add a new CardDAV address book for USERNAME
 		if len(args) > 2 {
 			description = args[2]
 		}
-		response, err := MAB.AddBook(username, bookname, description)
-		cobra.CheckErr(err)
+		response, err := MAB.AddBookCtx(cmd.Context(), username, bookname, description)
+		CheckErr(err)
 		if !HandleResponse(response, response.Book) {
 			fmt.Println(response.Book.URI)
 		}
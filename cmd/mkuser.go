@@ -44,8 +44,8 @@ addresses by convention.  The display name will be visible to the user.
 		if len(args) > 2 {
 			password = args[2]
 		}
-		response, err := MAB.AddUser(email, display, password)
-		cobra.CheckErr(err)
+		response, err := MAB.AddUserCtx(cmd.Context(), email, display, password)
+		CheckErr(err)
 		if !HandleResponse(response, response.User) {
 			fmt.Printf("created: %s\n", response.User.UserName)
 		}
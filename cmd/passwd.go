@@ -35,8 +35,8 @@ Write the CardDAV password for USERNAME to stdout
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		username := args[0]
-		response, err := MAB.GetPassword(username)
-		cobra.CheckErr(err)
+		response, err := MAB.GetPasswordCtx(cmd.Context(), username)
+		CheckErr(err)
 		if !HandleResponse(response, response.Password) {
 			fmt.Println(response.Password)
 		}
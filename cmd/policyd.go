@@ -0,0 +1,99 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var policydCmd = &cobra.Command{
+	Use:   "policyd",
+	Short: "run a postfix policy server checking senders against address books",
+	Long: `
+Answer Postfix SMTP access policy delegation requests on --listen, a TCP
+HOST:PORT or a unix socket given as unix:PATH or an absolute path.  For
+each request with a sender and a recipient who is a user, the recipient's
+address books are scanned for the sender.  Postfix applies the action to
+the message delivered to every recipient, so only a message with a single
+recipient is looked up; since the number of recipients is known only once
+the DATA command is received, the policy belongs in
+smtpd_data_restrictions or smtpd_end_of_data_restrictions.  If any contain the sender, the
+--match-action is returned, with {book} replaced by the first such book,
+{books} by all of them separated by commas, and {sender} and {recipient}
+by the addresses.  Otherwise --nomatch-action is returned, or
+--error-action if the lookup fails.
+
+Results and the list of users are cached for --cache-ttl, holding at most
+--cache-size results; a --cache-ttl of 0 disables caching.  The settings
+may be set in the config file as mabctl.policyd.listen, match_action,
+nomatch_action, error_action, cache_ttl and cache_size.  Runs until
+interrupted.
+
+Setting mabctl.cache.ttl in the config file also caches user passwords,
+book lists and the addresses of each book, so a lookup missing the result
+cache is still answered without server requests; mabctl.cache.size limits
+the entries of each kind (default 1000), and mabctl.cache.revalidate
+refreshes expired address sets with a sync-collection request.
+
+Example main.cf entry for a server on the default --listen address:
+  smtpd_end_of_data_restrictions = ...,
+      check_policy_service inet:127.0.0.1:10040
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		config := api.PolicyConfig{
+			MatchAction:   viper.GetString("mabctl.policyd.match_action"),
+			NoMatchAction: viper.GetString("mabctl.policyd.nomatch_action"),
+			ErrorAction:   viper.GetString("mabctl.policyd.error_action"),
+			CacheTTL:      viper.GetDuration("mabctl.policyd.cache_ttl"),
+			CacheSize:     viper.GetInt("mabctl.policyd.cache_size"),
+		}
+		address := viper.GetString("mabctl.policyd.listen")
+		listener, err := api.PolicyListen(pathname(address))
+		CheckErr(err)
+		if !viper.GetBool("quiet") {
+			fmt.Fprintf(os.Stderr, "policyd listening on %s\n", listener.Addr())
+		}
+		server := api.NewPolicyServer(MAB, config)
+		CheckErr(server.Serve(cmd.Context(), listener))
+	},
+}
+
+func init() {
+	defaults := api.NewPolicyConfig()
+	flags := policydCmd.Flags()
+	flags.String("listen", api.DEFAULT_POLICY_LISTEN, "listen address: HOST:PORT, unix:PATH or an absolute socket path")
+	flags.String("match-action", defaults.MatchAction, "action when the sender is in a recipient's address book")
+	flags.String("nomatch-action", defaults.NoMatchAction, "action when the sender is in none of the recipient's address books")
+	flags.String("error-action", defaults.ErrorAction, "action when the lookup fails")
+	flags.Duration("cache-ttl", defaults.CacheTTL, "lookup cache lifetime (0 disables)")
+	flags.Int("cache-size", defaults.CacheSize, "maximum number of cached lookups")
+	for _, name := range []string{"listen", "match-action", "nomatch-action", "error-action", "cache-ttl", "cache-size"} {
+		viper.BindPFlag("mabctl.policyd."+viperKey(name), flags.Lookup(name))
+	}
+	rootCmd.AddCommand(policydCmd)
+}
@@ -32,8 +32,8 @@ var resetCmd = &cobra.Command{
 Stop and restart the browser instance used by the baikalctl admin interface.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		response, err := MAB.Reset()
-		cobra.CheckErr(err)
+		response, err := MAB.ResetCtx(cmd.Context())
+		CheckErr(err)
 		PrintMessage(response)
 	},
 }
@@ -22,15 +22,25 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/rstms/mabctl/api"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"os"
+	"slices"
+	"strings"
 )
 
 var restoreUser string
+var restoreDryRun bool
+var restorePlanOut string
+var restoreApplyPlan string
+var restoreMode string
+var restoreJournal string
+var restoreResume string
 
 var restoreCmd = &cobra.Command{
 	Use:   "restore [FILENAME]",
@@ -38,45 +48,171 @@ var restoreCmd = &cobra.Command{
 	Long: `
 Restore the CardDAV server config from a JSON dump file.  If FILENAME is 
 provided read from the file.  If FILENAME is absent or '-' read from STDIN
+Dumps written by earlier versions, which list only email addresses, are
+accepted; each address is restored as a new card.  Dumps written with
+dump --encrypt are decrypted using the --passphrase-fd or --passphrase-env
+passphrase.
+
+--mode selects how the dump is combined with the server:
+  merge    add missing users, books and cards; change nothing else (default)
+  replace  delete all users, or the --user, and recreate them (default with --force)
+  sync     make the server match the dump, deleting surplus users, books and
+           cards, adding missing ones and replacing changed cards; users in
+           both are kept so their CardDAV clients do not lose sync state
+replace and sync require --force.
+
+With --dry-run, the dump is compared to the current server state and the
+users, books and cards which would be created, deleted or left untouched
+are listed instead of changing anything.  --plan-out writes the plan to a
+file, which --apply-plan executes exactly; the plan is refused if the
+server has changed since it was made.  Applying a replace or sync plan, or
+any plan which deletes, requires --force.
+
+--journal records each user, book and card restored in a new file, which
+also holds the dump, mode and user.  If the restore is interrupted or
+fails, --resume JOURNAL continues it: replace skips the steps the journal
+shows as done, and merge and sync recompute the plan from the server.
+Every failed step is listed on stderr; a failed user or book skips its
+contents, but all other steps are attempted.
 `,
-	Args: cobra.ExactArgs(1),
+	Args: cobra.RangeArgs(0, 1),
 	Run: func(cmd *cobra.Command, args []string) {
-		filename := args[0]
-		var file *os.File
-		var err error
-		if filename == "" || filename == "-" {
-			// read from STDIN
-			file = os.Stdin
-		} else {
-			// read from file
-			file, err = os.Open(filename)
-			cobra.CheckErr(err)
-			defer file.Close()
+		if restoreApplyPlan != "" {
+			data, err := readInput(restoreApplyPlan)
+			CheckErr(err)
+			plan, err := api.ReadPlan(bytes.NewReader(data))
+			CheckErr(err)
+			if plan.Destructive() && !viper.GetBool("force") {
+				CheckErr(fmt.Errorf("plan for restore mode '%s' deletes or replaces data and requires --force", plan.Mode))
+			}
+			response, err := api.ApplyPlan(cmd.Context(), MAB, plan)
+			printRestore(response, err)
+			return
+		}
+		if restoreResume != "" {
+			if len(args) > 0 {
+				CheckErr(fmt.Errorf("--resume reads the dump from the journal; FILENAME is not allowed"))
+			}
+			resumeRestore(cmd, restoreResume)
+			return
+		}
+		filename := ""
+		if len(args) > 0 {
+			filename = args[0]
 		}
-		var dump api.ConfigDump
-		decoder := json.NewDecoder(file)
-		err = decoder.Decode(&dump)
-		cobra.CheckErr(err)
+		data, err := readDecrypted(filename)
+		CheckErr(err)
+		dump, err := api.ReadDump(bytes.NewReader(data))
+		CheckErr(err)
 
+		restoreDump(cmd, dump)
+	},
+}
+
+// restoreDump restores dump using the restore command's mode and plan flags
+func restoreDump(cmd *cobra.Command, dump *api.DumpFile) {
+	mode := restoreMode
+	if mode == "" {
+		mode = api.RESTORE_MERGE
 		if viper.GetBool("force") {
-		    if restoreUser != "" {
-			_, err := MAB.DeleteUser(restoreUser)
-			cobra.CheckErr(err)
-		    } else {
-			_, err := MAB.Clear()
-			cobra.CheckErr(err)
-		    }
+			mode = api.RESTORE_REPLACE
 		}
+	}
+	if !slices.Contains(api.RESTORE_MODES, mode) {
+		CheckErr(fmt.Errorf("unknown restore mode '%s'; expected one of %s", mode, strings.Join(api.RESTORE_MODES, ", ")))
+	}
 
-		response, err := MAB.Restore(&dump, restoreUser)
-		cobra.CheckErr(err)
-		if !HandleResponse(response, response) {
+	if restoreDryRun || restorePlanOut != "" {
+		plan, err := api.PlanRestore(cmd.Context(), MAB, dump, mode, restoreUser)
+		CheckErr(err)
+		if restorePlanOut != "" {
+			data, err := json.MarshalIndent(plan, "", "  ")
+			CheckErr(err)
+			err = os.WriteFile(restorePlanOut, data, 0600)
+			CheckErr(err)
+		}
+		if !HandleResponse(plan, plan) {
+			fmt.Println(plan.Text())
+		}
+		return
+	}
+
+	if mode != api.RESTORE_MERGE && !viper.GetBool("force") {
+		CheckErr(fmt.Errorf("restore mode '%s' requires --force", mode))
+	}
+	var journal *api.RestoreJournal
+	if restoreJournal != "" {
+		var err error
+		journal, err = api.CreateJournal(restoreJournal, dump, mode, restoreUser)
+		CheckErr(err)
+		defer journal.Close()
+	}
+	runRestore(cmd, dump, mode, restoreUser, journal)
+}
+
+// resumeRestore continues the restore recorded in a journal
+func resumeRestore(cmd *cobra.Command, filename string) {
+	journal, err := api.OpenJournal(filename)
+	CheckErr(err)
+	defer journal.Close()
+	mode := journal.Header.Mode
+	if mode != api.RESTORE_MERGE && !viper.GetBool("force") {
+		CheckErr(fmt.Errorf("restore mode '%s' requires --force", mode))
+	}
+	restoreJournal = filename
+	runRestore(cmd, &journal.Header.Dump, mode, journal.Header.User, journal)
+}
+
+// runRestore restores dump, recording progress in journal if not nil
+func runRestore(cmd *cobra.Command, dump *api.DumpFile, mode, username string, journal *api.RestoreJournal) {
+	if mode != api.RESTORE_REPLACE {
+		plan, err := api.PlanRestore(cmd.Context(), MAB, dump, mode, username)
+		CheckErr(err)
+		response, err := api.ExecutePlan(cmd.Context(), MAB, plan, journal)
+		printRestore(response, err)
+		return
+	}
+
+	clear := api.JournalEntry{Action: api.PLAN_DELETE, Kind: api.JOURNAL_CLEAR, Username: username}
+	if !journal.Done(clear) {
+		var err error
+		if username != "" {
+			_, err = MAB.DeleteUserCtx(cmd.Context(), username)
+		} else {
+			_, err = MAB.ClearCtx(cmd.Context())
+		}
+		CheckErr(err)
+		CheckErr(journal.Record(clear))
+	}
+
+	response, err := MAB.RestoreCtx(cmd.Context(), dump, username, journal)
+	printRestore(response, err)
+}
+
+// printRestore outputs a restore response, writing each failure to stderr,
+// and exits if the restore failed
+func printRestore(response *api.RestoreResponse, err error) {
+	if response != nil && !HandleResponse(response, response) {
+		for _, failure := range response.Failures {
+			fmt.Fprintf(os.Stderr, "failed: %s\n", failure)
+		}
+		if err == nil {
 			fmt.Println(response.Message)
 		}
-	},
+	}
+	if errors.Is(err, api.ErrRestoreIncomplete) && restoreJournal != "" {
+		fmt.Fprintf(os.Stderr, "resume with: %s restore --resume %s\n", ProgramName, restoreJournal)
+	}
+	CheckErr(err)
 }
 
 func init() {
 	restoreCmd.Flags().StringVar(&restoreUser, "user", "", "restore username")
+	restoreCmd.Flags().StringVar(&restoreMode, "mode", "", "restore mode: merge, replace or sync")
+	restoreCmd.Flags().BoolVar(&restoreDryRun, "dry-run", false, "print the restore plan without changing the server")
+	restoreCmd.Flags().StringVar(&restorePlanOut, "plan-out", "", "write the restore plan to a file (implies --dry-run)")
+	restoreCmd.Flags().StringVar(&restoreApplyPlan, "apply-plan", "", "execute a plan written by --plan-out")
+	restoreCmd.Flags().StringVar(&restoreJournal, "journal", "", "record restore progress in a new journal file")
+	restoreCmd.Flags().StringVar(&restoreResume, "resume", "", "continue the restore recorded in a journal file")
 	rootCmd.AddCommand(restoreCmd)
 }
@@ -36,8 +36,8 @@ Delete address book identified by USERNAME and BOOKNAME
 	Run: func(cmd *cobra.Command, args []string) {
 		username := args[0]
 		bookname := args[1]
-		response, err := MAB.DeleteBook(username, bookname)
-		cobra.CheckErr(err)
+		response, err := MAB.DeleteBookCtx(cmd.Context(), username, bookname)
+		CheckErr(err)
 		PrintMessage(response)
 	},
 }
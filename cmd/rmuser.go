@@ -35,8 +35,8 @@ Delete the CardDAV account for USERNAME including all address books.
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		username := args[0]
-		response, err := MAB.DeleteUser(username)
-		cobra.CheckErr(err)
+		response, err := MAB.DeleteUserCtx(cmd.Context(), username)
+		CheckErr(err)
 		if !HandleResponse(response, response.Message) {
 			fmt.Println(response.Message)
 		}
@@ -22,22 +22,34 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/rstms/mabctl/api"
+	"github.com/rstms/mabctl/util"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
 const ProgramName = "mabctl"
 
-var MAB *api.Controller
+var MAB api.AddressBookManager
+
+// newController is replaced by tests to substitute an offline implementation
+var newController = func() (api.AddressBookManager, error) {
+	return api.NewAddressBookController()
+}
 
 var cfgFile string
 
+var cancelTimeout context.CancelFunc = func() {}
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "mabctl",
@@ -45,22 +57,61 @@ var rootCmd = &cobra.Command{
 	Short: "mabctl address book control tool library",
 	Long: `
 CLI toolkit for administering a baikal carddav/caldav server.
+
+Long operations (dump, restore, backup, destroy, userbooks) draw a progress
+bar when stderr is a terminal.  --progress writes a line per user instead,
+and --events jsonl writes each event as a JSON object, one per line, with
+fields time, type (start, user, book, address, error or done), operation,
+username, bookname, uid, address, done, total and error.
+
+Exit codes:
+  1   error
+  2   differences found (diff)
+  3   user, book, or address not found
+  4   user, book, or address exists
+  5   unauthorized
+  6   server unavailable or server error
+  7   conflict, including a failed --if-match or --if-none-match
+  8   timeout
+  130 interrupted
 `,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		switch cmd.Use {
 		case "version", "config":
 			return
 		}
+		timeout := commandTimeout(cmd)
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(cmd.Context(), timeout)
+			cmd.SetContext(ctx)
+			cancelTimeout = cancel
+		}
 		var err error
-		MAB, err = api.NewAddressBookController()
-		cobra.CheckErr(err)
+		MAB, err = newController()
+		CheckErr(err)
+		installEventHandler(MAB)
 	},
 }
 
+// commandTimeout returns the configured timeout, or none for the servers
+// and watch, which run until interrupted or terminated
+func commandTimeout(cmd *cobra.Command) time.Duration {
+	switch cmd.Name() {
+	case "policyd", "milter", "serve", "watch":
+		return 0
+	}
+	return viper.GetDuration("mabctl.timeout")
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// SIGINT and SIGTERM cancel the command context, aborting any in-flight
+// server requests and stopping the servers.
 func Execute() {
-	err := rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := rootCmd.ExecuteContext(ctx)
+	cancelTimeout()
+	stop()
 	if err != nil {
 		os.Exit(1)
 	}
@@ -87,6 +138,35 @@ func init() {
 	optionString("api-key", "", "", "bcc API key")
 	optionString("client-cert", "", "/etc/mabctl/mabctl.pem", "client certificate file")
 	optionString("client-key", "", "/etc/mabctl/mabctl.key", "client certificate key file")
+	optionString("sync-dir", "", "", "address book sync state and card copy directory (default is user cache dir)")
+	optionDuration("timeout", "", 0, "overall command timeout, except for servers and watch (0 disables)")
+	optionInt("passphrase-fd", "", -1, "read the dump encryption passphrase from this file descriptor")
+	optionSwitch("progress", "", "report per-user progress of dump, restore and backup on stderr")
+	optionString("events", "", "", "write progress events to stderr in this format: jsonl")
+	optionInt("jobs", "", api.DEFAULT_JOBS, "number of users dumped or restored concurrently")
+	optionFloat("rate-limit", "", 0, "maximum server requests per second (0 disables)")
+	optionString("passphrase-env", "", "MABCTL_PASSPHRASE", "environment variable holding the dump encryption passphrase")
+	retryOptions()
+}
+
+// retryOptions binds the --retry-* flags to the mabctl.retry config keys
+func retryOptions() {
+	flags := rootCmd.PersistentFlags()
+	flags.Int("retry-attempts", util.DEFAULT_RETRY_ATTEMPTS, "maximum attempts for each server request (1 disables retry)")
+	flags.Duration("retry-backoff", util.DEFAULT_RETRY_BACKOFF, "delay before the first retry, doubled for each retry")
+	flags.Duration("retry-max-backoff", util.DEFAULT_RETRY_MAX_BACKOFF, "maximum delay between retries (0 for no limit)")
+	flags.Float64("retry-jitter", util.DEFAULT_RETRY_JITTER, "random fraction applied to each retry delay")
+	flags.IntSlice("retry-status", util.DEFAULT_RETRY_STATUS, "HTTP status codes which are retried")
+	keys := map[string]string{
+		"retry-attempts":    "mabctl.retry.max_attempts",
+		"retry-backoff":     "mabctl.retry.backoff",
+		"retry-max-backoff": "mabctl.retry.max_backoff",
+		"retry-jitter":      "mabctl.retry.jitter",
+		"retry-status":      "mabctl.retry.status",
+	}
+	for name, key := range keys {
+		viper.BindPFlag(key, flags.Lookup(name))
+	}
 }
 
 func viperKey(name string) string {
@@ -112,10 +192,37 @@ func optionString(name, flag, value, description string) {
 	viper.BindPFlag("mabctl." + viperKey(name), rootCmd.PersistentFlags().Lookup(name))
 }
 
+func optionDuration(name, flag string, value time.Duration, description string) {
+	if flag == "" {
+		rootCmd.PersistentFlags().Duration(name, value, description)
+	} else {
+		rootCmd.PersistentFlags().DurationP(name, flag, value, description)
+	}
+	viper.BindPFlag("mabctl."+viperKey(name), rootCmd.PersistentFlags().Lookup(name))
+}
+
+func optionInt(name, flag string, value int, description string) {
+	if flag == "" {
+		rootCmd.PersistentFlags().Int(name, value, description)
+	} else {
+		rootCmd.PersistentFlags().IntP(name, flag, value, description)
+	}
+	viper.BindPFlag("mabctl."+viperKey(name), rootCmd.PersistentFlags().Lookup(name))
+}
+
+func optionFloat(name, flag string, value float64, description string) {
+	if flag == "" {
+		rootCmd.PersistentFlags().Float64(name, value, description)
+	} else {
+		rootCmd.PersistentFlags().Float64P(name, flag, value, description)
+	}
+	viper.BindPFlag("mabctl."+viperKey(name), rootCmd.PersistentFlags().Lookup(name))
+}
+
 func pathname(filename string) string {
 	if strings.HasPrefix(filename, "~") {
 		home, err := os.UserHomeDir()
-		cobra.CheckErr(err)
+		CheckErr(err)
 		filename = filepath.Join(home, filename[1:])
 	}
 	return filename
@@ -148,7 +255,7 @@ func initConfig() {
 	}
 
 	err := viper.ReadInConfig()
-	cobra.CheckErr(err)
+	CheckErr(err)
 	file := viper.ConfigFileUsed()
 	if file != "" && viper.GetBool("verbose") {
 		fmt.Fprintf(os.Stderr, "Configured from file: %v\n", file)
@@ -184,7 +291,7 @@ func PrintResponse(response interface{}) {
 	}
 	if viper.GetBool("json") {
 		buf, err := json.MarshalIndent(response, "", "  ")
-		cobra.CheckErr(err)
+		CheckErr(err)
 		fmt.Println(string(buf))
 		return
 	}
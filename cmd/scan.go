@@ -33,16 +33,17 @@ var scanCmd = &cobra.Command{
 	Short: "report address books containing address",
 	Long: `
 Scan for EMAIL_ADDRESS in all CardDAV address books under the user account
-USERNAME.  Output name of each book containing EMAIL_ADDRESS.  Set exit
-code 0 if at least one book contains the address.
+USERNAME.  Output name of each book containing an address equal to
+EMAIL_ADDRESS, ignoring case.  Set exit code 0 if at least one book
+contains the address.
 `,
 	Args: cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
 		username := args[0]
 		email := args[1]
 		exitCode := 1
-		response, err := MAB.ScanAddress(username, email)
-		cobra.CheckErr(err)
+		response, err := MAB.ScanAddressCtx(cmd.Context(), username, email)
+		CheckErr(err)
 		if len(response.Books) > 0 {
 			exitCode = 0
 		}
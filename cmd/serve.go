@@ -0,0 +1,116 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/rstms/mabctl/api"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "run a REST API server for address book management",
+	Long: `
+Serve the user, book, address, scan and dump operations as a REST API with
+JSON responses on --listen.  The responses are those written by the
+corresponding commands with --verbose; failures return an error response
+with an HTTP status reporting the cause.  The OpenAPI description of the
+API is served at /api/v1/openapi.yaml and /api/v1/openapi.json.  The
+dump omits user passwords.
+
+Requests must be authenticated with a bearer token or a TLS client
+certificate.  Tokens are read from --token-file, one per line, ignoring
+blank lines and lines beginning with #, and from the mabctl.serve.tokens
+list in the config file.  With --tls-cert and --tls-key the server accepts
+only TLS connections; adding --client-ca accepts client certificates
+signed by that CA in place of a token.  Without TLS, tokens are sent in
+the clear, so listen only on a loopback address.
+
+The settings may be set in the config file as mabctl.serve.listen,
+token_file, tls_cert, tls_key and client_ca.  Runs until interrupted.
+
+Example:
+  curl -H "Authorization: Bearer $TOKEN" \
+      http://127.0.0.1:8480/api/v1/users/USERNAME/books
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		tokens, err := readTokens(viper.GetString("mabctl.serve.token_file"))
+		CheckErr(err)
+		config := api.ServerConfig{
+			Tokens:       append(tokens, viper.GetStringSlice("mabctl.serve.tokens")...),
+			CertFile:     pathname(viper.GetString("mabctl.serve.tls_cert")),
+			KeyFile:      pathname(viper.GetString("mabctl.serve.tls_key")),
+			ClientCAFile: pathname(viper.GetString("mabctl.serve.client_ca")),
+		}
+		server, err := api.NewAPIServer(MAB, config)
+		CheckErr(err)
+		listener, err := net.Listen("tcp", viper.GetString("mabctl.serve.listen"))
+		CheckErr(err)
+		if !viper.GetBool("quiet") {
+			scheme := "http"
+			if server.TLS() {
+				scheme = "https"
+			}
+			fmt.Fprintf(os.Stderr, "serving %s://%s/api/v1\n", scheme, listener.Addr())
+		}
+		CheckErr(server.Serve(cmd.Context(), listener))
+	},
+}
+
+// readTokens returns the tokens in filename, if set
+func readTokens(filename string) ([]string, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	data, err := readInput(pathname(filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading token file: %w", err)
+	}
+	tokens := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+	return tokens, nil
+}
+
+func init() {
+	flags := serveCmd.Flags()
+	flags.String("listen", api.DEFAULT_SERVER_LISTEN, "listen address HOST:PORT")
+	flags.String("token-file", "", "file of accepted bearer tokens, one per line")
+	flags.String("tls-cert", "", "server certificate file")
+	flags.String("tls-key", "", "server key file")
+	flags.String("client-ca", "", "CA certificate file verifying client certificates")
+	for _, name := range []string{"listen", "token-file", "tls-cert", "tls-key", "client-ca"} {
+		viper.BindPFlag("mabctl.serve."+viperKey(name), flags.Lookup(name))
+	}
+	rootCmd.AddCommand(serveCmd)
+}
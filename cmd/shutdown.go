@@ -33,8 +33,8 @@ var shutdownCmd = &cobra.Command{
 Request server shutdown.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		response, err := MAB.RequestShutdown()
-		cobra.CheckErr(err)
+		response, err := MAB.RequestShutdownCtx(cmd.Context())
+		CheckErr(err)
 		PrintMessage(response)
 	},
 }
@@ -34,8 +34,8 @@ var statusCmd = &cobra.Command{
 Query the admin server status and write to stdout as JSON
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		response, err := MAB.GetStatus()
-		cobra.CheckErr(err)
+		response, err := MAB.GetStatusCtx(cmd.Context())
+		CheckErr(err)
 		if !HandleResponse(response, response.Status) {
 			viper.Set("json", true)
 			PrintResponse(response.Status)
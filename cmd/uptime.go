@@ -33,8 +33,8 @@ var uptimeCmd = &cobra.Command{
 Query the admin server uptime and write to stdout as JSON
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		response, err := MAB.GetUptime()
-		cobra.CheckErr(err)
+		response, err := MAB.GetUptimeCtx(cmd.Context())
+		CheckErr(err)
 		PrintMessage(response)
 	},
 }
@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/rstms/mabctl/api"
 	"github.com/spf13/cobra"
 )
 
@@ -33,13 +34,13 @@ var userCmd = &cobra.Command{
 	Short: "display a user",
 	Long: `
 Output JSON data for a user account.  Sets exit code non-zero on error.
-Can be used to determine user existence.
+Can be used to determine user existence: a missing user exits with code 3.
 `,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		username := args[0]
-		response, err := MAB.GetUsers()
-		cobra.CheckErr(err)
+		response, err := MAB.GetUsersCtx(cmd.Context())
+		CheckErr(err)
 		for _, user := range response.Users {
 			if user.UserName == username {
 				if !HandleResponse(&user, &user.UserName) {
@@ -48,7 +49,7 @@ Can be used to determine user existence.
 				os.Exit(0)
 			}
 		}
-		os.Exit(1)
+		CheckErr(fmt.Errorf("%w: %s", api.ErrUserNotFound, username))
 	},
 }
 
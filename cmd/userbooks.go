@@ -34,8 +34,8 @@ var userbooksCmd = &cobra.Command{
 Output the list of users including all address books for each user.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		response, err := MAB.GetUserBooks()
-		cobra.CheckErr(err)
+		response, err := MAB.GetUserBooksCtx(cmd.Context())
+		CheckErr(err)
 		if !HandleResponse(response, response.UserBooks) {
 			for username, books := range response.UserBooks {
 				fmt.Printf("%s\t%s\n", username, strings.Join(books, ","))
@@ -33,8 +33,8 @@ var usersCmd = &cobra.Command{
 Query admin interface and output a list of all user accounts
 `,
 	Run: func(cmd *cobra.Command, args []string) {
-		response, err := MAB.GetUsers()
-		cobra.CheckErr(err)
+		response, err := MAB.GetUsersCtx(cmd.Context())
+		CheckErr(err)
 		if !HandleResponse(response, response.Users) {
 			for _, user := range response.Users {
 				fmt.Println(user.UserName)
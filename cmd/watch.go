@@ -0,0 +1,91 @@
+/*
+Copyright © 2024 Matt Krueger <mkrueger@rstms.net>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-webdav/carddav"
+	"github.com/spf13/cobra"
+)
+
+var watchInterval time.Duration
+var watchInitial bool
+
+var watchCmd = &cobra.Command{
+	Use:   "watch USERNAME BOOKNAME",
+	Short: "output address book changes",
+	Long: `
+Poll the CardDAV address book BOOKNAME under the user account USERNAME,
+writing a line for each address added, changed or deleted.  Only changes
+are transferred when the server supports WebDAV sync-collection.  The first
+poll finds the changes since the book was last watched from this host, or
+the entire book as added if it has not been; they are reported only with
+--initial.  Other commands reading the book do not affect what watch
+reports.  Only the paths and ETags of the cards are kept between runs, so a
+card deleted while watch was not running is reported by its path.  Runs
+until interrupted.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+		bookname := args[1]
+		ctx := cmd.Context()
+		report := watchInitial
+		for {
+			response, err := MAB.SyncAddressBookCtx(ctx, username, bookname)
+			if ctx.Err() != nil {
+				return
+			}
+			CheckErr(err)
+			changes := len(response.Added) + len(response.Changed) + len(response.Deleted)
+			if report && changes > 0 && !HandleResponse(response, response) {
+				printChanges("added", response.Added)
+				printChanges("changed", response.Changed)
+				printChanges("deleted", response.Deleted)
+			}
+			report = true
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchInterval):
+			}
+		}
+	},
+}
+
+func printChanges(label string, addrs []carddav.AddressObject) {
+	for _, addr := range addrs {
+		email, err := MAB.EmailAddress(addr)
+		if err != nil {
+			email = addr.Path
+		}
+		fmt.Printf("%s\t%s\n", label, email)
+	}
+}
+
+func init() {
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", 30*time.Second, "polling interval")
+	watchCmd.Flags().BoolVar(&watchInitial, "initial", false, "report the changes found by the first poll")
+	rootCmd.AddCommand(watchCmd)
+}
@@ -0,0 +1,906 @@
+// Package memory provides an in-memory api.AddressBookManager which mimics
+// the behavior of the bcc admin API and the baikal CardDAV server.  It is
+// intended for offline testing of code that manages address books.
+package memory
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav/carddav"
+	"github.com/google/uuid"
+	"github.com/rstms/mabctl/api"
+	davapi "github.com/rstms/mabctl/carddav"
+	"github.com/rstms/mabctl/util"
+)
+
+const DEFAULT_URL = "https://localhost"
+
+type book struct {
+	description string
+	addrs       map[string]carddav.AddressObject
+}
+
+type user struct {
+	display  string
+	password string
+	books    map[string]*book
+}
+
+type Controller struct {
+	URL     string
+	mutex   sync.Mutex
+	users   map[string]*user
+	started time.Time
+	synced  map[string]map[string]carddav.AddressObject
+	api.Emitter
+}
+
+var _ api.AddressBookManager = (*Controller)(nil)
+
+func NewAddressBookController() *Controller {
+	return &Controller{
+		URL:     DEFAULT_URL,
+		users:   make(map[string]*user),
+		started: time.Now(),
+		synced:  make(map[string]map[string]carddav.AddressObject),
+	}
+}
+
+func response(request, message string) api.Response {
+	return api.Response{Success: true, Request: request, Message: message}
+}
+
+func mkpasswd() string {
+	bytes := make([]byte, api.PASSWORD_LENGTH)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+func mketag() string {
+	bytes := make([]byte, 8)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// match mirrors the default CardDAV text-match: a case-insensitive substring
+// of any EMAIL property
+func match(addr carddav.AddressObject, email string) bool {
+	for _, value := range addr.Card.Values(vcard.FieldEmail) {
+		if strings.Contains(strings.ToLower(value), strings.ToLower(email)) {
+			return true
+		}
+	}
+	return false
+}
+
+// equal reports whether an address object has an EMAIL equal to email
+func equal(addr carddav.AddressObject, email string) bool {
+	for _, value := range addr.Card.Values(vcard.FieldEmail) {
+		if strings.EqualFold(value, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the user and book; caller must hold the mutex
+func (c *Controller) lookup(username, bookname string) (*user, *book, error) {
+	u, ok := c.users[username]
+	if !ok {
+		return nil, nil, util.Fatalf("%w: %s", api.ErrUserNotFound, username)
+	}
+	if bookname == "" {
+		return u, nil, nil
+	}
+	b, ok := u.books[bookname]
+	if !ok {
+		return nil, nil, util.Fatalf("%w: %s", api.ErrBookNotFound, bookname)
+	}
+	return u, b, nil
+}
+
+func (c *Controller) book(username, bookname string, b *book) api.Book {
+	return api.Book{
+		UserName:    username,
+		BookName:    bookname,
+		Description: b.description,
+		Contacts:    len(b.addrs),
+		Token:       util.BookToken(username, bookname),
+		URI:         c.URL + util.BookURI(username, bookname),
+	}
+}
+
+func (c *Controller) sortedAddrs(b *book) []carddav.AddressObject {
+	paths := make([]string, 0, len(b.addrs))
+	for path := range b.addrs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	ret := make([]carddav.AddressObject, len(paths))
+	for i, path := range paths {
+		ret[i] = b.addrs[path]
+	}
+	return ret
+}
+
+func (c *Controller) InitializeCtx(ctx context.Context) (*api.Response, error) {
+	ret := response("initialize", "initialized")
+	return &ret, nil
+}
+
+func (c *Controller) ResetCtx(ctx context.Context) (*api.Response, error) {
+	ret := response("reset", "reset")
+	return &ret, nil
+}
+
+func (c *Controller) GetStatusCtx(ctx context.Context) (*api.StatusResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ret := api.StatusResponse{Response: response("status", "status")}
+	ret.Status = map[string]any{"users": len(c.users)}
+	return &ret, nil
+}
+
+func (c *Controller) GetUptimeCtx(ctx context.Context) (*api.Response, error) {
+	ret := response("uptime", time.Since(c.started).Round(time.Second).String())
+	return &ret, nil
+}
+
+func (c *Controller) RequestShutdownCtx(ctx context.Context) (*api.Response, error) {
+	ret := response("shutdown", "shutdown requested")
+	return &ret, nil
+}
+
+func (c *Controller) GetUsersCtx(ctx context.Context) (*api.UsersResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ret := api.UsersResponse{Response: response("users", "users")}
+	ret.Users = []api.User{}
+	for username, u := range c.users {
+		ret.Users = append(ret.Users, api.User{
+			UserName:    username,
+			DisplayName: u.display,
+			URI:         fmt.Sprintf("%s/dav.php/principals/%s/", c.URL, username),
+		})
+	}
+	sort.Slice(ret.Users, func(i, j int) bool { return ret.Users[i].UserName < ret.Users[j].UserName })
+	return &ret, nil
+}
+
+func (c *Controller) GetUserBooksCtx(ctx context.Context) (*api.UserBooksResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ret := api.UserBooksResponse{Response: response("get user books", "all users and address books")}
+	ret.UserBooks = make(map[string][]string)
+	op := c.Start("userbooks", len(c.users))
+	for username, u := range c.users {
+		books := []string{}
+		for bookname := range u.books {
+			books = append(books, bookname)
+		}
+		sort.Strings(books)
+		ret.UserBooks[username] = books
+		op.User(username, nil)
+	}
+	op.Finish(nil)
+	return &ret, nil
+}
+
+func (c *Controller) AddUserCtx(ctx context.Context, username, display, password string) (*api.AddUserResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.users[username]; ok {
+		return nil, util.Fatalf("%w: %s", api.ErrUserExists, username)
+	}
+	if display == "" {
+		display = username
+	}
+	if password == "" {
+		password = mkpasswd()
+	}
+	c.users[username] = &user{display: display, password: password, books: make(map[string]*book)}
+	ret := api.AddUserResponse{Response: response("add user", "created")}
+	ret.User = api.User{
+		UserName:    username,
+		DisplayName: display,
+		URI:         fmt.Sprintf("%s/dav.php/principals/%s/", c.URL, username),
+	}
+	return &ret, nil
+}
+
+func (c *Controller) DeleteUserCtx(ctx context.Context, username string) (*api.Response, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, _, err := c.lookup(username, ""); err != nil {
+		return nil, err
+	}
+	delete(c.users, username)
+	ret := response("delete user", fmt.Sprintf("deleted: %s", username))
+	return &ret, nil
+}
+
+func (c *Controller) GetPasswordCtx(ctx context.Context, username string) (*api.AccountResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ret := api.AccountResponse{}
+	ret.Request = fmt.Sprintf("get password: %s", username)
+	u, _, err := c.lookup(username, "")
+	if err != nil {
+		ret.Message = fmt.Sprintf("%v", err)
+		return &ret, nil
+	}
+	ret.Success = true
+	ret.Username = username
+	ret.Password = u.password
+	return &ret, nil
+}
+
+func (c *Controller) GetBooksCtx(ctx context.Context, username string) (*api.BooksResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	u, _, err := c.lookup(username, "")
+	if err != nil {
+		return nil, err
+	}
+	ret := api.BooksResponse{Response: response("books", fmt.Sprintf("%s books", username))}
+	ret.Books = []api.Book{}
+	for bookname, b := range u.books {
+		ret.Books = append(ret.Books, c.book(username, bookname, b))
+	}
+	sort.Slice(ret.Books, func(i, j int) bool { return ret.Books[i].BookName < ret.Books[j].BookName })
+	return &ret, nil
+}
+
+func (c *Controller) GetBookCtx(ctx context.Context, username, bookname string) (*api.Book, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	ret := c.book(username, bookname, b)
+	return &ret, nil
+}
+
+func (c *Controller) AddBookCtx(ctx context.Context, username, bookname, description string) (*api.AddBookResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	u, _, err := c.lookup(username, "")
+	if err != nil {
+		return nil, err
+	}
+	ret := api.AddBookResponse{Response: response("add book", "created")}
+	if b, ok := u.books[bookname]; ok {
+		ret.Message = "book Exists"
+		ret.Book = c.book(username, bookname, b)
+		return &ret, nil
+	}
+	if description == "" {
+		description = bookname
+	}
+	b := &book{description: description, addrs: make(map[string]carddav.AddressObject)}
+	u.books[bookname] = b
+	ret.Book = c.book(username, bookname, b)
+	return &ret, nil
+}
+
+func (c *Controller) DeleteBookCtx(ctx context.Context, username, bookname string) (*api.Response, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	u, _, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	delete(u.books, bookname)
+	ret := response("delete book", fmt.Sprintf("deleted: %s", bookname))
+	return &ret, nil
+}
+
+func (c *Controller) AddressesCtx(ctx context.Context, username, bookname string) (*api.AddressesResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	addrs := c.sortedAddrs(b)
+	emails, err := c.EmailAddressList(&addrs)
+	if err != nil {
+		return nil, err
+	}
+	ret := api.AddressesResponse{Response: response("address book addresses", fmt.Sprintf("%s %s addresses", username, bookname))}
+	ret.Addresses = *emails
+	return &ret, nil
+}
+
+func (c *Controller) CardsCtx(ctx context.Context, username, bookname string) (*api.CardsResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	ret := api.CardsResponse{Response: response("address book cards", fmt.Sprintf("%s %s cards", username, bookname))}
+	ret.Cards = c.sortedAddrs(b)
+	return &ret, nil
+}
+
+// SyncAddressBookCtx reports the changes to a book since the previous call
+// by comparing it with a snapshot taken at that time
+func (c *Controller) SyncAddressBookCtx(ctx context.Context, username, bookname string) (*api.SyncResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	key := util.BookURI(username, bookname)
+	previous, synced := c.synced[key]
+	ret := api.SyncResponse{Response: response(fmt.Sprintf("sync %s %s", username, bookname), "")}
+	ret.Full = !synced
+	snapshot := make(map[string]carddav.AddressObject)
+	for _, addr := range c.sortedAddrs(b) {
+		snapshot[addr.Path] = addr
+		old, exists := previous[addr.Path]
+		switch {
+		case !exists:
+			ret.Added = append(ret.Added, addr)
+		case old.ETag != addr.ETag:
+			ret.Changed = append(ret.Changed, addr)
+		}
+	}
+	paths := []string{}
+	for path := range previous {
+		if _, exists := snapshot[path]; !exists {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		ret.Deleted = append(ret.Deleted, previous[path])
+	}
+	c.synced[key] = snapshot
+	ret.SyncToken = fmt.Sprintf("%d", time.Now().UnixNano())
+	ret.Message = fmt.Sprintf("added: %d, changed: %d, deleted: %d", len(ret.Added), len(ret.Changed), len(ret.Deleted))
+	return &ret, nil
+}
+
+func (c *Controller) AddAddressCtx(ctx context.Context, username, bookname, email, name string) (*api.AddressResponse, error) {
+	return c.AddAddressIfCtx(ctx, username, bookname, email, name, api.Precondition{})
+}
+
+func (c *Controller) AddAddressIfCtx(ctx context.Context, username, bookname, email, name string, cond api.Precondition) (*api.AddressResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	ret := api.AddressResponse{Response: response(fmt.Sprintf("Add CardDAV address: %s", email), "")}
+	for _, addr := range c.sortedAddrs(b) {
+		if equal(addr, email) {
+			if cond.IfNoneMatch {
+				return nil, &api.ConflictError{Path: addr.Path, Err: fmt.Errorf("%w: %s", api.ErrAddressExists, email)}
+			}
+			if cond.IfMatch != "" && cond.IfMatch != addr.ETag {
+				return nil, &api.ConflictError{Path: addr.Path, ETag: cond.IfMatch, Err: fmt.Errorf("ETag mismatch: %s", addr.ETag)}
+			}
+			ret.Address = &addr
+			ret.Message = fmt.Sprintf("existing %s", email)
+			return &ret, nil
+		}
+	}
+	if cond.IfMatch != "" {
+		return nil, &api.ConflictError{ETag: cond.IfMatch, Err: fmt.Errorf("%w: %s", api.ErrAddressNotFound, email)}
+	}
+	uid := uuid.New().String()
+	card := vcard.Card{}
+	card.SetValue(vcard.FieldEmail, email)
+	card.SetValue(vcard.FieldUID, uid)
+	card.SetValue(vcard.FieldVersion, davapi.VCARD_VERSION)
+	firstName, lastName, found := strings.Cut(name, " ")
+	nameField := vcard.Name{}
+	if found {
+		nameField.GivenName = firstName
+		nameField.FamilyName = lastName
+	} else {
+		nameField.AdditionalName = name
+	}
+	card.SetName(&nameField)
+	addr := carddav.AddressObject{
+		Path:    util.BookURI(username, bookname) + uid + ".vcf",
+		ModTime: time.Now(),
+		ETag:    mketag(),
+		Card:    card,
+	}
+	b.addrs[addr.Path] = addr
+	ret.Address = &addr
+	ret.Message = fmt.Sprintf("added %s", email)
+	return &ret, nil
+}
+
+func (c *Controller) DeleteAddressCtx(ctx context.Context, username, bookname, email string) (*api.AddressesResponse, error) {
+	return c.DeleteAddressIfCtx(ctx, username, bookname, email, api.Precondition{})
+}
+
+func (c *Controller) DeleteAddressIfCtx(ctx context.Context, username, bookname, email string, cond api.Precondition) (*api.AddressesResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	deleted := []carddav.AddressObject{}
+	for _, addr := range c.sortedAddrs(b) {
+		if equal(addr, email) {
+			if cond.IfMatch != "" && cond.IfMatch != addr.ETag {
+				return nil, &api.ConflictError{Path: addr.Path, ETag: cond.IfMatch, Err: fmt.Errorf("ETag mismatch: %s", addr.ETag)}
+			}
+			deleted = append(deleted, addr)
+		}
+	}
+	if cond.IfMatch != "" && len(deleted) > 1 {
+		return nil, util.Fatalf("%w: If-Match applies to a single address, but %d match %s", api.ErrConflict, len(deleted), email)
+	}
+	for _, addr := range deleted {
+		delete(b.addrs, addr.Path)
+	}
+	emails, err := c.EmailAddressList(&deleted)
+	if err != nil {
+		return nil, err
+	}
+	ret := api.AddressesResponse{Response: response(fmt.Sprintf("Delete CardDAV address: %s", email), "")}
+	if len(deleted) == 0 {
+		ret.Message = fmt.Sprintf("not found: %s", email)
+	} else {
+		ret.Message = fmt.Sprintf("deleted: %d", len(deleted))
+	}
+	ret.Addresses = *emails
+	return &ret, nil
+}
+
+func (c *Controller) QueryAddressCtx(ctx context.Context, username, bookname, email string) (*api.AddressResponse, error) {
+	return c.queryAddress(username, bookname, email, match)
+}
+
+func (c *Controller) FindAddressCtx(ctx context.Context, username, bookname, email string) (*api.AddressResponse, error) {
+	return c.queryAddress(username, bookname, email, equal)
+}
+
+func (c *Controller) queryAddress(username, bookname, email string, matches func(carddav.AddressObject, string) bool) (*api.AddressResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	found := []carddav.AddressObject{}
+	for _, addr := range c.sortedAddrs(b) {
+		if matches(addr, email) {
+			found = append(found, addr)
+		}
+	}
+	ret := api.AddressResponse{Response: response(fmt.Sprintf("Query CardDAV address: %s", email), "")}
+	if len(found) == 0 {
+		ret.Message = fmt.Sprintf("not found: %s", email)
+	} else {
+		ret.Message = fmt.Sprintf("found: %d", len(found))
+		ret.Address = &found[0]
+	}
+	return &ret, nil
+}
+
+func (c *Controller) ScanAddressCtx(ctx context.Context, username, email string) (*api.BooksResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ret := api.BooksResponse{}
+	ret.Request = fmt.Sprintf("Scan books for CardDAV address: %s", email)
+	u, _, err := c.lookup(username, "")
+	if err != nil {
+		ret.Message = fmt.Sprintf("%v", err)
+		return &ret, nil
+	}
+	ret.Books = []api.Book{}
+	for bookname, b := range u.books {
+		for _, addr := range b.addrs {
+			if equal(addr, email) {
+				book := c.book(username, bookname, b)
+				book.URI = ""
+				book.Contacts = 0
+				ret.Books = append(ret.Books, book)
+				break
+			}
+		}
+	}
+	sort.Slice(ret.Books, func(i, j int) bool { return ret.Books[i].BookName < ret.Books[j].BookName })
+	ret.Message = fmt.Sprintf("books found: %d", len(ret.Books))
+	ret.Success = true
+	return &ret, nil
+}
+
+// findContact returns the address object identified by an email address
+// or a UID; caller must hold the mutex
+func (c *Controller) findContact(username, bookname string, b *book, id string) (*carddav.AddressObject, error) {
+	if !strings.Contains(id, "@") {
+		addr, ok := b.addrs[util.BookURI(username, bookname)+id+".vcf"]
+		if !ok {
+			return nil, util.Fatalf("%w: %s", api.ErrAddressNotFound, id)
+		}
+		return &addr, nil
+	}
+	for _, addr := range c.sortedAddrs(b) {
+		for _, email := range addr.Card.Values(vcard.FieldEmail) {
+			if strings.EqualFold(email, id) {
+				return &addr, nil
+			}
+		}
+	}
+	return nil, util.Fatalf("%w: %s", api.ErrAddressNotFound, id)
+}
+
+// putCard stores card at path, or if path is empty under the path derived
+// from its UID; caller must hold the mutex
+func (c *Controller) putCard(username, bookname, path string, b *book, card vcard.Card) carddav.AddressObject {
+	if path == "" {
+		path = util.BookURI(username, bookname) + card.Value(vcard.FieldUID) + ".vcf"
+	}
+	addr := carddav.AddressObject{
+		Path:    path,
+		ModTime: time.Now(),
+		ETag:    mketag(),
+		Card:    card,
+	}
+	b.addrs[addr.Path] = addr
+	return addr
+}
+
+func (c *Controller) GetContactCtx(ctx context.Context, username, bookname, id string) (*api.ContactResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := c.findContact(username, bookname, b, id)
+	if err != nil {
+		return nil, err
+	}
+	ret := api.ContactResponse{Response: response(fmt.Sprintf("Get CardDAV contact: %s", id), "found")}
+	ret.Contact = api.NewContact(*addr)
+	return &ret, nil
+}
+
+func (c *Controller) PutContactCtx(ctx context.Context, username, bookname string, contact *api.Contact) (*api.ContactResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	var existing *carddav.AddressObject
+	switch {
+	case contact.UID != "":
+		existing, _ = c.findContact(username, bookname, b, contact.UID)
+	case len(contact.Emails) > 0:
+		existing, _ = c.findContact(username, bookname, b, contact.Emails[0])
+	}
+	if contact.ETag != "" && (existing == nil || existing.ETag != contact.ETag) {
+		return nil, &api.ConflictError{Path: util.BookURI(username, bookname) + contact.UID + ".vcf", ETag: contact.ETag, Err: api.ErrConflict}
+	}
+	update := *contact
+	base := vcard.Card{}
+	if existing != nil {
+		base = existing.Card
+		update.UID = existing.Card.Value(vcard.FieldUID)
+	}
+	if update.UID == "" {
+		update.UID = uuid.New().String()
+	}
+	path := ""
+	if existing != nil {
+		path = existing.Path
+	}
+	addr := c.putCard(username, bookname, path, b, update.Card(base))
+	ret := api.ContactResponse{Response: response(fmt.Sprintf("Put CardDAV contact: %s", update.DisplayName()), "")}
+	if existing == nil {
+		ret.Message = fmt.Sprintf("created %s", update.UID)
+	} else {
+		ret.Message = fmt.Sprintf("updated %s", update.UID)
+	}
+	ret.Contact = api.NewContact(addr)
+	return &ret, nil
+}
+
+func (c *Controller) UpdateContactCtx(ctx context.Context, username, bookname, id string, update *api.Contact) (*api.ContactResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := c.findContact(username, bookname, b, id)
+	if err != nil {
+		return nil, err
+	}
+	if update.ETag != "" && update.ETag != existing.ETag {
+		return nil, &api.ConflictError{Path: existing.Path, ETag: update.ETag, Err: fmt.Errorf("ETag mismatch: %s", existing.ETag)}
+	}
+	contact := api.NewContact(*existing)
+	contact.Merge(update)
+	addr := c.putCard(username, bookname, existing.Path, b, contact.Card(existing.Card))
+	ret := api.ContactResponse{Response: response(fmt.Sprintf("Update CardDAV contact: %s", id), fmt.Sprintf("updated %s", contact.UID))}
+	ret.Contact = api.NewContact(addr)
+	return &ret, nil
+}
+
+func (c *Controller) PutCardCtx(ctx context.Context, username, bookname string, card vcard.Card, cond api.Precondition) (*api.AddressResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	uid := card.Value(vcard.FieldUID)
+	if uid == "" {
+		return nil, util.Fatalf("%w: card has no UID", api.ErrAddressInvalid)
+	}
+	path := util.BookURI(username, bookname) + uid + ".vcf"
+	existing, exists := b.addrs[path]
+	if cond.IfNoneMatch && exists {
+		return nil, &api.ConflictError{Path: path, Err: fmt.Errorf("%w: %s", api.ErrAddressExists, uid)}
+	}
+	if cond.IfMatch != "" && (!exists || existing.ETag != cond.IfMatch) {
+		return nil, &api.ConflictError{Path: path, ETag: cond.IfMatch, Err: fmt.Errorf("ETag mismatch: %s", existing.ETag)}
+	}
+	addr := c.putCard(username, bookname, "", b, card)
+	ret := api.AddressResponse{Response: response(fmt.Sprintf("Put CardDAV card: %s", uid), fmt.Sprintf("stored %s", uid))}
+	ret.Address = &addr
+	return &ret, nil
+}
+
+func (c *Controller) DeleteCardCtx(ctx context.Context, username, bookname, uid string, cond api.Precondition) (*api.Response, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	path := util.BookURI(username, bookname) + uid + ".vcf"
+	err = c.deleteObject(b, path, uid, cond)
+	if err != nil {
+		return nil, err
+	}
+	ret := response(fmt.Sprintf("Delete CardDAV card: %s", uid), fmt.Sprintf("deleted %s", uid))
+	return &ret, nil
+}
+
+func (c *Controller) PutObjectCtx(ctx context.Context, username, bookname, path string, card vcard.Card, cond api.Precondition) (*api.AddressResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	existing, exists := b.addrs[path]
+	if cond.IfNoneMatch && exists {
+		return nil, &api.ConflictError{Path: path, Err: fmt.Errorf("%w: %s", api.ErrAddressExists, path)}
+	}
+	if cond.IfMatch != "" && (!exists || existing.ETag != cond.IfMatch) {
+		return nil, &api.ConflictError{Path: path, ETag: cond.IfMatch, Err: fmt.Errorf("ETag mismatch: %s", existing.ETag)}
+	}
+	addr := c.putCard(username, bookname, path, b, card)
+	ret := api.AddressResponse{Response: response(fmt.Sprintf("Put CardDAV card: %s", path), fmt.Sprintf("stored %s", card.Value(vcard.FieldUID)))}
+	ret.Address = &addr
+	return &ret, nil
+}
+
+func (c *Controller) DeleteObjectCtx(ctx context.Context, username, bookname, path string, cond api.Precondition) (*api.Response, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, b, err := c.lookup(username, bookname)
+	if err != nil {
+		return nil, err
+	}
+	err = c.deleteObject(b, path, path, cond)
+	if err != nil {
+		return nil, err
+	}
+	ret := response(fmt.Sprintf("Delete CardDAV card: %s", path), fmt.Sprintf("deleted %s", path))
+	return &ret, nil
+}
+
+// deleteObject deletes the card at path, naming it id in errors; caller
+// must hold the mutex
+func (c *Controller) deleteObject(b *book, path, id string, cond api.Precondition) error {
+	existing, exists := b.addrs[path]
+	if !exists {
+		return util.Fatalf("%w: %s", api.ErrAddressNotFound, id)
+	}
+	if cond.IfMatch != "" && existing.ETag != cond.IfMatch {
+		return &api.ConflictError{Path: path, ETag: cond.IfMatch, Err: fmt.Errorf("ETag mismatch: %s", existing.ETag)}
+	}
+	delete(b.addrs, path)
+	return nil
+}
+
+func (c *Controller) EmailAddress(addr carddav.AddressObject) (string, error) {
+	return davapi.GetAddressEmail(addr)
+}
+
+func (c *Controller) EmailAddressList(addrs *[]carddav.AddressObject) (*[]string, error) {
+	ret := []string{}
+	for _, addr := range *addrs {
+		email, err := c.EmailAddress(addr)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, email)
+	}
+	return &ret, nil
+}
+
+func (c *Controller) GetAccountsCtx(ctx context.Context) (*api.UserAccountsResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ret := api.UserAccountsResponse{Response: response("accounts", "accounts")}
+	ret.Accounts = make(map[string]string)
+	for username, u := range c.users {
+		ret.Accounts[username] = u.password
+	}
+	return &ret, nil
+}
+
+func (c *Controller) SetAccountsCtx(ctx context.Context, request *api.UserAccountsRequest) (*api.UserAccountsResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for username := range request.Accounts {
+		if _, _, err := c.lookup(username, ""); err != nil {
+			return nil, err
+		}
+	}
+	ret := api.UserAccountsResponse{Response: response("set accounts", "accounts updated")}
+	ret.Accounts = make(map[string]string)
+	for username, password := range request.Accounts {
+		c.users[username].password = password
+		ret.Accounts[username] = password
+	}
+	return &ret, nil
+}
+
+func (c *Controller) DumpCtx(ctx context.Context, dumpUser string) (*api.DumpResponse, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	dump := api.NewDumpFile()
+	total := len(c.users)
+	if dumpUser != "" {
+		total = 1
+	}
+	op := c.Start("dump", total)
+	for username, u := range c.users {
+		if dumpUser != "" && username != dumpUser {
+			continue
+		}
+		userdump := api.DumpUser{DisplayName: u.display, Password: u.password, Books: make(map[string]api.DumpBook)}
+		for bookname, b := range u.books {
+			bookdump := api.DumpBook{Description: b.description, Cards: []api.DumpCard{}}
+			for _, addr := range c.sortedAddrs(b) {
+				card, err := api.NewDumpCard(addr.Card)
+				if err != nil {
+					op.User(username, err)
+					op.Finish(err)
+					return nil, err
+				}
+				card.Path = addr.Path
+				card.ETag = addr.ETag
+				bookdump.Cards = append(bookdump.Cards, card)
+				op.Address(username, bookname, card.UID, addr.Card.PreferredValue(vcard.FieldEmail), nil)
+			}
+			sort.Slice(bookdump.Cards, func(i, j int) bool { return bookdump.Cards[i].UID < bookdump.Cards[j].UID })
+			userdump.Books[bookname] = bookdump
+			op.Book(username, bookname, nil)
+		}
+		dump.Users[username] = userdump
+		op.User(username, nil)
+	}
+	op.Finish(nil)
+	ret := api.DumpResponse{Response: response("dump all", "dumped")}
+	if dumpUser != "" {
+		ret.Request = fmt.Sprintf("dump user %s", dumpUser)
+	}
+	ret.Dump = *dump
+	return &ret, nil
+}
+
+func (c *Controller) RestoreCtx(ctx context.Context, dump *api.DumpFile, restoreUser string, journal *api.RestoreJournal) (*api.RestoreResponse, error) {
+	report := api.NewRestoreReport(journal, "restore")
+	total := len(dump.Users)
+	if restoreUser != "" {
+		total = 1
+	}
+	op := c.Start("restore", total)
+	for username, u := range dump.Users {
+		if restoreUser != "" && username != restoreUser {
+			continue
+		}
+		entry := api.JournalEntry{Action: api.PLAN_CREATE, Kind: api.PLAN_USER, Username: username}
+		if !report.Done(entry) {
+			_, err := c.AddUserCtx(ctx, username, u.DisplayName, u.Password)
+			if report.Record(entry, err) != nil {
+				op.User(username, err)
+				continue
+			}
+		}
+		for bookname, bookdump := range u.Books {
+			if api.IsDefaultBook(bookname) {
+				continue
+			}
+			entry := api.JournalEntry{Action: api.PLAN_CREATE, Kind: api.PLAN_BOOK, Username: username, Bookname: bookname}
+			if !report.Done(entry) {
+				_, err := c.AddBookCtx(ctx, username, bookname, bookdump.Description)
+				if report.Record(entry, err) != nil {
+					op.Book(username, bookname, err)
+					continue
+				}
+			}
+			for _, dumpCard := range bookdump.Cards {
+				entry := api.JournalEntry{Action: api.PLAN_CREATE, Kind: api.PLAN_CARD, Username: username, Bookname: bookname, UID: dumpCard.UID}
+				if report.Done(entry) {
+					continue
+				}
+				card, err := dumpCard.Card()
+				if err != nil {
+					report.Record(entry, err)
+					op.Address(username, bookname, dumpCard.UID, "", err)
+					continue
+				}
+				c.mutex.Lock()
+				_, b, err := c.lookup(username, bookname)
+				if err != nil {
+					// the journal shows the book restored, but it has
+					// since been deleted
+					c.mutex.Unlock()
+					report.Record(entry, err)
+					op.Address(username, bookname, dumpCard.UID, "", err)
+					continue
+				}
+				_, exists := b.addrs[util.BookURI(username, bookname)+card.Value(vcard.FieldUID)+".vcf"]
+				if !exists {
+					c.putCard(username, bookname, "", b, card)
+				}
+				c.mutex.Unlock()
+				if exists {
+					report.Skip(entry)
+				} else {
+					report.Record(entry, nil)
+				}
+				op.Address(username, bookname, dumpCard.UID, card.PreferredValue(vcard.FieldEmail), nil)
+			}
+			op.Book(username, bookname, nil)
+		}
+		op.User(username, nil)
+	}
+	response, err := report.Result()
+	op.Finish(err)
+	return response, err
+}
+
+func (c *Controller) ClearCtx(ctx context.Context) (*api.Response, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	op := c.Start("clear", len(c.users))
+	for username := range c.users {
+		op.User(username, nil)
+	}
+	c.users = make(map[string]*user)
+	op.Finish(nil)
+	ret := response("clear", "cleared")
+	return &ret, nil
+}
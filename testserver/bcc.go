@@ -0,0 +1,342 @@
+package testserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rstms/mabctl/util"
+)
+
+type response struct {
+	Success bool   `json:"success"`
+	User    string `json:"user"`
+	Message string `json:"message"`
+	Request string `json:"request"`
+}
+
+type bccUser struct {
+	UserName    string `json:"username"`
+	DisplayName string `json:"displayname"`
+	URI         string `json:"uri"`
+}
+
+type bccBook struct {
+	UserName    string `json:"username"`
+	BookName    string `json:"bookname"`
+	Description string `json:"description"`
+	Contacts    int    `json:"contacts"`
+	Token       string `json:"token"`
+	URI         string `json:"uri"`
+}
+
+func reply(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func fail(w http.ResponseWriter, status int, format string, args ...any) {
+	reply(w, status, map[string]any{
+		"success": false,
+		"message": http.StatusText(status),
+		"detail":  fmt.Sprintf(format, args...),
+	})
+}
+
+func ok(request, message string) response {
+	return response{Success: true, Request: request, Message: message}
+}
+
+func (s *Server) bccHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /initialize/", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusOK, ok("initialize", "initialized"))
+	})
+	mux.HandleFunc("POST /reset/", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusOK, ok("reset", "reset"))
+	})
+	mux.HandleFunc("POST /shutdown/", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusOK, ok("shutdown", "shutdown requested"))
+	})
+	mux.HandleFunc("GET /status/", s.handleStatus)
+	mux.HandleFunc("GET /uptime/", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, http.StatusOK, ok("uptime", time.Since(s.started).Round(time.Second).String()))
+	})
+	mux.HandleFunc("GET /users/", s.handleUsers)
+	mux.HandleFunc("POST /user/", s.handleAddUser)
+	mux.HandleFunc("DELETE /user/", s.handleDeleteUser)
+	mux.HandleFunc("GET /books/{username}/", s.handleBooks)
+	mux.HandleFunc("POST /book/", s.handleAddBook)
+	mux.HandleFunc("DELETE /book/", s.handleDeleteBook)
+	mux.HandleFunc("GET /password/{username}/", s.handlePassword)
+	mux.HandleFunc("GET /accounts/", s.handleAccounts)
+	mux.HandleFunc("POST /accounts/", s.handleSetAccounts)
+	return s.authorizeAdmin(mux)
+}
+
+func (s *Server) authorizeAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != API_KEY {
+			fail(w, http.StatusUnauthorized, "invalid API key")
+			return
+		}
+		if r.Header.Get("X-Admin-Username") != ADMIN_USERNAME || r.Header.Get("X-Admin-Password") != ADMIN_PASSWORD {
+			fail(w, http.StatusUnauthorized, "invalid admin credentials")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func decode(w http.ResponseWriter, r *http.Request, data any) bool {
+	err := json.NewDecoder(r.Body).Decode(data)
+	if err != nil {
+		fail(w, http.StatusUnprocessableEntity, "failed decoding request: %v", err)
+		return false
+	}
+	return true
+}
+
+func (s *Server) bookInfo(username, token string, b *book) bccBook {
+	return bccBook{
+		UserName:    username,
+		BookName:    b.name,
+		Description: b.description,
+		Contacts:    len(b.objects),
+		Token:       token,
+		URI:         s.URL + bookPath(username, token),
+	}
+}
+
+func (s *Server) userInfo(username string, u *user) bccUser {
+	return bccUser{
+		UserName:    username,
+		DisplayName: u.display,
+		URI:         fmt.Sprintf("%s/dav.php/principals/%s/", s.URL, username),
+	}
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	reply(w, http.StatusOK, map[string]any{
+		"success": true,
+		"request": "status",
+		"message": "status",
+		"status":  map[string]any{"users": len(s.users), "version": "testserver"},
+	})
+}
+
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	users := []bccUser{}
+	for username, u := range s.users {
+		users = append(users, s.userInfo(username, u))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UserName < users[j].UserName })
+	reply(w, http.StatusOK, map[string]any{
+		"success": true,
+		"request": "users",
+		"message": "users",
+		"users":   users,
+	})
+}
+
+func (s *Server) handleAddUser(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		UserName    string `json:"username"`
+		DisplayName string `json:"displayname"`
+		Password    string `json:"password"`
+	}
+	if !decode(w, r, &request) {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.users[request.UserName]; exists {
+		fail(w, http.StatusConflict, "user exists: %s", request.UserName)
+		return
+	}
+	u := &user{
+		display:  request.DisplayName,
+		password: request.Password,
+		books:    make(map[string]*book),
+	}
+	// baikal creates a default book for each new user
+	u.books[util.BookToken(request.UserName, "Default Address Book")] = &book{
+		name:        "Default Address Book",
+		description: "Default Address Book",
+		objects:     make(map[string]*object),
+	}
+	s.users[request.UserName] = u
+	reply(w, http.StatusCreated, map[string]any{
+		"success": true,
+		"request": "add user",
+		"message": "created",
+		"user":    s.userInfo(request.UserName, u),
+	})
+}
+
+func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		UserName string `json:"username"`
+	}
+	if !decode(w, r, &request) {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.users[request.UserName]; !exists {
+		fail(w, http.StatusNotFound, "user not found: %s", request.UserName)
+		return
+	}
+	delete(s.users, request.UserName)
+	reply(w, http.StatusOK, ok("delete user", fmt.Sprintf("deleted: %s", request.UserName)))
+}
+
+func (s *Server) handleBooks(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u, exists := s.users[username]
+	if !exists {
+		fail(w, http.StatusNotFound, "user not found: %s", username)
+		return
+	}
+	books := []bccBook{}
+	for token, b := range u.books {
+		books = append(books, s.bookInfo(username, token, b))
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].BookName < books[j].BookName })
+	reply(w, http.StatusOK, map[string]any{
+		"success": true,
+		"request": "books",
+		"message": fmt.Sprintf("%s books", username),
+		"books":   books,
+	})
+}
+
+func (s *Server) handleAddBook(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		UserName    string `json:"username"`
+		BookName    string `json:"bookname"`
+		Description string `json:"description"`
+	}
+	if !decode(w, r, &request) {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u, exists := s.users[request.UserName]
+	if !exists {
+		fail(w, http.StatusNotFound, "user not found: %s", request.UserName)
+		return
+	}
+	token := util.BookToken(request.UserName, request.BookName)
+	if _, exists := u.books[token]; exists {
+		fail(w, http.StatusConflict, "book exists: %s", request.BookName)
+		return
+	}
+	b := &book{
+		name:        request.BookName,
+		description: request.Description,
+		objects:     make(map[string]*object),
+	}
+	u.books[token] = b
+	reply(w, http.StatusCreated, map[string]any{
+		"success": true,
+		"request": "add book",
+		"message": "created",
+		"book":    s.bookInfo(request.UserName, token, b),
+	})
+}
+
+func (s *Server) handleDeleteBook(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		UserName string `json:"username"`
+		Token    string `json:"token"`
+	}
+	if !decode(w, r, &request) {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u, exists := s.users[request.UserName]
+	if !exists {
+		fail(w, http.StatusNotFound, "user not found: %s", request.UserName)
+		return
+	}
+	if _, exists := u.books[request.Token]; !exists {
+		fail(w, http.StatusNotFound, "book not found: %s", request.Token)
+		return
+	}
+	delete(u.books, request.Token)
+	reply(w, http.StatusOK, ok("delete book", fmt.Sprintf("deleted: %s", request.Token)))
+}
+
+func (s *Server) handlePassword(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u, exists := s.users[username]
+	if !exists {
+		fail(w, http.StatusNotFound, "user not found: %s", username)
+		return
+	}
+	reply(w, http.StatusOK, map[string]any{
+		"success":  true,
+		"request":  fmt.Sprintf("get password: %s", username),
+		"message":  "password",
+		"username": username,
+		"password": u.password,
+	})
+}
+
+func (s *Server) accounts() map[string]string {
+	accounts := make(map[string]string)
+	for username, u := range s.users {
+		accounts[username] = u.password
+	}
+	return accounts
+}
+
+func (s *Server) handleAccounts(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	reply(w, http.StatusOK, map[string]any{
+		"success":  true,
+		"request":  "accounts",
+		"message":  "accounts",
+		"accounts": s.accounts(),
+	})
+}
+
+func (s *Server) handleSetAccounts(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Accounts map[string]string `json:"accounts"`
+	}
+	if !decode(w, r, &request) {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for username := range request.Accounts {
+		if _, exists := s.users[username]; !exists {
+			fail(w, http.StatusNotFound, "user not found: %s", username)
+			return
+		}
+	}
+	for username, password := range request.Accounts {
+		s.users[username].password = password
+	}
+	reply(w, http.StatusOK, map[string]any{
+		"success":  true,
+		"request":  "set accounts",
+		"message":  fmt.Sprintf("updated: %d", len(request.Accounts)),
+		"accounts": s.accounts(),
+	})
+}
@@ -0,0 +1,379 @@
+package testserver
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/carddav"
+)
+
+const NONCE = "6d616263746c2d74657374"
+const OPAQUE = "74657374736572766572"
+
+type userKey struct{}
+
+type backend struct {
+	s    *Server
+	etag int
+}
+
+func (s *Server) davHandler() http.Handler {
+	handler := &carddav.Handler{
+		Backend: &backend{s: s},
+		Prefix:  "/dav.php",
+	}
+	return s.authorizeDigest(s.syncCollection(s.deletePrecondition(handler)))
+}
+
+// deletePrecondition enforces If-Match on DELETE, which the go-webdav
+// handler does not pass to the backend
+func (s *Server) deletePrecondition(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifMatch := webdav.ConditionalMatch(r.Header.Get("If-Match"))
+		if r.Method != http.MethodDelete || !ifMatch.IsSet() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		b := backend{s: s}
+		s.mutex.Lock()
+		etag := ""
+		_, _, bk, name, err := b.lookup(r.Context(), r.URL.Path)
+		if err == nil {
+			if o, exists := bk.objects[name]; exists {
+				etag = o.etag
+			}
+		}
+		s.mutex.Unlock()
+		matched, err := ifMatch.MatchETag(etag)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !matched {
+			http.Error(w, "If-Match condition failed", http.StatusPreconditionFailed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func md5hex(text string) string {
+	sum := md5.Sum([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseDigest(header string) map[string]string {
+	params := make(map[string]string)
+	value, found := strings.CutPrefix(header, "Digest ")
+	if !found {
+		return params
+	}
+	for _, field := range strings.Split(value, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		params[key] = strings.Trim(value, `"`)
+	}
+	return params
+}
+
+func challenge(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", nonce="%s", qop="auth", algorithm=MD5, opaque="%s"`, REALM, NONCE, OPAQUE))
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// authorizeDigest validates RFC 2617 digest credentials against user passwords
+func (s *Server) authorizeDigest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := parseDigest(r.Header.Get("Authorization"))
+		username := params["username"]
+		s.mutex.Lock()
+		u, exists := s.users[username]
+		password := ""
+		if exists {
+			password = u.password
+		}
+		s.mutex.Unlock()
+		if !exists || params["nonce"] != NONCE || params["realm"] != REALM {
+			challenge(w)
+			return
+		}
+		ha1 := md5hex(username + ":" + REALM + ":" + password)
+		ha2 := md5hex(r.Method + ":" + params["uri"])
+		expected := md5hex(ha1 + ":" + NONCE + ":" + ha2)
+		if params["qop"] != "" {
+			expected = md5hex(strings.Join([]string{ha1, NONCE, params["nc"], params["cnonce"], params["qop"], ha2}, ":"))
+		}
+		if params["response"] != expected {
+			challenge(w)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, username)))
+	})
+}
+
+func notFound(format string, args ...any) error {
+	return webdav.NewHTTPError(http.StatusNotFound, fmt.Errorf(format, args...))
+}
+
+// parsePath splits a CardDAV path into username, book token, and object name
+func parsePath(path string) (string, string, string) {
+	path = strings.TrimPrefix(path, "/dav.php/addressbooks/")
+	fields := strings.Split(strings.Trim(path, "/"), "/")
+	for len(fields) < 3 {
+		fields = append(fields, "")
+	}
+	return fields[0], fields[1], fields[2]
+}
+
+// lookup returns the current user's book at path; caller must hold the mutex
+func (b *backend) lookup(ctx context.Context, path string) (string, string, *book, string, error) {
+	username := ctx.Value(userKey{}).(string)
+	owner, token, name := parsePath(path)
+	if owner != username {
+		return "", "", nil, "", webdav.NewHTTPError(http.StatusForbidden, fmt.Errorf("access denied: %s", path))
+	}
+	u, exists := b.s.users[username]
+	if !exists {
+		return "", "", nil, "", notFound("user not found: %s", username)
+	}
+	bk, exists := u.books[token]
+	if !exists {
+		return "", "", nil, "", notFound("address book not found: %s", path)
+	}
+	return username, token, bk, name, nil
+}
+
+func (b *backend) addressObject(username, token, name string, o *object) carddav.AddressObject {
+	return carddav.AddressObject{
+		Path:    bookPath(username, token) + name,
+		ModTime: o.modTime,
+		ETag:    o.etag,
+		Card:    o.card,
+	}
+}
+
+func (b *backend) objects(username, token string, bk *book) []carddav.AddressObject {
+	names := make([]string, 0, len(bk.objects))
+	for name := range bk.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ret := make([]carddav.AddressObject, len(names))
+	for i, name := range names {
+		ret[i] = b.addressObject(username, token, name, bk.objects[name])
+	}
+	return ret
+}
+
+func (b *backend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return fmt.Sprintf("/dav.php/%s/", ctx.Value(userKey{}).(string)), nil
+}
+
+func (b *backend) AddressBookHomeSetPath(ctx context.Context) (string, error) {
+	return fmt.Sprintf("/dav.php/addressbooks/%s/", ctx.Value(userKey{}).(string)), nil
+}
+
+func (b *backend) ListAddressBooks(ctx context.Context) ([]carddav.AddressBook, error) {
+	username := ctx.Value(userKey{}).(string)
+	b.s.mutex.Lock()
+	defer b.s.mutex.Unlock()
+	u, exists := b.s.users[username]
+	if !exists {
+		return nil, notFound("user not found: %s", username)
+	}
+	books := []carddav.AddressBook{}
+	for token, bk := range u.books {
+		books = append(books, bk.addressBook(username, token))
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].Path < books[j].Path })
+	return books, nil
+}
+
+func (b *backend) GetAddressBook(ctx context.Context, path string) (*carddav.AddressBook, error) {
+	b.s.mutex.Lock()
+	defer b.s.mutex.Unlock()
+	username, token, bk, _, err := b.lookup(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	ret := bk.addressBook(username, token)
+	return &ret, nil
+}
+
+func (b *backend) CreateAddressBook(ctx context.Context, addressBook *carddav.AddressBook) error {
+	return webdav.NewHTTPError(http.StatusForbidden, fmt.Errorf("address books are created with the admin API"))
+}
+
+func (b *backend) DeleteAddressBook(ctx context.Context, path string) error {
+	b.s.mutex.Lock()
+	defer b.s.mutex.Unlock()
+	username, token, _, _, err := b.lookup(ctx, path)
+	if err != nil {
+		return err
+	}
+	delete(b.s.users[username].books, token)
+	return nil
+}
+
+func (b *backend) GetAddressObject(ctx context.Context, path string, req *carddav.AddressDataRequest) (*carddav.AddressObject, error) {
+	b.s.mutex.Lock()
+	defer b.s.mutex.Unlock()
+	username, token, bk, name, err := b.lookup(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	o, exists := bk.objects[name]
+	if !exists {
+		return nil, notFound("address object not found: %s", path)
+	}
+	ret := b.addressObject(username, token, name, o)
+	return &ret, nil
+}
+
+func (b *backend) ListAddressObjects(ctx context.Context, path string, req *carddav.AddressDataRequest) ([]carddav.AddressObject, error) {
+	b.s.mutex.Lock()
+	defer b.s.mutex.Unlock()
+	username, token, bk, _, err := b.lookup(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return b.objects(username, token, bk), nil
+}
+
+func (b *backend) QueryAddressObjects(ctx context.Context, path string, query *carddav.AddressBookQuery) ([]carddav.AddressObject, error) {
+	b.s.mutex.Lock()
+	defer b.s.mutex.Unlock()
+	username, token, bk, _, err := b.lookup(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	ret := []carddav.AddressObject{}
+	for _, o := range b.objects(username, token, bk) {
+		if matchQuery(query, o.Card) {
+			ret = append(ret, o)
+		}
+	}
+	return ret, nil
+}
+
+// matchQuery evaluates a query as sabre/dav does: every instance of a
+// property is tested and text matches are case-insensitive
+func matchQuery(query *carddav.AddressBookQuery, card vcard.Card) bool {
+	if len(query.PropFilters) == 0 {
+		return true
+	}
+	for _, prop := range query.PropFilters {
+		ok := matchPropFilter(prop, card)
+		if query.FilterTest == carddav.FilterAllOf && !ok {
+			return false
+		}
+		if query.FilterTest != carddav.FilterAllOf && ok {
+			return true
+		}
+	}
+	return query.FilterTest == carddav.FilterAllOf
+}
+
+func matchPropFilter(prop carddav.PropFilter, card vcard.Card) bool {
+	fields := card[prop.Name]
+	if prop.IsNotDefined {
+		return len(fields) == 0
+	}
+	if len(prop.TextMatches) == 0 {
+		return len(fields) > 0
+	}
+	for _, txt := range prop.TextMatches {
+		ok := false
+		for _, field := range fields {
+			if matchText(txt, field.Value) {
+				ok = true
+				break
+			}
+		}
+		if prop.Test == carddav.FilterAllOf && !ok {
+			return false
+		}
+		if prop.Test != carddav.FilterAllOf && ok {
+			return true
+		}
+	}
+	return prop.Test == carddav.FilterAllOf
+}
+
+func matchText(txt carddav.TextMatch, value string) bool {
+	text := strings.ToLower(txt.Text)
+	value = strings.ToLower(value)
+	var ok bool
+	switch txt.MatchType {
+	case carddav.MatchEquals:
+		ok = value == text
+	case carddav.MatchStartsWith:
+		ok = strings.HasPrefix(value, text)
+	case carddav.MatchEndsWith:
+		ok = strings.HasSuffix(value, text)
+	default:
+		ok = strings.Contains(value, text)
+	}
+	return ok != txt.NegateCondition
+}
+
+func (b *backend) PutAddressObject(ctx context.Context, path string, card vcard.Card, opts *carddav.PutAddressObjectOptions) (*carddav.AddressObject, error) {
+	b.s.mutex.Lock()
+	defer b.s.mutex.Unlock()
+	username, token, bk, name, err := b.lookup(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, webdav.NewHTTPError(http.StatusMethodNotAllowed, fmt.Errorf("not an address object: %s", path))
+	}
+	existing, exists := bk.objects[name]
+	if opts.IfNoneMatch.IsSet() && exists {
+		return nil, webdav.NewHTTPError(http.StatusPreconditionFailed, fmt.Errorf("If-None-Match condition failed"))
+	}
+	if opts.IfMatch.IsSet() {
+		etag := ""
+		if exists {
+			etag = existing.etag
+		}
+		matched, err := opts.IfMatch.MatchETag(etag)
+		if err != nil {
+			return nil, webdav.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if !matched {
+			return nil, webdav.NewHTTPError(http.StatusPreconditionFailed, fmt.Errorf("If-Match condition failed"))
+		}
+	}
+	b.etag++
+	o := &object{
+		card:    card,
+		etag:    fmt.Sprintf("%x-%d", time.Now().UnixNano(), b.etag),
+		modTime: time.Now(),
+	}
+	bk.objects[name] = o
+	bk.touch(name)
+	ret := b.addressObject(username, token, name, o)
+	return &ret, nil
+}
+
+func (b *backend) DeleteAddressObject(ctx context.Context, path string) error {
+	b.s.mutex.Lock()
+	defer b.s.mutex.Unlock()
+	_, _, bk, name, err := b.lookup(ctx, path)
+	if err != nil {
+		return err
+	}
+	if _, exists := bk.objects[name]; !exists {
+		return notFound("address object not found: %s", path)
+	}
+	delete(bk.objects, name)
+	bk.touch(name)
+	return nil
+}
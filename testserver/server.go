@@ -0,0 +1,241 @@
+// Package testserver runs an in-process imitation of a mailserver's bcc
+// admin API and baikal CardDAV server for offline testing of mabctl.
+//
+// A single TLS listener requiring client certificates serves the bcc API
+// under /bcc and a go-webdav CardDAV handler with digest authentication
+// under /dav.php.  A throwaway CA and client certificate are generated into
+// a temporary directory.
+package testserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav/carddav"
+)
+
+const DOMAIN = "example.org"
+const API_KEY = "test-api-key"
+const ADMIN_USERNAME = "admin"
+const ADMIN_PASSWORD = "test-admin-password"
+const REALM = "BaikalDAV"
+
+type object struct {
+	card    vcard.Card
+	etag    string
+	modTime time.Time
+}
+
+type book struct {
+	name        string
+	description string
+	objects     map[string]*object
+	revision    int
+	changes     map[string]int
+}
+
+type user struct {
+	display  string
+	password string
+	books    map[string]*book
+}
+
+type Server struct {
+	URL      string
+	BCCURL   string
+	DAVURL   string
+	CertFile string
+	KeyFile  string
+	mutex    sync.Mutex
+	users    map[string]*user
+	started  time.Time
+	server   *httptest.Server
+	failures []failure
+	dir      string
+}
+
+// Start launches a server using certificate files written under dir
+func Start(dir string) (*Server, error) {
+	s := Server{
+		users:   make(map[string]*user),
+		started: time.Now(),
+		dir:     dir,
+	}
+	caPool, err := s.generateCertificates(dir)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/bcc/", http.StripPrefix("/bcc", s.bccHandler()))
+	mux.Handle("/dav.php/", s.davHandler())
+	mux.Handle("/dav.php", s.davHandler())
+	s.server = httptest.NewUnstartedServer(s.injectFailures(mux))
+	s.server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  caPool,
+	}
+	s.server.StartTLS()
+	s.URL = s.server.URL
+	s.BCCURL = s.URL + "/bcc"
+	s.DAVURL = s.URL + "/dav.php"
+	return &s, nil
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+type failure struct {
+	method string
+	status int
+}
+
+// FailNext makes the server answer the next len(statuses) requests with
+// the given HTTP status codes instead of handling them
+func (s *Server) FailNext(statuses ...int) {
+	s.FailNextMethod("", statuses...)
+}
+
+// FailNextMethod is FailNext limited to requests using method
+func (s *Server) FailNextMethod(method string, statuses ...int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, status := range statuses {
+		s.failures = append(s.failures, failure{method, status})
+	}
+}
+
+func (s *Server) injectFailures(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		status := 0
+		if len(s.failures) > 0 && (s.failures[0].method == "" || s.failures[0].method == r.Method) {
+			status = s.failures[0].status
+			s.failures = s.failures[1:]
+		}
+		s.mutex.Unlock()
+		if status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Config returns mabctl YAML configuration for connecting to the server
+func (s *Server) Config() string {
+	return fmt.Sprintf(`mabctl:
+  domain: %s
+  url: %s
+  bcc_url: %s
+  dav_url: %s
+  api_key: %s
+  admin_username: %s
+  admin_password: %s
+  client_cert: %s
+  client_key: %s
+  insecure_no_validate_server_certificate: true
+  sync_dir: %s
+`, DOMAIN, s.server.Listener.Addr().String(), s.BCCURL, s.DAVURL, API_KEY, ADMIN_USERNAME, ADMIN_PASSWORD, s.CertFile, s.KeyFile, filepath.Join(s.dir, "sync"))
+}
+
+// WriteConfig writes the output of Config to filename
+func (s *Server) WriteConfig(filename string) error {
+	return os.WriteFile(filename, []byte(s.Config()), 0600)
+}
+
+func (s *Server) generateCertificates(dir string) (*x509.CertPool, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed generating CA key: %v", err)
+	}
+	caTemplate := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "testserver CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating CA certificate: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing CA certificate: %v", err)
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed generating client key: %v", err)
+	}
+	clientTemplate := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "mabctl"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, &clientTemplate, caCert, &clientKey.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating client certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed marshalling client key: %v", err)
+	}
+
+	s.CertFile = filepath.Join(dir, "mabctl.pem")
+	s.KeyFile = filepath.Join(dir, "mabctl.key")
+	err = os.WriteFile(s.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientDER}), 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(s.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return pool, nil
+}
+
+// bookPath returns the CardDAV collection path for a user's book token
+func bookPath(username, token string) string {
+	return fmt.Sprintf("/dav.php/addressbooks/%s/%s/", username, token)
+}
+
+// touch records a change to the named object for sync-collection reports
+func (b *book) touch(name string) {
+	if b.changes == nil {
+		b.changes = make(map[string]int)
+	}
+	b.revision++
+	b.changes[name] = b.revision
+}
+
+func (b *book) addressBook(username, token string) carddav.AddressBook {
+	return carddav.AddressBook{
+		Path:        bookPath(username, token),
+		Name:        b.name,
+		Description: b.description,
+	}
+}
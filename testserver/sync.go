@@ -0,0 +1,97 @@
+package testserver
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SYNC_TOKEN_PREFIX matches the sync-token URIs issued by sabre/dav
+const SYNC_TOKEN_PREFIX = "http://sabre.io/ns/sync/"
+
+type syncCollectionQuery struct {
+	XMLName   xml.Name `xml:"DAV: sync-collection"`
+	SyncToken string   `xml:"DAV: sync-token"`
+}
+
+// syncCollection answers RFC 6578 sync-collection REPORT requests, which
+// the go-webdav CardDAV handler does not implement, and passes any other
+// request to next
+func (s *Server) syncCollection(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "REPORT" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var query syncCollectionQuery
+		if xml.Unmarshal(body, &query) != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.handleSyncCollection(w, r, query.SyncToken)
+	})
+}
+
+func (s *Server) handleSyncCollection(w http.ResponseWriter, r *http.Request, syncToken string) {
+	b := backend{s: s}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	username, token, bk, _, err := b.lookup(r.Context(), r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	since := 0
+	if syncToken != "" {
+		revision, found := strings.CutPrefix(syncToken, SYNC_TOKEN_PREFIX)
+		since, err = strconv.Atoi(revision)
+		if !found || err != nil || since > bk.revision {
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><d:error xmlns:d="DAV:"><d:valid-sync-token/></d:error>`)
+			return
+		}
+	}
+	names := []string{}
+	if since == 0 {
+		for name := range bk.objects {
+			names = append(names, name)
+		}
+	} else {
+		for name, revision := range bk.changes {
+			if revision > since {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	var out strings.Builder
+	out.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n")
+	out.WriteString(`<d:multistatus xmlns:d="DAV:">` + "\n")
+	for _, name := range names {
+		href := bookPath(username, token) + name
+		o, exists := bk.objects[name]
+		if !exists {
+			fmt.Fprintf(&out, "<d:response><d:href>%s</d:href><d:status>HTTP/1.1 404 Not Found</d:status></d:response>\n", href)
+			continue
+		}
+		fmt.Fprintf(&out, "<d:response><d:href>%s</d:href><d:propstat><d:prop><d:getetag>%q</d:getetag></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>\n", href, o.etag)
+	}
+	fmt.Fprintf(&out, "<d:sync-token>%s%d</d:sync-token>\n", SYNC_TOKEN_PREFIX, bk.revision)
+	out.WriteString("</d:multistatus>\n")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, out.String())
+}
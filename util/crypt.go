@@ -0,0 +1,134 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const ENCRYPTED_FORMAT = "mabctl-encrypted"
+const ENCRYPTED_VERSION = 1
+
+const SCRYPT_N = 1 << 15
+const SCRYPT_R = 8
+const SCRYPT_P = 1
+
+// the most memory, 128*N*r bytes, and the most passes scrypt may use for
+// an envelope, so that a crafted file cannot make Decrypt exhaust memory or
+// stall; Encrypt uses 32 MiB and one pass
+const SCRYPT_MAX_MEMORY = 256 << 20
+const SCRYPT_MAX_P = 4
+
+var ErrDecrypt = errors.New("decryption failed: wrong passphrase or damaged file")
+
+// Envelope is a passphrase-encrypted document: the key is derived from the
+// passphrase with scrypt and the content is sealed with AES-256-GCM.  The
+// header fields are authenticated along with the content.
+type Envelope struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func (e *Envelope) additionalData() []byte {
+	return []byte(fmt.Sprintf("%s/%d/%s/%d/%d/%d/%x", e.Format, e.Version, e.KDF, e.N, e.R, e.P, e.Salt))
+}
+
+func (e *Envelope) aead(passphrase []byte) (cipher.AEAD, error) {
+	if e.KDF != "scrypt" {
+		return nil, Fatalf("unsupported key derivation: %s", e.KDF)
+	}
+	if e.N < 2 || e.N&(e.N-1) != 0 || e.R < 1 || e.N > SCRYPT_MAX_MEMORY/128/e.R || e.P < 1 || e.P > SCRYPT_MAX_P {
+		return nil, Fatalf("unsupported scrypt parameters: n=%d r=%d p=%d", e.N, e.R, e.P)
+	}
+	key, err := scrypt.Key(passphrase, e.Salt, e.N, e.R, e.P, 32)
+	if err != nil {
+		return nil, Fatalf("failed deriving key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, Fatalf("failed creating cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt returns the JSON envelope holding plaintext sealed with passphrase
+func Encrypt(plaintext, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, Fatalf("empty passphrase")
+	}
+	e := Envelope{
+		Format:  ENCRYPTED_FORMAT,
+		Version: ENCRYPTED_VERSION,
+		KDF:     "scrypt",
+		N:       SCRYPT_N,
+		R:       SCRYPT_R,
+		P:       SCRYPT_P,
+		Salt:    make([]byte, 16),
+	}
+	_, err := rand.Read(e.Salt)
+	if err != nil {
+		return nil, Fatalf("failed generating salt: %w", err)
+	}
+	aead, err := e.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	e.Nonce = make([]byte, aead.NonceSize())
+	_, err = rand.Read(e.Nonce)
+	if err != nil {
+		return nil, Fatalf("failed generating nonce: %w", err)
+	}
+	e.Ciphertext = aead.Seal(nil, e.Nonce, plaintext, e.additionalData())
+	data, err := json.MarshalIndent(&e, "", "  ")
+	if err != nil {
+		return nil, Fatalf("failed encoding envelope: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// IsEncrypted reports whether data is an envelope written by Encrypt
+func IsEncrypted(data []byte) bool {
+	var header struct {
+		Format string `json:"format"`
+	}
+	return json.Unmarshal(data, &header) == nil && header.Format == ENCRYPTED_FORMAT
+}
+
+// Decrypt returns the plaintext of an envelope written by Encrypt
+func Decrypt(data, passphrase []byte) ([]byte, error) {
+	e := Envelope{}
+	err := json.Unmarshal(data, &e)
+	if err != nil {
+		return nil, Fatalf("failed decoding envelope: %w", err)
+	}
+	if e.Format != ENCRYPTED_FORMAT {
+		return nil, Fatalf("not an encrypted file: '%s'", e.Format)
+	}
+	if e.Version > ENCRYPTED_VERSION {
+		return nil, Fatalf("unsupported encryption version %d; maximum is %d", e.Version, ENCRYPTED_VERSION)
+	}
+	aead, err := e.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := aead.Open(nil, e.Nonce, e.Ciphertext, e.additionalData())
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
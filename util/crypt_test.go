@@ -0,0 +1,73 @@
+package util
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCryptRoundTrip(t *testing.T) {
+	data, err := Encrypt([]byte("secret"), []byte("passphrase"))
+	require.Nil(t, err)
+	require.True(t, IsEncrypted(data))
+	require.NotContains(t, string(data), "secret")
+
+	plaintext, err := Decrypt(data, []byte("passphrase"))
+	require.Nil(t, err)
+	require.Equal(t, "secret", string(plaintext))
+
+	_, err = Encrypt([]byte("secret"), nil)
+	require.NotNil(t, err)
+}
+
+func TestCryptWrongPassphrase(t *testing.T) {
+	data, err := Encrypt([]byte("secret"), []byte("passphrase"))
+	require.Nil(t, err)
+	_, err = Decrypt(data, []byte("wrong"))
+	require.ErrorIs(t, err, ErrDecrypt)
+}
+
+// tamper returns data with the envelope changed by edit
+func tamper(t *testing.T, data []byte, edit func(e *Envelope)) []byte {
+	e := Envelope{}
+	require.Nil(t, json.Unmarshal(data, &e))
+	edit(&e)
+	ret, err := json.Marshal(&e)
+	require.Nil(t, err)
+	return ret
+}
+
+func TestCryptTamper(t *testing.T) {
+	data, err := Encrypt([]byte("secret"), []byte("passphrase"))
+	require.Nil(t, err)
+
+	for name, edit := range map[string]func(e *Envelope){
+		"ciphertext": func(e *Envelope) { e.Ciphertext[0] ^= 1 },
+		"nonce":      func(e *Envelope) { e.Nonce[0] ^= 1 },
+		"short":      func(e *Envelope) { e.Nonce = e.Nonce[1:] },
+		"salt":       func(e *Envelope) { e.Salt[0] ^= 1 },
+		"version":    func(e *Envelope) { e.Version = 0 },
+		"n":          func(e *Envelope) { e.N = SCRYPT_N / 2 },
+	} {
+		_, err = Decrypt(tamper(t, data, edit), []byte("passphrase"))
+		require.ErrorIs(t, err, ErrDecrypt, name)
+	}
+
+	for name, edit := range map[string]func(e *Envelope){
+		"kdf":     func(e *Envelope) { e.KDF = "none" },
+		"format":  func(e *Envelope) { e.Format = "other" },
+		"future":  func(e *Envelope) { e.Version = ENCRYPTED_VERSION + 1 },
+		"large n": func(e *Envelope) { e.N = 1 << 40 },
+		"odd n":   func(e *Envelope) { e.N = SCRYPT_N + 1 },
+		"large r": func(e *Envelope) { e.R = 1 << 20 },
+		"large p": func(e *Envelope) { e.P = 1 << 20 },
+		"p":       func(e *Envelope) { e.P = SCRYPT_MAX_P + 1 },
+		"memory":  func(e *Envelope) { e.N, e.R = 1<<20, 32 },
+		"zero r":  func(e *Envelope) { e.R = 0 },
+	} {
+		_, err = Decrypt(tamper(t, data, edit), []byte("passphrase"))
+		require.NotNil(t, err, name)
+		require.NotErrorIs(t, err, ErrDecrypt, name)
+	}
+}
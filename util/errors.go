@@ -0,0 +1,113 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrNotFound         = errors.New("not found")
+	ErrConflict         = errors.New("conflict")
+	ErrServerError      = errors.New("server error")
+	ErrUnavailable      = errors.New("server unavailable")
+	ErrUserNotFound     = errors.New("user not found")
+	ErrUserExists       = errors.New("user exists")
+	ErrBookNotFound     = errors.New("book not found")
+	ErrBookExists       = errors.New("book exists")
+	ErrAddressNotFound  = errors.New("address not found")
+	ErrAddressExists    = errors.New("address exists")
+	ErrAddressInvalid   = errors.New("address invalid")
+	ErrSyncUnsupported  = errors.New("sync-collection unsupported")
+	ErrSyncTokenInvalid = errors.New("sync token invalid")
+)
+
+// HTTPError describes a non-2xx response from the bcc API or CardDAV server.
+// errors.Is reports a match for the sentinel error corresponding to the
+// status code class, and for Err when a caller has identified the condition.
+type HTTPError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+	Detail     string
+	Err        error
+}
+
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("%s %s '%s'", e.Method, e.Path, e.Status)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+func (e *HTTPError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict || e.StatusCode == http.StatusPreconditionFailed
+	case ErrUnavailable:
+		return e.StatusCode == http.StatusBadGateway || e.StatusCode == http.StatusServiceUnavailable || e.StatusCode == http.StatusGatewayTimeout
+	case ErrServerError:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+// ConflictError reports a write rejected because the address object was
+// created or modified concurrently; errors.Is matches ErrConflict
+type ConflictError struct {
+	Path string
+	ETag string
+	Err  error
+}
+
+func (e *ConflictError) Error() string {
+	msg := "conflict: " + e.Path
+	if e.ETag != "" {
+		msg += fmt.Sprintf(" (If-Match %s)", e.ETag)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// Classify sets err's condition to notFound if it is an HTTP 404 response
+// or to exists if it is an HTTP 409 response
+func Classify(err error, notFound, exists error) error {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.Err == nil {
+		switch httpErr.StatusCode {
+		case http.StatusNotFound:
+			httpErr.Err = notFound
+		case http.StatusConflict:
+			httpErr.Err = exists
+		}
+	}
+	return err
+}
+
+// RequestError wraps a transport failure as ErrUnavailable unless it was
+// caused by context cancellation
+func RequestError(method, path string, err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%s %s failed: %w", method, path, err)
+	}
+	return fmt.Errorf("%w: %s %s failed: %w", ErrUnavailable, method, path, err)
+}
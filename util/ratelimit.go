@@ -0,0 +1,97 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// RateLimiter spaces requests so that no more than a fixed number start in
+// each second.  A nil RateLimiter does not limit.
+type RateLimiter struct {
+	mutex    sync.Mutex
+	rate     float64
+	interval time.Duration
+	next     time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate requests per second, or
+// nil if rate is not positive
+func NewRateLimiter(rate float64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{rate: rate, interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// Wait blocks until the next request may start
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(l.interval)
+	l.mutex.Unlock()
+	delay := start.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+var sharedLimiter struct {
+	mutex   sync.Mutex
+	limiter *RateLimiter
+}
+
+// SharedRateLimiter returns the process-wide limiter for the rate set by
+// the mabctl.rate_limit config key, or nil if no rate is set
+func SharedRateLimiter() *RateLimiter {
+	rate := viper.GetFloat64("mabctl.rate_limit")
+	sharedLimiter.mutex.Lock()
+	defer sharedLimiter.mutex.Unlock()
+	if sharedLimiter.limiter == nil || sharedLimiter.limiter.rate != rate {
+		sharedLimiter.limiter = NewRateLimiter(rate)
+	}
+	return sharedLimiter.limiter
+}
+
+// RateLimitedTransport delays each request, including each retry, until
+// Limiter allows it
+type RateLimitedTransport struct {
+	Base    http.RoundTripper
+	Limiter *RateLimiter
+}
+
+// NewRateLimitedTransport wraps base with the shared limiter; base is
+// returned unchanged if no rate is set
+func NewRateLimitedTransport(base http.RoundTripper) http.RoundTripper {
+	limiter := SharedRateLimiter()
+	if limiter == nil {
+		return base
+	}
+	return &RateLimitedTransport{Base: base, Limiter: limiter}
+}
+
+func (t *RateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := t.Limiter.Wait(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	return t.Base.RoundTrip(req)
+}
@@ -0,0 +1,137 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const DEFAULT_RETRY_ATTEMPTS = 3
+const DEFAULT_RETRY_BACKOFF = 500 * time.Millisecond
+const DEFAULT_RETRY_MAX_BACKOFF = 10 * time.Second
+const DEFAULT_RETRY_JITTER = 0.2
+
+var DEFAULT_RETRY_STATUS = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy controls the repetition of requests which fail with a
+// transient error.  Non-idempotent requests are only repeated when the
+// failure shows the request never reached the server.
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Jitter      float64
+	RetryOn     []int
+	Verbose     bool
+}
+
+// NewRetryPolicy returns a policy read from the mabctl.retry config keys
+func NewRetryPolicy() *RetryPolicy {
+	p := RetryPolicy{
+		MaxAttempts: DEFAULT_RETRY_ATTEMPTS,
+		Backoff:     DEFAULT_RETRY_BACKOFF,
+		MaxBackoff:  DEFAULT_RETRY_MAX_BACKOFF,
+		Jitter:      DEFAULT_RETRY_JITTER,
+		RetryOn:     DEFAULT_RETRY_STATUS,
+		Verbose:     viper.GetBool("verbose"),
+	}
+	if viper.IsSet("mabctl.retry.max_attempts") {
+		p.MaxAttempts = viper.GetInt("mabctl.retry.max_attempts")
+	}
+	if viper.IsSet("mabctl.retry.backoff") {
+		p.Backoff = viper.GetDuration("mabctl.retry.backoff")
+	}
+	if viper.IsSet("mabctl.retry.max_backoff") {
+		p.MaxBackoff = viper.GetDuration("mabctl.retry.max_backoff")
+	}
+	if viper.IsSet("mabctl.retry.jitter") {
+		p.Jitter = viper.GetFloat64("mabctl.retry.jitter")
+	}
+	if viper.IsSet("mabctl.retry.status") {
+		p.RetryOn = viper.GetIntSlice("mabctl.retry.status")
+	}
+	return &p
+}
+
+// Delay returns the wait before the retry following attempt n (1-based).
+// The wait doubles with each attempt up to MaxBackoff; a MaxBackoff of 0
+// sets no limit.
+func (p *RetryPolicy) Delay(n int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < n && (p.MaxBackoff <= 0 || delay < p.MaxBackoff) && delay <= math.MaxInt64/2; i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(float64(delay) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return delay
+}
+
+// notSent reports whether err shows the request was not delivered
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Retryable reports whether a request which failed with err may be repeated
+func (p *RetryPolicy) Retryable(err error, idempotent bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if !idempotent {
+		return notSent(err)
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return slices.Contains(p.RetryOn, httpErr.StatusCode)
+	}
+	return errors.Is(err, ErrUnavailable)
+}
+
+// Do calls fn until it succeeds, fails with a permanent error, or the
+// attempts are exhausted
+func (p *RetryPolicy) Do(ctx context.Context, idempotent bool, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !p.Retryable(err, idempotent) {
+			return err
+		}
+		delay := p.Delay(attempt)
+		if p.Verbose {
+			log.Printf("retry %d/%d in %v: %v\n", attempt, p.MaxAttempts-1, delay, err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+}
+
+// IdempotentMethod reports whether an HTTP method may be safely repeated
+func IdempotentMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE", "PROPFIND", "REPORT":
+		return true
+	}
+	return false
+}
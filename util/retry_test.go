@@ -0,0 +1,21 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{Backoff: time.Second, MaxBackoff: 3 * time.Second}
+	require.Equal(t, time.Second, p.Delay(1))
+	require.Equal(t, 2*time.Second, p.Delay(2))
+	require.Equal(t, 3*time.Second, p.Delay(3))
+
+	// a MaxBackoff of 0 sets no limit
+	p.MaxBackoff = 0
+	require.Equal(t, 4*time.Second, p.Delay(3))
+	require.Equal(t, 8*time.Second, p.Delay(4))
+	require.Greater(t, p.Delay(1000), time.Duration(0))
+}
@@ -6,11 +6,13 @@ import (
 	"runtime"
 )
 
+// Fatalf formats an error prefixed with the caller's file and line; a %w
+// verb wraps its argument as with fmt.Errorf
 func Fatalf(format string, args ...interface{}) error {
 	_, file, line, ok := runtime.Caller(1)
 	if ok {
 		_, file := filepath.Split(file)
-		return fmt.Errorf("%s:%d: %s", file, line, fmt.Sprintf(format, args...))
+		return fmt.Errorf("%s:%d: "+format, append([]interface{}{file, line}, args...)...)
 	}
 	return fmt.Errorf(format, args...)
 }
@@ -19,7 +21,7 @@ func Fatal(err error) error {
 	_, file, line, ok := runtime.Caller(1)
 	if ok {
 		_, file := filepath.Split(file)
-		return fmt.Errorf("%s:%d: %v", file, line, err)
+		return fmt.Errorf("%s:%d: %w", file, line, err)
 	}
 	return err
 }